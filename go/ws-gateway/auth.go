@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// defaultOpenPaths are served without credentials unless ADMIN_OPEN_PATHS
+// says otherwise, so scrapers and probes keep working.
+const defaultOpenPaths = "/metrics,/healthz"
+
+// adminAuth guards the HTTP endpoints with a bearer token, basic-auth
+// credentials or either. Secrets are kept as SHA-256 digests so comparing
+// them takes the same time whatever their length.
+type adminAuth struct {
+	token    *[sha256.Size]byte
+	user     *[sha256.Size]byte
+	password *[sha256.Size]byte
+	open     map[string]bool
+}
+
+// loadAdminAuth reads the process-wide ADMIN_TOKEN, ADMIN_USER,
+// ADMIN_PASSWORD and ADMIN_OPEN_PATHS. It returns nil, leaving every
+// endpoint open, when no credentials are set.
+func loadAdminAuth() (*adminAuth, error) {
+	e, err := env(nil).withSecretFiles()
+	if err != nil {
+		return nil, err
+	}
+	token, user, password := e.get("ADMIN_TOKEN"), e.get("ADMIN_USER"), e.get("ADMIN_PASSWORD")
+	if (user == "") != (password == "") {
+		return nil, fmt.Errorf("ADMIN_USER and ADMIN_PASSWORD must be set together")
+	}
+	if token == "" && user == "" {
+		return nil, nil
+	}
+	a := &adminAuth{open: make(map[string]bool)}
+	if open := e.str("ADMIN_OPEN_PATHS", defaultOpenPaths); open != "none" {
+		for _, p := range splitList(open) {
+			if !strings.HasPrefix(p, "/") {
+				return nil, fmt.Errorf("invalid ADMIN_OPEN_PATHS: %q is not a path", p)
+			}
+			a.open[p] = true
+		}
+	}
+	if token != "" {
+		a.token = digest(token)
+	}
+	if user != "" {
+		a.user, a.password = digest(user), digest(password)
+	}
+	return a, nil
+}
+
+func digest(s string) *[sha256.Size]byte {
+	d := sha256.Sum256([]byte(s))
+	return &d
+}
+
+func equalDigest(want *[sha256.Size]byte, got string) bool {
+	return want != nil && subtle.ConstantTimeCompare(want[:], digest(got)[:]) == 1
+}
+
+func (a *adminAuth) authorized(r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok {
+		// Both are compared so a wrong user takes as long as a wrong
+		// password.
+		userOK := equalDigest(a.user, user)
+		return equalDigest(a.password, password) && userOK
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && equalDigest(a.token, token)
+}
+
+// protect answers 401 to requests for paths outside ADMIN_OPEN_PATHS
+// without valid credentials. A nil adminAuth protects nothing.
+func (a *adminAuth) protect(h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.open[r.URL.Path] || a.authorized(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		adminAuthFailuresTotal.Inc()
+		if a.token != nil {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="ws-gateway"`)
+		}
+		if a.user != nil {
+			w.Header().Add("WWW-Authenticate", `Basic realm="ws-gateway"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAdminAuth(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ADMIN_TOKEN_FILE", secret)
+	t.Setenv("ADMIN_USER", "ops")
+	t.Setenv("ADMIN_PASSWORD", "hunter2")
+	auth, err := loadAdminAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := auth.protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	before := testutil.ToFloat64(adminAuthFailuresTotal)
+	for _, tc := range []struct {
+		path     string
+		set      func(r *http.Request)
+		wantCode int
+	}{
+		{"/drain", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"/drain", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusOK},
+		{"/drain", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cre") }, http.StatusUnauthorized},
+		{"/reconnect", func(r *http.Request) { r.SetBasicAuth("ops", "hunter2") }, http.StatusOK},
+		{"/reconnect", func(r *http.Request) { r.SetBasicAuth("ops", "s3cret") }, http.StatusUnauthorized},
+		{"/info", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"/metrics", func(r *http.Request) {}, http.StatusOK},
+		{"/healthz", func(r *http.Request) {}, http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+		tc.set(req)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.wantCode {
+			t.Errorf("%s %v: code = %d, want %d", tc.path, req.Header, rec.Code, tc.wantCode)
+		}
+		if rec.Code == http.StatusUnauthorized && len(rec.Header().Values("WWW-Authenticate")) != 2 {
+			t.Errorf("challenges = %v", rec.Header().Values("WWW-Authenticate"))
+		}
+	}
+	if n := testutil.ToFloat64(adminAuthFailuresTotal) - before; n != 4 {
+		t.Fatalf("auth failures = %v, want 4", n)
+	}
+
+	t.Setenv("ADMIN_OPEN_PATHS", "none")
+	if auth, err = loadAdminAuth(); err != nil || auth.open["/metrics"] {
+		t.Fatalf("ADMIN_OPEN_PATHS=none left %v open (%v)", auth.open, err)
+	}
+}
+
+func TestAdminAuthConfig(t *testing.T) {
+	if auth, err := loadAdminAuth(); err != nil || auth != nil {
+		t.Fatalf("auth without credentials = %v, %v", auth, err)
+	}
+	t.Setenv("ADMIN_USER", "ops")
+	if _, err := loadAdminAuth(); err == nil {
+		t.Fatal("ADMIN_USER accepted without ADMIN_PASSWORD")
+	}
+	t.Setenv("ADMIN_PASSWORD", "hunter2")
+	t.Setenv("ADMIN_OPEN_PATHS", "metrics")
+	if _, err := loadAdminAuth(); err == nil {
+		t.Fatal("ADMIN_OPEN_PATHS accepted a name that isn't a path")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/binary"
+)
+
+const contentTypeAvro = "application/avro"
+
+//go:embed outevent.avsc
+var outEventAvsc string
+
+// encodeOutEventAvro serializes ev in Avro binary encoding as the record in
+// outevent.avsc: longs and ints zigzag varints, strings and bytes
+// length-prefixed, fields in schema order.
+func encodeOutEventAvro(ev OutEvent, canonical bool) ([]byte, error) {
+	payload, err := marshalEvent(ev.Payload, canonical)
+	if err != nil {
+		return nil, err
+	}
+	var raw []byte
+	if len(ev.Raw) > 0 {
+		if raw, err = decodeRaw(ev.Raw); err != nil {
+			return nil, err
+		}
+	}
+	var part Part
+	if ev.Part != nil {
+		part = *ev.Part
+	}
+	b := make([]byte, 0, len(payload)+len(raw)+len(ev.Symbol)+len(ev.Type)+len(ev.Action)+32)
+	b = binary.AppendVarint(b, ev.Ts)
+	b = appendAvroBytes(b, []byte(ev.Symbol))
+	b = appendAvroBytes(b, []byte(ev.Type))
+	b = appendAvroBytes(b, payload)
+	b = appendAvroBytes(b, []byte(ev.Action))
+	b = appendAvroBytes(b, raw)
+	b = binary.AppendVarint(b, int64(part.Index))
+	b = binary.AppendVarint(b, int64(part.Total))
+	return b, nil
+}
+
+func appendAvroBytes(b, v []byte) []byte {
+	return append(binary.AppendVarint(b, int64(len(v))), v...)
+}
+
+// confluentAvroFrame prepends the Confluent wire-format header for Avro:
+// magic byte 0 and the big-endian schema id, without protobuf's message
+// index.
+func confluentAvroFrame(id uint32, msg []byte) []byte {
+	out := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(out[1:5], id)
+	return append(out, msg...)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKafkaAvroEncoding(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["schemaType"] != "AVRO" || !json.Valid([]byte(body["schema"])) {
+			t.Errorf("register body = %v, %v", body, err)
+		}
+		_, _ = w.Write([]byte(`{"id":7}`))
+	}))
+	defer srv.Close()
+
+	s := &kafkaSink{registry: newSchemaRegistry(srv.URL, "md_ticks-value", kafkaFormatAvro)}
+	ev := OutEvent{Ts: 1700000000000, Symbol: "BTCUSDT", Type: "orderbook.500.BTCUSDT", Action: actionSnapshot,
+		Payload: map[string]any{"b": []any{}}, Raw: json.RawMessage(`{"topic":"orderbook.500.BTCUSDT"}`), Part: &Part{Index: 1, Total: 3}}
+	b, err := s.encode(context.Background(), ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 0 || binary.BigEndian.Uint32(b[1:5]) != 7 {
+		t.Fatalf("header = %v", b[:5])
+	}
+	got := decodeOutEventAvro(t, b[5:])
+	want := decodedEvent{Ts: ev.Ts, Symbol: ev.Symbol, Type: ev.Type, Payload: `{"b":[]}`, Action: ev.Action, PartIndex: 1, PartTotal: 3}
+	if got != want {
+		t.Fatalf("decoded = %+v, want %+v", got, want)
+	}
+
+	// Absent fields take the schema defaults.
+	b, err = encodeOutEventAvro(OutEvent{Ts: -1, Symbol: "BTCUSDT", Type: typeVol, Payload: nil}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decodeOutEventAvro(t, b); got != (decodedEvent{Ts: -1, Symbol: "BTCUSDT", Type: typeVol, Payload: "null"}) {
+		t.Fatalf("decoded = %+v", got)
+	}
+}
+
+func TestKafkaAvroHeaders(t *testing.T) {
+	for _, h := range kafkaHeaders(Config{KafkaFormat: kafkaFormatAvro}) {
+		if h.Key == "content-type" && string(h.Value) != contentTypeAvro {
+			t.Fatalf("content-type = %s", h.Value)
+		}
+	}
+	cfg, err := loadConfig(env{"KAFKA_BROKERS": "localhost:9092", "KAFKA_FORMAT": "avro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Validate() == nil {
+		t.Fatal("KAFKA_FORMAT=avro accepted without SCHEMA_REGISTRY_URL")
+	}
+}
+
+// decodeOutEventAvro reads outevent.avsc's fields in order, checking the
+// raw frame is the one encodeOutEventAvro was given.
+func decodeOutEventAvro(t *testing.T, b []byte) decodedEvent {
+	t.Helper()
+	long := func() int64 {
+		v, n := binary.Varint(b)
+		if n <= 0 {
+			t.Fatalf("bad varint at %v", b)
+		}
+		b = b[n:]
+		return v
+	}
+	str := func() string {
+		n := int(long())
+		if n < 0 || n > len(b) {
+			t.Fatalf("bad length %d", n)
+		}
+		v := string(b[:n])
+		b = b[n:]
+		return v
+	}
+	var ev decodedEvent
+	ev.Ts = long()
+	ev.Symbol = str()
+	ev.Type = str()
+	ev.Payload = str()
+	ev.Action = str()
+	if raw := str(); raw != "" && raw != `{"topic":"orderbook.500.BTCUSDT"}` {
+		t.Fatalf("raw = %q", raw)
+	}
+	ev.PartIndex = int(long())
+	ev.PartTotal = int(long())
+	if len(b) != 0 {
+		t.Fatalf("%d trailing bytes", len(b))
+	}
+	return ev
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	bookModePassthrough = "passthrough"
+	bookModeMaintained  = "maintained"
+)
+
+func parseBookMode(v string) (string, error) {
+	switch v {
+	case bookModePassthrough, bookModeMaintained:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown book mode %q (want passthrough|maintained)", v)
+}
+
+// orderBook is a local copy of one symbol's book built from a snapshot and
+// the deltas that follow it. A level with size 0 is removed.
+type orderBook struct {
+	bids, asks map[float64]float64
+	updateID   int64
+	seq        int64
+}
+
+func newOrderBook() *orderBook {
+	return &orderBook{bids: make(map[float64]float64), asks: make(map[float64]float64)}
+}
+
+func (b *orderBook) apply(data map[string]any, snapshot bool) {
+	if snapshot {
+		clear(b.bids)
+		clear(b.asks)
+	}
+	applyLevels(b.bids, parseLevels(data["b"]))
+	applyLevels(b.asks, parseLevels(data["a"]))
+	b.updateID = int64(toFloat(data["u"]))
+	b.seq = int64(toFloat(data["seq"]))
+}
+
+func applyLevels(side map[float64]float64, levels []Level) {
+	for _, l := range levels {
+		if l.Size == 0 {
+			delete(side, l.Price)
+		} else {
+			side[l.Price] = l.Size
+		}
+	}
+}
+
+// view renders the book with bids best (highest) first and asks best
+// (lowest) first.
+func (b *orderBook) view() NormalizedBook {
+	return NormalizedBook{
+		Bids:     sortedLevels(b.bids, true),
+		Asks:     sortedLevels(b.asks, false),
+		UpdateID: b.updateID,
+		Seq:      b.seq,
+	}
+}
+
+func sortedLevels(side map[float64]float64, desc bool) []Level {
+	levels := make([]Level, 0, len(side))
+	for p, s := range side {
+		levels = append(levels, Level{Price: p, Size: s})
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		if desc {
+			return levels[i].Price > levels[j].Price
+		}
+		return levels[i].Price < levels[j].Price
+	})
+	return levels
+}
+
+// trimBook keeps the best depth levels of each side and returns the
+// approximate JSON bytes the dropped levels would have taken.
+func trimBook(b NormalizedBook, depth int) (NormalizedBook, int) {
+	saved := 0
+	for _, side := range []*[]Level{&b.Bids, &b.Asks} {
+		if len(*side) <= depth {
+			continue
+		}
+		for _, l := range (*side)[depth:] {
+			saved += levelJSONSize(l)
+		}
+		*side = (*side)[:depth:depth]
+	}
+	return b, saved
+}
+
+// levelJSONSize is the encoded size of l followed by a comma.
+func levelJSONSize(l Level) int {
+	var buf [64]byte
+	n := len(`{"price":,"size":},`)
+	n += len(strconv.AppendFloat(buf[:0], l.Price, 'f', -1, 64))
+	n += len(strconv.AppendFloat(buf[:0], l.Size, 'f', -1, 64))
+	return n
+}
+
+// bookState is one symbol's maintained book plus its coalescing state.
+type bookState struct {
+	book    *orderBook
+	topic   string
+	pending bool
+	timer   *time.Timer
+}
+
+// bookKeeper maintains books for BOOK_MODE=maintained and emits the full
+// book after each update. With a coalesce window, deltas are applied as they
+// arrive but emitted at most once per window per symbol; snapshots flush
+// immediately and cancel any pending window. Books beyond limit are evicted
+// least recently updated first and rebuilt from the symbol's next snapshot.
+type bookKeeper struct {
+	window time.Duration
+	limit  stateLimit
+	clock  Clock
+	emit   func(OutEvent)
+
+	mu    sync.Mutex
+	books *symbolLRU[*bookState]
+}
+
+func newBookKeeper(window time.Duration, limit stateLimit, clock Clock, emit func(OutEvent)) *bookKeeper {
+	k := &bookKeeper{window: window, limit: limit, clock: clock, emit: emit}
+	k.books = k.newBooks()
+	return k
+}
+
+func (k *bookKeeper) newBooks() *symbolLRU[*bookState] {
+	return newSymbolLRU(k.limit, func(_ string, st *bookState) {
+		if st.timer != nil {
+			st.timer.Stop()
+		}
+	})
+}
+
+func (k *bookKeeper) handle(symbol, topic, msgType string, data any) {
+	m, ok := data.(map[string]any)
+	if !ok {
+		return
+	}
+	snapshot := msgType == actionSnapshot
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	st, ok := k.books.get(symbol)
+	if !ok {
+		if !snapshot {
+			// Deltas before the first snapshot have nothing to apply to.
+			return
+		}
+		st = &bookState{book: newOrderBook()}
+		k.books.put(symbol, st)
+	}
+	st.topic = topic
+	st.book.apply(m, snapshot)
+	if snapshot || k.window <= 0 {
+		if st.timer != nil {
+			st.timer.Stop()
+		}
+		st.pending = false
+		action := actionUpdate
+		if snapshot {
+			action = actionSnapshot
+		}
+		// Emitting under the lock keeps a window flush racing this update
+		// from publishing an older book after a newer one.
+		k.emit(k.event(symbol, action, st))
+		return
+	}
+	if !st.pending {
+		st.pending = true
+		st.timer = time.AfterFunc(k.window, func() { k.flush(symbol) })
+	}
+}
+
+func (k *bookKeeper) flush(symbol string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	st, ok := k.books.get(symbol)
+	if !ok || !st.pending {
+		return
+	}
+	st.pending = false
+	k.emit(k.event(symbol, actionUpdate, st))
+}
+
+// event carries the whole book, so even an "update" can be applied by
+// replacing local state.
+func (k *bookKeeper) event(symbol, action string, st *bookState) OutEvent {
+	return OutEvent{Ts: k.clock.Now().UnixMilli(), Symbol: symbol, Type: st.topic, Action: action, Payload: st.book.view()}
+}
+
+// flushAll emits the books with a coalesce window pending now, e.g. on
+// drain.
+func (k *bookKeeper) flushAll() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.books.each(func(symbol string, st *bookState) {
+		if !st.pending {
+			return
+		}
+		st.timer.Stop()
+		st.pending = false
+		k.emit(k.event(symbol, actionUpdate, st))
+	})
+}
+
+// reset forgets every book, e.g. after a reconnect where Bybit resends
+// snapshots.
+func (k *bookKeeper) reset() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.books.each(func(_ string, st *bookState) {
+		if st.timer != nil {
+			st.timer.Stop()
+		}
+	})
+	k.books = k.newBooks()
+}
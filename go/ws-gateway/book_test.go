@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type bookRecorder struct {
+	mu  sync.Mutex
+	evs []OutEvent
+}
+
+func (r *bookRecorder) emit(ev OutEvent) {
+	r.mu.Lock()
+	r.evs = append(r.evs, ev)
+	r.mu.Unlock()
+}
+
+func (r *bookRecorder) books() []NormalizedBook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]NormalizedBook, len(r.evs))
+	for i, ev := range r.evs {
+		out[i] = ev.Payload.(NormalizedBook)
+	}
+	return out
+}
+
+func bookData(u int, bids, asks [][2]string) map[string]any {
+	side := func(levels [][2]string) []any {
+		out := make([]any, len(levels))
+		for i, l := range levels {
+			out[i] = []any{l[0], l[1]}
+		}
+		return out
+	}
+	return map[string]any{"s": "BTCUSDT", "b": side(bids), "a": side(asks), "u": float64(u)}
+}
+
+func TestBookKeeperAppliesDeltas(t *testing.T) {
+	var r bookRecorder
+	k := newBookKeeper(0, stateLimit{}, newSystemClock(0), r.emit)
+	k.handle("BTCUSDT", "orderbook.25.BTCUSDT", "delta", bookData(1, [][2]string{{"99", "1"}}, nil))
+	k.handle("BTCUSDT", "orderbook.25.BTCUSDT", "snapshot", bookData(2,
+		[][2]string{{"100", "1"}, {"99", "2"}}, [][2]string{{"101", "1"}, {"102", "3"}}))
+	k.handle("BTCUSDT", "orderbook.25.BTCUSDT", "delta", bookData(3,
+		[][2]string{{"100", "0"}, {"100.5", "4"}}, [][2]string{{"102", "5"}}))
+
+	got := r.books()
+	if len(got) != 2 {
+		t.Fatalf("emitted %d books, want 2 (delta before snapshot is dropped)", len(got))
+	}
+	want := NormalizedBook{
+		Bids:     []Level{{Price: 100.5, Size: 4}, {Price: 99, Size: 2}},
+		Asks:     []Level{{Price: 101, Size: 1}, {Price: 102, Size: 5}},
+		UpdateID: 3,
+	}
+	if !reflect.DeepEqual(got[1], want) {
+		t.Fatalf("book = %+v, want %+v", got[1], want)
+	}
+	if a0, a1 := r.evs[0].Action, r.evs[1].Action; a0 != actionSnapshot || a1 != actionUpdate {
+		t.Fatalf("actions = %q, %q; want snapshot, update", a0, a1)
+	}
+}
+
+func TestBookKeeperCoalescesDeltas(t *testing.T) {
+	var r bookRecorder
+	k := newBookKeeper(40*time.Millisecond, stateLimit{}, newSystemClock(0), r.emit)
+	topic := "orderbook.25.BTCUSDT"
+	k.handle("BTCUSDT", topic, "snapshot", bookData(1, [][2]string{{"100", "1"}}, [][2]string{{"101", "1"}}))
+	if n := len(r.books()); n != 1 {
+		t.Fatalf("snapshot not flushed immediately (%d books)", n)
+	}
+	k.handle("BTCUSDT", topic, "delta", bookData(2, [][2]string{{"100", "2"}}, nil))
+	k.handle("BTCUSDT", topic, "delta", bookData(3, nil, [][2]string{{"101", "0"}, {"101.5", "7"}}))
+	if n := len(r.books()); n != 1 {
+		t.Fatalf("deltas emitted before the window closed (%d books)", n)
+	}
+	time.Sleep(80 * time.Millisecond)
+	got := r.books()
+	if len(got) != 2 {
+		t.Fatalf("emitted %d books, want one merged update", len(got))
+	}
+	want := NormalizedBook{Bids: []Level{{Price: 100, Size: 2}}, Asks: []Level{{Price: 101.5, Size: 7}}, UpdateID: 3}
+	if !reflect.DeepEqual(got[1], want) {
+		t.Fatalf("merged book = %+v, want %+v", got[1], want)
+	}
+
+	// A snapshot inside an open window replaces the pending update.
+	k.handle("BTCUSDT", topic, "delta", bookData(4, [][2]string{{"99", "1"}}, nil))
+	k.handle("BTCUSDT", topic, "snapshot", bookData(5, [][2]string{{"98", "1"}}, nil))
+	time.Sleep(80 * time.Millisecond)
+	got = r.books()
+	if len(got) != 3 || got[2].UpdateID != 5 || len(got[2].Bids) != 1 {
+		t.Fatalf("books after snapshot = %+v", got)
+	}
+}
+
+func TestBookImbalance(t *testing.T) {
+	b := NormalizedBook{
+		Bids: []Level{{Price: 100, Size: 3}, {Price: 99, Size: 1}, {Price: 98, Size: 50}},
+		Asks: []Level{{Price: 101, Size: 1}},
+	}
+	im, ok := bookImbalance(b, 2)
+	if !ok || im.BidVolume != 4 || im.AskVolume != 1 || im.Imbalance != 0.6 {
+		t.Fatalf("imbalance = %+v, %v", im, ok)
+	}
+	if _, ok := bookImbalance(NormalizedBook{}, 5); ok {
+		t.Fatal("empty book has no imbalance")
+	}
+
+	g, sink := newTestGateway(t, "ws://unused", "BTCUSDT")
+	g.cfg.ImbalanceDepth = 2
+	g.cfg.PerSymbol = true
+	g.allowed.Store(newSymbolSet(g.symbols))
+	g.metrics = newGatewayMetrics("imbalance_test")
+	g.publishBook(OutEvent{Ts: 7, Symbol: "BTCUSDT", Type: "orderbook.25.BTCUSDT", Action: actionSnapshot, Payload: b})
+	g.publishBook(OutEvent{Ts: 8, Symbol: "ETHUSDT", Type: "orderbook.25.ETHUSDT", Action: actionSnapshot, Payload: b})
+
+	evs := sink.Events()
+	if len(evs) != 4 || evs[1].Type != typeImbalance || evs[1].Ts != 7 || evs[1].Payload.(Imbalance) != im {
+		t.Fatalf("events = %+v", evs)
+	}
+	if v := testutil.ToFloat64(g.metrics.imbalance.WithLabelValues("BTCUSDT")); v != 0.6 {
+		t.Fatalf("gauge = %v, want 0.6", v)
+	}
+	// ETHUSDT isn't subscribed, so it gets the event but no series.
+	if n := testutil.CollectAndCount(bookImbalanceGauge); n != 1 {
+		t.Fatalf("imbalance series = %d, want 1", n)
+	}
+}
+
+func TestPublishDepth(t *testing.T) {
+	b := NormalizedBook{
+		Bids: []Level{{Price: 100, Size: 3}, {Price: 99, Size: 1}, {Price: 98.5, Size: 50}},
+		Asks: []Level{{Price: 101, Size: 1}},
+		Seq:  9,
+	}
+	g, sink := newTestGateway(t, "ws://unused", "BTCUSDT")
+	g.cfg.PublishDepth = 2
+	g.cfg.ImbalanceDepth = 3
+	g.metrics = newGatewayMetrics("publish_depth_test")
+	g.publishBook(OutEvent{Symbol: "BTCUSDT", Type: "orderbook.50.BTCUSDT", Action: actionSnapshot, Payload: b})
+
+	evs := sink.Events()
+	got := evs[0].Payload.(NormalizedBook)
+	want := NormalizedBook{Bids: b.Bids[:2], Asks: b.Asks, Seq: 9}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("published %+v, want %+v", got, want)
+	}
+	// The imbalance still covers the whole book.
+	if im := evs[1].Payload.(Imbalance); im.BidVolume != 54 {
+		t.Fatalf("imbalance = %+v", im)
+	}
+	dropped, _ := json.Marshal(b.Bids[2])
+	if saved := testutil.ToFloat64(g.metrics.depthBytesSaved); saved != float64(len(dropped)+1) {
+		t.Fatalf("bytes saved = %v, want %d", saved, len(dropped)+1)
+	}
+	if len(b.Bids) != 3 {
+		t.Fatal("trimming modified the maintained book")
+	}
+}
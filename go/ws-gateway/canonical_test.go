@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestCanonicalJSONIsByteIdentical(t *testing.T) {
+	// The same event built two ways: a decoded payload map, and the payload
+	// and raw frame as JSON text with a different key order and spacing.
+	frame := `{"topic":"tickers.BTCUSDT","data":{"s":"BTCUSDT","lastPrice":"42000.5"}}`
+	a := OutEvent{
+		Ts: 1700000000000, Symbol: "BTCUSDT", Type: "tickers.BTCUSDT", Action: actionSnapshot,
+		Payload: map[string]any{"s": "BTCUSDT", "lastPrice": "42000.5", "note": "<a&b>", "levels": []any{1.5, nil, true}},
+		Raw:     json.RawMessage(frame),
+	}
+	b := a
+	b.Payload = json.RawMessage(`{ "levels": [1.5, null, true], "note": "<a&b>",
+		"lastPrice": "42000.5", "s": "BTCUSDT" }`)
+	b.Raw = json.RawMessage(`{"data": {"lastPrice": "42000.5", "s": "BTCUSDT"}, "topic": "tickers.BTCUSDT"}`)
+
+	ea, err := canonicalJSON(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eb, err := canonicalJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ea, eb) {
+		t.Fatalf("encodings differ:\n%s\n%s", ea, eb)
+	}
+	want := `{"action":"snapshot","payload":{"lastPrice":"42000.5","levels":[1.5,null,true],"note":"<a&b>","s":"BTCUSDT"},` +
+		`"raw":{"data":{"lastPrice":"42000.5","s":"BTCUSDT"},"topic":"tickers.BTCUSDT"},"symbol":"BTCUSDT","ts":1700000000000,"type":"tickers.BTCUSDT"}`
+	if string(ea) != want {
+		t.Fatalf("canonical =\n%s\nwant\n%s", ea, want)
+	}
+
+	plain, err := marshalEvent(a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(plain, ea) {
+		t.Fatal("plain encoding unexpectedly canonical; the test no longer covers the difference")
+	}
+}
+
+func TestCanonicalJSONEscapes(t *testing.T) {
+	got, err := canonicalJSON("q\"\\\n\x01é ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\"q\\\"\\\\\\n\\u0001é \""; string(got) != want {
+		t.Fatalf("canonical = %s, want %s", got, want)
+	}
+}
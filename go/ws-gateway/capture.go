@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	captureKlineGap = "kline_gap"
+	captureBookGap  = "book_gap"
+)
+
+// capturedFrame is one raw frame as dumped, a line of the capture file.
+type capturedFrame struct {
+	ReadAt time.Time       `json:"readAt"`
+	Frame  json.RawMessage `json:"frame"`
+}
+
+// frameRing is one symbol's last frames, oldest first, plus the last
+// order book update id of each of its orderbook topics.
+type frameRing struct {
+	frames    []capturedFrame
+	bytes     int
+	updateIDs map[string]int64
+}
+
+// dropOldest drops the ring's oldest frame, returning its size.
+func (r *frameRing) dropOldest() int {
+	n := len(r.frames[0].Frame)
+	r.bytes -= n
+	r.frames[0] = capturedFrame{}
+	r.frames = r.frames[1:]
+	return n
+}
+
+// frameCapture keeps the last CAPTURE_RING_SIZE raw frames of each symbol,
+// at most CAPTURE_RING_BYTES of them, so what led up to a gap can be
+// dumped without capturing everything all the time. CAPTURE_TOTAL_BYTES
+// bounds the frames of all symbols together.
+type frameCapture struct {
+	size       int
+	maxBytes   int
+	totalBytes int
+
+	mu    sync.Mutex
+	total int
+	rings *symbolLRU[*frameRing]
+}
+
+func newFrameCapture(size, maxBytes, totalBytes int, limit stateLimit) *frameCapture {
+	c := &frameCapture{size: size, maxBytes: maxBytes, totalBytes: totalBytes}
+	c.rings = newSymbolLRU[*frameRing](limit, func(_ string, r *frameRing) { c.total -= r.bytes })
+	return c
+}
+
+// record copies frame into symbol's ring, dropping its oldest frames past
+// the count or byte bound, then the oldest frames of the symbols recorded
+// least recently past the total bound. A frame larger than either bound on
+// its own is not kept.
+func (c *frameCapture) record(symbol string, frame []byte, readAt time.Time) {
+	if len(frame) > c.maxBytes || len(frame) > c.totalBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.ringLocked(symbol)
+	for len(r.frames) > 0 && (len(r.frames) >= c.size || r.bytes+len(frame) > c.maxBytes) {
+		c.total -= r.dropOldest()
+	}
+	c.rings.eachOldest(func(_ string, old *frameRing) bool {
+		for len(old.frames) > 0 && c.total+len(frame) > c.totalBytes {
+			c.total -= old.dropOldest()
+		}
+		return c.total+len(frame) > c.totalBytes
+	})
+	// frame aliases the reused read buffer.
+	r.frames = append(r.frames, capturedFrame{ReadAt: readAt, Frame: bytes.Clone(frame)})
+	r.bytes += len(frame)
+	c.total += len(frame)
+}
+
+// bookGap reports whether an orderbook delta's update id doesn't follow
+// the last one seen on its topic. Snapshots start the topic over.
+func (c *frameCapture) bookGap(symbol, topic, action string, data any) (prev, id int64, gap bool) {
+	m, ok := data.(map[string]any)
+	if !ok {
+		return 0, 0, false
+	}
+	u, ok := m["u"].(float64)
+	if !ok {
+		return 0, 0, false
+	}
+	id = int64(u)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.ringLocked(symbol)
+	prev, seen := r.updateIDs[topic]
+	r.updateIDs[topic] = id
+	return prev, id, seen && action == actionDelta && id != prev+1
+}
+
+func (c *frameCapture) ringLocked(symbol string) *frameRing {
+	r, ok := c.rings.get(symbol)
+	if !ok {
+		r = &frameRing{updateIDs: make(map[string]int64)}
+		c.rings.put(symbol, r)
+	}
+	return r
+}
+
+// take empties symbol's ring and returns its frames, so a burst of gaps
+// doesn't dump the same frames again.
+func (c *frameCapture) take(symbol string) []capturedFrame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.rings.get(symbol)
+	if !ok {
+		return nil
+	}
+	frames := r.frames
+	c.total -= r.bytes
+	r.frames, r.bytes = nil, 0
+	return frames
+}
+
+// dumpCapture writes symbol's captured frames to a file in CAPTURE_DIR, or
+// logs them one per line without it.
+func (g *Gateway) dumpCapture(symbol, reason string) {
+	frames := g.capture.take(symbol)
+	if len(frames) == 0 {
+		return
+	}
+	g.metrics.captureDumps.WithLabelValues(reason).Inc()
+	if g.cfg.CaptureDir == "" {
+		for _, f := range frames {
+			log.Printf("instance=%s capture symbol=%s reason=%s read_at=%s frame=%s", g.cfg.Instance, symbol, reason, f.ReadAt.Format(time.RFC3339Nano), f.Frame)
+		}
+		return
+	}
+	// Drain waits for the file to be written.
+	g.dumps.Add(1)
+	go func() {
+		defer g.dumps.Done()
+		path, err := writeCapture(g.cfg.CaptureDir, fmt.Sprintf("%s-%s-%s-%d.ndjson", g.cfg.Instance, symbol, reason, g.clock.Now().UnixMilli()), frames)
+		if err != nil {
+			g.metrics.errors.Inc()
+			log.Printf("instance=%s capture_error symbol=%s err=%v", g.cfg.Instance, symbol, err)
+			return
+		}
+		log.Printf("instance=%s capture symbol=%s reason=%s frames=%d path=%s", g.cfg.Instance, symbol, reason, len(frames), path)
+	}()
+}
+
+func writeCapture(dir, name string, frames []capturedFrame) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, f := range frames {
+		if err := enc.Encode(f); err != nil {
+			return "", err
+		}
+	}
+	path := filepath.Join(dir, name)
+	return path, os.WriteFile(path, buf.Bytes(), 0o644)
+}
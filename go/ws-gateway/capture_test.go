@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFrameCaptureBounds(t *testing.T) {
+	c := newFrameCapture(3, 10, 1<<20, stateLimit{})
+	for _, f := range []string{"1", "22", "333", "4444", "55555"} {
+		c.record("BTCUSDT", []byte(f), time.Now())
+	}
+	// 4444 and 55555 alone fit in 10 bytes.
+	frames := c.take("BTCUSDT")
+	if len(frames) != 2 || string(frames[0].Frame) != "4444" || string(frames[1].Frame) != "55555" {
+		t.Fatalf("frames = %v", frames)
+	}
+	c.record("BTCUSDT", []byte("12345678901"), time.Now())
+	if frames := c.take("BTCUSDT"); len(frames) != 0 {
+		t.Fatalf("frame over CAPTURE_RING_BYTES kept: %v", frames)
+	}
+	for _, f := range []string{"1", "2", "3", "4"} {
+		c.record("ETHUSDT", []byte(f), time.Now())
+	}
+	if frames := c.take("ETHUSDT"); len(frames) != 3 || string(frames[0].Frame) != "2" {
+		t.Fatalf("frames = %v", frames)
+	}
+}
+
+func TestFrameCaptureTotalBound(t *testing.T) {
+	c := newFrameCapture(10, 10, 12, stateLimit{})
+	c.record("BTCUSDT", []byte("1111"), time.Now())
+	c.record("BTCUSDT", []byte("2222"), time.Now())
+	c.record("ETHUSDT", []byte("3333"), time.Now())
+	// BTCUSDT had a frame least recently, so its oldest goes.
+	c.record("ETHUSDT", []byte("4444"), time.Now())
+	if frames := c.take("BTCUSDT"); len(frames) != 1 || string(frames[0].Frame) != "2222" {
+		t.Fatalf("BTCUSDT frames = %v", frames)
+	}
+	if frames := c.take("ETHUSDT"); len(frames) != 2 {
+		t.Fatalf("ETHUSDT frames = %v", frames)
+	}
+	if c.total != 0 {
+		t.Fatalf("total = %d after taking everything", c.total)
+	}
+	c.record("BTCUSDT", []byte("1234567890123"), time.Now())
+	if frames := c.take("BTCUSDT"); len(frames) != 0 {
+		t.Fatalf("frame over CAPTURE_TOTAL_BYTES kept: %v", frames)
+	}
+}
+
+func TestCaptureDumpOnBookGap(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("capture")
+	g.cfg.CaptureDir = t.TempDir()
+	g.capture = newFrameCapture(10, 1<<20, 1<<20, stateLimit{})
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	go g.readLoop()
+
+	for _, f := range []struct {
+		action string
+		u      int
+	}{{actionSnapshot, 10}, {actionDelta, 11}, {actionDelta, 13}} {
+		sendJSON(t, server, map[string]any{"topic": "orderbook.25.BTCUSDT", "type": f.action, "ts": 1700000000000 + f.u,
+			"data": map[string]any{"s": "BTCUSDT", "u": f.u, "b": []any{}, "a": []any{}}})
+	}
+	waitEvents(t, sink, 3)
+
+	var files []string
+	deadline := time.Now().Add(2 * time.Second)
+	for len(files) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no capture file written")
+		}
+		time.Sleep(5 * time.Millisecond)
+		files, _ = filepath.Glob(filepath.Join(g.cfg.CaptureDir, "test-BTCUSDT-book_gap-*.ndjson"))
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var frames []capturedFrame
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var cf capturedFrame
+		if err := json.Unmarshal(sc.Bytes(), &cf); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, cf)
+	}
+	var last struct {
+		Data struct {
+			U int `json:"u"`
+		} `json:"data"`
+	}
+	if len(frames) != 3 || json.Unmarshal(frames[2].Frame, &last) != nil || last.Data.U != 13 {
+		t.Fatalf("captured %d frames, last %s", len(frames), frames[len(frames)-1].Frame)
+	}
+	if n := testutil.ToFloat64(g.metrics.captureDumps.WithLabelValues(captureBookGap)); n != 1 {
+		t.Fatalf("book_gap dumps = %v", n)
+	}
+	g.closeConn()
+}
+
+func TestCaptureConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"CAPTURE_RING_SIZE": "200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CaptureRing != 200 || cfg.CaptureBytes != 1<<20 || cfg.Validate() != nil {
+		t.Fatalf("CaptureRing = %d, bytes %d, Validate = %v", cfg.CaptureRing, cfg.CaptureBytes, cfg.Validate())
+	}
+	cfg.CaptureBytes = 0
+	if cfg.Validate() == nil {
+		t.Fatal("CAPTURE_RING_BYTES=0 accepted")
+	}
+}
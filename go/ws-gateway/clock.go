@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Clock is the source of event timestamps. Socket deadlines and timers keep
+// using the monotonic wall clock directly; only values that end up in
+// events or are compared against them go through a Clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the host clock corrected by a skew offset, either fixed by
+// CLOCK_OFFSET or measured against NTP_SERVER.
+type systemClock struct {
+	offset atomic.Int64
+	// start is set by anchor.
+	start time.Time
+}
+
+func newSystemClock(offset time.Duration) *systemClock {
+	c := &systemClock{}
+	c.offset.Store(int64(offset))
+	return c
+}
+
+// anchor makes the clock the host clock at the time of the call advanced
+// by the monotonic clock, which NTP slews but never steps back. It must be
+// called before the clock is used.
+func (c *systemClock) anchor() { c.start = time.Now() }
+
+func (c *systemClock) Now() time.Time {
+	return c.local().Add(time.Duration(c.offset.Load()))
+}
+
+// local is Now without the skew offset.
+func (c *systemClock) local() time.Time {
+	now := time.Now()
+	if c.start.IsZero() {
+		return now
+	}
+	return c.start.Add(now.Sub(c.start))
+}
+
+const ntpSyncInterval = 10 * time.Minute
+
+// syncNTP measures the host offset against server now and every
+// ntpSyncInterval until ctx is done. A failed query keeps the last offset.
+func (c *systemClock) syncNTP(ctx context.Context, server string, m *gatewayMetrics) {
+	t := time.NewTicker(ntpSyncInterval)
+	defer t.Stop()
+	for {
+		offset, err := queryNTPOffset(server, 5*time.Second)
+		if err != nil {
+			m.errors.Inc()
+			log.Printf("ntp_error server=%s err=%v", server, err)
+		} else {
+			if !c.start.IsZero() {
+				// The offset was measured against the host clock, which the
+				// anchored one may have drifted from; Round(0) compares
+				// wall readings.
+				offset += time.Now().Round(0).Sub(c.local().Round(0))
+			}
+			c.offset.Store(int64(offset))
+			log.Printf("ntp_offset server=%s offset=%s", server, offset)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// ntpEpochOffset is the number of seconds between the NTP era 0 epoch (1900)
+// and the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+// queryNTPOffset sends one SNTP v4 client request and returns how far the
+// local clock is behind the server, ((t2-t1)+(t3-t4))/2.
+func queryNTPOffset(server string, timeout time.Duration) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // LI 0, version 4, mode 3 (client)
+	t1 := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	t4 := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	if n < 48 {
+		return 0, fmt.Errorf("short ntp response (%d bytes)", n)
+	}
+	if mode := resp[0] & 0x7; mode != 4 {
+		return 0, fmt.Errorf("unexpected ntp mode %d", mode)
+	}
+	if resp[1] == 0 {
+		return 0, fmt.Errorf("ntp kiss-of-death from %s", server)
+	}
+	t2 := ntpTime(resp[32:40])
+	t3 := ntpTime(resp[40:48])
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+func ntpTime(b []byte) time.Time {
+	sec := int64(binary.BigEndian.Uint32(b[0:4])) - ntpEpochOffset
+	frac := int64(binary.BigEndian.Uint32(b[4:8]))
+	return time.Unix(sec, (frac*1e9)>>32)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock(t time.Time) *fakeClock { return &fakeClock{t: t} }
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+func TestSystemClockOffset(t *testing.T) {
+	c := newSystemClock(time.Hour)
+	if d := c.Now().Sub(time.Now()); d < 59*time.Minute || d > 61*time.Minute {
+		t.Fatalf("offset clock is %s ahead, want ~1h", d)
+	}
+}
+
+func putNTPTime(b []byte, t time.Time) {
+	binary.BigEndian.PutUint32(b[0:4], uint32(t.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[4:8], uint32((int64(t.Nanosecond())<<32)/1e9))
+}
+
+func TestQueryNTPOffset(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	const skew = 3 * time.Second
+	go func() {
+		req := make([]byte, 48)
+		_, addr, err := pc.ReadFrom(req)
+		if err != nil {
+			return
+		}
+		resp := make([]byte, 48)
+		resp[0] = 0x24 // version 4, mode 4 (server)
+		resp[1] = 2
+		now := time.Now().Add(skew)
+		putNTPTime(resp[32:40], now)
+		putNTPTime(resp[40:48], now)
+		_, _ = pc.WriteTo(resp, addr)
+	}()
+
+	offset, err := queryNTPOffset(pc.LocalAddr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := offset - skew; d < -100*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("offset = %s, want ~%s", offset, skew)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+	zlibWriters = sync.Pool{New: func() any { return zlib.NewWriter(io.Discard) }}
+)
+
+// compressWriter is what gzip.Writer and zlib.Writer share.
+type compressWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// compressed serves h gzip- or deflate-encoded when the client accepts it,
+// preferring gzip. /metrics instead relies on promhttp's own gzip support.
+func compressed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			h(w, r)
+			return
+		}
+		pool := &gzipWriters
+		if encoding == "deflate" {
+			pool = &zlibWriters
+		}
+		cw := pool.Get().(compressWriter)
+		cw.Reset(w)
+		defer func() {
+			_ = cw.Close()
+			pool.Put(cw)
+		}()
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Del("Content-Length")
+		h(compressResponseWriter{ResponseWriter: w, w: cw}, r)
+	}
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (c compressResponseWriter) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// honouring q=0 exclusions, or returns "" for identity.
+func negotiateEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		ok := true
+		if v, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			q, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			ok = err == nil && q > 0
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = ok
+	}
+	for _, enc := range []string{"gzip", "deflate"} {
+		if ok, listed := accepted[enc]; ok || !listed && accepted["*"] {
+			return enc
+		}
+	}
+	return ""
+}
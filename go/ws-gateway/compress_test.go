@@ -0,0 +1,74 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                        "",
+		"gzip":                    "gzip",
+		"deflate, gzip;q=0.8":     "gzip",
+		"gzip;q=0, deflate":       "deflate",
+		"br":                      "",
+		"*":                       "gzip",
+		"gzip;q=0, *":             "deflate",
+		"identity, GZIP; q=0.5":   "gzip",
+		"gzip;q=0.0, deflate;q=0": "",
+	} {
+		if got := negotiateEncoding(header); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestCompressedHandler(t *testing.T) {
+	body := strings.Repeat(`{"symbol":"BTCUSDT"}`, 100)
+	h := compressed(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, body)
+	})
+	for _, enc := range []string{"", "gzip", "deflate"} {
+		req := httptest.NewRequest(http.MethodGet, "/info", nil)
+		if enc != "" {
+			req.Header.Set("Accept-Encoding", enc)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		n := rec.Body.Len()
+		if got := rec.Header().Get("Content-Encoding"); got != enc {
+			t.Fatalf("%q: Content-Encoding = %q", enc, got)
+		}
+		var r io.Reader = rec.Body
+		switch enc {
+		case "gzip":
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = zr
+		case "deflate":
+			zr, err := zlib.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = zr
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != body {
+			t.Fatalf("%q: body = %q", enc, got)
+		}
+		if enc != "" && n >= len(body) {
+			t.Fatalf("%q: %d bytes not smaller than %d", enc, n, len(body))
+		}
+	}
+}
@@ -0,0 +1,1332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+const (
+	exchangeBybit   = "bybit"
+	defaultInstance = "default"
+)
+
+// Config is the effective gateway configuration, resolved from the
+// environment at startup.
+type Config struct {
+	Instance          string            `json:"instance"`
+	Exchange          string            `json:"exchange"`
+	Source            string            `json:"source"`
+	ReplayPath        string            `json:"replayPath,omitempty"`
+	ReplayStream      string            `json:"replayStream,omitempty"`
+	ReplaySpeed       float64           `json:"replaySpeed,omitempty"`
+	WSURL             string            `json:"wsUrl"`
+	Redundant         []string          `json:"redundantEndpoints,omitempty"`
+	Symbols           []string          `json:"symbols"`
+	Topics            []string          `json:"topics"`
+	SymbolsFile       string            `json:"symbolsFile,omitempty"`
+	PlanKey           string            `json:"subscriptionPlanKey,omitempty"`
+	PlanInterval      time.Duration     `json:"subscriptionPlanInterval,omitempty"`
+	RedisURL          string            `json:"redisUrl,omitempty"`
+	RedisStream       string            `json:"redisStream,omitempty"`
+	RedisMode         string            `json:"redisMode,omitempty"`
+	RedisChannel      string            `json:"redisChannel,omitempty"`
+	RedisLayout       string            `json:"redisFieldLayout,omitempty"`
+	KafkaBrokers      []string          `json:"kafkaBrokers,omitempty"`
+	Sink              string            `json:"sink,omitempty"`
+	SinkRoutes        string            `json:"sinkRoutes,omitempty"`
+	ShadowSink        string            `json:"shadowSink,omitempty"`
+	SinkConnect       time.Duration     `json:"sinkConnectTimeout,omitempty"`
+	SelfTest          bool              `json:"selfTest,omitempty"`
+	SelfTestTimeout   time.Duration     `json:"selfTestTimeout,omitempty"`
+	SelfTestFailure   string            `json:"selfTestFailure,omitempty"`
+	SinkWrite         time.Duration     `json:"sinkWriteTimeout,omitempty"`
+	ShadowBuffer      int               `json:"shadowBuffer,omitempty"`
+	MaxPublish        int               `json:"maxPublishAttempts,omitempty"`
+	DLQRedisStream    string            `json:"dlqRedisStream,omitempty"`
+	DLQFile           string            `json:"dlqFile,omitempty"`
+	KafkaTopic        string            `json:"kafkaTopic,omitempty"`
+	KafkaHeaders      map[string]string `json:"kafkaHeaders,omitempty"`
+	KafkaPartitions   map[string]int    `json:"kafkaPartitionMap,omitempty"`
+	KafkaDRBrokers    []string          `json:"kafkaDrBrokers,omitempty"`
+	KafkaDRTopic      string            `json:"kafkaDrTopic,omitempty"`
+	KafkaDRBatch      int               `json:"kafkaDrBatchSize,omitempty"`
+	KafkaDRTimeout    time.Duration     `json:"kafkaDrBatchTimeout,omitempty"`
+	KafkaDRBuffer     int               `json:"kafkaDrBuffer,omitempty"`
+	RecordBatch       int               `json:"recordBatchSize,omitempty"`
+	RecordInterval    time.Duration     `json:"recordBatchInterval,omitempty"`
+	KafkaFormat       string            `json:"kafkaFormat,omitempty"`
+	KafkaBatchSize    int               `json:"kafkaBatchSize,omitempty"`
+	KafkaBatchTimeout time.Duration     `json:"kafkaBatchTimeout,omitempty"`
+	KafkaAsync        bool              `json:"kafkaAsync,omitempty"`
+	KafkaMaxAttempts  int               `json:"kafkaMaxAttempts,omitempty"`
+	KafkaSASL         string            `json:"kafkaSaslMechanism,omitempty"`
+	KafkaUser         string            `json:"kafkaSaslUser,omitempty"`
+	KafkaPassword     string            `json:"kafkaSaslPassword,omitempty"`
+	KafkaTLS          bool              `json:"kafkaTls,omitempty"`
+	KafkaCAFile       string            `json:"kafkaTlsCaFile,omitempty"`
+	KafkaCertFile     string            `json:"kafkaTlsCertFile,omitempty"`
+	KafkaKeyFile      string            `json:"kafkaTlsKeyFile,omitempty"`
+	SchemaRegistry    string            `json:"schemaRegistryUrl,omitempty"`
+	SchemaSubject     string            `json:"schemaSubject,omitempty"`
+	MaxConnections    int               `json:"maxConnections"`
+	MaxInbound        int               `json:"maxInboundMsgsPerSec,omitempty"`
+	PayloadMode       string            `json:"payloadMode"`
+	EmitBoth          bool              `json:"emitBoth,omitempty"`
+	ValidateOutput    bool              `json:"validateOutput,omitempty"`
+	BookMode          string            `json:"bookMode"`
+	BookCoalesce      time.Duration     `json:"bookCoalesceWindow,omitempty"`
+	ImbalanceDepth    int               `json:"imbalanceDepth,omitempty"`
+	FlowInterval      time.Duration     `json:"flowInterval,omitempty"`
+	VolWindow         time.Duration     `json:"volWindow,omitempty"`
+	VolSample         time.Duration     `json:"volSample,omitempty"`
+	VolBasis          string            `json:"volBasis,omitempty"`
+	MaxOutbound       int               `json:"maxOutboundBytes,omitempty"`
+	OversizePolicy    string            `json:"oversizePolicy"`
+	UnknownTopic      string            `json:"unknownTopicPolicy"`
+	PublishDepth      int               `json:"publishDepth,omitempty"`
+	ConflateInterval  time.Duration     `json:"conflateInterval,omitempty"`
+	Conflate          conflateIntervals `json:"conflate,omitempty"`
+	TsFields          tsFields          `json:"tsFields,omitempty"`
+	TickerOnChange    bool              `json:"tickerOnChange,omitempty"`
+	TickerMerge       bool              `json:"tickerMerge,omitempty"`
+	Ingest            bool              `json:"ingest,omitempty"`
+	TickerFields      []string          `json:"tickerChangeFields,omitempty"`
+	TickerSnapshot    string            `json:"tickerSnapshotUrl,omitempty"`
+	InstrumentsURL    string            `json:"instrumentsUrl,omitempty"`
+	SymbolValidation  string            `json:"symbolValidation"`
+	RemoteWriteURL    string            `json:"remoteWriteUrl,omitempty"`
+	RemoteSymbols     []string          `json:"remoteWriteSymbols,omitempty"`
+	RemoteFields      []string          `json:"remoteWriteFields,omitempty"`
+	RemoteInterval    time.Duration     `json:"remoteWriteInterval,omitempty"`
+	KlineConfirmed    bool              `json:"klineConfirmedOnly,omitempty"`
+	KlineBackfill     string            `json:"klineBackfillUrl,omitempty"`
+	SymbolState       int               `json:"symbolStateCapacity"`
+	PingInterval      time.Duration     `json:"pingInterval"`
+	RTTMetrics        bool              `json:"rttMetrics,omitempty"`
+	PinReadLoop       bool              `json:"pinReadLoop,omitempty"`
+	ReadLimit         int               `json:"readLimit"`
+	ReadLimitMax      int               `json:"readLimitMax,omitempty"`
+	WatchdogTimeout   time.Duration     `json:"watchdogTimeout,omitempty"`
+	DeadmanTimeout    time.Duration     `json:"deadmanTimeout,omitempty"`
+	DeadmanHalt       bool              `json:"deadmanHalt,omitempty"`
+	ConnMigration     bool              `json:"connectionMigration,omitempty"`
+	MigrationInterval time.Duration     `json:"connectionMigrationInterval,omitempty"`
+	WSReadBuffer      int               `json:"wsReadBuffer,omitempty"`
+	WSWriteBuffer     int               `json:"wsWriteBuffer,omitempty"`
+	WSNetwork         string            `json:"wsNetwork"`
+	ConnectTimeout    time.Duration     `json:"connectTimeout"`
+	HandshakeTimeout  time.Duration     `json:"handshakeTimeout"`
+	WSDNSServer       string            `json:"wsDnsServer,omitempty"`
+	PublishBuffer     int               `json:"publishBuffer"`
+	PublishWorkers    int               `json:"publishWorkers"`
+	Ordering          string            `json:"ordering"`
+	SortWindow        time.Duration     `json:"sortWindow,omitempty"`
+	MonotonicTs       bool              `json:"monotonicTs,omitempty"`
+	CaptureRing       int               `json:"captureRingSize,omitempty"`
+	CaptureBytes      int               `json:"captureRingBytes,omitempty"`
+	CaptureTotal      int               `json:"captureTotalBytes,omitempty"`
+	CaptureDir        string            `json:"captureDir,omitempty"`
+	Backpressure      string            `json:"backpressure"`
+	SpillDir          string            `json:"spillDir,omitempty"`
+	Filter            string            `json:"filter,omitempty"`
+	Processors        []string          `json:"processors,omitempty"`
+	SampleEvery       int               `json:"sampleEvery,omitempty"`
+	EnrichFields      map[string]string `json:"enrichFields,omitempty"`
+	LogPayload        string            `json:"logPayload"`
+	StdoutFormat      string            `json:"stdoutFormat"`
+	IncludeRaw        string            `json:"includeRaw,omitempty"`
+	CanonicalJSON     bool              `json:"canonicalJson,omitempty"`
+	PerSymbol         bool              `json:"perSymbolMetrics"`
+	StrictSymbols     bool              `json:"strictSymbols,omitempty"`
+	SymbolPriority    []string          `json:"symbolPriority,omitempty"`
+	WarmupData        float64           `json:"warmupRequireData,omitempty"`
+	MinConfirmed      float64           `json:"minConfirmedFraction,omitempty"`
+	ConfirmTimeout    time.Duration     `json:"confirmTimeout,omitempty"`
+	AckTimeout        time.Duration     `json:"subscribeAckTimeout,omitempty"`
+	WarmupTimeout     time.Duration     `json:"warmupTimeout,omitempty"`
+	ClockOffset       time.Duration     `json:"clockOffset,omitempty"`
+	NTPServer         string            `json:"ntpServer,omitempty"`
+	Addr              string            `json:"addr"`
+}
+
+// loadConfig resolves an instance configuration. e overrides the process
+// environment; nil reads the environment only.
+func loadConfig(e env) (Config, error) {
+	e, err := e.withSecretFiles()
+	if err != nil {
+		return Config{}, err
+	}
+	cfg := Config{
+		Instance:       e.str("INSTANCE", defaultInstance),
+		Exchange:       exchangeBybit,
+		Source:         e.str("SOURCE", sourceWS),
+		ReplayPath:     e.get("REPLAY_PATH"),
+		ReplayStream:   e.str("REPLAY_STREAM", "md_ticks"),
+		WSURL:          e.str("WS_URL", "wss://stream-testnet.bybit.com/v5/public"),
+		Redundant:      splitList(e.get("REDUNDANT_ENDPOINTS")),
+		TickerSnapshot: e.get("TICKER_SNAPSHOT_URL"),
+		InstrumentsURL: e.get("INSTRUMENTS_URL"),
+		KlineBackfill:  e.get("KLINE_BACKFILL_URL"),
+		WSNetwork:      e.str("WS_NETWORK", wsNetworkAny),
+		Symbols:        splitList(e.str("SYMBOLS", "BTCUSDT,ETHUSDT")),
+		SymbolPriority: splitList(e.get("SYMBOL_PRIORITY")),
+		SymbolsFile:    e.get("SYMBOLS_FILE"),
+		PlanKey:        e.get("SUBSCRIPTION_PLAN_KEY"),
+		Topics:         splitList(e.str("TOPICS", strings.Join(defaultTopics, ","))),
+		RedisURL:       e.get("REDIS_URL"),
+		RedisStream:    e.str("REDIS_STREAM", "md_ticks"),
+		RedisMode:      strings.ToLower(e.str("REDIS_MODE", redisModeStream)),
+		RedisChannel:   e.str("REDIS_CHANNEL", "md_ticks"),
+		RedisLayout:    strings.ToLower(e.str("REDIS_FIELD_LAYOUT", redisLayoutBlob)),
+		KafkaBrokers:   splitList(e.get("KAFKA_BROKERS")),
+		KafkaTopic:     e.str("KAFKA_TOPIC", "md_ticks"),
+		KafkaDRBrokers: splitList(e.get("KAFKA_DR_BROKERS")),
+		KafkaSASL:      strings.ToLower(e.get("KAFKA_SASL_MECHANISM")),
+		KafkaUser:      e.get("KAFKA_SASL_USER"),
+		KafkaPassword:  e.get("KAFKA_SASL_PASSWORD"),
+		KafkaCAFile:    e.get("KAFKA_TLS_CA_FILE"),
+		KafkaCertFile:  e.get("KAFKA_TLS_CERT_FILE"),
+		KafkaKeyFile:   e.get("KAFKA_TLS_KEY_FILE"),
+		Sink:           e.get("SINK"),
+		SinkRoutes:     e.get("SINK_ROUTES"),
+		ShadowSink:     e.get("SHADOW_SINK"),
+		DLQRedisStream: e.get("DLQ_REDIS_STREAM"),
+		DLQFile:        e.get("DLQ_FILE"),
+		KafkaFormat:    e.str("KAFKA_FORMAT", kafkaFormatJSON),
+		SchemaRegistry: e.get("SCHEMA_REGISTRY_URL"),
+		PayloadMode:    e.str("PAYLOAD_MODE", payloadRaw),
+		BookMode:       e.str("BOOK_MODE", bookModePassthrough),
+		Addr:           e.str("ADDR", ":8082"),
+		Backpressure:   e.str("BACKPRESSURE", backpressureBlock),
+		Ordering:       e.str("ORDERING", orderingPerSymbol),
+		OversizePolicy: e.str("OVERSIZE_POLICY", oversizeSplit),
+		UnknownTopic:   e.str("UNKNOWN_TOPIC_POLICY", unknownPassthrough),
+		SpillDir:       e.str("SPILL_DIR", os.TempDir()),
+		Filter:         e.get("FILTER"),
+		LogPayload:     e.str("LOG_PAYLOAD", logPayloadFull),
+		StdoutFormat:   e.str("STDOUT_FORMAT", stdoutLog),
+	}
+	if cfg.Processors, err = parseProcessors(e.get("PROCESSORS")); err != nil {
+		return cfg, fmt.Errorf("invalid PROCESSORS: %w", err)
+	}
+	if cfg.SampleEvery, err = e.int("SAMPLE_EVERY", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.EnrichFields, err = parseKeyValues(e.get("ENRICH_FIELDS")); err != nil {
+		return cfg, fmt.Errorf("invalid ENRICH_FIELDS: %w", err)
+	}
+	if cfg.KafkaHeaders, err = parseKeyValues(e.get("KAFKA_HEADERS")); err != nil {
+		return cfg, fmt.Errorf("invalid KAFKA_HEADERS: %w", err)
+	}
+	if cfg.KafkaPartitions, err = parsePartitionMap(e.get("KAFKA_PARTITION_MAP")); err != nil {
+		return cfg, fmt.Errorf("invalid KAFKA_PARTITION_MAP: %w", err)
+	}
+	if cfg.MaxConnections, err = e.int("MAX_CONNECTIONS", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxInbound, err = e.int("MAX_INBOUND_MSGS_PER_SEC", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.PublishBuffer, err = e.int("PUBLISH_BUFFER", 10000); err != nil {
+		return cfg, err
+	}
+	if cfg.ShadowBuffer, err = e.int("SHADOW_BUFFER", 10000); err != nil {
+		return cfg, err
+	}
+	if cfg.SinkConnect, err = e.duration("SINK_CONNECT_TIMEOUT", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.SelfTest, err = e.bool("SELF_TEST", false); err != nil {
+		return cfg, err
+	}
+	if cfg.SelfTestTimeout, err = e.duration("SELF_TEST_TIMEOUT", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	cfg.SelfTestFailure = e.str("SELF_TEST_FAILURE", selfTestExit)
+	if cfg.SinkWrite, err = e.duration("SINK_WRITE_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxPublish, err = e.int("MAX_PUBLISH_ATTEMPTS", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.KafkaBatchSize, err = e.int("KAFKA_BATCH_SIZE", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.KafkaBatchTimeout, err = e.duration("KAFKA_BATCH_TIMEOUT", time.Second); err != nil {
+		return cfg, err
+	}
+	cfg.KafkaDRTopic = e.str("KAFKA_DR_TOPIC", cfg.KafkaTopic)
+	if cfg.KafkaDRBatch, err = e.int("KAFKA_DR_BATCH_SIZE", cfg.KafkaBatchSize); err != nil {
+		return cfg, err
+	}
+	if cfg.KafkaDRTimeout, err = e.duration("KAFKA_DR_BATCH_TIMEOUT", cfg.KafkaBatchTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.KafkaDRBuffer, err = e.int("KAFKA_DR_BUFFER", 10000); err != nil {
+		return cfg, err
+	}
+	if cfg.RecordBatch, err = e.int("RECORD_BATCH_SIZE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.RecordInterval, err = e.duration("RECORD_BATCH_INTERVAL", 100*time.Millisecond); err != nil {
+		return cfg, err
+	}
+	if cfg.KafkaAsync, err = e.bool("KAFKA_ASYNC", false); err != nil {
+		return cfg, err
+	}
+	if cfg.KafkaMaxAttempts, err = e.int("KAFKA_MAX_ATTEMPTS", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.KafkaTLS, err = e.bool("KAFKA_TLS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.BookCoalesce, err = e.duration("BOOK_COALESCE_WINDOW", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.PublishWorkers, err = e.int("PUBLISH_WORKERS", 1); err != nil {
+		return cfg, err
+	}
+	if cfg.ReplaySpeed, err = e.float("REPLAY_SPEED", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.WSReadBuffer, err = e.int("WS_READ_BUFFER", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.WSWriteBuffer, err = e.int("WS_WRITE_BUFFER", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.ConnectTimeout, err = e.duration("CONNECT_TIMEOUT", 5*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.HandshakeTimeout, err = e.duration("HANDSHAKE_TIMEOUT", 15*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.WSDNSServer, err = parseDNSServer(e.get("WS_DNS_SERVER")); err != nil {
+		return cfg, fmt.Errorf("invalid WS_DNS_SERVER: %w", err)
+	}
+	if cfg.PingInterval, err = e.duration("PING_INTERVAL", 20*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.RTTMetrics, err = e.bool("RTT_METRICS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.PinReadLoop, err = e.bool("PIN_READLOOP", false); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadLimit, err = e.int("WS_READ_LIMIT", 8<<20); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadLimitMax, err = e.int("WS_READ_LIMIT_MAX", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.WatchdogTimeout, err = e.duration("WATCHDOG_TIMEOUT", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.DeadmanTimeout, err = e.duration("DEADMAN_TIMEOUT", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.DeadmanHalt, err = e.bool("DEADMAN_HALT", false); err != nil {
+		return cfg, err
+	}
+	if cfg.ConnMigration, err = e.bool("CONNECTION_MIGRATION", false); err != nil {
+		return cfg, err
+	}
+	if cfg.MigrationInterval, err = e.duration("CONNECTION_MIGRATION_INTERVAL", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.ImbalanceDepth, err = e.int("IMBALANCE_DEPTH", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.FlowInterval, err = e.duration("FLOW_INTERVAL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.VolWindow, err = e.duration("VOL_WINDOW", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.VolSample, err = e.duration("VOL_SAMPLE", time.Second); err != nil {
+		return cfg, err
+	}
+	cfg.VolBasis = e.str("VOL_BASIS", volBasisTrades)
+	cfg.SymbolValidation = strings.ToLower(e.str("SYMBOL_VALIDATION", symbolValidationOff))
+	cfg.RemoteWriteURL = e.get("REMOTE_WRITE_URL")
+	cfg.RemoteSymbols = splitList(e.get("REMOTE_WRITE_SYMBOLS"))
+	cfg.RemoteFields = splitList(e.get("REMOTE_WRITE_FIELDS"))
+	if cfg.RemoteWriteURL != "" {
+		if len(cfg.RemoteFields) == 0 {
+			cfg.RemoteFields = []string{"lastPrice", "markPrice"}
+		}
+		if cfg.RemoteInterval, err = e.duration("REMOTE_WRITE_INTERVAL", 5*time.Second); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.MaxOutbound, err = e.int("MAX_OUTBOUND_BYTES", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.PublishDepth, err = e.int("PUBLISH_DEPTH", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.ConflateInterval, err = e.duration("CONFLATE_INTERVAL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.Conflate, err = parseConflate(e.get("CONFLATE")); err != nil {
+		return cfg, fmt.Errorf("invalid CONFLATE: %w", err)
+	}
+	if cfg.TickerOnChange, err = e.bool("TICKER_ON_CHANGE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.TickerMerge, err = e.bool("TICKER_MERGE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.KlineConfirmed, err = e.bool("KLINE_CONFIRMED_ONLY", false); err != nil {
+		return cfg, err
+	}
+	if cfg.Ingest, err = e.bool("INGEST", false); err != nil {
+		return cfg, err
+	}
+	if cfg.EmitBoth, err = e.bool("EMIT_BOTH", false); err != nil {
+		return cfg, err
+	}
+	if cfg.ValidateOutput, err = e.bool("VALIDATE_OUTPUT", false); err != nil {
+		return cfg, err
+	}
+	if cfg.TickerOnChange {
+		cfg.TickerFields = splitList(e.get("TICKER_CHANGE_FIELDS"))
+		if len(cfg.TickerFields) == 0 {
+			cfg.TickerFields = defaultTickerFields
+		}
+	}
+	if cfg.SymbolState, err = e.int("SYMBOL_STATE_CAPACITY", 10000); err != nil {
+		return cfg, err
+	}
+	if cfg.TsFields, err = parseTsFields(e.get("TS_FIELDS")); err != nil {
+		return cfg, fmt.Errorf("invalid TS_FIELDS: %w", err)
+	}
+	cfg.SchemaSubject = e.str("SCHEMA_REGISTRY_SUBJECT", cfg.KafkaTopic+"-value")
+	if cfg.WarmupData, err = parseWarmupFraction(e.get("WARMUP_REQUIRE_DATA")); err != nil {
+		return cfg, fmt.Errorf("invalid WARMUP_REQUIRE_DATA: %w", err)
+	}
+	if cfg.SortWindow, err = e.duration("SORT_WINDOW", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MonotonicTs, err = e.bool("MONOTONIC_TS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.CaptureRing, err = e.int("CAPTURE_RING_SIZE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.CaptureBytes, err = e.int("CAPTURE_RING_BYTES", 1<<20); err != nil {
+		return cfg, err
+	}
+	if cfg.CaptureTotal, err = e.int("CAPTURE_TOTAL_BYTES", 64<<20); err != nil {
+		return cfg, err
+	}
+	cfg.CaptureDir = e.get("CAPTURE_DIR")
+	if cfg.WarmupTimeout, err = e.duration("WARMUP_TIMEOUT", 2*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.MinConfirmed, err = e.float("MIN_CONFIRMED_FRACTION", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.ConfirmTimeout, err = e.duration("CONFIRM_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.AckTimeout, err = e.duration("SUBSCRIBE_ACK_TIMEOUT", 5*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.ClockOffset, err = e.duration("CLOCK_OFFSET", 0); err != nil {
+		return cfg, err
+	}
+	cfg.NTPServer = e.get("NTP_SERVER")
+	if cfg.PerSymbol, err = e.bool("PER_SYMBOL_METRICS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.StrictSymbols, err = e.bool("STRICT_SYMBOLS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.CanonicalJSON, err = e.bool("CANONICAL_JSON", false); err != nil {
+		return cfg, err
+	}
+	if cfg.IncludeRaw, err = parseIncludeRaw(e.get("INCLUDE_RAW")); err != nil {
+		return cfg, fmt.Errorf("invalid INCLUDE_RAW: %w", err)
+	}
+	if cfg.PlanInterval, err = e.duration("SUBSCRIPTION_PLAN_INTERVAL", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.SymbolsFile != "" {
+		if cfg.Symbols, err = readSymbolsFile(cfg.SymbolsFile); err != nil {
+			return cfg, fmt.Errorf("invalid SYMBOLS_FILE: %w", err)
+		}
+	}
+	var dups []string
+	if cfg.Symbols, dups = dedupeSymbols(cfg.Symbols); len(dups) > 0 {
+		log.Printf("duplicate_symbols instance=%s symbols=%v", cfg.Instance, dups)
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration for values the gateway cannot run with.
+func (c Config) Validate() error {
+	if c.Instance == "" {
+		return fmt.Errorf("instance name is empty")
+	}
+	switch c.Source {
+	case sourceWS:
+	case sourceReplay:
+		if c.ReplayPath == "" {
+			return fmt.Errorf("SOURCE=replay requires REPLAY_PATH")
+		}
+		if c.ReplaySpeed < 0 {
+			return fmt.Errorf("invalid REPLAY_SPEED: %v", c.ReplaySpeed)
+		}
+	default:
+		return fmt.Errorf("unknown SOURCE %q (want ws|replay)", c.Source)
+	}
+	if c.WSURL == "" {
+		return fmt.Errorf("WS_URL is empty")
+	}
+	for _, u := range c.Redundant {
+		p, err := url.Parse(u)
+		if err != nil || (p.Scheme != "ws" && p.Scheme != "wss") || p.Host == "" {
+			return fmt.Errorf("invalid REDUNDANT_ENDPOINTS: %q is not a ws:// or wss:// URL", redactURL(u))
+		}
+		if u == c.WSURL {
+			return fmt.Errorf("invalid REDUNDANT_ENDPOINTS: %q is WS_URL", redactURL(u))
+		}
+	}
+	if len(c.Redundant) > 0 && c.Source != sourceWS {
+		return fmt.Errorf("REDUNDANT_ENDPOINTS requires SOURCE=ws")
+	}
+	if c.PlanKey != "" {
+		switch {
+		case c.Source != sourceWS:
+			return fmt.Errorf("SUBSCRIPTION_PLAN_KEY requires SOURCE=ws")
+		case c.RedisURL == "":
+			return fmt.Errorf("SUBSCRIPTION_PLAN_KEY requires REDIS_URL")
+		case c.SymbolsFile != "":
+			return fmt.Errorf("SUBSCRIPTION_PLAN_KEY and SYMBOLS_FILE are mutually exclusive")
+		case c.PlanInterval <= 0:
+			return fmt.Errorf("invalid SUBSCRIPTION_PLAN_INTERVAL: %s", c.PlanInterval)
+		}
+	}
+	if c.ConnMigration {
+		if c.Source != sourceWS {
+			return fmt.Errorf("CONNECTION_MIGRATION requires SOURCE=ws")
+		}
+		if c.MigrationInterval <= 0 {
+			return fmt.Errorf("invalid CONNECTION_MIGRATION_INTERVAL: %s", c.MigrationInterval)
+		}
+	}
+	if len(c.Symbols) == 0 {
+		return fmt.Errorf("no symbols configured")
+	}
+	if len(c.Topics) == 0 {
+		return fmt.Errorf("no topics configured")
+	}
+	if _, err := parsePayloadMode(c.PayloadMode); err != nil {
+		return fmt.Errorf("invalid PAYLOAD_MODE: %w", err)
+	}
+	if _, err := parseBookMode(c.BookMode); err != nil {
+		return fmt.Errorf("invalid BOOK_MODE: %w", err)
+	}
+	if c.BookCoalesce < 0 {
+		return fmt.Errorf("invalid BOOK_COALESCE_WINDOW: %s", c.BookCoalesce)
+	}
+	if c.BookCoalesce > 0 && c.BookMode != bookModeMaintained {
+		return fmt.Errorf("BOOK_COALESCE_WINDOW requires BOOK_MODE=maintained")
+	}
+	if c.FlowInterval < 0 || (c.FlowInterval > 0 && c.FlowInterval%time.Millisecond != 0) {
+		return fmt.Errorf("invalid FLOW_INTERVAL: %s (want a whole number of milliseconds)", c.FlowInterval)
+	}
+	if c.FlowInterval > 0 && !c.subscribesKind("publicTrade") {
+		return fmt.Errorf("FLOW_INTERVAL requires publicTrade in TOPICS")
+	}
+	if c.VolWindow < 0 || c.VolWindow%time.Millisecond != 0 {
+		return fmt.Errorf("invalid VOL_WINDOW: %s (want a whole number of milliseconds)", c.VolWindow)
+	}
+	if c.VolWindow > 0 {
+		if c.VolSample <= 0 || c.VolSample%time.Millisecond != 0 || c.VolSample >= c.VolWindow {
+			return fmt.Errorf("invalid VOL_SAMPLE: %s (want whole milliseconds shorter than VOL_WINDOW)", c.VolSample)
+		}
+		if _, err := parseVolBasis(c.VolBasis); err != nil {
+			return fmt.Errorf("invalid VOL_BASIS: %w", err)
+		}
+		if kind := volKind(c.VolBasis); !c.subscribesKind(kind) {
+			return fmt.Errorf("VOL_WINDOW requires %s in TOPICS", kind)
+		}
+	}
+	if c.MaxOutbound < 0 {
+		return fmt.Errorf("invalid MAX_OUTBOUND_BYTES: %d", c.MaxOutbound)
+	}
+	if _, err := parseOversizePolicy(c.OversizePolicy); err != nil {
+		return fmt.Errorf("invalid OVERSIZE_POLICY: %w", err)
+	}
+	if _, err := parseUnknownTopicPolicy(c.UnknownTopic); err != nil {
+		return fmt.Errorf("invalid UNKNOWN_TOPIC_POLICY: %w", err)
+	}
+	if c.ImbalanceDepth < 0 {
+		return fmt.Errorf("invalid IMBALANCE_DEPTH: %d", c.ImbalanceDepth)
+	}
+	if c.PublishDepth < 0 {
+		return fmt.Errorf("invalid PUBLISH_DEPTH: %d", c.PublishDepth)
+	}
+	if c.PublishDepth > 0 && c.BookMode != bookModeMaintained {
+		// Deltas can't be trimmed without the book they apply to.
+		return fmt.Errorf("PUBLISH_DEPTH requires BOOK_MODE=maintained")
+	}
+	if c.ImbalanceDepth > 0 && c.BookMode != bookModeMaintained {
+		return fmt.Errorf("IMBALANCE_DEPTH requires BOOK_MODE=maintained")
+	}
+	if c.ConflateInterval < 0 {
+		return fmt.Errorf("invalid CONFLATE_INTERVAL: %s", c.ConflateInterval)
+	}
+	for kind := range c.Conflate {
+		if !c.subscribesKind(kind) {
+			return fmt.Errorf("invalid CONFLATE: %s is not a kind in TOPICS", kind)
+		}
+		if kind == "orderbook" && c.BookMode == bookModeMaintained {
+			return fmt.Errorf("invalid CONFLATE: maintained books are coalesced by BOOK_COALESCE_WINDOW")
+		}
+	}
+	if c.EmitBoth && c.PayloadMode != payloadNormalized {
+		return fmt.Errorf("EMIT_BOTH requires PAYLOAD_MODE=normalized")
+	}
+	if c.TickerOnChange && !c.subscribesKind("tickers") {
+		return fmt.Errorf("TICKER_ON_CHANGE requires tickers in TOPICS")
+	}
+	if c.TickerMerge && !c.subscribesKind("tickers") {
+		return fmt.Errorf("TICKER_MERGE requires tickers in TOPICS")
+	}
+	if c.TickerSnapshot != "" {
+		if p, err := url.Parse(c.TickerSnapshot); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			return fmt.Errorf("invalid TICKER_SNAPSHOT_URL: %q is not an http:// or https:// URL", redactURL(c.TickerSnapshot))
+		}
+		if !c.subscribesKind("tickers") {
+			return fmt.Errorf("TICKER_SNAPSHOT_URL requires tickers in TOPICS")
+		}
+	}
+	if _, err := parseSymbolValidation(c.SymbolValidation); err != nil {
+		return fmt.Errorf("invalid SYMBOL_VALIDATION: %w", err)
+	}
+	if c.InstrumentsURL != "" {
+		if p, err := url.Parse(c.InstrumentsURL); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			return fmt.Errorf("invalid INSTRUMENTS_URL: %q is not an http:// or https:// URL", redactURL(c.InstrumentsURL))
+		}
+	}
+	if (c.SymbolValidation != symbolValidationOff) != (c.InstrumentsURL != "") {
+		return fmt.Errorf("SYMBOL_VALIDATION and INSTRUMENTS_URL must be set together")
+	}
+	if c.SymbolValidation != symbolValidationOff && c.Source != sourceWS {
+		return fmt.Errorf("SYMBOL_VALIDATION requires SOURCE=ws")
+	}
+	if c.RemoteWriteURL != "" {
+		if p, err := url.Parse(c.RemoteWriteURL); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			return fmt.Errorf("invalid REMOTE_WRITE_URL: %q is not an http:// or https:// URL", redactURL(c.RemoteWriteURL))
+		}
+		if len(c.RemoteSymbols) == 0 {
+			return fmt.Errorf("REMOTE_WRITE_URL requires REMOTE_WRITE_SYMBOLS")
+		}
+		for _, f := range c.RemoteFields {
+			if !remoteWriteFields[f] {
+				return fmt.Errorf("invalid REMOTE_WRITE_FIELDS: %q is not a numeric ticker field", f)
+			}
+		}
+		if c.RemoteInterval <= 0 {
+			return fmt.Errorf("invalid REMOTE_WRITE_INTERVAL: %s (want > 0)", c.RemoteInterval)
+		}
+		if !c.subscribesKind("tickers") {
+			return fmt.Errorf("REMOTE_WRITE_URL requires tickers in TOPICS")
+		}
+		if c.Source != sourceWS {
+			return fmt.Errorf("REMOTE_WRITE_URL requires SOURCE=ws")
+		}
+	} else if len(c.RemoteSymbols) > 0 || len(c.RemoteFields) > 0 {
+		return fmt.Errorf("REMOTE_WRITE_SYMBOLS and REMOTE_WRITE_FIELDS require REMOTE_WRITE_URL")
+	}
+	if c.KlineConfirmed && !c.subscribesKind("kline") {
+		return fmt.Errorf("KLINE_CONFIRMED_ONLY requires kline in TOPICS")
+	}
+	if c.KlineBackfill != "" {
+		if p, err := url.Parse(c.KlineBackfill); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			return fmt.Errorf("invalid KLINE_BACKFILL_URL: %q is not an http:// or https:// URL", redactURL(c.KlineBackfill))
+		}
+		if !c.subscribesKind("kline") {
+			return fmt.Errorf("KLINE_BACKFILL_URL requires kline in TOPICS")
+		}
+	}
+	for kind := range c.TsFields {
+		if !c.subscribesKind(kind) {
+			return fmt.Errorf("invalid TS_FIELDS: %s is not a kind in TOPICS", kind)
+		}
+	}
+	if _, err := parseBackpressure(c.Backpressure); err != nil {
+		return fmt.Errorf("invalid BACKPRESSURE: %w", err)
+	}
+	if _, err := parseFilter(c.Filter); err != nil {
+		return fmt.Errorf("invalid FILTER: %w", err)
+	}
+	if err := c.checkProcessors(); err != nil {
+		return err
+	}
+	if c.Sink != "" {
+		if err := c.checkSink(); err != nil {
+			return fmt.Errorf("invalid SINK: %w", err)
+		}
+	}
+	if routes, err := parseSinkRoutes(c.SinkRoutes); err != nil {
+		return fmt.Errorf("invalid SINK_ROUTES: %w", err)
+	} else if err := c.checkRouteSinks(routes); err != nil {
+		return fmt.Errorf("invalid SINK_ROUTES: %w", err)
+	}
+	if c.SinkConnect < 0 {
+		return fmt.Errorf("invalid SINK_CONNECT_TIMEOUT: %s", c.SinkConnect)
+	}
+	if c.SelfTest {
+		if c.SelfTestTimeout <= 0 {
+			return fmt.Errorf("invalid SELF_TEST_TIMEOUT: %s", c.SelfTestTimeout)
+		}
+		if _, err := parseSelfTestFailure(c.SelfTestFailure); err != nil {
+			return fmt.Errorf("invalid SELF_TEST_FAILURE: %w", err)
+		}
+	}
+	if c.SymbolState < 0 {
+		return fmt.Errorf("invalid SYMBOL_STATE_CAPACITY: %d", c.SymbolState)
+	}
+	if c.SortWindow < 0 {
+		return fmt.Errorf("invalid SORT_WINDOW: %s", c.SortWindow)
+	}
+	if c.CaptureRing < 0 {
+		return fmt.Errorf("invalid CAPTURE_RING_SIZE: %d", c.CaptureRing)
+	}
+	if c.CaptureRing > 0 && c.CaptureBytes <= 0 {
+		return fmt.Errorf("invalid CAPTURE_RING_BYTES: %d", c.CaptureBytes)
+	}
+	if c.CaptureRing > 0 && c.CaptureTotal <= 0 {
+		return fmt.Errorf("invalid CAPTURE_TOTAL_BYTES: %d", c.CaptureTotal)
+	}
+	if c.SinkWrite < 0 {
+		return fmt.Errorf("invalid SINK_WRITE_TIMEOUT: %s", c.SinkWrite)
+	}
+	if c.ShadowSink != "" {
+		if err := c.checkShadowSink(); err != nil {
+			return fmt.Errorf("invalid SHADOW_SINK: %w", err)
+		}
+		if c.ShadowBuffer < 1 {
+			return fmt.Errorf("invalid SHADOW_BUFFER: %d", c.ShadowBuffer)
+		}
+	}
+	if c.MaxPublish < 1 {
+		return fmt.Errorf("invalid MAX_PUBLISH_ATTEMPTS: %d", c.MaxPublish)
+	}
+	switch c.RedisMode {
+	case redisModeStream, redisModePubSub:
+	default:
+		return fmt.Errorf("invalid REDIS_MODE: %q (want stream|pubsub)", c.RedisMode)
+	}
+	if _, err := parseRedisLayout(c.RedisLayout); err != nil {
+		return fmt.Errorf("invalid REDIS_FIELD_LAYOUT: %w", err)
+	}
+	if c.RedisLayout == redisLayoutFields && c.RedisMode == redisModePubSub {
+		return fmt.Errorf("REDIS_FIELD_LAYOUT=fields requires REDIS_MODE=stream")
+	}
+	if c.DLQRedisStream != "" && c.DLQFile != "" {
+		return fmt.Errorf("DLQ_REDIS_STREAM and DLQ_FILE are mutually exclusive")
+	}
+	if c.DLQRedisStream != "" && c.RedisURL == "" {
+		return fmt.Errorf("DLQ_REDIS_STREAM requires REDIS_URL")
+	}
+	if _, err := parseLogPayload(c.LogPayload); err != nil {
+		return fmt.Errorf("invalid LOG_PAYLOAD: %w", err)
+	}
+	if _, err := parseStdoutFormat(c.StdoutFormat); err != nil {
+		return fmt.Errorf("invalid STDOUT_FORMAT: %w", err)
+	}
+	if _, err := parseKafkaFormat(c.KafkaFormat); err != nil {
+		return fmt.Errorf("invalid KAFKA_FORMAT: %w", err)
+	}
+	if c.KafkaFormat != kafkaFormatJSON {
+		if c.SchemaRegistry == "" {
+			return fmt.Errorf("KAFKA_FORMAT=%s requires SCHEMA_REGISTRY_URL", c.KafkaFormat)
+		}
+		if _, err := url.Parse(c.SchemaRegistry); err != nil {
+			return fmt.Errorf("invalid SCHEMA_REGISTRY_URL: %w", urlError(err))
+		}
+	}
+	if c.KafkaBatchSize < 1 {
+		return fmt.Errorf("invalid KAFKA_BATCH_SIZE: %d", c.KafkaBatchSize)
+	}
+	if c.KafkaBatchTimeout <= 0 {
+		return fmt.Errorf("invalid KAFKA_BATCH_TIMEOUT: %s", c.KafkaBatchTimeout)
+	}
+	if len(c.KafkaDRBrokers) > 0 {
+		if err := c.checkKafkaDR(); err != nil {
+			return err
+		}
+	}
+	if c.RecordBatch < 0 {
+		return fmt.Errorf("invalid RECORD_BATCH_SIZE: %d", c.RecordBatch)
+	}
+	if c.RecordBatch > 1 {
+		if c.RecordInterval <= 0 {
+			return fmt.Errorf("invalid RECORD_BATCH_INTERVAL: %s", c.RecordInterval)
+		}
+		if len(c.KafkaPartitions) > 0 {
+			// A record mixes symbols, so it has no key to partition by.
+			return fmt.Errorf("RECORD_BATCH_SIZE and KAFKA_PARTITION_MAP are mutually exclusive")
+		}
+		if c.RedisMode == redisModePubSub && strings.Contains(c.RedisChannel, "{") {
+			return fmt.Errorf("RECORD_BATCH_SIZE requires a REDIS_CHANNEL without placeholders")
+		}
+		if c.RedisLayout == redisLayoutFields {
+			return fmt.Errorf("RECORD_BATCH_SIZE and REDIS_FIELD_LAYOUT=fields are mutually exclusive")
+		}
+	}
+	if c.KafkaMaxAttempts < 1 {
+		return fmt.Errorf("invalid KAFKA_MAX_ATTEMPTS: %d", c.KafkaMaxAttempts)
+	}
+	// The TLS files are read when the sink is built.
+	if _, err := kafkaSASL(c); err != nil {
+		return fmt.Errorf("invalid KAFKA_SASL_MECHANISM: %w", err)
+	}
+	if !c.KafkaTLS && (c.KafkaCAFile != "" || c.KafkaCertFile != "" || c.KafkaKeyFile != "") {
+		return fmt.Errorf("KAFKA_TLS_CA_FILE, KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE require KAFKA_TLS=true")
+	}
+	if (c.KafkaCertFile == "") != (c.KafkaKeyFile == "") {
+		return fmt.Errorf("KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE must be set together")
+	}
+	if c.KafkaSASL != "" && (c.KafkaUser == "" || c.KafkaPassword == "") {
+		return fmt.Errorf("KAFKA_SASL_MECHANISM requires KAFKA_SASL_USER and KAFKA_SASL_PASSWORD")
+	}
+	if c.PublishBuffer < 0 {
+		return fmt.Errorf("invalid PUBLISH_BUFFER: %d", c.PublishBuffer)
+	}
+	if c.PublishWorkers < 1 {
+		return fmt.Errorf("invalid PUBLISH_WORKERS: %d", c.PublishWorkers)
+	}
+	if _, err := parseOrdering(c.Ordering); err != nil {
+		return fmt.Errorf("invalid ORDERING: %w", err)
+	}
+	if c.MinConfirmed < 0 || c.MinConfirmed > 1 {
+		return fmt.Errorf("invalid MIN_CONFIRMED_FRACTION: %v (want a fraction in [0,1])", c.MinConfirmed)
+	}
+	if c.AckTimeout < 0 {
+		return fmt.Errorf("invalid SUBSCRIBE_ACK_TIMEOUT: %s", c.AckTimeout)
+	}
+	if c.MinConfirmed > 0 && c.ConfirmTimeout <= 0 {
+		return fmt.Errorf("invalid CONFIRM_TIMEOUT: %s", c.ConfirmTimeout)
+	}
+	if c.WatchdogTimeout < 0 {
+		return fmt.Errorf("invalid WATCHDOG_TIMEOUT: %s", c.WatchdogTimeout)
+	}
+	if c.DeadmanTimeout < 0 || c.DeadmanTimeout > 0 && c.DeadmanTimeout < time.Second {
+		return fmt.Errorf("invalid DEADMAN_TIMEOUT: %s (want 0 or at least 1s)", c.DeadmanTimeout)
+	}
+	if c.DeadmanTimeout > 0 && c.Source != sourceWS {
+		return fmt.Errorf("DEADMAN_TIMEOUT requires SOURCE=ws")
+	}
+	if c.DeadmanHalt && c.DeadmanTimeout == 0 {
+		return fmt.Errorf("DEADMAN_HALT requires DEADMAN_TIMEOUT")
+	}
+	if c.RTTMetrics && c.PingInterval <= 0 {
+		return fmt.Errorf("RTT_METRICS requires PING_INTERVAL")
+	}
+	if c.WatchdogTimeout > 0 && c.PingInterval > 0 && c.WatchdogTimeout <= c.PingInterval {
+		// Pongs are the only frames a quiet connection is guaranteed to see.
+		return fmt.Errorf("WATCHDOG_TIMEOUT %s must exceed PING_INTERVAL %s", c.WatchdogTimeout, c.PingInterval)
+	}
+	if c.ConnectTimeout < 0 || c.HandshakeTimeout < 0 {
+		return fmt.Errorf("invalid CONNECT_TIMEOUT/HANDSHAKE_TIMEOUT: %s/%s", c.ConnectTimeout, c.HandshakeTimeout)
+	}
+	if _, err := parseWSNetwork(c.WSNetwork); err != nil {
+		return fmt.Errorf("invalid WS_NETWORK: %w", err)
+	}
+	if c.WSReadBuffer < 0 || c.WSWriteBuffer < 0 {
+		return fmt.Errorf("invalid WS_READ_BUFFER/WS_WRITE_BUFFER: %d/%d", c.WSReadBuffer, c.WSWriteBuffer)
+	}
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("invalid MAX_CONNECTIONS: %d", c.MaxConnections)
+	}
+	if c.MaxInbound < 0 {
+		return fmt.Errorf("invalid MAX_INBOUND_MSGS_PER_SEC: %d", c.MaxInbound)
+	}
+	if c.ReadLimit <= 0 {
+		return fmt.Errorf("invalid WS_READ_LIMIT: %d", c.ReadLimit)
+	}
+	if c.ReadLimitMax != 0 && c.ReadLimitMax < c.ReadLimit {
+		return fmt.Errorf("invalid WS_READ_LIMIT_MAX: %d (want at least WS_READ_LIMIT)", c.ReadLimitMax)
+	}
+	if c.RedisURL != "" {
+		if _, err := redis.ParseURL(c.RedisURL); err != nil {
+			return fmt.Errorf("invalid REDIS_URL: %w", urlError(err))
+		}
+	}
+	return nil
+}
+
+// loadValidConfigs loads every instance and validates it; it is the check
+// run at startup and by --print-config.
+func loadValidConfigs() ([]Config, error) {
+	cfgs, err := loadConfigs()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cfgs {
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("instance %s: %w", c.Instance, err)
+		}
+	}
+	if err := checkDisjoint(cfgs); err != nil {
+		return nil, err
+	}
+	return cfgs, nil
+}
+
+// checkDisjoint rejects instances that would subscribe the same topic on
+// the same WS endpoint, which would publish every event twice.
+func checkDisjoint(cfgs []Config) error {
+	owner := map[topicOwnerKey]string{}
+	for _, c := range cfgs {
+		if c.Source != sourceWS {
+			continue
+		}
+		for _, s := range c.Symbols {
+			for _, topic := range c.topicsFor(s) {
+				key := topicOwnerKey{url: c.WSURL, topic: topic}
+				if other, ok := owner[key]; ok {
+					return fmt.Errorf("instances %s and %s both subscribe %s on %s",
+						other, c.Instance, topic, redactURL(c.WSURL))
+				}
+				owner[key] = c.Instance
+			}
+		}
+	}
+	return nil
+}
+
+// printConfig writes the redacted configurations as a JSON array.
+func printConfig(w io.Writer, cfgs []Config) error {
+	out := make([]Config, len(cfgs))
+	for i, c := range cfgs {
+		out[i] = c.Redacted()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// loadMetricsConfig reads the process-wide METRIC_NAMESPACE and
+// METRIC_CONST_LABELS. They apply to the shared /metrics endpoint, so
+// per-instance overrides are not consulted.
+func loadMetricsConfig() (string, map[string]string, error) {
+	labels, err := parseKeyValues(os.Getenv("METRIC_CONST_LABELS"))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid METRIC_CONST_LABELS: %w", err)
+	}
+	return os.Getenv("METRIC_NAMESPACE"), labels, nil
+}
+
+// configFlags are command-line shortcuts for ad-hoc runs. Each overrides
+// the variable it names for every instance.
+var configFlags = []struct{ name, key, usage string }{
+	{"ws-url", "WS_URL", "exchange WebSocket URL (overrides WS_URL)"},
+	{"symbols", "SYMBOLS", "comma-separated symbols (overrides SYMBOLS)"},
+	{"sink", "SINK", "default sink: redis, kafka or none (overrides SINK)"},
+}
+
+// flagOverrides holds the configFlags given on the command line. It is set
+// once by main and applied on every load, including SIGHUP reloads.
+var flagOverrides env
+
+// bindConfigFlags registers configFlags on fs. The returned func, called
+// after fs.Parse, yields the flags that were explicitly set.
+func bindConfigFlags(fs *flag.FlagSet) func() env {
+	vals := make(map[string]*string, len(configFlags))
+	for _, f := range configFlags {
+		vals[f.name] = fs.String(f.name, "", f.usage)
+	}
+	return func() env {
+		out := env{}
+		fs.Visit(func(f *flag.Flag) {
+			for _, cf := range configFlags {
+				if cf.name == f.Name {
+					out[cf.key] = *vals[f.Name]
+				}
+			}
+		})
+		return out
+	}
+}
+
+// over returns base with o's entries applied on top; o wins.
+func (o env) over(base env) env {
+	if len(o) == 0 {
+		return base
+	}
+	out := make(env, len(base)+len(o))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range o {
+		out[k] = v
+	}
+	return out
+}
+
+type instanceSpec struct {
+	Instance string            `json:"instance"`
+	Env      map[string]string `json:"env"`
+}
+
+// loadConfigs returns one Config per gateway instance. Without
+// INSTANCES_FILE that is the single environment-derived instance; otherwise
+// the file holds a JSON array of {"instance": name, "env": {...}} objects
+// whose env entries override the process environment for that instance.
+func loadConfigs() ([]Config, error) {
+	path := os.Getenv("INSTANCES_FILE")
+	if path == "" {
+		cfg, err := loadConfig(flagOverrides.over(nil))
+		if err != nil {
+			return nil, err
+		}
+		return []Config{cfg}, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid INSTANCES_FILE: %w", err)
+	}
+	var specs []instanceSpec
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return nil, fmt.Errorf("invalid INSTANCES_FILE: %w", err)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("INSTANCES_FILE %s defines no instances", path)
+	}
+	seen := make(map[string]bool, len(specs))
+	cfgs := make([]Config, 0, len(specs))
+	for _, spec := range specs {
+		if spec.Instance == "" {
+			return nil, fmt.Errorf("INSTANCES_FILE: instance without a name")
+		}
+		if seen[spec.Instance] {
+			return nil, fmt.Errorf("INSTANCES_FILE: duplicate instance %q", spec.Instance)
+		}
+		seen[spec.Instance] = true
+		e := env{"INSTANCE": spec.Instance}
+		for k, v := range spec.Env {
+			e[k] = v
+		}
+		cfg, err := loadConfig(flagOverrides.over(e))
+		if err != nil {
+			return nil, fmt.Errorf("instance %s: %w", spec.Instance, err)
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
+
+// Redacted returns a copy safe to log or serve: credentials embedded in URLs
+// are masked.
+func (c Config) Redacted() Config {
+	r := c
+	r.WSURL = redactURL(c.WSURL)
+	if c.Redundant != nil {
+		r.Redundant = make([]string, len(c.Redundant))
+		for i, u := range c.Redundant {
+			r.Redundant[i] = redactURL(u)
+		}
+	}
+	r.RedisURL = redactURL(c.RedisURL)
+	r.SchemaRegistry = redactURL(c.SchemaRegistry)
+	r.RemoteWriteURL = redactURL(c.RemoteWriteURL)
+	if c.KafkaPassword != "" {
+		r.KafkaPassword = "xxxxx"
+	}
+	if isRedisURL(c.ReplayPath) {
+		r.ReplayPath = redactURL(c.ReplayPath)
+	}
+	return r
+}
+
+// SinkNames lists the sinks this configuration enables: every sink named by
+// SINK_ROUTES, otherwise the single default sink.
+func (c Config) SinkNames() []string {
+	routes, err := parseSinkRoutes(c.SinkRoutes)
+	if err != nil || len(routes) == 0 {
+		return []string{c.defaultSink()}
+	}
+	seen := map[string]bool{}
+	var names []string
+	for _, name := range append(routeSinkNames(routes), c.defaultRoute(routes).sinks...) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// defaultSink is the sink used without SINK_ROUTES: SINK if set, otherwise
+// Redis, else Kafka, else logging to stdout.
+func (c Config) defaultSink() string {
+	switch {
+	case c.Sink != "":
+		return c.Sink
+	case c.RedisURL != "":
+		return sinkRedis
+	case len(c.KafkaBrokers) > 0:
+		return sinkKafka
+	}
+	return sinkNone
+}
+
+// checkShadowSink requires the shadow to be a configured sink the primary
+// doesn't already write to.
+func (c Config) checkShadowSink() error {
+	switch c.ShadowSink {
+	case sinkRedis, sinkKafka, sinkNone:
+	default:
+		return fmt.Errorf("unknown sink %q (want redis|kafka|none)", c.ShadowSink)
+	}
+	if err := c.checkRouteSinks([]sinkRoute{{sinks: []string{c.ShadowSink}}}); err != nil {
+		return err
+	}
+	for _, name := range c.SinkNames() {
+		if name == c.ShadowSink {
+			return fmt.Errorf("%s is already a primary sink", name)
+		}
+	}
+	return nil
+}
+
+// checkKafkaDR requires a primary Kafka sink for KAFKA_DR_BROKERS to copy.
+func (c Config) checkKafkaDR() error {
+	primary := false
+	for _, name := range c.SinkNames() {
+		primary = primary || name == sinkKafka
+	}
+	if !primary {
+		return fmt.Errorf("KAFKA_DR_BROKERS requires a kafka sink")
+	}
+	if c.KafkaDRBatch < 1 {
+		return fmt.Errorf("invalid KAFKA_DR_BATCH_SIZE: %d", c.KafkaDRBatch)
+	}
+	if c.KafkaDRTimeout <= 0 {
+		return fmt.Errorf("invalid KAFKA_DR_BATCH_TIMEOUT: %s", c.KafkaDRTimeout)
+	}
+	if c.KafkaDRBuffer < 1 {
+		return fmt.Errorf("invalid KAFKA_DR_BUFFER: %d", c.KafkaDRBuffer)
+	}
+	return nil
+}
+
+// checkSink requires SINK to name a configured sink.
+func (c Config) checkSink() error {
+	switch c.Sink {
+	case sinkRedis, sinkKafka, sinkNone:
+	default:
+		return fmt.Errorf("unknown sink %q (want redis|kafka|none)", c.Sink)
+	}
+	return c.checkRouteSinks([]sinkRoute{{sinks: []string{c.Sink}}})
+}
+
+func (c Config) subscribesKind(kind string) bool {
+	for _, t := range c.Topics {
+		if topicKind(t) == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRouteSinks rejects routes to sinks that aren't configured.
+func (c Config) checkRouteSinks(routes []sinkRoute) error {
+	for _, name := range routeSinkNames(routes) {
+		switch {
+		case name == sinkRedis && c.RedisURL == "":
+			return fmt.Errorf("route to redis requires REDIS_URL")
+		case name == sinkKafka && len(c.KafkaBrokers) == 0:
+			return fmt.Errorf("route to kafka requires KAFKA_BROKERS")
+		}
+	}
+	return nil
+}
+
+func redactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "REDACTED"
+	}
+	return u.Redacted()
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// parseKeyValues parses "k1=v1,k2=v2".
+func parseKeyValues(v string) (map[string]string, error) {
+	items := splitList(v)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]string, len(items))
+	for _, item := range items {
+		k, val, ok := strings.Cut(item, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", item)
+		}
+		out[k] = strings.TrimSpace(val)
+	}
+	return out, nil
+}
+
+// env resolves configuration variables, consulting per-instance overrides
+// before the process environment. An empty value counts as unset.
+type env map[string]string
+
+func (e env) get(k string) string {
+	if v, ok := e[k]; ok {
+		return v
+	}
+	return os.Getenv(k)
+}
+
+// urlError strips the URL that url.Parse echoes into its errors, since it
+// may carry credentials.
+func urlError(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return ue.Err
+	}
+	return err
+}
+
+// secretVars may carry credentials and can instead be read from the file
+// named by the same variable with a _FILE suffix, so secrets mounted by
+// Kubernetes or Vault never have to pass through the environment.
+var secretVars = []string{"WS_URL", "REDIS_URL", "REPLAY_PATH", "SCHEMA_REGISTRY_URL", "KAFKA_SASL_USER", "KAFKA_SASL_PASSWORD", "ADMIN_TOKEN", "ADMIN_PASSWORD", "BYBIT_API_SECRET"}
+
+// withSecretFiles returns e with every set <VAR>_FILE of secretVars resolved
+// to the trimmed file contents. Errors name the variable and path only.
+func (e env) withSecretFiles() (env, error) {
+	out := make(env, len(e)+len(secretVars))
+	for k, v := range e {
+		out[k] = v
+	}
+	for _, k := range secretVars {
+		path := e.get(k + "_FILE")
+		if path == "" {
+			continue
+		}
+		if e.get(k) != "" {
+			return nil, fmt.Errorf("both %s and %s_FILE are set", k, k)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s_FILE: %w", k, err)
+		}
+		out[k] = strings.TrimSpace(string(b))
+	}
+	return out, nil
+}
+
+func (e env) str(k, def string) string {
+	if v := e.get(k); v != "" {
+		return v
+	}
+	return def
+}
+
+func (e env) int(k string, def int) (int, error) {
+	v := e.get(k)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", k, err)
+	}
+	return n, nil
+}
+
+func (e env) duration(k string, def time.Duration) (time.Duration, error) {
+	v := e.get(k)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", k, err)
+	}
+	return d, nil
+}
+
+func (e env) float(k string, def float64) (float64, error) {
+	v := e.get(k)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", k, err)
+	}
+	return f, nil
+}
+
+func (e env) bool(k string, def bool) (bool, error) {
+	v := e.get(k)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", k, err)
+	}
+	return b, nil
+}
+
+// checkProcessors requires the settings of each processor in PROCESSORS,
+// and a processor listed for each setting.
+func (c Config) checkProcessors() error {
+	for _, p := range []struct {
+		name, setting string
+		set           bool
+	}{
+		{processorFilter, "FILTER", c.Filter != ""},
+		{processorSampler, "SAMPLE_EVERY", c.SampleEvery != 0},
+		{processorEnricher, "ENRICH_FIELDS", len(c.EnrichFields) > 0},
+	} {
+		switch listed := c.hasProcessor(p.name); {
+		case listed && !p.set:
+			return fmt.Errorf("%s in PROCESSORS requires %s", p.name, p.setting)
+		case p.set && !listed:
+			return fmt.Errorf("%s requires %s in PROCESSORS", p.setting, p.name)
+		}
+	}
+	if c.SampleEvery < 0 || c.SampleEvery == 1 {
+		return fmt.Errorf("invalid SAMPLE_EVERY: %d (want at least 2)", c.SampleEvery)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigsFromInstancesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instances.json")
+	err := os.WriteFile(path, []byte(`[
+		{"instance": "linear", "env": {"SYMBOLS": "BTCUSDT", "WS_URL": "wss://stream.bybit.com/v5/public/linear"}},
+		{"instance": "spot", "env": {"SYMBOLS": "ETHUSDT,SOLUSDT", "PAYLOAD_MODE": "normalized"}}
+	]`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("INSTANCES_FILE", path)
+	t.Setenv("KAFKA_TOPIC", "shared_topic")
+
+	cfgs, err := loadConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfgs) != 2 {
+		t.Fatalf("got %d configs", len(cfgs))
+	}
+	if cfgs[0].Instance != "linear" || cfgs[0].WSURL != "wss://stream.bybit.com/v5/public/linear" || len(cfgs[0].Symbols) != 1 {
+		t.Fatalf("linear = %+v", cfgs[0])
+	}
+	if cfgs[1].Instance != "spot" || cfgs[1].PayloadMode != payloadNormalized || len(cfgs[1].Symbols) != 2 {
+		t.Fatalf("spot = %+v", cfgs[1])
+	}
+	for _, c := range cfgs {
+		if c.KafkaTopic != "shared_topic" {
+			t.Fatalf("%s did not inherit process env: %q", c.Instance, c.KafkaTopic)
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("%s: %v", c.Instance, err)
+		}
+	}
+}
+
+func TestLoadConfigsRejectsDuplicateInstances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instances.json")
+	if err := os.WriteFile(path, []byte(`[{"instance":"a"},{"instance":"a"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("INSTANCES_FILE", path)
+	if _, err := loadConfigs(); err == nil {
+		t.Fatal("expected duplicate instance error")
+	}
+}
+
+func TestConfigFlagPrecedence(t *testing.T) {
+	fs := flag.NewFlagSet("ws-gateway", flag.ContinueOnError)
+	setFlags := bindConfigFlags(fs)
+	if err := fs.Parse([]string{"-symbols", "SOLUSDT", "-sink", "none"}); err != nil {
+		t.Fatal(err)
+	}
+	flagOverrides = setFlags()
+	t.Cleanup(func() { flagOverrides = nil })
+	if _, ok := flagOverrides["WS_URL"]; ok {
+		t.Fatal("unset -ws-url must not override WS_URL")
+	}
+
+	t.Setenv("REDIS_URL", "redis://localhost:6379/0")
+	t.Setenv("SYMBOLS", "BTCUSDT")
+	t.Setenv("WS_URL", "wss://env")
+	t.Setenv("TOPICS", "tickers")
+	cfgs, err := loadValidConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cfgs[0]
+	if strings.Join(c.Symbols, ",") != "SOLUSDT" || c.WSURL != "wss://env" || c.defaultSink() != sinkNone {
+		t.Fatalf("flags over env: symbols=%v url=%s sink=%s", c.Symbols, c.WSURL, c.defaultSink())
+	}
+	if c.PayloadMode != payloadRaw {
+		t.Fatalf("default payload mode = %s", c.PayloadMode)
+	}
+
+	path := filepath.Join(t.TempDir(), "instances.json")
+	err = os.WriteFile(path, []byte(`[{"instance": "a", "env": {"SYMBOLS": "ETHUSDT", "WS_URL": "wss://file", "TOPICS": "orderbook.1"}}]`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("INSTANCES_FILE", path)
+	if cfgs, err = loadValidConfigs(); err != nil {
+		t.Fatal(err)
+	}
+	c = cfgs[0]
+	if strings.Join(c.Symbols, ",") != "SOLUSDT" || c.WSURL != "wss://file" || c.Topics[0] != "orderbook.1" {
+		t.Fatalf("flags over instance env: symbols=%v url=%s topics=%v", c.Symbols, c.WSURL, c.Topics)
+	}
+
+	flagOverrides = env{"SINK": "kafka"}
+	if _, err := loadValidConfigs(); err == nil || !strings.Contains(err.Error(), "SINK") {
+		t.Fatalf("-sink kafka without brokers: %v", err)
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "redis_url")
+	if err := os.WriteFile(path, []byte("redis://:s3cret@redis:6379/0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REDIS_URL_FILE", path)
+
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RedisURL != "redis://:s3cret@redis:6379/0" {
+		t.Fatalf("RedisURL = %q", cfg.RedisURL)
+	}
+	if r := cfg.Redacted().RedisURL; strings.Contains(r, "s3cret") {
+		t.Fatalf("redacted RedisURL leaks the secret: %q", r)
+	}
+
+	if _, err := loadConfig(env{"REDIS_URL": "redis://other:6379"}); err == nil {
+		t.Fatal("expected error when both REDIS_URL and REDIS_URL_FILE are set")
+	}
+	if _, err := loadConfig(env{"REDIS_URL_FILE": filepath.Join(dir, "missing")}); err == nil {
+		t.Fatal("expected error for unreadable REDIS_URL_FILE")
+	}
+
+	apiSecret := filepath.Join(dir, "bybit_api_secret")
+	if err := os.WriteFile(apiSecret, []byte("api-s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := (env{"BYBIT_API_SECRET_FILE": apiSecret}).withSecretFiles(); err != nil || e["BYBIT_API_SECRET"] != "api-s3cret" {
+		t.Fatalf("BYBIT_API_SECRET_FILE resolved to %q, %v", e["BYBIT_API_SECRET"], err)
+	}
+	if _, err := loadConfig(env{"BYBIT_API_SECRET": "api-s3cret", "BYBIT_API_SECRET_FILE": apiSecret}); err == nil || strings.Contains(err.Error(), "api-s3cret") {
+		t.Fatalf("both BYBIT_API_SECRET and BYBIT_API_SECRET_FILE: %v", err)
+	}
+}
+
+func TestValidateDoesNotEchoURL(t *testing.T) {
+	cfg, err := loadConfig(env{"REDIS_URL": "redis://:s3cret@bad host:6379"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("expected invalid REDIS_URL")
+	}
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Fatalf("error leaks the secret: %v", err)
+	}
+}
+
+func TestCheckDisjoint(t *testing.T) {
+	a := Config{Instance: "a", Source: sourceWS, WSURL: "wss://x", Symbols: []string{"BTCUSDT"}, Topics: []string{"tickers"}}
+	b := a
+	b.Instance, b.Topics = "b", []string{"orderbook.50"}
+	if err := checkDisjoint([]Config{a, b}); err != nil {
+		t.Fatalf("different topics: %v", err)
+	}
+	b.Topics = []string{"orderbook.50", "tickers"}
+	if err := checkDisjoint([]Config{a, b}); err == nil || !strings.Contains(err.Error(), "tickers.BTCUSDT") {
+		t.Fatalf("overlap err = %v", err)
+	}
+	b.WSURL = "wss://y"
+	if err := checkDisjoint([]Config{a, b}); err != nil {
+		t.Fatalf("different endpoints: %v", err)
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	t.Setenv("REDIS_URL", "redis://:s3cret@redis:6379/0")
+	cfgs, err := loadValidConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := printConfig(&buf, cfgs); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "s3cret") {
+		t.Fatalf("printed config leaks the secret:\n%s", buf.String())
+	}
+	var out []Config
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || out[0].Instance != "default" || out[0].RedisStream == "" {
+		t.Fatalf("printed config = %+v", out)
+	}
+
+	t.Setenv("BACKPRESSURE", "bogus")
+	if _, err := loadValidConfigs(); err == nil {
+		t.Fatal("expected validation error")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// conflateIntervals maps topic kinds to conflation intervals.
+type conflateIntervals map[string]time.Duration
+
+// parseConflate parses CONFLATE, comma-separated kind:interval pairs such as
+// "orderbook:100ms,tickers:0".
+func parseConflate(v string) (conflateIntervals, error) {
+	items := splitList(v)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	out := make(conflateIntervals, len(items))
+	for _, item := range items {
+		kind, d, ok := strings.Cut(item, ":")
+		kind = strings.TrimSpace(kind)
+		if !ok || kind == "" {
+			return nil, fmt.Errorf("expected kind:interval, got %q", item)
+		}
+		if _, dup := out[kind]; dup {
+			return nil, fmt.Errorf("%s listed twice", kind)
+		}
+		interval, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", kind, err)
+		}
+		if interval < 0 {
+			return nil, fmt.Errorf("%s: negative interval %s", kind, interval)
+		}
+		out[kind] = interval
+	}
+	return out, nil
+}
+
+// conflateInterval is the interval for a topic kind: its CONFLATE entry,
+// else CONFLATE_INTERVAL. Maintained books are coalesced by the book keeper
+// instead.
+func (c Config) conflateInterval(kind string) time.Duration {
+	if kind == "orderbook" && c.BookMode == bookModeMaintained {
+		return 0
+	}
+	if d, ok := c.Conflate[kind]; ok {
+		return d
+	}
+	return c.ConflateInterval
+}
+
+type conflateKey struct{ symbol, topic string }
+
+type conflateState struct {
+	ev    OutEvent
+	timer *time.Timer
+}
+
+// conflater merges each symbol and topic's events over its kind's interval
+// and emits the result when the interval ends. Merging keeps the combined
+// event equivalent to the ones it replaces: ticker and order book deltas are
+// folded field by field, trades are concatenated, and a snapshot discards
+// what came before it. Kinds with a zero interval pass straight through.
+type conflater struct {
+	interval func(kind string) time.Duration
+	emit     func(OutEvent)
+
+	mu      sync.Mutex
+	pending map[conflateKey]*conflateState
+}
+
+func newConflater(interval func(kind string) time.Duration, emit func(OutEvent)) *conflater {
+	return &conflater{interval: interval, emit: emit, pending: make(map[conflateKey]*conflateState)}
+}
+
+// handle takes ev if its kind is conflated and reports whether it did.
+func (c *conflater) handle(ev OutEvent) bool {
+	d := c.interval(topicKind(ev.Type))
+	if d <= 0 {
+		return false
+	}
+	key := conflateKey{ev.Symbol, ev.Type}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st, ok := c.pending[key]; ok {
+		st.ev = mergeEvents(st.ev, ev)
+		return true
+	}
+	c.pending[key] = &conflateState{ev: ev, timer: time.AfterFunc(d, func() { c.flush(key) })}
+	return true
+}
+
+func (c *conflater) flush(key conflateKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st, ok := c.pending[key]
+	if !ok {
+		return
+	}
+	delete(c.pending, key)
+	// Emitting under the lock keeps this window ahead of the next one.
+	c.emit(st.ev)
+}
+
+// flushAll emits every pending window now, e.g. on drain.
+func (c *conflater) flushAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, st := range c.pending {
+		st.timer.Stop()
+		delete(c.pending, key)
+		c.emit(st.ev)
+	}
+}
+
+// reset drops pending windows, e.g. after a reconnect where Bybit resends
+// snapshots.
+func (c *conflater) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, st := range c.pending {
+		st.timer.Stop()
+	}
+	c.pending = make(map[conflateKey]*conflateState)
+}
+
+// mergeEvents folds next into prev. The result has no Raw frame since it
+// stands for several.
+func mergeEvents(prev, next OutEvent) OutEvent {
+	if next.Action == actionSnapshot {
+		return next
+	}
+	out := next
+	out.Raw = nil
+	if prev.Action == actionSnapshot {
+		// A snapshot with deltas applied is still a full snapshot.
+		out.Action = actionSnapshot
+	}
+	switch p := prev.Payload.(type) {
+	case map[string]any:
+		if n, ok := next.Payload.(map[string]any); ok {
+			out.Payload = mergeFields(topicKind(next.Type), p, n, out.Action == actionSnapshot)
+		}
+	case []any:
+		if n, ok := next.Payload.([]any); ok {
+			out.Payload = append(p, n...)
+		}
+	}
+	return out
+}
+
+// mergeFields overlays next's fields on prev; for order books the b and a
+// level lists are merged by price, later sizes winning. In a snapshot,
+// levels deleted by a delta (size 0) are removed rather than kept.
+func mergeFields(kind string, prev, next map[string]any, snapshot bool) map[string]any {
+	for k, v := range next {
+		if kind == "orderbook" && (k == "b" || k == "a") {
+			prev[k] = mergeLevelLists(prev[k], v, snapshot)
+			continue
+		}
+		prev[k] = v
+	}
+	return prev
+}
+
+func mergeLevelLists(prev, next any, dropEmpty bool) []any {
+	p, _ := prev.([]any)
+	n, _ := next.([]any)
+	index := make(map[any]int, len(p))
+	for i, l := range p {
+		if pair, ok := l.([]any); ok && len(pair) > 0 {
+			index[pair[0]] = i
+		}
+	}
+	for _, l := range n {
+		pair, ok := l.([]any)
+		if !ok || len(pair) == 0 {
+			continue
+		}
+		if i, seen := index[pair[0]]; seen {
+			p[i] = l
+			continue
+		}
+		index[pair[0]] = len(p)
+		p = append(p, l)
+	}
+	if !dropEmpty {
+		return p
+	}
+	kept := p[:0]
+	for _, l := range p {
+		if pair, ok := l.([]any); ok && len(pair) > 1 && toFloat(pair[1]) == 0 {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	return kept
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseConflate(t *testing.T) {
+	got, err := parseConflate("orderbook:100ms, tickers:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, conflateIntervals{"orderbook": 100 * time.Millisecond, "tickers": 0}) {
+		t.Fatalf("conflate = %v", got)
+	}
+	for _, bad := range []string{"orderbook", "orderbook:fast", "tickers:-1s", "tickers:0,tickers:1s", ":1s"} {
+		if _, err := parseConflate(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestConflateIntervalFallback(t *testing.T) {
+	cfg, err := loadConfig(env{"CONFLATE": "tickers:0", "CONFLATE_INTERVAL": "250ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if d := cfg.conflateInterval("tickers"); d != 0 {
+		t.Fatalf("tickers interval = %s, want 0", d)
+	}
+	if d := cfg.conflateInterval("orderbook"); d != 250*time.Millisecond {
+		t.Fatalf("orderbook interval = %s, want the global 250ms", d)
+	}
+	cfg.BookMode = bookModeMaintained
+	if d := cfg.conflateInterval("orderbook"); d != 0 {
+		t.Fatalf("maintained orderbook interval = %s, want 0", d)
+	}
+
+	cfg.Conflate = conflateIntervals{"kline": time.Second}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for a kind not in TOPICS")
+	}
+}
+
+func TestMergeEvents(t *testing.T) {
+	tick := func(action string, data map[string]any) OutEvent {
+		return OutEvent{Symbol: "BTCUSDT", Type: "tickers.BTCUSDT", Action: action, Payload: data}
+	}
+	got := mergeEvents(
+		tick(actionSnapshot, map[string]any{"lastPrice": "1", "markPrice": "1"}),
+		tick(actionDelta, map[string]any{"markPrice": "2"}))
+	if got.Action != actionSnapshot || !reflect.DeepEqual(got.Payload, map[string]any{"lastPrice": "1", "markPrice": "2"}) {
+		t.Fatalf("ticker merge = %+v", got)
+	}
+
+	book := func(action string, bids ...[]any) OutEvent {
+		levels := make([]any, len(bids))
+		for i, b := range bids {
+			levels[i] = b
+		}
+		return OutEvent{Symbol: "BTCUSDT", Type: "orderbook.50.BTCUSDT", Action: action, Payload: map[string]any{"b": levels, "u": float64(len(bids))}}
+	}
+	got = mergeEvents(book(actionDelta, []any{"100", "1"}, []any{"99", "2"}), book(actionDelta, []any{"100", "0"}, []any{"98", "3"}))
+	want := []any{[]any{"100", "0"}, []any{"99", "2"}, []any{"98", "3"}}
+	if got.Action != actionDelta || !reflect.DeepEqual(got.Payload.(map[string]any)["b"], want) {
+		t.Fatalf("delta merge = %+v", got)
+	}
+	got = mergeEvents(book(actionSnapshot, []any{"100", "1"}, []any{"99", "2"}), book(actionDelta, []any{"100", "0"}))
+	want = []any{[]any{"99", "2"}}
+	if got.Action != actionSnapshot || !reflect.DeepEqual(got.Payload.(map[string]any)["b"], want) {
+		t.Fatalf("snapshot merge = %+v", got)
+	}
+
+	trades := mergeEvents(
+		OutEvent{Type: "publicTrade.BTCUSDT", Payload: []any{"t1"}, Raw: []byte(`{}`)},
+		OutEvent{Type: "publicTrade.BTCUSDT", Payload: []any{"t2"}, Raw: []byte(`{}`)})
+	if !reflect.DeepEqual(trades.Payload, []any{"t1", "t2"}) || trades.Raw != nil {
+		t.Fatalf("trade merge = %+v", trades)
+	}
+}
+
+func TestConflaterWindows(t *testing.T) {
+	var mu sync.Mutex
+	var emitted []OutEvent
+	intervals := conflateIntervals{"orderbook": 30 * time.Millisecond}
+	c := newConflater(func(kind string) time.Duration { return intervals[kind] }, func(ev OutEvent) {
+		mu.Lock()
+		emitted = append(emitted, ev)
+		mu.Unlock()
+	})
+
+	if c.handle(OutEvent{Symbol: "BTCUSDT", Type: "tickers.BTCUSDT"}) {
+		t.Fatal("tickers have no interval and must pass through")
+	}
+	for i := 0; i < 3; i++ {
+		ev := OutEvent{Ts: int64(i), Symbol: "BTCUSDT", Type: "orderbook.50.BTCUSDT", Action: actionDelta, Payload: map[string]any{"u": float64(i)}}
+		if !c.handle(ev) {
+			t.Fatal("orderbook event not conflated")
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(emitted)
+		mu.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(emitted) != 1 || emitted[0].Ts != 2 || emitted[0].Payload.(map[string]any)["u"] != float64(2) {
+		t.Fatalf("emitted = %+v, want one merged event", emitted)
+	}
+}
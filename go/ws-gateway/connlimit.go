@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/gorilla/websocket"
+)
+
+var errConnLimit = errors.New("connection limit exceeded")
+
+// connSlots caps the number of concurrently open WS connections across the
+// whole process (MAX_CONNECTIONS). A nil channel means unlimited.
+var (
+	connSlots     chan struct{}
+	connSlotsOnce sync.Once
+)
+
+func initConnSlots(max int) {
+	connSlotsOnce.Do(func() {
+		if max > 0 {
+			connSlots = make(chan struct{}, max)
+		}
+	})
+}
+
+func acquireConnSlot(ctx context.Context) error {
+	if connSlots == nil {
+		return nil
+	}
+	select {
+	case connSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseConnSlot() {
+	if connSlots == nil {
+		return
+	}
+	<-connSlots
+}
+
+var connLimitMarkers = []string{
+	"too many connections",
+	"connection limit",
+	"max connections",
+	"exceeded the connection",
+}
+
+// isConnLimit reports whether a dial or read failure is Bybit signalling that
+// the IP has exceeded its connection limits: an HTTP 403/429 on the upgrade
+// or a close frame whose reason mentions the limit.
+func isConnLimit(resp *http.Response, err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, errConnLimit) {
+		return true
+	}
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusForbidden) {
+		return true
+	}
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		if ce.Code == websocket.CloseTryAgainLater {
+			return true
+		}
+		return hasConnLimitMarker(ce.Text)
+	}
+	return hasConnLimitMarker(err.Error())
+}
+
+func hasConnLimitMarker(s string) bool {
+	s = strings.ToLower(s)
+	for _, m := range connLimitMarkers {
+		if strings.Contains(s, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func newConnLimitBackOff() *backoff.ExponentialBackOff {
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = 30 * time.Second
+	bo.MaxInterval = 5 * time.Minute
+	bo.MaxElapsedTime = 0
+	return bo
+}
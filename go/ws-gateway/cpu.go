@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the process's cgroup is mounted in a container.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// autoMaxProcs reads AUTO_GOMAXPROCS, process-wide and on by default.
+func autoMaxProcs() (bool, error) {
+	v := os.Getenv("AUTO_GOMAXPROCS")
+	if v == "" {
+		return true, nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid AUTO_GOMAXPROCS: %q", v)
+	}
+	return on, nil
+}
+
+// tuneMaxProcs lowers GOMAXPROCS to the cgroup's CPU limit, rounded down
+// but at least 1. The Go versions this module targets size it from the
+// host's CPUs, so a container limited to 2 of 64 cores would run 64 Ps
+// and be throttled by the CFS quota in bursts. An explicit GOMAXPROCS wins.
+func tuneMaxProcs(root string) {
+	if v := os.Getenv("GOMAXPROCS"); v != "" {
+		log.Printf("gomaxprocs=%s source=env", v)
+		return
+	}
+	limit, err := cgroupCPULimit(root)
+	if err != nil {
+		log.Printf("gomaxprocs_error err=%v", err)
+		return
+	}
+	procs := runtime.GOMAXPROCS(0)
+	if limit <= 0 || int(limit) >= procs {
+		log.Printf("gomaxprocs=%d source=cpus", procs)
+		return
+	}
+	n := max(1, int(limit))
+	runtime.GOMAXPROCS(n)
+	log.Printf("gomaxprocs=%d source=cgroup cpu_limit=%g", n, limit)
+}
+
+// cgroupCPULimit returns the CPU limit under root in cores, or 0 without
+// one: cpu.max under cgroup v2, the CFS quota and period under v1.
+func cgroupCPULimit(root string) (float64, error) {
+	if b, err := os.ReadFile(filepath.Join(root, "cpu.max")); err == nil {
+		quota, period, ok := strings.Cut(strings.TrimSpace(string(b)), " ")
+		if quota == "max" {
+			return 0, nil
+		}
+		return cpuQuota(quota, period, ok)
+	}
+	for _, dir := range []string{"cpu", "cpu,cpuacct"} {
+		q, err := os.ReadFile(filepath.Join(root, dir, "cpu.cfs_quota_us"))
+		if err != nil {
+			continue
+		}
+		quota := strings.TrimSpace(string(q))
+		if quota == "-1" {
+			return 0, nil
+		}
+		p, err := os.ReadFile(filepath.Join(root, dir, "cpu.cfs_period_us"))
+		if err != nil {
+			return 0, err
+		}
+		return cpuQuota(quota, strings.TrimSpace(string(p)), true)
+	}
+	return 0, nil
+}
+
+func cpuQuota(quota, period string, ok bool) (float64, error) {
+	q, qerr := strconv.ParseFloat(quota, 64)
+	p, perr := strconv.ParseFloat(period, 64)
+	if !ok || qerr != nil || perr != nil || q <= 0 || p <= 0 {
+		return 0, fmt.Errorf("unexpected cgroup CPU quota %q period %q", quota, period)
+	}
+	return q / p, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func writeCgroupFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCgroupCPULimit(t *testing.T) {
+	v2 := t.TempDir()
+	writeCgroupFile(t, filepath.Join(v2, "cpu.max"), "150000 100000\n")
+	v1 := t.TempDir()
+	writeCgroupFile(t, filepath.Join(v1, "cpu,cpuacct", "cpu.cfs_quota_us"), "200000\n")
+	writeCgroupFile(t, filepath.Join(v1, "cpu,cpuacct", "cpu.cfs_period_us"), "100000\n")
+	unlimited := t.TempDir()
+	writeCgroupFile(t, filepath.Join(unlimited, "cpu.max"), "max 100000\n")
+	bad := t.TempDir()
+	writeCgroupFile(t, filepath.Join(bad, "cpu.max"), "lots\n")
+
+	for _, tc := range []struct {
+		root string
+		want float64
+	}{{v2, 1.5}, {v1, 2}, {unlimited, 0}, {t.TempDir(), 0}} {
+		if got, err := cgroupCPULimit(tc.root); err != nil || got != tc.want {
+			t.Fatalf("limit = %v, %v; want %v", got, err, tc.want)
+		}
+	}
+	if _, err := cgroupCPULimit(bad); err == nil {
+		t.Fatal("malformed cpu.max accepted")
+	}
+}
+
+func TestTuneMaxProcs(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	root := t.TempDir()
+	writeCgroupFile(t, filepath.Join(root, "cpu.max"), "50000 100000\n")
+	runtime.GOMAXPROCS(4)
+	t.Setenv("GOMAXPROCS", "3")
+	tuneMaxProcs(root)
+	if n := runtime.GOMAXPROCS(0); n != 4 {
+		t.Fatalf("GOMAXPROCS = %d with it set explicitly", n)
+	}
+	os.Unsetenv("GOMAXPROCS")
+	tuneMaxProcs(root)
+	if n := runtime.GOMAXPROCS(0); n != 1 {
+		t.Fatalf("GOMAXPROCS = %d under half a CPU, want 1", n)
+	}
+}
+
+func TestAutoMaxProcs(t *testing.T) {
+	t.Setenv("AUTO_GOMAXPROCS", "")
+	if on, err := autoMaxProcs(); !on || err != nil {
+		t.Fatalf("default = %v, %v", on, err)
+	}
+	t.Setenv("AUTO_GOMAXPROCS", "false")
+	if on, err := autoMaxProcs(); on || err != nil {
+		t.Fatalf("false = %v, %v", on, err)
+	}
+	t.Setenv("AUTO_GOMAXPROCS", "sometimes")
+	if _, err := autoMaxProcs(); err == nil {
+		t.Fatal("AUTO_GOMAXPROCS=sometimes accepted")
+	}
+}
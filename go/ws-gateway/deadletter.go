@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+const (
+	deadLetterEncode  = "encode"
+	deadLetterPublish = "publish"
+	deadLetterSchema  = "schema"
+
+	publishRetryDelay = 100 * time.Millisecond
+	deadLetterTimeout = 5 * time.Second
+)
+
+// deadLetter is what the dead-letter destination records for an event that
+// could not be published: the event itself, or when it can't be encoded, a
+// Go rendering of it, plus the source frame with INCLUDE_RAW.
+type deadLetter struct {
+	Ts       int64           `json:"ts"`
+	Instance string          `json:"instance"`
+	Reason   string          `json:"reason"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	Symbol   string          `json:"symbol,omitempty"`
+	Type     string          `json:"type,omitempty"`
+	Event    json.RawMessage `json:"event,omitempty"`
+	Dump     string          `json:"dump,omitempty"`
+	Raw      json.RawMessage `json:"raw,omitempty"`
+}
+
+// deadLetterQueue stores poison events for offline analysis.
+type deadLetterQueue interface {
+	write(ctx context.Context, rec []byte) error
+	Close() error
+}
+
+func newDeadLetterQueue(cfg Config) (deadLetterQueue, error) {
+	switch {
+	case cfg.DLQRedisStream != "":
+		opt, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", urlError(err))
+		}
+		return &redisDeadLetters{client: redis.NewClient(opt), stream: cfg.DLQRedisStream}, nil
+	case cfg.DLQFile != "":
+		f, err := os.OpenFile(cfg.DLQFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return &fileDeadLetters{f: f}, nil
+	}
+	return nil, nil
+}
+
+// redisDeadLetters writes to DLQ_REDIS_STREAM on REDIS_URL, whose client
+// is replaced when the sink's credentials rotate.
+type redisDeadLetters struct {
+	stream string
+
+	mu     sync.RWMutex
+	client *redis.Client
+}
+
+func (d *redisDeadLetters) write(ctx context.Context, rec []byte) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.client.XAdd(ctx, &redis.XAddArgs{Stream: d.stream, Values: map[string]interface{}{"data": rec}}).Err()
+}
+
+// rotate connects to redisURL instead, closing the old client once no
+// write is using it.
+func (d *redisDeadLetters) rotate(redisURL string) error {
+	opt, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return fmt.Errorf("invalid REDIS_URL: %w", urlError(err))
+	}
+	d.mu.Lock()
+	old := d.client
+	d.client = redis.NewClient(opt)
+	d.mu.Unlock()
+	return old.Close()
+}
+
+func (d *redisDeadLetters) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.client.Close()
+}
+
+// fileDeadLetters appends one JSON record per line.
+type fileDeadLetters struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (d *fileDeadLetters) write(_ context.Context, rec []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err := d.f.Write(append(rec, '\n'))
+	return err
+}
+
+func (d *fileDeadLetters) Close() error { return d.f.Close() }
+
+// publishReason classifies a publish error: encoding failures are
+// deterministic, so they are not retried.
+func publishReason(err error) string {
+	var (
+		typeErr    *json.UnsupportedTypeError
+		valueErr   *json.UnsupportedValueError
+		marshalErr *json.MarshalerError
+	)
+	if errors.As(err, &typeErr) || errors.As(err, &valueErr) || errors.As(err, &marshalErr) {
+		return deadLetterEncode
+	}
+	return deadLetterPublish
+}
+
+// deadLetter records ev after its last failed attempt.
+func (g *Gateway) deadLetter(ev OutEvent, err error, reason string, attempts int) {
+	rec := deadLetter{
+		Ts:       g.clock.Now().UnixMilli(),
+		Instance: g.cfg.Instance,
+		Reason:   reason,
+		Error:    err.Error(),
+		Attempts: attempts,
+		Symbol:   ev.Symbol,
+		Type:     ev.Type,
+		Raw:      ev.Raw,
+	}
+	if b, mErr := json.Marshal(ev); mErr == nil {
+		rec.Event = b
+	} else {
+		rec.Dump = fmt.Sprintf("%+v", ev.Payload)
+		if !json.Valid(rec.Raw) {
+			rec.Raw = nil
+		}
+	}
+	b, mErr := json.Marshal(rec)
+	if mErr != nil {
+		g.metrics.errors.Inc()
+		log.Printf("instance=%s dead_letter_error err=%v", g.cfg.Instance, mErr)
+		return
+	}
+	// g.ctx is already cancelled while Stop drains the buffer.
+	ctx, cancel := context.WithTimeout(context.Background(), deadLetterTimeout)
+	defer cancel()
+	if wErr := g.dlq.write(ctx, b); wErr != nil {
+		g.metrics.errors.Inc()
+		log.Printf("instance=%s dead_letter_error err=%v", g.cfg.Instance, wErr)
+		return
+	}
+	g.metrics.deadLettered.WithLabelValues(reason).Inc()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// failingSink fails its first publishes with err.
+type failingSink struct {
+	memSink
+	failures int
+	calls    int
+	err      error
+}
+
+func (s *failingSink) Publish(ctx context.Context, ev OutEvent) error {
+	s.calls++
+	if s.calls <= s.failures {
+		return s.err
+	}
+	return s.memSink.Publish(ctx, ev)
+}
+
+func readDeadLetters(t *testing.T, path string) []deadLetter {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []deadLetter
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec deadLetter
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("bad record %q: %v", sc.Text(), err)
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+func TestDeadLetter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dlq.ndjson")
+	g, _ := newTestGateway(t, "")
+	g.metrics = newGatewayMetrics("dead_letter")
+	g.cfg.MaxPublish = 3
+	g.cfg.DLQFile = path
+	dlq, err := newDeadLetterQueue(g.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.dlq = dlq
+	defer dlq.Close()
+
+	ev := OutEvent{Type: "tickers", Symbol: "BTCUSDT", Ts: 1, Raw: json.RawMessage(`{"topic":"tickers.BTCUSDT"}`)}
+
+	transient := &failingSink{failures: 2, err: errors.New("timeout")}
+	g.sink = transient
+	g.deliver(ev)
+	if transient.calls != 3 || len(transient.Events()) != 1 {
+		t.Fatalf("calls=%d published=%d, want retried into a publish", transient.calls, len(transient.Events()))
+	}
+
+	down := &failingSink{failures: math.MaxInt, err: errors.New("connection refused")}
+	g.sink = down
+	g.deliver(ev)
+	if down.calls != 3 {
+		t.Fatalf("calls = %d, want MAX_PUBLISH_ATTEMPTS", down.calls)
+	}
+
+	poison := &failingSink{failures: math.MaxInt, err: fmt.Errorf("encode: %w", &json.UnsupportedValueError{Str: "NaN"})}
+	g.sink = poison
+	g.deliver(OutEvent{Type: "tickers", Symbol: "ETHUSDT", Payload: math.NaN()})
+	if poison.calls != 1 {
+		t.Fatalf("encode failure retried: calls = %d", poison.calls)
+	}
+
+	recs := readDeadLetters(t, path)
+	if len(recs) != 2 {
+		t.Fatalf("dead letters = %+v, want 2", recs)
+	}
+	if r := recs[0]; r.Reason != deadLetterPublish || r.Attempts != 3 || r.Error != "connection refused" ||
+		r.Symbol != "BTCUSDT" || string(r.Raw) != `{"topic":"tickers.BTCUSDT"}` || len(r.Event) == 0 {
+		t.Fatalf("publish dead letter = %+v", r)
+	}
+	if r := recs[1]; r.Reason != deadLetterEncode || r.Attempts != 1 || r.Dump != "NaN" || r.Event != nil {
+		t.Fatalf("encode dead letter = %+v", r)
+	}
+	if got := testutil.ToFloat64(g.metrics.deadLettered.WithLabelValues(deadLetterPublish)); got != 1 {
+		t.Fatalf("dead_lettered{reason=publish} = %v", got)
+	}
+	if got := testutil.ToFloat64(g.metrics.deadLettered.WithLabelValues(deadLetterEncode)); got != 1 {
+		t.Fatalf("dead_lettered{reason=encode} = %v", got)
+	}
+}
+
+func TestDeadLetterConfig(t *testing.T) {
+	for _, tc := range []env{
+		{"MAX_PUBLISH_ATTEMPTS": "0"},
+		{"DLQ_REDIS_STREAM": "md_dlq"},
+		{"REDIS_URL": "redis://localhost:6379", "DLQ_REDIS_STREAM": "md_dlq", "DLQ_FILE": "/tmp/dlq"},
+	} {
+		cfg, err := loadConfig(tc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Validate() == nil {
+			t.Fatalf("%v: expected error", tc)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// typeStale is the OutEvent.Type of DEADMAN_TIMEOUT markers.
+const typeStale = "stale"
+
+// Stale is the payload of a stale marker: Stale is true once a symbol has
+// had no data for DEADMAN_TIMEOUT and false on the first data after that.
+// LastData is when data was last read, in local time, or when the symbol
+// started being watched if it never had any.
+type Stale struct {
+	Stale     bool  `json:"stale"`
+	LastData  int64 `json:"lastData"`
+	TimeoutMs int64 `json:"timeoutMs"`
+}
+
+// deadman tracks when each subscribed symbol last had data, on the
+// monotonic clock.
+type deadman struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	last  map[string]time.Time
+	wall  map[string]int64
+	stale map[string]bool
+}
+
+func newDeadman(timeout time.Duration) *deadman {
+	return &deadman{timeout: timeout, last: make(map[string]time.Time), wall: make(map[string]int64), stale: make(map[string]bool)}
+}
+
+// observe records data for symbol and reports whether it was stale.
+func (d *deadman) observe(symbol string, now time.Time, wallMs int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.last[symbol], d.wall[symbol] = now, wallMs
+	if !d.stale[symbol] {
+		return false
+	}
+	delete(d.stale, symbol)
+	return true
+}
+
+// expire returns the symbols that just went stale, with when they last had
+// data. Symbols not seen before start their timeout now, and symbols no
+// longer subscribed are forgotten.
+func (d *deadman) expire(symbols []string, now time.Time, wallMs int64) map[string]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	subscribed := newSymbolSet(symbols)
+	for s := range d.last {
+		if !subscribed.has(s) {
+			delete(d.last, s)
+			delete(d.wall, s)
+			delete(d.stale, s)
+		}
+	}
+	var expired map[string]int64
+	for _, s := range symbols {
+		last, ok := d.last[s]
+		if !ok {
+			d.last[s], d.wall[s] = now, wallMs
+			continue
+		}
+		if d.stale[s] || now.Sub(last) <= d.timeout {
+			continue
+		}
+		d.stale[s] = true
+		if expired == nil {
+			expired = make(map[string]int64)
+		}
+		expired[s] = d.wall[s]
+	}
+	return expired
+}
+
+// forget stops watching symbols.
+func (d *deadman) forget(symbols []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range symbols {
+		delete(d.last, s)
+		delete(d.wall, s)
+		delete(d.stale, s)
+	}
+}
+
+func (d *deadman) isStale(symbol string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stale[symbol]
+}
+
+func (d *deadman) staleCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.stale)
+}
+
+// observeData clears symbol's stale state on fresh data, publishing the
+// marker saying so ahead of the data.
+func (g *Gateway) observeData(symbol string) {
+	now := g.clock.Now().UnixMilli()
+	if !g.deadman.observe(symbol, time.Now(), now) {
+		return
+	}
+	g.metrics.staleSymbols.Set(float64(g.deadman.staleCount()))
+	log.Printf("instance=%s deadman_resumed symbol=%s", g.cfg.Instance, symbol)
+	g.publish(OutEvent{Ts: now, Symbol: symbol, Type: typeStale, Payload: Stale{LastData: now, TimeoutMs: g.cfg.DeadmanTimeout.Milliseconds()}})
+}
+
+// watchDeadman publishes a stale marker for each subscribed symbol that
+// goes DEADMAN_TIMEOUT without data, connected or not.
+func (g *Gateway) watchDeadman() {
+	t := time.NewTicker(g.cfg.DeadmanTimeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case now := <-t.C:
+			g.mu.Lock()
+			symbols := g.symbols
+			g.mu.Unlock()
+			ts := g.clock.Now().UnixMilli()
+			expired := g.deadman.expire(symbols, now, ts)
+			g.metrics.staleSymbols.Set(float64(g.deadman.staleCount()))
+			for _, s := range symbols {
+				last, ok := expired[s]
+				if !ok {
+					continue
+				}
+				g.metrics.staleMarkers.Inc()
+				log.Printf("instance=%s deadman_stale symbol=%s idle=%s", g.cfg.Instance, s, time.Duration(ts-last)*time.Millisecond)
+				g.publish(OutEvent{Ts: ts, Symbol: s, Type: typeStale, Payload: Stale{Stale: true, LastData: last, TimeoutMs: g.cfg.DeadmanTimeout.Milliseconds()}})
+			}
+		}
+	}
+}
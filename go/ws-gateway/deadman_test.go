@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDeadmanExpire(t *testing.T) {
+	d := newDeadman(time.Second)
+	start := time.Now()
+	if got := d.expire([]string{"BTCUSDT", "ETHUSDT"}, start, 1000); len(got) != 0 {
+		t.Fatalf("expired on first sight: %v", got)
+	}
+	d.observe("BTCUSDT", start.Add(900*time.Millisecond), 1900)
+	got := d.expire([]string{"BTCUSDT", "ETHUSDT"}, start.Add(1500*time.Millisecond), 2500)
+	if len(got) != 1 || got["ETHUSDT"] != 1000 {
+		t.Fatalf("expired = %v, want ETHUSDT since 1000", got)
+	}
+	if got := d.expire([]string{"BTCUSDT", "ETHUSDT"}, start.Add(1600*time.Millisecond), 2600); len(got) != 0 {
+		t.Fatalf("expired again: %v", got)
+	}
+	if !d.observe("ETHUSDT", start.Add(1700*time.Millisecond), 2700) || d.isStale("ETHUSDT") {
+		t.Fatal("fresh data didn't clear ETHUSDT")
+	}
+	d.expire([]string{"BTCUSDT"}, start.Add(5*time.Second), 6000)
+	if _, ok := d.last["ETHUSDT"]; ok {
+		t.Fatal("unsubscribed ETHUSDT still tracked")
+	}
+}
+
+func TestDeadmanMarkers(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("deadman")
+	g.cfg.DeadmanTimeout, g.cfg.DeadmanHalt = 40*time.Millisecond, true
+	g.deadman = newDeadman(g.cfg.DeadmanTimeout)
+	// Markers get past a filter dropping everything but tickers.
+	f, err := parseFilter("type == tickers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.processors = processorChain{&filterProcessor{filter: f, filtered: g.metrics.filtered}}
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	go g.readLoop()
+	go g.watchDeadman()
+
+	evs := waitEvents(t, sink, 1)
+	if p, ok := evs[0].Payload.(Stale); evs[0].Type != typeStale || evs[0].Symbol != "BTCUSDT" || !ok || !p.Stale || p.TimeoutMs != 40 {
+		t.Fatalf("marker = %+v", evs[0])
+	}
+	if v := testutil.ToFloat64(g.metrics.staleSymbols); v != 1 {
+		t.Fatalf("stale symbols = %v", v)
+	}
+	g.publish(OutEvent{Symbol: "BTCUSDT", Type: "tickers.BTCUSDT"})
+	if n := testutil.ToFloat64(g.metrics.deadmanDropped); n != 1 {
+		t.Fatalf("dropped = %v", n)
+	}
+
+	sendJSON(t, server, map[string]any{"topic": "tickers.BTCUSDT", "type": "snapshot", "data": map[string]any{"s": "BTCUSDT"}})
+	evs = waitEvents(t, sink, 3)
+	if p, ok := evs[1].Payload.(Stale); evs[1].Type != typeStale || !ok || p.Stale || evs[2].Type != "tickers.BTCUSDT" {
+		t.Fatalf("after fresh data: %+v", evs[1:])
+	}
+	g.closeConn()
+
+	// Unsubscribing a stale symbol clears it.
+	if err := g.applySymbols(nil); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(g.metrics.staleSymbols); v != 0 {
+		t.Fatalf("stale symbols = %v after unsubscribing", v)
+	}
+}
+
+func TestDeadmanConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"DEADMAN_TIMEOUT": "5s", "DEADMAN_HALT": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DeadmanTimeout != 5*time.Second || !cfg.DeadmanHalt || cfg.Validate() != nil {
+		t.Fatalf("DeadmanTimeout = %s, halt %v, Validate = %v", cfg.DeadmanTimeout, cfg.DeadmanHalt, cfg.Validate())
+	}
+	cfg.DeadmanTimeout = 0
+	if cfg.Validate() == nil {
+		t.Fatal("DEADMAN_HALT without DEADMAN_TIMEOUT accepted")
+	}
+	cfg.DeadmanTimeout = time.Millisecond
+	if cfg.Validate() == nil {
+		t.Fatal("DEADMAN_TIMEOUT under 1s accepted")
+	}
+}
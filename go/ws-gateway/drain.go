@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const (
+	drainNone = iota
+	drainDraining
+	drainDrained
+)
+
+// drain stops taking work ahead of shutdown: frames still read from the WS,
+// which stays open, and /ingest uploads are ignored, then everything
+// buffered is published and the sinks are closed. healthState reports
+// "draining" and then "drained", both failing /healthz.
+func (g *Gateway) drain() {
+	if !g.drainState.CompareAndSwap(drainNone, drainDraining) {
+		// Already draining; wait for whoever started it.
+		g.closePublish()
+		return
+	}
+	log.Printf("instance=%s drain_start", g.cfg.Instance)
+	// Frames already past the draining check may still be feeding books
+	// and conflation windows; let them finish before those are flushed.
+	g.frameMu.Lock()
+	g.frameMu.Unlock()
+	g.closePublish()
+	g.drainState.Store(drainDrained)
+	log.Printf("instance=%s drain_done", g.cfg.Instance)
+}
+
+func (g *Gateway) draining() bool { return g.drainState.Load() != drainNone }
+
+// closePublish shuts the publish path down once: queued kline backfills
+// are published, pending book coalesce and conflation windows, the sort
+// window and the publish buffer are delivered, in that order, capture
+// dumps in progress are written and the sinks are closed. Later publishes
+// are dropped.
+func (g *Gateway) closePublish() {
+	g.closeOnce.Do(func() {
+		if g.backfills != nil {
+			g.backfills.close()
+		}
+		// Books go first: their events may still be conflated.
+		if g.books != nil {
+			g.books.flushAll()
+		}
+		if g.conflate != nil {
+			g.conflate.flushAll()
+		}
+		if g.sorter != nil {
+			g.sorter.close()
+		}
+		g.pubMu.Lock()
+		g.pubClosed = true
+		g.pubMu.Unlock()
+		if g.queue != nil {
+			g.queue.Close()
+		}
+		// Nothing may publish once the queue is closed.
+		if g.books != nil {
+			g.books.reset()
+		}
+		if g.conflate != nil {
+			g.conflate.reset()
+		}
+		g.dumps.Wait()
+		// A rotation in progress finishes first; none starts afterwards.
+		g.rotateMu.Lock()
+		defer g.rotateMu.Unlock()
+		g.closeSink(g.sink)
+		if g.dlq != nil {
+			g.dlq.Close()
+		}
+	})
+}
+
+// drain handles POST /drain, draining every instance and answering once all
+// of them are drained, with the /healthz body but a 200.
+func (s gatewaySet) drain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, g := range s {
+		wg.Add(1)
+		go func(g *Gateway) {
+			defer wg.Done()
+			g.drain()
+		}(g)
+	}
+	wg.Wait()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.health())
+}
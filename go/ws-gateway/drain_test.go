@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDrain(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("drain")
+	g.cfg.Topics = []string{"tickers"}
+	q, err := newEventQueue(Config{PublishBuffer: 16, PublishWorkers: 1, Backpressure: backpressureBlock}, g.metrics, g.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.queue = q
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	go g.readLoop()
+	ticker := func(ts int64) map[string]any {
+		return map[string]any{"topic": "tickers.BTCUSDT", "type": "snapshot", "ts": ts, "data": map[string]any{"symbol": "BTCUSDT", "lastPrice": "100"}}
+	}
+	sendJSON(t, server, ticker(1700000000000))
+	waitEvents(t, sink, 1)
+
+	set := gatewaySet{g}
+	rec := httptest.NewRecorder()
+	set.drain(rec, httptest.NewRequest("POST", "/drain", nil))
+	var resp healthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != 200 || resp.Status != "drained" || resp.Instances["test"] != "drained" {
+		t.Fatalf("drain = %d %+v", rec.Code, resp)
+	}
+	rec = httptest.NewRecorder()
+	set.healthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != 503 {
+		t.Fatalf("healthz after drain = %d, want 503", rec.Code)
+	}
+
+	// The socket stays open but its data is ignored.
+	sendJSON(t, server, ticker(1700000000001))
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(g.metrics.drainIgnored) < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("frame after drain was not ignored")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := len(sink.Events()); n != 1 {
+		t.Fatalf("published %d events, want none after drain", n)
+	}
+	if !g.live.Load() {
+		t.Fatal("drain closed the connection")
+	}
+	// A later shutdown doesn't close the publish path twice.
+	g.closePublish()
+}
+
+func TestDrainFlushesPendingWindows(t *testing.T) {
+	g, sink := newTestGateway(t, "", "BTCUSDT")
+	g.metrics = newGatewayMetrics("drain_flush")
+	g.conflate = newConflater(func(string) time.Duration { return time.Hour }, g.emit)
+	g.books = newBookKeeper(time.Hour, stateLimit{}, g.clock, g.publishBook)
+	g.conflate.handle(OutEvent{Symbol: "BTCUSDT", Type: "tickers.BTCUSDT", Action: actionDelta, Payload: map[string]any{"lastPrice": "100"}})
+	g.books.handle("BTCUSDT", "orderbook.50.BTCUSDT", actionSnapshot, bookData(1, [][2]string{{"100", "1"}}, [][2]string{{"101", "1"}}))
+	g.books.handle("BTCUSDT", "orderbook.50.BTCUSDT", actionDelta, bookData(2, [][2]string{{"99", "2"}}, nil))
+	if n := len(sink.Events()); n != 1 {
+		t.Fatalf("published %d events before drain, want the snapshot", n)
+	}
+
+	g.drain()
+	evs := sink.Events()
+	if len(evs) != 3 {
+		t.Fatalf("published %+v, want the pending book and ticker too", evs)
+	}
+	if book := evs[1].Payload.(NormalizedBook); evs[1].Action != actionUpdate || len(book.Bids) != 2 {
+		t.Fatalf("flushed book = %+v", evs[1])
+	}
+	if evs[2].Type != "tickers.BTCUSDT" {
+		t.Fatalf("flushed %+v, want the conflated ticker", evs[2])
+	}
+}
+
+// gatedClock holds the first Now call until release is closed, to park a
+// frame halfway through handleFrame.
+type gatedClock struct {
+	Clock
+	once    sync.Once
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (c *gatedClock) Now() time.Time {
+	c.once.Do(func() {
+		close(c.entered)
+		<-c.release
+	})
+	return c.Clock.Now()
+}
+
+func TestDrainWaitsForFrameInFlight(t *testing.T) {
+	g, sink := newTestGateway(t, "", "BTCUSDT")
+	g.metrics = newGatewayMetrics("drain_in_flight")
+	g.conflate = newConflater(func(string) time.Duration { return time.Hour }, g.emit)
+	clock := &gatedClock{Clock: g.clock, entered: make(chan struct{}), release: make(chan struct{})}
+	g.clock = clock
+	r := &connReader{leg: legPrimary, seenTopics: make(map[string]bool), unexpected: make(symbolSet), unknownTopics: make(map[string]bool)}
+	frame := []byte(`{"topic":"tickers.BTCUSDT","type":"delta","data":{"symbol":"BTCUSDT","lastPrice":"100"}}`)
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		g.handleFrame(r, frame, time.Now())
+	}()
+	<-clock.entered
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		g.drain()
+	}()
+	for !g.draining() {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-drained:
+		t.Fatal("drain finished with a frame in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(clock.release)
+	<-handled
+	<-drained
+	if evs := sink.Events(); len(evs) != 1 || evs[0].Type != "tickers.BTCUSDT" {
+		t.Fatalf("published %+v, want the in-flight ticker", evs)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// topicOwners maps each topic, per WS endpoint, to the gateway whose
+// connection first delivered it, so that several instances in one process
+// subscribed to the same stream are noticed.
+var topicOwners sync.Map // topicOwnerKey -> *Gateway
+
+type topicOwnerKey struct{ url, topic string }
+
+// claimTopic is called for each data frame; seen holds the topics already
+// checked on this connection. A topic another live connection owns counts
+// once in ws_gateway_duplicate_subscription_total.
+func (g *Gateway) claimTopic(topic string, seen map[string]bool) {
+	if _, ok := seen[topic]; ok {
+		return
+	}
+	owner, loaded := topicOwners.LoadOrStore(topicOwnerKey{g.wsURL, topic}, g)
+	owned := !loaded || owner == g
+	seen[topic] = owned
+	if !owned {
+		g.metrics.duplicateSubs.Inc()
+		log.Printf("duplicate_subscription instance=%s topic=%s other=%s",
+			g.cfg.Instance, topic, owner.(*Gateway).cfg.Instance)
+	}
+}
+
+// releaseTopics gives up the topics this connection owned once it ends.
+func (g *Gateway) releaseTopics(seen map[string]bool) {
+	for topic, owned := range seen {
+		if owned {
+			topicOwners.CompareAndDelete(topicOwnerKey{g.wsURL, topic}, g)
+		}
+	}
+}
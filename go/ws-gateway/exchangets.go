@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tsLocal as a TS_FIELDS entry stamps events with the local clock.
+const tsLocal = "local"
+
+// defaultTsFields are where Bybit puts the authoritative time for kinds
+// whose top-level ts is only when the frame was pushed: the matching engine
+// time of a book update and the fill time of the first trade.
+var defaultTsFields = map[string]string{
+	"orderbook":   "cts",
+	"publicTrade": "data.T",
+}
+
+// tsFields maps topic kinds to the frame field holding their timestamp.
+type tsFields map[string]string
+
+// parseTsFields parses TS_FIELDS, comma-separated kind:field pairs such as
+// "orderbook:ts,publicTrade:data.T". A field is a top-level key, data.<key>
+// for a key of the data object (or of the first element of a data array),
+// or local.
+func parseTsFields(v string) (tsFields, error) {
+	items := splitList(v)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	out := make(tsFields, len(items))
+	for _, item := range items {
+		kind, field, ok := strings.Cut(item, ":")
+		kind, field = strings.TrimSpace(kind), strings.TrimSpace(field)
+		if !ok || kind == "" || field == "" {
+			return nil, fmt.Errorf("expected kind:field, got %q", item)
+		}
+		if _, dup := out[kind]; dup {
+			return nil, fmt.Errorf("%s listed twice", kind)
+		}
+		if key, ok := strings.CutPrefix(field, "data."); (ok && key == "") || strings.Trim(field, ".") != field {
+			return nil, fmt.Errorf("%s: invalid field %q", kind, field)
+		}
+		out[kind] = field
+	}
+	return out, nil
+}
+
+// tsField is the timestamp field for a topic kind: its TS_FIELDS entry, else
+// the built-in default, else ts.
+func (c Config) tsField(kind string) string {
+	if f, ok := c.TsFields[kind]; ok {
+		return f
+	}
+	if f, ok := defaultTsFields[kind]; ok {
+		return f
+	}
+	return "ts"
+}
+
+// exchangeTs reads the milliseconds timestamp at field from a decoded frame,
+// reporting false when it is absent or not a number.
+func exchangeTs(raw map[string]any, field string) (int64, bool) {
+	if field == tsLocal {
+		return 0, false
+	}
+	var v any
+	if key, ok := strings.CutPrefix(field, "data."); ok {
+		data := raw["data"]
+		if arr, ok := data.([]any); ok && len(arr) > 0 {
+			data = arr[0]
+		}
+		m, _ := data.(map[string]any)
+		v = m[key]
+	} else {
+		v = raw[field]
+	}
+	var ts int64
+	switch n := v.(type) {
+	case float64:
+		ts = int64(n)
+	case json.Number:
+		ts, _ = n.Int64()
+	case string:
+		// Some Bybit payloads quote their numbers.
+		ts, _ = strconv.ParseInt(n, 10, 64)
+	}
+	return ts, ts > 0
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeBybit is an httptest-backed WS server that records client ops and hands
+// each accepted connection to the test so it can push frames.
+type fakeBybit struct {
+	srv   *httptest.Server
+	recv  chan map[string]any
+	conns chan *websocket.Conn
+}
+
+func newFakeBybit(t testing.TB) *fakeBybit {
+	t.Helper()
+	f := &fakeBybit{
+		recv:  make(chan map[string]any, 64),
+		conns: make(chan *websocket.Conn, 8),
+	}
+	upgrader := websocket.Upgrader{}
+	f.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		select {
+		case f.conns <- conn:
+		default:
+		}
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg map[string]any
+			if json.Unmarshal(b, &msg) != nil {
+				continue
+			}
+			select {
+			case f.recv <- msg:
+			default:
+			}
+		}
+	}))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeBybit) url() string {
+	return "ws" + strings.TrimPrefix(f.srv.URL, "http")
+}
+
+func (f *fakeBybit) nextConn(t testing.TB) *websocket.Conn {
+	t.Helper()
+	select {
+	case c := <-f.conns:
+		return c
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for connection")
+		return nil
+	}
+}
+
+func (f *fakeBybit) nextOp(t *testing.T) map[string]any {
+	t.Helper()
+	select {
+	case m := <-f.recv:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for client op")
+		return nil
+	}
+}
+
+func sendJSON(t testing.TB, conn *websocket.Conn, v any) {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var testMetrics = newGatewayMetrics("test")
+
+func newTestGateway(t testing.TB, wsURL string, symbols ...string) (*Gateway, *memSink) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &memSink{}
+	clock := newFakeClock(time.UnixMilli(1700000000000))
+	g := &Gateway{
+		cfg:     Config{Instance: "test", Source: sourceWS},
+		metrics: testMetrics,
+		done:    make(chan struct{}),
+		wsURL:   wsURL,
+		symbols: symbols,
+		sink:    sink,
+		subs:    newSubscriptions(),
+		dialer:  &websocket.Dialer{HandshakeTimeout: 2 * time.Second},
+		warmup:  newWarmup(clock, 0, 0),
+		clock:   clock,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	t.Cleanup(func() {
+		cancel()
+		g.closeConn()
+	})
+	return g, sink
+}
+
+func waitEvents(t *testing.T, s *memSink, n int) []OutEvent {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if evs := s.Events(); len(evs) >= n {
+			return evs
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d events, have %d", n, len(s.Events()))
+	return nil
+}
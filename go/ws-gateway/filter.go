@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// eventFilter is a compiled FILTER expression: a disjunction (||) of
+// conjunctions (&&) of predicates. There is no grouping; && binds tighter.
+//
+// Predicates:
+//
+//	field == value         field != value
+//	field in [v1, v2]      field not in [v1, v2]
+//	changed(payloadField)
+//
+// Fields are symbol, topic (the full Bybit topic) and type (the topic kind,
+// e.g. "tickers"). changed(f) holds when payload field f differs from the
+// last value seen for the same symbol and topic kind, and on first sight.
+type eventFilter struct {
+	expr string
+	any  [][]predicate
+}
+
+type predicate interface {
+	match(ev *OutEvent) bool
+}
+
+func parseFilter(expr string) (*eventFilter, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, nil
+	}
+	f := &eventFilter{expr: expr}
+	for _, disj := range strings.Split(expr, "||") {
+		var all []predicate
+		for _, term := range strings.Split(disj, "&&") {
+			p, err := parsePredicate(strings.TrimSpace(term))
+			if err != nil {
+				return nil, fmt.Errorf("filter %q: %w", expr, err)
+			}
+			all = append(all, p)
+		}
+		f.any = append(f.any, all)
+	}
+	return f, nil
+}
+
+func (f *eventFilter) match(ev *OutEvent) bool {
+	for _, all := range f.any {
+		ok := true
+		for _, p := range all {
+			if !p.match(ev) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+type eventField int
+
+const (
+	fieldSymbol eventField = iota
+	fieldTopic
+	fieldType
+)
+
+func parseField(name string) (eventField, error) {
+	switch name {
+	case "symbol":
+		return fieldSymbol, nil
+	case "topic":
+		return fieldTopic, nil
+	case "type":
+		return fieldType, nil
+	}
+	return 0, fmt.Errorf("unknown field %q (want symbol|topic|type)", name)
+}
+
+func (f eventField) of(ev *OutEvent) string {
+	switch f {
+	case fieldSymbol:
+		return ev.Symbol
+	case fieldTopic:
+		return ev.Type
+	}
+	return topicKind(ev.Type)
+}
+
+type eqPredicate struct {
+	field  eventField
+	value  string
+	negate bool
+}
+
+func (p eqPredicate) match(ev *OutEvent) bool {
+	return (p.field.of(ev) == p.value) != p.negate
+}
+
+type inPredicate struct {
+	field  eventField
+	set    map[string]struct{}
+	negate bool
+}
+
+func (p inPredicate) match(ev *OutEvent) bool {
+	_, ok := p.set[p.field.of(ev)]
+	return ok != p.negate
+}
+
+type changedKey struct{ symbol, kind string }
+
+type changedPredicate struct {
+	name string
+	mu   sync.Mutex
+	last map[changedKey]string
+}
+
+func (p *changedPredicate) match(ev *OutEvent) bool {
+	v, ok := payloadField(ev.Payload, p.name)
+	if !ok {
+		return false
+	}
+	key := changedKey{ev.Symbol, topicKind(ev.Type)}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if prev, seen := p.last[key]; seen && prev == v {
+		return false
+	}
+	p.last[key] = v
+	return true
+}
+
+func parsePredicate(term string) (predicate, error) {
+	if term == "" {
+		return nil, fmt.Errorf("empty term")
+	}
+	if strings.HasPrefix(term, "changed(") && strings.HasSuffix(term, ")") {
+		name := strings.TrimSpace(term[len("changed(") : len(term)-1])
+		if name == "" {
+			return nil, fmt.Errorf("changed() needs a payload field")
+		}
+		return &changedPredicate{name: name, last: make(map[changedKey]string)}, nil
+	}
+	for _, op := range []string{"==", "!="} {
+		if lhs, rhs, ok := strings.Cut(term, op); ok {
+			field, err := parseField(strings.TrimSpace(lhs))
+			if err != nil {
+				return nil, err
+			}
+			return eqPredicate{field: field, value: unquote(strings.TrimSpace(rhs)), negate: op == "!="}, nil
+		}
+	}
+	for _, op := range []string{" not in ", " in "} {
+		if lhs, rhs, ok := strings.Cut(term, op); ok {
+			field, err := parseField(strings.TrimSpace(lhs))
+			if err != nil {
+				return nil, err
+			}
+			rhs = strings.TrimSpace(rhs)
+			if !strings.HasPrefix(rhs, "[") || !strings.HasSuffix(rhs, "]") {
+				return nil, fmt.Errorf("expected [list] after %q", strings.TrimSpace(op))
+			}
+			set := make(map[string]struct{})
+			for _, v := range splitList(rhs[1 : len(rhs)-1]) {
+				set[unquote(v)] = struct{}{}
+			}
+			return inPredicate{field: field, set: set, negate: op == " not in "}, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot parse %q", term)
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// payloadField returns a payload field rendered as a string, for raw Bybit
+// maps and for normalized tickers.
+func payloadField(payload any, name string) (string, bool) {
+	switch p := payload.(type) {
+	case map[string]any:
+		v, ok := p[name]
+		if !ok {
+			return "", false
+		}
+		if s, ok := v.(string); ok {
+			return s, true
+		}
+		return fmt.Sprint(v), true
+	case NormalizedTicker:
+		var f *float64
+		switch name {
+		case "lastPrice":
+			f = p.LastPrice
+		case "markPrice":
+			f = p.MarkPrice
+		case "indexPrice":
+			f = p.IndexPrice
+		case "bidPrice":
+			f = p.BidPrice
+		case "askPrice":
+			f = p.AskPrice
+		case "fundingRate":
+			f = p.FundingRate
+		case "openInterest":
+			f = p.OpenInterest
+		}
+		if f == nil {
+			return "", false
+		}
+		return strconv.FormatFloat(*f, 'g', -1, 64), true
+	}
+	return "", false
+}
@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestFilterMatch(t *testing.T) {
+	f, err := parseFilter("type==tickers && symbol in [BTCUSDT, ETHUSDT] || topic == orderbook.25.SOLUSDT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		ev   OutEvent
+		want bool
+	}{
+		{OutEvent{Symbol: "BTCUSDT", Type: "tickers.BTCUSDT"}, true},
+		{OutEvent{Symbol: "ETHUSDT", Type: "tickers.ETHUSDT"}, true},
+		{OutEvent{Symbol: "XRPUSDT", Type: "tickers.XRPUSDT"}, false},
+		{OutEvent{Symbol: "BTCUSDT", Type: "orderbook.25.BTCUSDT"}, false},
+		{OutEvent{Symbol: "SOLUSDT", Type: "orderbook.25.SOLUSDT"}, true},
+	}
+	for _, c := range cases {
+		if got := f.match(&c.ev); got != c.want {
+			t.Errorf("match(%s) = %v, want %v", c.ev.Type, got, c.want)
+		}
+	}
+}
+
+func TestFilterChanged(t *testing.T) {
+	f, err := parseFilter("type == tickers && changed(markPrice)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tick := func(sym, mark string) *OutEvent {
+		return &OutEvent{Symbol: sym, Type: "tickers." + sym, Payload: map[string]any{"markPrice": mark}}
+	}
+	steps := []struct {
+		ev   *OutEvent
+		want bool
+	}{
+		{tick("BTCUSDT", "42000"), true},
+		{tick("BTCUSDT", "42000"), false},
+		{tick("ETHUSDT", "2500"), true},
+		{tick("BTCUSDT", "42001"), true},
+		{&OutEvent{Symbol: "BTCUSDT", Type: "tickers.BTCUSDT", Payload: map[string]any{"lastPrice": "1"}}, false},
+	}
+	for i, s := range steps {
+		if got := f.match(s.ev); got != s.want {
+			t.Errorf("step %d: match = %v, want %v", i, got, s.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"price == 1",
+		"symbol in BTCUSDT",
+		"symbol",
+		"type == tickers && ",
+		"changed()",
+	} {
+		if _, err := parseFilter(expr); err == nil {
+			t.Errorf("parseFilter(%q) succeeded", expr)
+		}
+	}
+	if f, err := parseFilter("  "); f != nil || err != nil {
+		t.Fatalf("empty filter = %v, %v", f, err)
+	}
+}
+
+func TestFilterMatchDoesNotAllocate(t *testing.T) {
+	f, err := parseFilter("type == tickers && symbol not in [XRPUSDT] && changed(markPrice)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := &OutEvent{Symbol: "BTCUSDT", Type: "tickers.BTCUSDT", Payload: map[string]any{"markPrice": "42000"}}
+	f.match(ev)
+	if n := testing.AllocsPerRun(100, func() { f.match(ev) }); n != 0 {
+		t.Fatalf("match allocates %v times per event", n)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// typeFlow is the OutEvent.Type of trade flow events.
+const typeFlow = "flow"
+
+// Flow is the payload of a flow event: the taker buy and sell volume of a
+// symbol's public trades in one FLOW_INTERVAL, Start to End inclusive, in
+// exchange time.
+type Flow struct {
+	Start      int64   `json:"start"`
+	End        int64   `json:"end"`
+	BuyVolume  float64 `json:"buyVolume"`
+	SellVolume float64 `json:"sellVolume"`
+	Trades     int     `json:"trades"`
+}
+
+// tradeFlow sums each symbol's publicTrade volume by taker side per
+// interval. An interval is complete once a trade stamped after it arrives,
+// so intervals without trades produce no event.
+type tradeFlow struct {
+	interval int64
+
+	mu      sync.Mutex
+	current *symbolLRU[*Flow]
+}
+
+func newTradeFlow(interval time.Duration, limit stateLimit) *tradeFlow {
+	return &tradeFlow{interval: interval.Milliseconds(), current: newSymbolLRU[*Flow](limit, nil)}
+}
+
+// observe adds the trades of a publicTrade data array and returns the
+// intervals they completed. A trade stamped before the open interval, which
+// Bybit doesn't send, counts towards it.
+func (f *tradeFlow) observe(symbol string, data any) []Flow {
+	trades, ok := data.([]any)
+	if !ok {
+		return nil
+	}
+	var done []Flow
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, t := range trades {
+		trade, _ := t.(map[string]any)
+		ts := int64(toFloat(trade["T"]))
+		size := toFloat(trade["v"])
+		if ts <= 0 || size <= 0 {
+			continue
+		}
+		start := ts - ts%f.interval
+		cur, ok := f.current.get(symbol)
+		if !ok || start > cur.Start {
+			if ok {
+				done = append(done, *cur)
+			}
+			cur = &Flow{Start: start, End: start + f.interval - 1}
+			f.current.put(symbol, cur)
+		}
+		switch trade["S"] {
+		case "Buy":
+			cur.BuyVolume += size
+		case "Sell":
+			cur.SellVolume += size
+		default:
+			continue
+		}
+		cur.Trades++
+	}
+	return done
+}
+
+// publishFlows publishes completed flow intervals of symbol, and with
+// PER_SYMBOL_METRICS sets ws_gateway_buy_volume and ws_gateway_sell_volume
+// to the latest for subscribed symbols.
+func (g *Gateway) publishFlows(symbol string, flows []Flow) {
+	for _, fl := range flows {
+		if g.cfg.PerSymbol && g.allowed.Load().has(symbol) {
+			g.metrics.buyVolume.WithLabelValues(symbol).Set(fl.BuyVolume)
+			g.metrics.sellVolume.WithLabelValues(symbol).Set(fl.SellVolume)
+		}
+		g.publish(OutEvent{Ts: fl.End, Symbol: symbol, Type: typeFlow, Payload: fl})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTradeFlow(t *testing.T) {
+	trade := func(ts int64, side, size string) any {
+		return map[string]any{"T": float64(ts), "s": "BTCUSDT", "S": side, "v": size, "p": "100"}
+	}
+	f := newTradeFlow(time.Second, stateLimit{})
+	if done := f.observe("BTCUSDT", []any{trade(1000, "Buy", "1"), trade(1500, "Sell", "0.5"), trade(1999, "Buy", "2")}); len(done) != 0 {
+		t.Fatalf("completed %v before the interval ended", done)
+	}
+	done := f.observe("BTCUSDT", []any{trade(3200, "Sell", "1")})
+	if want := (Flow{Start: 1000, End: 1999, BuyVolume: 3, SellVolume: 0.5, Trades: 3}); len(done) != 1 || done[0] != want {
+		t.Fatalf("completed %+v, want %+v", done, want)
+	}
+	if done := f.observe("ETHUSDT", []any{trade(5000, "Buy", "1")}); len(done) != 0 {
+		t.Fatal("symbols share an interval")
+	}
+	done = f.observe("BTCUSDT", []any{trade(4000, "Buy", "1")})
+	if want := (Flow{Start: 3000, End: 3999, SellVolume: 1, Trades: 1}); len(done) != 1 || done[0] != want {
+		t.Fatalf("completed %+v, want %+v", done, want)
+	}
+}
+
+func TestPublishFlows(t *testing.T) {
+	g, sink := newTestGateway(t, "", "BTCUSDT")
+	g.metrics = newGatewayMetrics("flow")
+	g.cfg.PerSymbol = true
+	g.allowed.Store(newSymbolSet([]string{"BTCUSDT"}))
+	g.publishFlows("BTCUSDT", []Flow{{Start: 0, End: 999, BuyVolume: 2, SellVolume: 1, Trades: 2}})
+	g.publishFlows("XRPUSDT", []Flow{{Start: 0, End: 999, BuyVolume: 5}})
+	evs := sink.Events()
+	if len(evs) != 2 || evs[0].Type != typeFlow || evs[0].Ts != 999 {
+		t.Fatalf("events = %+v", evs)
+	}
+	if testutil.ToFloat64(g.metrics.buyVolume.WithLabelValues("BTCUSDT")) != 2 || testutil.ToFloat64(g.metrics.sellVolume.WithLabelValues("BTCUSDT")) != 1 {
+		t.Fatal("volume gauges not set")
+	}
+	if n := testutil.CollectAndCount(buyVolumeGauge, "ws_gateway_buy_volume"); n != 1 {
+		t.Fatalf("buy volume series = %d, want only the subscribed symbol's", n)
+	}
+	if err := g.applySymbols(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(buyVolumeGauge) + testutil.CollectAndCount(sellVolumeGauge); n != 0 {
+		t.Fatalf("volume series = %d after unsubscribing", n)
+	}
+}
+
+func TestFlowIntervalConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"TOPICS": "publicTrade", "FLOW_INTERVAL": "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.FlowInterval != time.Minute || cfg.Validate() != nil {
+		t.Fatalf("FlowInterval = %s, Validate = %v", cfg.FlowInterval, cfg.Validate())
+	}
+	cfg.Topics = []string{"tickers"}
+	if cfg.Validate() == nil {
+		t.Fatal("FLOW_INTERVAL accepted without publicTrade in TOPICS")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"log"
+)
+
+// unmarshalSnippet is how many bytes of each end of an undecodable frame
+// are logged; truncation shows at the tail.
+const unmarshalSnippet = 96
+
+// frameTypeGuess names what an undecodable frame most likely was from the
+// topic near its start: the topic kind of a data frame, "control" for op
+// responses and "unknown" otherwise.
+func frameTypeGuess(message []byte) string {
+	if topic, ok := frameTopic(message); ok {
+		if kind := topicKind(topic); knownKinds[kind] {
+			return kind
+		}
+		return "unknown"
+	}
+	head := message[:min(len(message), 256)]
+	if bytes.Contains(head, []byte(`"op":`)) || bytes.Contains(head, []byte(`"success":`)) {
+		return "control"
+	}
+	return "unknown"
+}
+
+// frameTopic finds the topic in the first 256 bytes of a frame, which may
+// be cut short; ok is false when there's no topic key there.
+func frameTopic(message []byte) (topic string, ok bool) {
+	head := message[:min(len(message), 256)]
+	i := bytes.Index(head, []byte(`"topic":"`))
+	if i < 0 {
+		return "", false
+	}
+	rest := head[i+len(`"topic":"`):]
+	if j := bytes.IndexByte(rest, '"'); j >= 0 {
+		return string(rest[:j]), true
+	}
+	return "", true
+}
+
+func frameSnippet(message []byte) string {
+	if len(message) <= 2*unmarshalSnippet {
+		return string(message)
+	}
+	return string(message[:unmarshalSnippet]) + "..." + string(message[len(message)-unmarshalSnippet:])
+}
+
+// unmarshalError counts and logs a frame that isn't valid JSON.
+func (g *Gateway) unmarshalError(message []byte, err error) {
+	guess := frameTypeGuess(message)
+	g.metrics.errors.Inc()
+	g.metrics.unmarshalErrors.WithLabelValues(guess).Inc()
+	log.Printf("unmarshal_error instance=%s type_guess=%s bytes=%d err=%v snippet=%q", g.cfg.Instance, guess, len(message), err, frameSnippet(message))
+}
+
+// noteLargeFrame records the size of a frame of at least half the read
+// limit by topic, so a frame over it can be blamed on the topic that came
+// closest before.
+func (g *Gateway) noteLargeFrame(r *connReader, message []byte) {
+	if len(message) < int(g.readLimit.Load()/2) {
+		return
+	}
+	topic, _ := frameTopic(message)
+	if topic == "" {
+		return
+	}
+	if r.largeFrames == nil {
+		r.largeFrames = make(map[string]int)
+	}
+	r.largeFrames[topic] = max(r.largeFrames[topic], len(message))
+}
+
+// likelyOverLimit names the topic of the largest frame noteLargeFrame saw,
+// or "" if none came near the limit.
+func likelyOverLimit(large map[string]int) (topic string, size int) {
+	for t, n := range large {
+		if n > size || n == size && t < topic {
+			topic, size = t, n
+		}
+	}
+	return topic, size
+}
+
+// readLimitExceeded counts a frame over the read limit, which fails the
+// connection, and with WS_READ_LIMIT_MAX doubles the limit for the next one.
+// The read fails on the frame's header, before any of it is read, so the
+// topic logged is the likeliest one from earlier near-limit frames.
+func (g *Gateway) readLimitExceeded(r *connReader) {
+	g.metrics.readLimitHits.Inc()
+	likely, size := likelyOverLimit(r.largeFrames)
+	limit := g.readLimit.Load()
+	if g.cfg.ReadLimitMax <= int(limit) {
+		log.Printf("read_limit_exceeded instance=%s limit=%d likely=%s likely_bytes=%d", g.cfg.Instance, limit, likely, size)
+		return
+	}
+	next := min(2*limit, int64(g.cfg.ReadLimitMax))
+	if g.readLimit.CompareAndSwap(limit, next) {
+		log.Printf("read_limit_raised instance=%s limit=%d from=%d likely=%s likely_bytes=%d", g.cfg.Instance, next, limit, likely, size)
+	}
+}
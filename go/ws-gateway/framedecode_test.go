@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFrameTypeGuess(t *testing.T) {
+	for frame, want := range map[string]string{
+		`{"topic":"orderbook.50.BTCUSDT","type":"snapshot","data":{"b":[["1`: "orderbook",
+		`{"topic":"liquidation.BTCUSDT","da`:                                 "unknown",
+		`{"success":true,"ret_msg":"","op":"subscr`:                          "control",
+		`{"data":{"s":"BTCUSDT"`:                                             "unknown",
+	} {
+		if got := frameTypeGuess([]byte(frame)); got != want {
+			t.Errorf("frameTypeGuess(%s) = %q, want %q", frame, got, want)
+		}
+	}
+	long := strings.Repeat("a", 100) + strings.Repeat("b", 100)
+	if got := frameSnippet([]byte(long)); got != strings.Repeat("a", 96)+"..."+strings.Repeat("b", 96) {
+		t.Fatalf("frameSnippet = %q", got)
+	}
+}
+
+func TestUnmarshalErrorCounted(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("unmarshal")
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	go g.readLoop()
+
+	if err := server.WriteMessage(websocket.TextMessage, []byte(`{"topic":"orderbook.50.BTCUSDT","type":"snapshot","data":{"s":"BTC`)); err != nil {
+		t.Fatal(err)
+	}
+	sendJSON(t, server, map[string]any{"topic": "tickers.BTCUSDT", "data": map[string]any{"s": "BTCUSDT"}})
+	if evs := waitEvents(t, sink, 1); len(evs) != 1 || evs[0].Type != "tickers.BTCUSDT" {
+		t.Fatalf("published %+v", evs)
+	}
+	if n := testutil.ToFloat64(g.metrics.unmarshalErrors.WithLabelValues("orderbook")); n != 1 {
+		t.Fatalf("unmarshal errors = %v, want 1", n)
+	}
+}
+
+func TestReadLimitRaised(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("read_limit")
+	g.cfg.ReadLimitMax = 3000
+	g.readLimit.Store(1024)
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	go g.readLoop()
+
+	sendJSON(t, server, map[string]any{"topic": "tickers.BTCUSDT", "data": map[string]any{"s": "BTCUSDT", "pad": strings.Repeat("x", 2000)}})
+	deadline := time.Now().Add(2 * time.Second)
+	for g.readLimit.Load() != 2048 {
+		if time.Now().After(deadline) {
+			t.Fatalf("read limit = %d, want 2048", g.readLimit.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := testutil.ToFloat64(g.metrics.readLimitHits); n != 1 {
+		t.Fatalf("read limit hits = %v, want 1", n)
+	}
+
+	// Capped at WS_READ_LIMIT_MAX.
+	g.readLimitExceeded(&connReader{})
+	g.readLimitExceeded(&connReader{})
+	if limit := g.readLimit.Load(); limit != 3000 {
+		t.Fatalf("read limit = %d, want 3000", limit)
+	}
+}
+
+func TestReadLimitLikelyTopic(t *testing.T) {
+	g, _ := newTestGateway(t, "", "BTCUSDT", "ETHUSDT")
+	g.metrics = newGatewayMetrics("read_limit_topic")
+	g.readLimit.Store(1000)
+	r := &connReader{}
+	frame := func(topic string, n int) []byte {
+		b := []byte(`{"topic":"` + topic + `","data":"`)
+		return append(b, strings.Repeat("x", n-len(b))...)
+	}
+	g.noteLargeFrame(r, frame("tickers.ETHUSDT", 200))
+	g.noteLargeFrame(r, frame("orderbook.500.BTCUSDT", 700))
+	g.noteLargeFrame(r, frame("orderbook.500.BTCUSDT", 600))
+	g.noteLargeFrame(r, frame("orderbook.500.ETHUSDT", 650))
+	if want := map[string]int{"orderbook.500.BTCUSDT": 700, "orderbook.500.ETHUSDT": 650}; !reflect.DeepEqual(r.largeFrames, want) {
+		t.Fatalf("large frames = %v, want %v", r.largeFrames, want)
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	g.readLimitExceeded(r)
+	if line := logged.String(); !strings.Contains(line, "likely=orderbook.500.BTCUSDT likely_bytes=700") {
+		t.Fatalf("logged %q", line)
+	}
+}
+
+func TestReadLimitConfig(t *testing.T) {
+	cfg, err := loadConfig(env{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ReadLimit != 8<<20 || cfg.ReadLimitMax != 0 {
+		t.Fatalf("ReadLimit = %d, ReadLimitMax = %d", cfg.ReadLimit, cfg.ReadLimitMax)
+	}
+	cfg.ReadLimitMax = 1 << 20
+	if cfg.Validate() == nil {
+		t.Fatal("WS_READ_LIMIT_MAX below WS_READ_LIMIT accepted")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// hotMetrics holds the per-frame metric handles resolved up front for the
+// label values the read loop will see: the kinds in TOPICS, the payload
+// streams and, with PER_SYMBOL_METRICS, the subscribed symbols. Resolving a
+// vector's child hashes the label values and allocates, which adds up at
+// the message rates of busy symbols. Values outside the resolved set fall
+// back to the vectors. The maps are not written after construction.
+type hotMetrics struct {
+	m          *gatewayMetrics
+	wsMessages prometheus.Counter
+	emitted    map[string]prometheus.Counter
+	kinds      map[string]kindMetrics
+	gaps       map[string]prometheus.Observer
+	// exchange is exchange latency by conn index, then kind.
+	exchange []map[string]prometheus.Observer
+}
+
+type kindMetrics struct {
+	engineLatency  prometheus.Observer
+	processLatency prometheus.Observer
+}
+
+func newHotMetrics(m *gatewayMetrics, cfg Config, symbols []string) *hotMetrics {
+	h := &hotMetrics{
+		m:          m,
+		wsMessages: m.messages.WithLabelValues("ws"),
+		emitted:    make(map[string]prometheus.Counter, 2),
+		kinds:      make(map[string]kindMetrics),
+	}
+	for _, stream := range []string{payloadRaw, payloadNormalized} {
+		h.emitted[stream] = m.emitted.WithLabelValues(stream)
+	}
+	prefixes := cfg.Topics
+	if len(prefixes) == 0 {
+		prefixes = defaultTopics
+	}
+	h.exchange = make([]map[string]prometheus.Observer, 1+len(cfg.Redundant))
+	for i := range h.exchange {
+		h.exchange[i] = make(map[string]prometheus.Observer, len(prefixes))
+	}
+	for _, p := range prefixes {
+		kind := topicKind(p)
+		h.kinds[kind] = h.resolveKind(kind)
+		for i, byKind := range h.exchange {
+			byKind[kind] = m.exchangeLatency.WithLabelValues(connLabel(i), kind)
+		}
+	}
+	if cfg.PerSymbol {
+		h.gaps = make(map[string]prometheus.Observer, len(symbols))
+		for _, s := range symbols {
+			h.gaps[s] = m.interMsgGap.WithLabelValues(s)
+		}
+	}
+	return h
+}
+
+func (h *hotMetrics) resolveKind(kind string) kindMetrics {
+	return kindMetrics{
+		engineLatency:  h.m.engineLatency.WithLabelValues(kind),
+		processLatency: h.m.processLatency.WithLabelValues(kind),
+	}
+}
+
+func (h *hotMetrics) kind(kind string) kindMetrics {
+	if k, ok := h.kinds[kind]; ok {
+		return k
+	}
+	return h.resolveKind(kind)
+}
+
+func (h *hotMetrics) exchangeLatency(index int, kind string) prometheus.Observer {
+	if index < len(h.exchange) {
+		if o, ok := h.exchange[index][kind]; ok {
+			return o
+		}
+	}
+	return h.m.exchangeLatency.WithLabelValues(connLabel(index), kind)
+}
+
+func (h *hotMetrics) gap(symbol string) prometheus.Observer {
+	if o, ok := h.gaps[symbol]; ok {
+		return o
+	}
+	return h.m.interMsgGap.WithLabelValues(symbol)
+}
+
+func (h *hotMetrics) emittedFor(stream string) prometheus.Counter {
+	if c, ok := h.emitted[stream]; ok {
+		return c
+	}
+	return h.m.emitted.WithLabelValues(stream)
+}
+
+// resolveMetrics re-resolves the hot-path handles for the current symbols,
+// on subscribe and when the symbol set changes.
+func (g *Gateway) resolveMetrics() *hotMetrics {
+	g.mu.Lock()
+	symbols := g.symbols
+	g.mu.Unlock()
+	h := newHotMetrics(g.metrics, g.cfg, symbols)
+	g.hot.Store(h)
+	return h
+}
+
+// hotMetrics returns the resolved handles, resolving them if nothing has
+// yet or the metrics were swapped since.
+func (g *Gateway) hotMetrics() *hotMetrics {
+	if h := g.hot.Load(); h != nil && h.m == g.metrics {
+		return h
+	}
+	return g.resolveMetrics()
+}
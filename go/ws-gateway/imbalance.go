@@ -0,0 +1,62 @@
+package main
+
+// typeImbalance is the OutEvent.Type of book imbalance events.
+const typeImbalance = "imbalance"
+
+// Imbalance is the payload of an imbalance event: the top-Depth-level order
+// book imbalance, (BidVolume-AskVolume)/(BidVolume+AskVolume), in [-1, 1].
+type Imbalance struct {
+	Depth     int     `json:"depth"`
+	Imbalance float64 `json:"imbalance"`
+	BidVolume float64 `json:"bidVolume"`
+	AskVolume float64 `json:"askVolume"`
+}
+
+// bookImbalance computes the imbalance over the best depth levels of each
+// side. ok is false for an empty book.
+func bookImbalance(b NormalizedBook, depth int) (Imbalance, bool) {
+	im := Imbalance{Depth: depth, BidVolume: topVolume(b.Bids, depth), AskVolume: topVolume(b.Asks, depth)}
+	total := im.BidVolume + im.AskVolume
+	if total <= 0 {
+		return im, false
+	}
+	im.Imbalance = (im.BidVolume - im.AskVolume) / total
+	return im, true
+}
+
+func topVolume(levels []Level, depth int) float64 {
+	if len(levels) > depth {
+		levels = levels[:depth]
+	}
+	var v float64
+	for _, l := range levels {
+		v += l.Size
+	}
+	return v
+}
+
+// publishBook publishes a maintained book, trimmed to PUBLISH_DEPTH, and
+// with IMBALANCE_DEPTH its imbalance, over the untrimmed book, as a separate
+// event right after it. The ws_gateway_book_imbalance gauge is kept only
+// with PER_SYMBOL_METRICS and for subscribed symbols, so its series stay
+// bounded.
+func (g *Gateway) publishBook(ev OutEvent) {
+	book, ok := ev.Payload.(NormalizedBook)
+	if ok && g.cfg.PublishDepth > 0 {
+		trimmed, saved := trimBook(book, g.cfg.PublishDepth)
+		ev.Payload = trimmed
+		g.metrics.depthBytesSaved.Add(float64(saved))
+	}
+	g.publish(ev)
+	if !ok || g.cfg.ImbalanceDepth <= 0 {
+		return
+	}
+	im, ok := bookImbalance(book, g.cfg.ImbalanceDepth)
+	if !ok {
+		return
+	}
+	if g.cfg.PerSymbol && g.allowed.Load().has(ev.Symbol) {
+		g.metrics.imbalance.WithLabelValues(ev.Symbol).Set(im.Imbalance)
+	}
+	g.publish(OutEvent{Ts: ev.Ts, Symbol: ev.Symbol, Type: typeImbalance, Payload: im})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Set at build time via -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+var processStart = time.Now()
+
+type infoResponse struct {
+	Version       string         `json:"version"`
+	Commit        string         `json:"commit"`
+	StartTime     string         `json:"startTime"`
+	UptimeSeconds int64          `json:"uptimeSeconds"`
+	Instances     []instanceInfo `json:"instances"`
+}
+
+type instanceInfo struct {
+	Instance string      `json:"instance"`
+	Exchange string      `json:"exchange"`
+	Sinks    []string    `json:"sinks"`
+	Plan     *planStatus `json:"subscriptionPlan,omitempty"`
+	Config   Config      `json:"config"`
+}
+
+func (g *Gateway) instanceInfo() instanceInfo {
+	cfg := g.cfg.Redacted()
+	g.mu.Lock()
+	cfg.Symbols = append([]string(nil), g.symbols...)
+	g.mu.Unlock()
+	return instanceInfo{
+		Instance: cfg.Instance,
+		Exchange: cfg.Exchange,
+		Sinks:    cfg.SinkNames(),
+		Plan:     g.plan.Load(),
+		Config:   cfg,
+	}
+}
+
+func (s gatewaySet) info(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	resp := infoResponse{
+		Version:       version,
+		Commit:        commit,
+		StartTime:     processStart.UTC().Format(time.RFC3339),
+		UptimeSeconds: int64(time.Since(processStart).Seconds()),
+		Instances:     make([]instanceInfo, 0, len(s)),
+	}
+	for _, g := range s {
+		resp.Instances = append(resp.Instances, g.instanceInfo())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
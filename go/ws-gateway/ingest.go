@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+type ingestResponse struct {
+	Accepted  int    `json:"accepted"`
+	Malformed int    `json:"malformed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ingestTarget picks the instance a POST /ingest feeds: ?instance=, or the
+// only instance with INGEST enabled.
+func (s gatewaySet) ingestTarget(name string) (*Gateway, error) {
+	var target *Gateway
+	for _, g := range s {
+		if !g.cfg.Ingest || (name != "" && g.cfg.Instance != name) {
+			continue
+		}
+		if target != nil {
+			return nil, errors.New("several instances accept ingest; pick one with ?instance=")
+		}
+		target = g
+	}
+	if target == nil {
+		return nil, errors.New("no instance accepts ingest")
+	}
+	return target, nil
+}
+
+// ingest reads NDJSON OutEvents, as written by another gateway's sink, and
+// publishes each through the instance's filter, tee and sinks like an event
+// read from the WS. Lines that aren't an event with a symbol and type are
+// counted and skipped.
+func (s gatewaySet) ingest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	g, err := s.ingestTarget(r.URL.Query().Get("instance"))
+	if err != nil {
+		writeIngest(w, http.StatusNotFound, ingestResponse{Error: err.Error()})
+		return
+	}
+	if g.draining() {
+		writeIngest(w, http.StatusServiceUnavailable, ingestResponse{Error: "instance is draining"})
+		return
+	}
+	var resp ingestResponse
+	sc := bufio.NewScanner(r.Body)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var ev OutEvent
+		if err := json.Unmarshal(line, &ev); err != nil || ev.Symbol == "" || ev.Type == "" {
+			resp.Malformed++
+			g.metrics.ingestMalformed.Inc()
+			continue
+		}
+		g.metrics.messages.WithLabelValues("ingest").Inc()
+		g.publish(ev)
+		resp.Accepted++
+	}
+	if resp.Malformed > 0 {
+		log.Printf("instance=%s ingest_malformed lines=%d", g.cfg.Instance, resp.Malformed)
+	}
+	status := http.StatusOK
+	if err := sc.Err(); err != nil {
+		// Lines before the failure were published.
+		resp.Error = err.Error()
+		status = http.StatusBadRequest
+	}
+	writeIngest(w, status, resp)
+}
+
+func writeIngest(w http.ResponseWriter, status int, resp ingestResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestIngest(t *testing.T) {
+	g, sink := newTestGateway(t, "ws://unused", "BTCUSDT")
+	g.cfg.Ingest = true
+	g.metrics = newGatewayMetrics("ingest_test")
+	f, err := parseFilter("symbol != SOLUSDT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.processors = processorChain{&filterProcessor{filter: f, filtered: g.metrics.filtered}}
+	other, _ := newTestGateway(t, "ws://unused", "ETHUSDT")
+	other.cfg.Instance = "other"
+	set := gatewaySet{other, g}
+
+	body := strings.Join([]string{
+		`{"ts":1,"symbol":"BTCUSDT","type":"tickers.BTCUSDT","action":"snapshot","payload":{"lastPrice":"1"}}`,
+		``,
+		`{"ts":2,"symbol":"SOLUSDT","type":"tickers.SOLUSDT","payload":{}}`,
+		`not json`,
+		`{"ts":3,"payload":{}}`,
+		`{"ts":4,"symbol":"BTCUSDT","type":"publicTrade.BTCUSDT","payload":[]}`,
+	}, "\n")
+	rec := httptest.NewRecorder()
+	set.ingest(rec, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body)))
+	var resp ingestResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || resp.Accepted != 3 || resp.Malformed != 2 {
+		t.Fatalf("status %d, response %+v", rec.Code, resp)
+	}
+	evs := sink.Events()
+	if len(evs) != 2 || evs[0].Ts != 1 || evs[0].Action != actionSnapshot || evs[1].Ts != 4 {
+		t.Fatalf("published %+v, want the two BTCUSDT events after FILTER", evs)
+	}
+	if n := testutil.ToFloat64(g.metrics.ingestMalformed); n != 2 {
+		t.Fatalf("malformed = %v, want 2", n)
+	}
+
+	rec = httptest.NewRecorder()
+	set.ingest(rec, httptest.NewRequest(http.MethodPost, "/ingest?instance=other", strings.NewReader(body)))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("instance without INGEST: status %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	set.ingest(rec, httptest.NewRequest(http.MethodGet, "/ingest", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET: status %d", rec.Code)
+	}
+}
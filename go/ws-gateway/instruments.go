@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	symbolValidationOff     = "off"
+	symbolValidationStrict  = "strict"
+	symbolValidationLenient = "lenient"
+)
+
+func parseSymbolValidation(v string) (string, error) {
+	switch v {
+	case symbolValidationOff, symbolValidationStrict, symbolValidationLenient:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown mode %q (want off|strict|lenient)", v)
+}
+
+const (
+	instrumentsTimeout = 10 * time.Second
+	// instrumentsTTL is how long a fetched list is reused, so instances
+	// starting together and symbol changes soon after share one fetch.
+	instrumentsTTL = time.Minute
+	// instrumentsMaxPages bounds following nextPageCursor.
+	instrumentsMaxPages = 20
+)
+
+// instrumentCache holds INSTRUMENTS_URL lists process-wide, as symbol to
+// status. Failed fetches aren't cached.
+var instrumentCache = struct {
+	sync.Mutex
+	byURL map[string]instrumentList
+}{byURL: make(map[string]instrumentList)}
+
+type instrumentList struct {
+	fetched time.Time
+	status  map[string]string
+}
+
+func loadInstruments(ctx context.Context, endpoint string) (map[string]string, error) {
+	instrumentCache.Lock()
+	defer instrumentCache.Unlock()
+	if l, ok := instrumentCache.byURL[endpoint]; ok && time.Since(l.fetched) < instrumentsTTL {
+		return l.status, nil
+	}
+	status, err := fetchInstruments(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	instrumentCache.byURL[endpoint] = instrumentList{fetched: time.Now(), status: status}
+	return status, nil
+}
+
+// fetchInstruments reads every page of a Bybit v5 /market/instruments-info
+// response as symbol to status.
+func fetchInstruments(ctx context.Context, endpoint string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, instrumentsTimeout)
+	defer cancel()
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	status := make(map[string]string)
+	for page := 0; page < instrumentsMaxPages; page++ {
+		var out struct {
+			RetCode int    `json:"retCode"`
+			RetMsg  string `json:"retMsg"`
+			Result  struct {
+				List []struct {
+					Symbol string `json:"symbol"`
+					Status string `json:"status"`
+				} `json:"list"`
+				NextPageCursor string `json:"nextPageCursor"`
+			} `json:"result"`
+		}
+		if err := getJSON(ctx, u.String(), &out); err != nil {
+			return nil, err
+		}
+		if out.RetCode != 0 {
+			return nil, fmt.Errorf("retCode=%d retMsg=%s", out.RetCode, out.RetMsg)
+		}
+		for _, item := range out.Result.List {
+			status[item.Symbol] = item.Status
+		}
+		if out.Result.NextPageCursor == "" {
+			return status, nil
+		}
+		q := u.Query()
+		q.Set("cursor", out.Result.NextPageCursor)
+		u.RawQuery = q.Encode()
+	}
+	return nil, fmt.Errorf("more than %d pages", instrumentsMaxPages)
+}
+
+func getJSON(ctx context.Context, endpoint string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	return nil
+}
+
+// checkSymbols validates symbols against INSTRUMENTS_URL, since Bybit
+// acks subscribes to symbols it doesn't list and then sends nothing for
+// them. Symbols that aren't listed with status Trading fail the check
+// with SYMBOL_VALIDATION=strict and are dropped with lenient, which also
+// keeps every symbol when the list can't be fetched.
+func checkSymbols(ctx context.Context, cfg Config, symbols []string, m *gatewayMetrics) ([]string, error) {
+	status, err := loadInstruments(ctx, cfg.InstrumentsURL)
+	if err != nil {
+		err = fmt.Errorf("instruments list: %v", urlError(err))
+		if cfg.SymbolValidation == symbolValidationStrict {
+			return nil, err
+		}
+		m.errors.Inc()
+		log.Printf("instance=%s symbol_validation_error err=%v", cfg.Instance, err)
+		return symbols, nil
+	}
+	var valid []string
+	var invalid []string
+	for _, s := range symbols {
+		switch st, ok := status[s]; {
+		case !ok:
+			invalid = append(invalid, s+"(unlisted)")
+		case st != "Trading":
+			invalid = append(invalid, s+"("+st+")")
+		default:
+			valid = append(valid, s)
+		}
+	}
+	m.invalidSymbols.Set(float64(len(invalid)))
+	if len(invalid) == 0 {
+		return symbols, nil
+	}
+	if cfg.SymbolValidation == symbolValidationStrict {
+		return nil, fmt.Errorf("symbols not trading: %s", strings.Join(invalid, ","))
+	}
+	if len(valid) == 0 {
+		// Dropping them all would unsubscribe the whole feed.
+		return nil, fmt.Errorf("no symbols trading: %s", strings.Join(invalid, ","))
+	}
+	log.Printf("instance=%s invalid_symbols dropped=%s", cfg.Instance, strings.Join(invalid, ","))
+	return valid, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newFakeInstruments serves BTCUSDT and ETHUSDT trading and FOOUSDT closed
+// over two pages, or 404 on /missing, counting requests.
+func newFakeInstruments(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("cursor") == "" {
+			fmt.Fprint(w, `{"retCode":0,"result":{"list":[{"symbol":"BTCUSDT","status":"Trading"},{"symbol":"FOOUSDT","status":"Closed"}],"nextPageCursor":"p2"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"retCode":0,"result":{"list":[{"symbol":"ETHUSDT","status":"Trading"}],"nextPageCursor":""}}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestCheckSymbols(t *testing.T) {
+	srv, hits := newFakeInstruments(t)
+	m := newGatewayMetrics("instruments")
+	cfg := Config{Instance: "test", InstrumentsURL: srv.URL + "/v5/market/instruments-info?category=linear", SymbolValidation: symbolValidationLenient}
+	got, err := checkSymbols(context.Background(), cfg, []string{"BTCUSDT", "FOOUSDT", "XYZUSDT", "ETHUSDT"}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"BTCUSDT", "ETHUSDT"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("lenient kept %v, want %v", got, want)
+	}
+	if n := testutil.ToFloat64(m.invalidSymbols); n != 2 {
+		t.Fatalf("invalid symbols = %v, want 2", n)
+	}
+
+	cfg.SymbolValidation = symbolValidationStrict
+	if _, err := checkSymbols(context.Background(), cfg, []string{"BTCUSDT", "XYZUSDT"}, m); err == nil {
+		t.Fatal("strict accepted an unlisted symbol")
+	}
+	if got, err := checkSymbols(context.Background(), cfg, []string{"ETHUSDT"}, m); err != nil || len(got) != 1 {
+		t.Fatalf("strict = %v, %v", got, err)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("fetched %d pages, want the two of one cached list", n)
+	}
+
+	// Lenient rides out a failed fetch; strict doesn't.
+	cfg.InstrumentsURL = srv.URL + "/missing?category=linear"
+	if _, err := checkSymbols(context.Background(), cfg, []string{"BTCUSDT"}, m); err == nil {
+		t.Fatal("strict accepted symbols without an instruments list")
+	}
+	cfg.SymbolValidation = symbolValidationLenient
+	if got, err := checkSymbols(context.Background(), cfg, []string{"BTCUSDT", "XYZUSDT"}, m); err != nil || len(got) != 2 {
+		t.Fatalf("lenient without a list = %v, %v", got, err)
+	}
+}
+
+func TestApplySymbolsValidated(t *testing.T) {
+	srv, _ := newFakeInstruments(t)
+	g, _ := newTestGateway(t, "", "BTCUSDT")
+	g.metrics = newGatewayMetrics("instruments_apply")
+	g.cfg.InstrumentsURL = srv.URL + "/apply"
+	g.cfg.SymbolValidation = symbolValidationStrict
+	if err := g.applySymbols([]string{"BTCUSDT", "XYZUSDT"}); err == nil {
+		t.Fatal("strict applied an unlisted symbol")
+	}
+	if !reflect.DeepEqual(g.symbols, []string{"BTCUSDT"}) {
+		t.Fatalf("symbols = %v after a rejected change", g.symbols)
+	}
+	g.cfg.SymbolValidation = symbolValidationLenient
+	if err := g.applySymbols([]string{"BTCUSDT", "XYZUSDT", "ETHUSDT"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g.symbols, []string{"BTCUSDT", "ETHUSDT"}) {
+		t.Fatalf("symbols = %v", g.symbols)
+	}
+	if err := g.applySymbols([]string{"XYZUSDT"}); err == nil {
+		t.Fatal("lenient applied a set with no trading symbol")
+	}
+	if !reflect.DeepEqual(g.symbols, []string{"BTCUSDT", "ETHUSDT"}) {
+		t.Fatalf("symbols = %v after an empty lenient set", g.symbols)
+	}
+}
+
+func TestSymbolValidationConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"SYMBOL_VALIDATION": "Strict", "INSTRUMENTS_URL": "https://api.bybit.com/v5/market/instruments-info?category=linear&limit=1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SymbolValidation != symbolValidationStrict || cfg.Validate() != nil {
+		t.Fatalf("SymbolValidation = %q, Validate = %v", cfg.SymbolValidation, cfg.Validate())
+	}
+	for _, bad := range []env{
+		{"SYMBOL_VALIDATION": "lenient"},
+		{"INSTRUMENTS_URL": "https://api.bybit.com/v5/market/instruments-info"},
+		{"SYMBOL_VALIDATION": "warn", "INSTRUMENTS_URL": "https://api.bybit.com/v5/market/instruments-info"},
+		{"SYMBOL_VALIDATION": "strict", "INSTRUMENTS_URL": "api.bybit.com"},
+	} {
+		if cfg, err := loadConfig(bad); err == nil && cfg.Validate() == nil {
+			t.Fatalf("accepted %v", bad)
+		}
+	}
+}
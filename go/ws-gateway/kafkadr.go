@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaDRWriteTimeout bounds each write to the DR cluster.
+const kafkaDRWriteTimeout = 30 * time.Second
+
+// kafkaDRSink publishes to the primary Kafka sink as usual and copies every
+// event it accepted to a second, disaster recovery, cluster. As with
+// SHADOW_SINK the copies go through their own buffer and goroutine, so the
+// DR cluster being slow or down never delays or fails the primary; unlike
+// it, copies are written in batches of what is buffered, with their own
+// KAFKA_DR_BATCH_SIZE and KAFKA_DR_BATCH_TIMEOUT.
+type kafkaDRSink struct {
+	Sink
+	dr      kafkaDRWriter
+	batch   int
+	records int
+	m       *gatewayMetrics
+	ch      chan shadowEvent
+	done    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// kafkaDRWriter writes the copies; a kafkaSink for the DR cluster.
+type kafkaDRWriter interface {
+	sinkSelfTester
+	publishMany(ctx context.Context, evs []OutEvent, records int) error
+	Close() error
+}
+
+// drConfig is cfg with the Kafka settings of the DR cluster. It writes
+// synchronously: the copies are already off the publish path.
+func (c Config) drConfig() Config {
+	c.KafkaBrokers = c.KafkaDRBrokers
+	c.KafkaTopic = c.KafkaDRTopic
+	c.KafkaBatchSize = c.KafkaDRBatch
+	c.KafkaBatchTimeout = c.KafkaDRTimeout
+	c.KafkaAsync = false
+	return c
+}
+
+func newKafkaDRSink(cfg Config, primary Sink, m *gatewayMetrics) *kafkaDRSink {
+	dr := newBackendSink(cfg.drConfig(), m, sinkKafka).(*kafkaSink)
+	// The primary's batch fill ratio is not the DR cluster's.
+	dr.w.Completion = nil
+	log.Printf("kafka_dr brokers=%s topic=%s batch_size=%d batch_timeout=%s buffer=%d",
+		cfg.KafkaDRBrokers, cfg.KafkaDRTopic, cfg.KafkaDRBatch, cfg.KafkaDRTimeout, cfg.KafkaDRBuffer)
+	return startKafkaDRSink(primary, dr, cfg, m)
+}
+
+func startKafkaDRSink(primary Sink, dr kafkaDRWriter, cfg Config, m *gatewayMetrics) *kafkaDRSink {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &kafkaDRSink{
+		Sink:    primary,
+		dr:      dr,
+		batch:   cfg.KafkaDRBatch,
+		records: cfg.RecordBatch,
+		m:       m,
+		ch:      make(chan shadowEvent, cfg.KafkaDRBuffer),
+		done:    make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	go s.run()
+	return s
+}
+
+// Ping checks only the primary cluster; the DR cluster must not hold up
+// startup.
+func (s *kafkaDRSink) Ping(ctx context.Context) error {
+	if p, ok := s.Sink.(sinkPinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// selfTest tests the DR cluster too, as shadowSink does its shadow.
+func (s *kafkaDRSink) selfTest(ctx context.Context, ev OutEvent) error {
+	if err := selfTestSink(ctx, s.Sink, ev); err != nil {
+		return err
+	}
+	if err := s.dr.selfTest(ctx, ev); err != nil {
+		return fmt.Errorf("kafka dr: %w", err)
+	}
+	return nil
+}
+
+// Publish copies only events the primary accepted: a failed one is retried
+// through Publish, and copying it each time would duplicate it on the DR
+// cluster.
+func (s *kafkaDRSink) Publish(ctx context.Context, ev OutEvent) error {
+	if err := s.Sink.Publish(ctx, ev); err != nil {
+		return err
+	}
+	select {
+	case s.ch <- shadowEvent{ev: ev, primaryAt: time.Now()}:
+	default:
+		s.m.kafkaDRErrors.Inc()
+	}
+	return nil
+}
+
+func (s *kafkaDRSink) run() {
+	defer close(s.done)
+	for se := range s.ch {
+		batch := []shadowEvent{se}
+	fill:
+		for len(batch) < s.batch {
+			select {
+			case se, ok := <-s.ch:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, se)
+			default:
+				break fill
+			}
+		}
+		s.m.kafkaDRPending.Set(float64(len(s.ch)))
+		s.write(batch)
+	}
+}
+
+func (s *kafkaDRSink) write(batch []shadowEvent) {
+	ctx, cancel := context.WithTimeout(s.ctx, kafkaDRWriteTimeout)
+	defer cancel()
+	evs := make([]OutEvent, len(batch))
+	for i, se := range batch {
+		evs[i] = se.ev
+	}
+	if err := s.dr.publishMany(ctx, evs, s.records); err != nil {
+		s.m.kafkaDRErrors.Add(float64(len(batch)))
+		s.m.kafkaDRUp.Set(0)
+		log.Printf("kafka_dr_error events=%d err=%v", len(batch), err)
+		return
+	}
+	s.m.kafkaDRUp.Set(1)
+	for _, se := range batch {
+		s.m.kafkaDRLag.Observe(time.Since(se.primaryAt).Seconds())
+	}
+}
+
+// publishMany writes evs in one call, so the writer batches them, packing
+// them records at a time like recordBatchSink when records is over one.
+func (s *kafkaSink) publishMany(ctx context.Context, evs []OutEvent, records int) error {
+	var msgs []kafka.Message
+	if records < 2 {
+		for _, ev := range evs {
+			data, err := s.encode(ctx, ev)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, s.message(ev, data))
+		}
+		return s.w.WriteMessages(ctx, msgs...)
+	}
+	for _, chunk := range chunks(evs, (len(evs)+records-1)/records) {
+		encoded := make([][]byte, len(chunk))
+		for i, ev := range chunk {
+			var err error
+			if encoded[i], err = s.encodeRecord(ctx, ev); err != nil {
+				return err
+			}
+		}
+		msgs = append(msgs, s.batchMessage(chunk, encoded))
+	}
+	return s.w.WriteMessages(ctx, msgs...)
+}
+
+// Close closes the primary, then gives the DR cluster shadowDrainTimeout to
+// take what is still buffered before closing it too.
+func (s *kafkaDRSink) Close() error {
+	err := s.Sink.Close()
+	close(s.ch)
+	select {
+	case <-s.done:
+	case <-time.After(shadowDrainTimeout):
+		log.Printf("kafka_dr_drain_timeout pending=%d", len(s.ch))
+		s.cancel()
+		<-s.done
+	}
+	s.cancel()
+	if derr := s.dr.Close(); derr != nil {
+		log.Printf("kafka_dr_close_error err=%v", derr)
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeDRWriter records the writes to it, failing them with err.
+type fakeDRWriter struct {
+	mu     sync.Mutex
+	err    error
+	writes [][]OutEvent
+}
+
+func (w *fakeDRWriter) selfTest(context.Context, OutEvent) error { return w.err }
+func (w *fakeDRWriter) Close() error                             { return nil }
+func (w *fakeDRWriter) publishMany(_ context.Context, evs []OutEvent, _ int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.writes = append(w.writes, evs)
+	return nil
+}
+
+func TestKafkaDRSinkCopies(t *testing.T) {
+	m := newGatewayMetrics("kafka_dr_test")
+	primary, dr := &memSink{}, &fakeDRWriter{}
+	s := startKafkaDRSink(primary, dr, Config{KafkaDRBatch: 100, KafkaDRBuffer: 10}, m)
+	for i := 0; i < 5; i++ {
+		if err := s.Publish(context.Background(), OutEvent{Ts: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var ts []int64
+	for _, w := range dr.writes {
+		for _, ev := range w {
+			ts = append(ts, ev.Ts)
+		}
+	}
+	if len(primary.Events()) != 5 || len(ts) != 5 || ts[0] != 0 || ts[4] != 4 {
+		t.Fatalf("primary got %d events, DR %v", len(primary.Events()), ts)
+	}
+	if histogramCount(t, m.kafkaDRLag) != 5 || testutil.ToFloat64(m.kafkaDRUp) != 1 {
+		t.Fatal("DR writes not observed")
+	}
+}
+
+func TestKafkaDRSinkNeverAffectsPrimary(t *testing.T) {
+	m := newGatewayMetrics("kafka_dr_down_test")
+	primary, dr := &memSink{}, &fakeDRWriter{err: errors.New("dr down")}
+	s := startKafkaDRSink(primary, dr, Config{KafkaDRBatch: 100, KafkaDRBuffer: 10}, m)
+	for i := 0; i < 3; i++ {
+		if err := s.Publish(context.Background(), OutEvent{Ts: int64(i)}); err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(m.kafkaDRErrors); n != 3 || testutil.ToFloat64(m.kafkaDRUp) != 0 {
+		t.Fatalf("DR errors = %v, want 3", n)
+	}
+
+	// An event the primary failed isn't copied: its retry would be.
+	failing := startKafkaDRSink(&blockingSink{}, &fakeDRWriter{}, Config{KafkaDRBatch: 100, KafkaDRBuffer: 10}, newGatewayMetrics("kafka_dr_primary_down_test"))
+	if err := failing.Publish(context.Background(), OutEvent{Ts: 1}); err == nil {
+		t.Fatal("primary failure not returned")
+	}
+	failing.Close()
+	if n := len(failing.dr.(*fakeDRWriter).writes); n != 0 {
+		t.Fatalf("%d writes copied a failed event", n)
+	}
+}
+
+func TestKafkaDRConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"KAFKA_BROKERS": "a:9092", "KAFKA_DR_BROKERS": "dr:9092", "KAFKA_BATCH_SIZE": "50"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	dr := cfg.drConfig()
+	if dr.KafkaBrokers[0] != "dr:9092" || dr.KafkaTopic != "md_ticks" || dr.KafkaBatchSize != 50 || dr.KafkaAsync {
+		t.Fatalf("drConfig = %+v", dr)
+	}
+	cfg, _ = loadConfig(env{"REDIS_URL": "redis://localhost", "KAFKA_DR_BROKERS": "dr:9092"})
+	if cfg.Validate() == nil {
+		t.Fatal("KAFKA_DR_BROKERS without a kafka sink accepted")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/segmentio/kafka-go"
+)
+
+// parsePartitionMap parses KAFKA_PARTITION_MAP, SYMBOL:PARTITION pairs.
+func parsePartitionMap(v string) (map[string]int, error) {
+	items := splitList(v)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]int, len(items))
+	for _, item := range items {
+		sym, p, ok := strings.Cut(item, ":")
+		sym = strings.TrimSpace(sym)
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if !ok || sym == "" || err != nil || n < 0 {
+			return nil, fmt.Errorf("expected SYMBOL:PARTITION, got %q", item)
+		}
+		if _, dup := out[sym]; dup {
+			return nil, fmt.Errorf("%s mapped twice", sym)
+		}
+		out[sym] = n
+	}
+	return out, nil
+}
+
+// symbolBalancer sends messages keyed by a KAFKA_PARTITION_MAP symbol to
+// its partition and hashes the key of the rest.
+type symbolBalancer struct {
+	partitions map[string]int
+	hash       kafka.Hash
+}
+
+func (b *symbolBalancer) Balance(msg kafka.Message, partitions ...int) int {
+	if p, ok := b.partitions[string(msg.Key)]; ok {
+		for _, have := range partitions {
+			if have == p {
+				return p
+			}
+		}
+	}
+	return b.hash.Balance(msg, partitions...)
+}
+
+// checkPartitions fails permanently, so waitSinkReady doesn't retry it,
+// if KAFKA_PARTITION_MAP names a partition the topic doesn't have.
+func checkPartitions(conn *kafka.Conn, topic string, want map[string]int) error {
+	partitions, err := conn.ReadPartitions(topic)
+	if err != nil {
+		return err
+	}
+	have := make(map[int]bool, len(partitions))
+	for _, p := range partitions {
+		have[p.ID] = true
+	}
+	var missing []string
+	for sym, p := range want {
+		if !have[p] {
+			missing = append(missing, fmt.Sprintf("%s:%d", sym, p))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return backoff.Permanent(fmt.Errorf("invalid KAFKA_PARTITION_MAP: topic %s has %d partitions, no partition for %s",
+		topic, len(partitions), strings.Join(missing, ",")))
+}
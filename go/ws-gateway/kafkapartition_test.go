@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestParsePartitionMap(t *testing.T) {
+	m, err := parsePartitionMap("BTCUSDT:0, ETHUSDT : 3")
+	if err != nil || len(m) != 2 || m["BTCUSDT"] != 0 || m["ETHUSDT"] != 3 {
+		t.Fatalf("parsePartitionMap = %v, %v", m, err)
+	}
+	for _, bad := range []string{"BTCUSDT", "BTCUSDT:x", "BTCUSDT:-1", ":1", "BTCUSDT:0,BTCUSDT:1"} {
+		if _, err := parsePartitionMap(bad); err == nil {
+			t.Fatalf("%q accepted", bad)
+		}
+	}
+	if m, err := parsePartitionMap(""); m != nil || err != nil {
+		t.Fatalf("empty = %v, %v", m, err)
+	}
+}
+
+func TestSymbolBalancer(t *testing.T) {
+	b := &symbolBalancer{partitions: map[string]int{"BTCUSDT": 2, "ETHUSDT": 9}}
+	partitions := []int{0, 1, 2, 3}
+	if p := b.Balance(kafka.Message{Key: []byte("BTCUSDT")}, partitions...); p != 2 {
+		t.Fatalf("BTCUSDT went to %d", p)
+	}
+	sol := kafka.Message{Key: []byte("SOLUSDT")}
+	if p, want := b.Balance(sol, partitions...), (&kafka.Hash{}).Balance(sol, partitions...); p != want {
+		t.Fatalf("SOLUSDT went to %d, want its hash %d", p, want)
+	}
+	eth := kafka.Message{Key: []byte("ETHUSDT")}
+	if p, want := b.Balance(eth, partitions...), (&kafka.Hash{}).Balance(eth, partitions...); p != want {
+		t.Fatalf("ETHUSDT mapped to a missing partition went to %d, want its hash %d", p, want)
+	}
+}
+
+func TestKafkaPartitionConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"SINK": "kafka", "KAFKA_PARTITION_MAP": "BTCUSDT:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newNamedSink(cfg, newGatewayMetrics("partition"), sinkKafka)
+	defer s.Close()
+	ks := s.(*kafkaSink)
+	if _, ok := ks.w.Balancer.(*symbolBalancer); !ok {
+		t.Fatalf("Balancer = %T", ks.w.Balancer)
+	}
+	if m := ks.message(OutEvent{Symbol: "BTCUSDT"}, nil); string(m.Key) != "BTCUSDT" {
+		t.Fatalf("Key = %q", m.Key)
+	}
+	if _, err := loadConfig(env{"KAFKA_PARTITION_MAP": "BTCUSDT"}); err == nil {
+		t.Fatal("KAFKA_PARTITION_MAP=BTCUSDT accepted")
+	}
+}
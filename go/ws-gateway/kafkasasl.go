@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	saslPlain       = "plain"
+	saslScramSHA256 = "scram-sha-256"
+	saslScramSHA512 = "scram-sha-512"
+)
+
+// kafkaSASL builds the KAFKA_SASL_MECHANISM authenticator, nil when unset.
+func kafkaSASL(cfg Config) (sasl.Mechanism, error) {
+	switch cfg.KafkaSASL {
+	case "":
+		return nil, nil
+	case saslPlain:
+		return plain.Mechanism{Username: cfg.KafkaUser, Password: cfg.KafkaPassword}, nil
+	case saslScramSHA256:
+		return scram.Mechanism(scram.SHA256, cfg.KafkaUser, cfg.KafkaPassword)
+	case saslScramSHA512:
+		return scram.Mechanism(scram.SHA512, cfg.KafkaUser, cfg.KafkaPassword)
+	}
+	return nil, fmt.Errorf("unknown mechanism %q (want plain|scram-sha-256|scram-sha-512)", cfg.KafkaSASL)
+}
+
+// kafkaTLS builds the KAFKA_TLS client config, nil when disabled. A
+// KAFKA_TLS_CA_FILE replaces the system roots; KAFKA_TLS_CERT_FILE and
+// KAFKA_TLS_KEY_FILE add a client certificate for mTLS.
+func kafkaTLS(cfg Config) (*tls.Config, error) {
+	if !cfg.KafkaTLS {
+		return nil, nil
+	}
+	t := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.KafkaCAFile != "" {
+		pem, err := os.ReadFile(cfg.KafkaCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("KAFKA_TLS_CA_FILE: %w", err)
+		}
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("KAFKA_TLS_CA_FILE: no PEM certificates in %s", cfg.KafkaCAFile)
+		}
+	}
+	if cfg.KafkaCertFile != "" || cfg.KafkaKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.KafkaCertFile, cfg.KafkaKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("KAFKA_TLS_CERT_FILE/KAFKA_TLS_KEY_FILE: %w", err)
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+// kafkaAuth builds both halves of the Kafka auth settings, reading the TLS
+// files.
+func kafkaAuth(cfg Config) (sasl.Mechanism, *tls.Config, error) {
+	mech, err := kafkaSASL(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("kafka sasl: %w", err)
+	}
+	t, err := kafkaTLS(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("kafka tls: %w", err)
+	}
+	return mech, t, nil
+}
+
+// kafkaTransport carries the writer's SASL and TLS settings, and
+// kafkaDialer the same for single connections such as pings.
+func kafkaTransport(mech sasl.Mechanism, t *tls.Config) *kafka.Transport {
+	return &kafka.Transport{SASL: mech, TLS: t}
+}
+
+func kafkaDialer(mech sasl.Mechanism, t *tls.Config) *kafka.Dialer {
+	return &kafka.Dialer{Timeout: 10 * time.Second, DualStack: true, SASLMechanism: mech, TLS: t}
+}
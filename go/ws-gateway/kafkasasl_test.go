@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKafkaSASLConfig(t *testing.T) {
+	base := env{"KAFKA_BROKERS": "localhost:9092", "KAFKA_SASL_USER": "gw", "KAFKA_SASL_PASSWORD": "s3cret"}
+	for _, mech := range []string{"PLAIN", "SCRAM-SHA-256", "scram-sha-512"} {
+		e := env{"KAFKA_SASL_MECHANISM": mech}
+		for k, v := range base {
+			e[k] = v
+		}
+		cfg, err := loadConfig(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Fatalf("%s: %v", mech, err)
+		}
+		if m, err := kafkaSASL(cfg); err != nil || m == nil {
+			t.Fatalf("%s: mechanism %v, %v", mech, m, err)
+		}
+	}
+
+	for _, e := range []env{
+		{"KAFKA_SASL_MECHANISM": "GSSAPI", "KAFKA_SASL_USER": "gw", "KAFKA_SASL_PASSWORD": "s3cret"},
+		{"KAFKA_SASL_MECHANISM": "PLAIN", "KAFKA_SASL_USER": "gw"},
+		{"KAFKA_TLS_CA_FILE": "/etc/ca.pem"},
+		{"KAFKA_TLS": "true", "KAFKA_TLS_CERT_FILE": "/etc/client.pem"},
+	} {
+		cfg, err := loadConfig(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cfg.Validate()
+		if err == nil {
+			t.Fatalf("%v: expected error", e)
+		}
+		if strings.Contains(err.Error(), "s3cret") {
+			t.Fatalf("error leaks the password: %v", err)
+		}
+	}
+}
+
+func TestKafkaSASLPasswordNeverPrinted(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "password")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(env{"KAFKA_SASL_MECHANISM": "PLAIN", "KAFKA_SASL_USER": "gw", "KAFKA_SASL_PASSWORD_FILE": secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.KafkaPassword != "s3cret" {
+		t.Fatalf("password = %q, want the file contents", cfg.KafkaPassword)
+	}
+	var buf bytes.Buffer
+	if err := printConfig(&buf, []Config{cfg}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "s3cret") {
+		t.Fatalf("printed config leaks the password: %s", buf.String())
+	}
+}
+
+func TestKafkaTLSCA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tc, err := kafkaTLS(Config{KafkaTLS: true, KafkaCAFile: ca})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.RootCAs == nil {
+		t.Fatal("CA file not loaded")
+	}
+
+	if err := os.WriteFile(ca, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kafkaTLS(Config{KafkaTLS: true, KafkaCAFile: ca}); err == nil {
+		t.Fatal("expected error for a CA file without certificates")
+	}
+	if tc, err := kafkaTLS(Config{}); tc != nil || err != nil {
+		t.Fatalf("disabled TLS = %v, %v", tc, err)
+	}
+
+	// Missing files pass Validate and fail once the sink is built.
+	missing, err := loadConfig(env{"KAFKA_TLS": "true", "KAFKA_TLS_CA_FILE": filepath.Join(t.TempDir(), "missing.pem")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := missing.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := kafkaAuth(missing); err == nil || !strings.HasPrefix(err.Error(), "kafka tls: KAFKA_TLS_CA_FILE") {
+		t.Fatalf("kafkaAuth with a missing CA file = %v", err)
+	}
+}
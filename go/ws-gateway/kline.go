@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	klineBackfillTimeout = 10 * time.Second
+	// klineBackfillLimit is the most candles Bybit returns per request.
+	klineBackfillLimit = 1000
+	// klineBackfillQueue is how many gaps may wait for the backfill worker.
+	klineBackfillQueue = 64
+)
+
+// klineBar is the span of a confirmed candle, end being the last millisecond
+// it covers.
+type klineBar struct {
+	start, end int64
+}
+
+// klineGap is a stretch of missing candles, from and to inclusive.
+type klineGap struct {
+	topic, symbol, interval string
+	from, to                int64
+}
+
+// klineTracker drops unconfirmed candles with KLINE_CONFIRMED_ONLY and
+// finds gaps in each topic's confirmed candles: one starting later than the
+// millisecond after the previous one ended. It spans reconnects, so candles
+// missed during an outage count as a gap.
+type klineTracker struct {
+	confirmedOnly bool
+
+	mu   sync.Mutex
+	last *symbolLRU[klineBar]
+}
+
+func newKlineTracker(confirmedOnly bool, limit stateLimit) *klineTracker {
+	return &klineTracker{confirmedOnly: confirmedOnly, last: newSymbolLRU[klineBar](limit, nil)}
+}
+
+// observe records the confirmed candles of a kline data array and returns
+// the data to publish, false when nothing is left of it, and the gaps found.
+func (k *klineTracker) observe(topic, symbol string, data any) (any, bool, []klineGap) {
+	candles, ok := data.([]any)
+	if !ok {
+		return data, true, nil
+	}
+	kept := candles[:0:0]
+	var gaps []klineGap
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, c := range candles {
+		m, _ := c.(map[string]any)
+		if confirmed, _ := m["confirm"].(bool); !confirmed {
+			if !k.confirmedOnly {
+				kept = append(kept, c)
+			}
+			continue
+		}
+		kept = append(kept, c)
+		bar := klineBar{start: int64(toFloat(m["start"])), end: int64(toFloat(m["end"]))}
+		if bar.start <= 0 || bar.end < bar.start {
+			continue
+		}
+		prev, seen := k.last.get(topic)
+		if seen && bar.start <= prev.end {
+			// A repeat, or older than what we have.
+			continue
+		}
+		if seen && bar.start > prev.end+1 {
+			interval, _ := m["interval"].(string)
+			gaps = append(gaps, klineGap{topic: topic, symbol: symbol, interval: interval, from: prev.end + 1, to: bar.start - 1})
+		}
+		k.last.put(topic, bar)
+	}
+	return kept, len(kept) > 0, gaps
+}
+
+// klineBackfiller hands kline gaps to a single worker, one fetch at a
+// time, so a reconnect revealing a gap on every topic doesn't fan out into
+// as many concurrent REST calls. A gap found while the queue is full is
+// dropped.
+type klineBackfiller struct {
+	fill func(klineGap)
+	done chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	gaps   chan klineGap
+}
+
+func newKlineBackfiller(fill func(klineGap)) *klineBackfiller {
+	b := &klineBackfiller{fill: fill, done: make(chan struct{}), gaps: make(chan klineGap, klineBackfillQueue)}
+	go b.run()
+	return b
+}
+
+func (b *klineBackfiller) run() {
+	defer close(b.done)
+	for gap := range b.gaps {
+		b.fill(gap)
+	}
+}
+
+// enqueue queues gap, reporting false if the queue is full or closed.
+func (b *klineBackfiller) enqueue(gap klineGap) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false
+	}
+	select {
+	case b.gaps <- gap:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops taking gaps and waits for the queued ones to be filled.
+func (b *klineBackfiller) close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.gaps)
+	}
+	b.mu.Unlock()
+	<-b.done
+}
+
+// queueBackfill hands gap to the backfill worker.
+func (g *Gateway) queueBackfill(gap klineGap) {
+	if !g.backfills.enqueue(gap) {
+		g.metrics.klineUnfilled.WithLabelValues("queue_full").Inc()
+		log.Printf("instance=%s kline_backfill_dropped topic=%s from=%d to=%d", g.cfg.Instance, gap.topic, gap.from, gap.to)
+	}
+}
+
+// backfillKline fetches the candles of gap from KLINE_BACKFILL_URL and
+// publishes them as confirmed candles marked "backfill", oldest first.
+func (g *Gateway) backfillKline(gap klineGap) {
+	candles, err := fetchKlines(g.ctx, g.cfg.KlineBackfill, gap)
+	if err != nil {
+		g.metrics.errors.Inc()
+		log.Printf("instance=%s kline_backfill_error topic=%s from=%d to=%d err=%v", g.cfg.Instance, gap.topic, gap.from, gap.to, err)
+		return
+	}
+	if len(candles) == klineBackfillLimit {
+		// Bybit returns the newest candles of the range, so the oldest
+		// are what's missing.
+		if start, _ := candles[0]["start"].(int64); start > gap.from {
+			g.metrics.klineUnfilled.WithLabelValues("truncated").Inc()
+			log.Printf("instance=%s kline_backfill_truncated topic=%s from=%d to=%d", g.cfg.Instance, gap.topic, gap.from, start-1)
+		}
+	}
+	for _, c := range candles {
+		g.emit(OutEvent{Ts: int64(toFloat(c["end"])), Symbol: gap.symbol, Type: gap.topic, Action: actionSnapshot, Payload: []any{c}})
+	}
+	g.metrics.klineBackfilled.Add(float64(len(candles)))
+	log.Printf("instance=%s kline_backfill topic=%s from=%d to=%d candles=%d", g.cfg.Instance, gap.topic, gap.from, gap.to, len(candles))
+}
+
+// klineBackfilled reports whether ev is a candle published by backfillKline.
+func klineBackfilled(ev OutEvent) bool {
+	rows, ok := ev.Payload.([]any)
+	if !ok || len(rows) != 1 {
+		return false
+	}
+	c, ok := rows[0].(map[string]any)
+	return ok && c["backfill"] == true
+}
+
+// fetchKlines reads gap's candles from a Bybit v5 /market/kline URL in the
+// shape of WS kline data. Each ends where the next starts, the last at
+// gap.to.
+func fetchKlines(ctx context.Context, endpoint string, gap klineGap) ([]map[string]any, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("symbol", gap.symbol)
+	q.Set("interval", gap.interval)
+	q.Set("start", strconv.FormatInt(gap.from, 10))
+	q.Set("end", strconv.FormatInt(gap.to, 10))
+	q.Set("limit", strconv.Itoa(klineBackfillLimit))
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, klineBackfillTimeout)
+	defer cancel()
+	var out struct {
+		RetCode int    `json:"retCode"`
+		RetMsg  string `json:"retMsg"`
+		Result  struct {
+			// start, open, high, low, close, volume, turnover; newest first.
+			List [][]string `json:"list"`
+		} `json:"result"`
+	}
+	if err := getJSON(ctx, u.String(), &out); err != nil {
+		return nil, err
+	}
+	if out.RetCode != 0 {
+		return nil, fmt.Errorf("retCode=%d retMsg=%s", out.RetCode, out.RetMsg)
+	}
+	type row struct {
+		start  int64
+		fields []string
+	}
+	var rows []row
+	for i, fields := range out.Result.List {
+		if len(fields) < 7 {
+			return nil, fmt.Errorf("candle %d: %d fields, want 7", i, len(fields))
+		}
+		start, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("candle %d: start: %w", i, err)
+		}
+		if start >= gap.from && start <= gap.to {
+			rows = append(rows, row{start, fields})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].start < rows[j].start })
+	candles := make([]map[string]any, 0, len(rows))
+	for i, r := range rows {
+		end := gap.to
+		if i+1 < len(rows) {
+			end = rows[i+1].start - 1
+		}
+		f := r.fields
+		candles = append(candles, map[string]any{
+			"start": r.start, "end": end, "interval": gap.interval,
+			"open": f[1], "high": f[2], "low": f[3], "close": f[4], "volume": f[5], "turnover": f[6],
+			"confirm": true, "timestamp": end, "backfill": true,
+		})
+	}
+	return candles, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKlineTracker(t *testing.T) {
+	candle := func(start int64, confirm bool) any {
+		return map[string]any{"start": float64(start), "end": float64(start + 59999), "interval": "1", "confirm": confirm}
+	}
+	k := newKlineTracker(true, stateLimit{})
+	if _, ok, _ := k.observe("kline.1.BTCUSDT", "BTCUSDT", []any{candle(0, false), candle(60000, false)}); ok {
+		t.Fatal("unconfirmed candles kept with KLINE_CONFIRMED_ONLY")
+	}
+	if data, ok, gaps := k.observe("kline.1.BTCUSDT", "BTCUSDT", []any{candle(60000, true)}); !ok || len(data.([]any)) != 1 || len(gaps) != 0 {
+		t.Fatalf("first confirmed candle = %v, %v, gaps %v", data, ok, gaps)
+	}
+	if _, _, gaps := k.observe("kline.1.BTCUSDT", "BTCUSDT", []any{candle(120000, true)}); len(gaps) != 0 {
+		t.Fatalf("consecutive candles found gaps %v", gaps)
+	}
+	_, _, gaps := k.observe("kline.1.BTCUSDT", "BTCUSDT", []any{candle(300000, true)})
+	if want := (klineGap{topic: "kline.1.BTCUSDT", symbol: "BTCUSDT", interval: "1", from: 180000, to: 299999}); len(gaps) != 1 || gaps[0] != want {
+		t.Fatalf("gaps = %+v, want %+v", gaps, want)
+	}
+	if _, _, gaps := k.observe("kline.1.BTCUSDT", "BTCUSDT", []any{candle(120000, true)}); len(gaps) != 0 {
+		t.Fatal("an older candle found a gap")
+	}
+
+	all := newKlineTracker(false, stateLimit{})
+	if data, ok, _ := all.observe("kline.1.BTCUSDT", "BTCUSDT", []any{candle(0, false)}); !ok || len(data.([]any)) != 1 {
+		t.Fatal("unconfirmed candle dropped without KLINE_CONFIRMED_ONLY")
+	}
+}
+
+func TestFetchKlines(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query(); q.Get("symbol") != "BTCUSDT" || q.Get("interval") != "1" || q.Get("start") != "180000" || q.Get("end") != "299999" {
+			t.Errorf("query = %s", r.URL.RawQuery)
+		}
+		_, _ = w.Write([]byte(`{"retCode":0,"result":{"list":[
+			["240000","2","3","1","2","10","20"],
+			["180000","1","2","1","2","10","20"],
+			["120000","1","1","1","1","1","1"]]}}`))
+	}))
+	defer srv.Close()
+
+	candles, err := fetchKlines(context.Background(), srv.URL+"/v5/market/kline?category=linear", klineGap{symbol: "BTCUSDT", interval: "1", from: 180000, to: 299999})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candles) != 2 {
+		t.Fatalf("got %d candles, want the 2 in the gap", len(candles))
+	}
+	if c := candles[0]; c["start"] != int64(180000) || c["end"] != int64(239999) || c["open"] != "1" || c["backfill"] != true {
+		t.Fatalf("first candle = %v", c)
+	}
+	if c := candles[1]; c["start"] != int64(240000) || c["end"] != int64(299999) {
+		t.Fatalf("last candle = %v", c)
+	}
+}
+
+func TestKlineConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"TOPICS": "kline.1", "KLINE_CONFIRMED_ONLY": "true", "KLINE_BACKFILL_URL": "https://api.bybit.com/v5/market/kline?category=linear"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.KlineConfirmed || cfg.Validate() != nil {
+		t.Fatalf("KlineConfirmed = %v, Validate = %v", cfg.KlineConfirmed, cfg.Validate())
+	}
+	cfg.KlineBackfill = "ftp://example"
+	if cfg.Validate() == nil {
+		t.Fatal("non-http KLINE_BACKFILL_URL accepted")
+	}
+	cfg.KlineBackfill = ""
+	cfg.Topics = []string{"tickers"}
+	if cfg.Validate() == nil {
+		t.Fatal("KLINE_CONFIRMED_ONLY accepted without kline in TOPICS")
+	}
+}
+
+func TestKlineBackfiller(t *testing.T) {
+	release := make(chan struct{})
+	var filled []int64
+	b := newKlineBackfiller(func(gap klineGap) {
+		<-release
+		filled = append(filled, gap.from)
+	})
+	// One gap is being fetched while the queue fills up behind it.
+	if !b.enqueue(klineGap{from: 0}) {
+		t.Fatal("first gap refused")
+	}
+	for len(b.gaps) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i <= klineBackfillQueue; i++ {
+		if !b.enqueue(klineGap{from: int64(i)}) {
+			t.Fatalf("gap %d refused", i)
+		}
+	}
+	if b.enqueue(klineGap{from: -1}) {
+		t.Fatal("gap queued past klineBackfillQueue")
+	}
+	close(release)
+	b.close()
+	if len(filled) != klineBackfillQueue+1 || filled[0] != 0 || filled[len(filled)-1] != klineBackfillQueue {
+		t.Fatalf("filled %d gaps, %v", len(filled), filled)
+	}
+	if b.enqueue(klineGap{}) {
+		t.Fatal("gap queued after close")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	lastPriceDesc = prometheus.NewDesc("ws_gateway_last_price",
+		"Price of the latest public trade (PER_SYMBOL_METRICS)", []string{"instance", "symbol"}, nil)
+	lastPriceAgeDesc = prometheus.NewDesc("ws_gateway_last_price_age_seconds",
+		"Seconds since the latest public trade (PER_SYMBOL_METRICS)", []string{"instance", "symbol"}, nil)
+
+	lastPrices = &lastPriceCollector{caches: make(map[string]*lastPriceCache)}
+)
+
+type lastTrade struct {
+	price float64
+	at    time.Time
+}
+
+// lastPriceCache keeps the latest publicTrade price per subscribed symbol.
+// Symbols outside the subscribed set are ignored and dropped on resubscribe,
+// so the series count stays bounded.
+type lastPriceCache struct {
+	instance string
+	clock    Clock
+
+	mu      sync.Mutex
+	allowed map[string]struct{}
+	trades  map[string]lastTrade
+}
+
+func newLastPriceCache(instance string, clock Clock, symbols []string) *lastPriceCache {
+	c := &lastPriceCache{instance: instance, clock: clock, trades: make(map[string]lastTrade)}
+	c.retain(symbols)
+	lastPrices.add(c)
+	return c
+}
+
+// retain restricts the cache to symbols.
+func (c *lastPriceCache) retain(symbols []string) {
+	allowed := make(map[string]struct{}, len(symbols))
+	for _, s := range symbols {
+		allowed[s] = struct{}{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.allowed = allowed
+	for s := range c.trades {
+		if _, ok := allowed[s]; !ok {
+			delete(c.trades, s)
+		}
+	}
+}
+
+// observeTrades records the last trade of a publicTrade data array.
+func (c *lastPriceCache) observeTrades(symbol string, data any) {
+	trades, ok := data.([]any)
+	if !ok || len(trades) == 0 {
+		return
+	}
+	trade, ok := trades[len(trades)-1].(map[string]any)
+	if !ok {
+		return
+	}
+	price := toFloat(trade["p"])
+	if price == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.allowed[symbol]; ok {
+		c.trades[symbol] = lastTrade{price: price, at: c.clock.Now()}
+	}
+}
+
+func (c *lastPriceCache) collect(ch chan<- prometheus.Metric) {
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for s, t := range c.trades {
+		ch <- prometheus.MustNewConstMetric(lastPriceDesc, prometheus.GaugeValue, t.price, c.instance, s)
+		ch <- prometheus.MustNewConstMetric(lastPriceAgeDesc, prometheus.GaugeValue, now.Sub(t.at).Seconds(), c.instance, s)
+	}
+}
+
+// lastPriceCollector exports every instance's cache. Ages are computed at
+// scrape time, which a plain gauge can't do.
+type lastPriceCollector struct {
+	mu     sync.Mutex
+	caches map[string]*lastPriceCache
+}
+
+func (l *lastPriceCollector) add(c *lastPriceCache) {
+	l.mu.Lock()
+	l.caches[c.instance] = c
+	l.mu.Unlock()
+}
+
+func (l *lastPriceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lastPriceDesc
+	ch <- lastPriceAgeDesc
+}
+
+func (l *lastPriceCollector) Collect(ch chan<- prometheus.Metric) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.caches {
+		c.collect(ch)
+	}
+}
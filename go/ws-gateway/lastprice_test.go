@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func gatherGauges(t *testing.T, c prometheus.Collector) map[string]float64 {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := map[string]float64{}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			key := mf.GetName()
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "symbol" {
+					key += "{" + lp.GetValue() + "}"
+				}
+			}
+			out[key] = m.GetGauge().GetValue()
+		}
+	}
+	return out
+}
+
+func TestLastPriceCache(t *testing.T) {
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	c := newLastPriceCache("lastprice_test", clock, []string{"BTCUSDT", "ETHUSDT"})
+	col := &lastPriceCollector{caches: map[string]*lastPriceCache{c.instance: c}}
+
+	c.observeTrades("BTCUSDT", []any{
+		map[string]any{"s": "BTCUSDT", "p": "42000.5"},
+		map[string]any{"s": "BTCUSDT", "p": "42001"},
+	})
+	c.observeTrades("ETHUSDT", []any{map[string]any{"p": "2500"}})
+	c.observeTrades("DOGEUSDT", []any{map[string]any{"p": "0.1"}})
+	clock.Advance(3 * time.Second)
+
+	got := gatherGauges(t, col)
+	want := map[string]float64{
+		"ws_gateway_last_price{BTCUSDT}":             42001,
+		"ws_gateway_last_price_age_seconds{BTCUSDT}": 3,
+		"ws_gateway_last_price{ETHUSDT}":             2500,
+		"ws_gateway_last_price_age_seconds{ETHUSDT}": 3,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("gauges = %v", got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+
+	c.retain([]string{"ETHUSDT"})
+	if got := gatherGauges(t, col); len(got) != 2 || got["ws_gateway_last_price{ETHUSDT}"] != 2500 {
+		t.Fatalf("after retain gauges = %v", got)
+	}
+}
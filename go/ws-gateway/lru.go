@@ -0,0 +1,87 @@
+package main
+
+import (
+	"container/list"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stateLimit bounds a per-symbol state map at SYMBOL_STATE_CAPACITY
+// entries, counting evictions in evicted if set.
+type stateLimit struct {
+	capacity int
+	evicted  prometheus.Counter
+}
+
+// symbolLRU is a per-symbol map holding at most limit.capacity entries;
+// adding one more evicts the least recently used. A capacity <= 0 never
+// evicts. It is not safe for concurrent use.
+type symbolLRU[V any] struct {
+	limit   stateLimit
+	onEvict func(symbol string, v V)
+	order   *list.List // of *lruEntry[V], most recent first
+	items   map[string]*list.Element
+}
+
+type lruEntry[V any] struct {
+	symbol string
+	val    V
+}
+
+func newSymbolLRU[V any](limit stateLimit, onEvict func(string, V)) *symbolLRU[V] {
+	return &symbolLRU[V]{limit: limit, onEvict: onEvict, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns symbol's entry and marks it most recently used.
+func (c *symbolLRU[V]) get(symbol string) (V, bool) {
+	el, ok := c.items[symbol]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry[V]).val, true
+}
+
+// put sets symbol's entry, evicting the oldest when over capacity.
+func (c *symbolLRU[V]) put(symbol string, v V) {
+	if el, ok := c.items[symbol]; ok {
+		el.Value.(*lruEntry[V]).val = v
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[symbol] = c.order.PushFront(&lruEntry[V]{symbol: symbol, val: v})
+	for c.limit.capacity > 0 && c.order.Len() > c.limit.capacity {
+		oldest := c.order.Back()
+		e := oldest.Value.(*lruEntry[V])
+		c.order.Remove(oldest)
+		delete(c.items, e.symbol)
+		if c.onEvict != nil {
+			c.onEvict(e.symbol, e.val)
+		}
+		if c.limit.evicted != nil {
+			c.limit.evicted.Inc()
+		}
+	}
+}
+
+func (c *symbolLRU[V]) len() int { return c.order.Len() }
+
+// eachOldest calls fn for entries, least recent first, until it returns
+// false.
+func (c *symbolLRU[V]) eachOldest(fn func(symbol string, v V) bool) {
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*lruEntry[V])
+		if !fn(e.symbol, e.val) {
+			return
+		}
+	}
+}
+
+// each calls fn for every entry, most recent first.
+func (c *symbolLRU[V]) each(fn func(symbol string, v V)) {
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*lruEntry[V])
+		fn(e.symbol, e.val)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSymbolLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	evicted := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_evictions"})
+	var gone []string
+	c := newSymbolLRU(stateLimit{capacity: 2, evicted: evicted}, func(s string, _ int) { gone = append(gone, s) })
+	c.put("BTCUSDT", 1)
+	c.put("ETHUSDT", 2)
+	c.get("BTCUSDT")
+	c.put("SOLUSDT", 3)
+	if _, ok := c.get("ETHUSDT"); ok || len(gone) != 1 || gone[0] != "ETHUSDT" {
+		t.Fatalf("evicted %v, want ETHUSDT", gone)
+	}
+	if v, ok := c.get("BTCUSDT"); !ok || v != 1 || c.len() != 2 {
+		t.Fatalf("BTCUSDT = %v, %v; len %d", v, ok, c.len())
+	}
+	if n := testutil.ToFloat64(evicted); n != 1 {
+		t.Fatalf("evictions = %v", n)
+	}
+
+	unbounded := newSymbolLRU[int](stateLimit{}, nil)
+	for _, s := range []string{"A", "B", "C"} {
+		unbounded.put(s, 0)
+	}
+	if unbounded.len() != 3 {
+		t.Fatalf("capacity 0 evicted: len %d", unbounded.len())
+	}
+}
+
+func TestBookKeeperEvictsBeyondCapacity(t *testing.T) {
+	var r bookRecorder
+	k := newBookKeeper(0, stateLimit{capacity: 1}, newSystemClock(0), r.emit)
+	k.handle("BTCUSDT", "orderbook.25.BTCUSDT", "snapshot", bookData(1, [][2]string{{"100", "1"}}, nil))
+	k.handle("ETHUSDT", "orderbook.25.ETHUSDT", "snapshot", bookData(1, [][2]string{{"10", "1"}}, nil))
+	// BTCUSDT was evicted; its delta has no book to apply to until the
+	// next snapshot.
+	k.handle("BTCUSDT", "orderbook.25.BTCUSDT", "delta", bookData(2, [][2]string{{"100", "2"}}, nil))
+	if n := len(r.books()); n != 2 {
+		t.Fatalf("emitted %d books, want 2", n)
+	}
+}
@@ -1,193 +1,685 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	backoff "github.com/cenkalti/backoff/v4"
 	"github.com/gorilla/websocket"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	redis "github.com/redis/go-redis/v9"
-	"github.com/segmentio/kafka-go"
 )
 
-type SinkType int
-
-const (
-	SinkNone SinkType = iota
-	SinkRedis
-	SinkKafka
-)
+// Dialer opens the WS connection; *websocket.Dialer satisfies it and tests
+// substitute their own.
+type Dialer interface {
+	Dial(urlStr string, requestHeader http.Header) (*websocket.Conn, *http.Response, error)
+}
 
 type Gateway struct {
-	wsURL     string
-	symbols   []string
-	sinkType  SinkType
-	redis     *redis.Client
-	redisKey  string
-	kafkaW    *kafka.Writer
-	kafkaTopic string
-
-	conn   *websocket.Conn
-	mu     sync.Mutex
-	ctx    context.Context
-	cancel context.CancelFunc
-}
-
-var (
-	upgradesTotal = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "ws_gateway_reconnects_total",
-		Help: "Total reconnects to Bybit WS",
-	})
-	messagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "ws_gateway_messages_total",
-		Help: "Total messages processed",
-	}, []string{"type"})
-	errorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "ws_gateway_errors_total",
-		Help: "Total errors",
-	})
-	connectedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "ws_gateway_connected",
-		Help: "WS connection state (1 connected)",
-	})
-)
+	cfg          Config
+	metrics      *gatewayMetrics
+	done         chan struct{}
+	wsURL        string
+	symbols      []string
+	topics       []string // set by a subscription plan, see topicsLocked
+	planSource   *planSource
+	plan         atomic.Pointer[planStatus]
+	symbolsFile  string
+	sink         Sink
+	queue        eventQueue
+	processors   processorChain
+	dialer       Dialer
+	payloadMode  string
+	pingInterval time.Duration
+	maintenance  bool
+	warmup       *warmup
+	clock        Clock
+	lastPrices   *lastPriceCache
+	books        *bookKeeper
+	conflate     *conflater
+	sorter       *tsSorter
+	validator    *eventValidator
+	race         *endpointRace
+	handover     atomic.Pointer[endpointRace] // set during a migration's overlap
+	tickerSeed   *tickerSeed
+	tickerMerge  *tickerMerge
+	tickerDedup  *tickerDedup
+	klines       *klineTracker
+	backfills    *klineBackfiller
+	tsGuard      *tsGuard
+	capture      *frameCapture
+	deadman      *deadman
+	flow         *tradeFlow
+	vol          *rollingVol
+	remoteWrite  *remoteWriter
+	hot          atomic.Pointer[hotMetrics]
+	legs         sync.WaitGroup
+	dumps        sync.WaitGroup
+	allowed      atomic.Pointer[symbolSet]
+	tee          *teeHub
+	subs         *subscriptions
+	dlq          deadLetterQueue
+	creds        sinkCredentials
+	rotateMu     sync.Mutex
+	drainState   atomic.Int32
+	closeOnce    sync.Once
+	pubMu        sync.RWMutex
+	pubClosed    bool
+	lastPublish  atomic.Int64
+	replayErr    error
+	selfTestErr  error
+
+	// progress is when the live connection last read a frame and live
+	// whether there is one, for the watchdog.
+	progress atomic.Int64
+	live     atomic.Bool
+
+	// readLimit is the largest frame read, raised towards WS_READ_LIMIT_MAX
+	// when one exceeds it.
+	readLimit atomic.Int64
 
-func init() {
-	prometheus.MustRegister(upgradesTotal, messagesTotal, errorsTotal, connectedGauge)
+	conn       *websocket.Conn
+	reading    *websocket.Conn
+	migration  *migration
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	connCancel context.CancelFunc
+	connCtx    context.Context
+	connWG     sync.WaitGroup
+	mu         sync.Mutex
+	writeMu    sync.Mutex
+	subMu      sync.Mutex   // serializes subscribe and symbol set changes
+	frameMu    sync.RWMutex // read-held by handleFrame; drain waits it out
+	ctx        context.Context
+	cancel     context.CancelFunc
 }
 
-func NewGateway() *Gateway {
-	wsURL := getenv("WS_URL", "wss://stream-testnet.bybit.com/v5/public")
-	symbols := strings.Split(getenv("SYMBOLS", "BTCUSDT,ETHUSDT"), ",")
-	redisURL := os.Getenv("REDIS_URL")
-	kafkaBrokers := getenv("KAFKA_BROKERS", "")
-	kafkaTopic := getenv("KAFKA_TOPIC", "md_ticks")
+func NewGateway(cfg Config) *Gateway {
+	initConnSlots(cfg.MaxConnections)
+	initShedder(cfg.MaxInbound)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
+	clock := newSystemClock(cfg.ClockOffset)
+	if cfg.MonotonicTs {
+		clock.anchor()
+	}
+	metrics := newGatewayMetrics(cfg.Instance)
+	if cfg.SymbolValidation != symbolValidationOff {
+		// Everything below starts on the checked set.
+		symbols, err := checkSymbols(ctx, cfg, cfg.Symbols, metrics)
+		if err != nil {
+			log.Fatalf("instance=%s symbol_validation_error err=%v", cfg.Instance, err)
+		}
+		cfg.Symbols = symbols
+	}
 	g := &Gateway{
-		wsURL:   wsURL,
-		symbols: symbols,
-		ctx:     ctx,
-		cancel:  cancel,
+		cfg:          cfg,
+		metrics:      metrics,
+		done:         make(chan struct{}),
+		wsURL:        cfg.WSURL,
+		symbols:      cfg.Symbols,
+		symbolsFile:  cfg.SymbolsFile,
+		sink:         newRotatingSink(newSink(cfg, metrics)),
+		creds:        cfg.sinkCredentials(),
+		tee:          newTeeHub(),
+		subs:         newSubscriptions(),
+		dialer:       newDialer(cfg),
+		lookupHost:   wsResolver(cfg).LookupHost,
+		payloadMode:  cfg.PayloadMode,
+		pingInterval: cfg.PingInterval,
+		warmup:       newWarmup(clock, cfg.WarmupData, cfg.WarmupTimeout),
+		clock:        clock,
+		ctx:          ctx,
+		cancel:       cancel,
 	}
-
-	if redisURL != "" {
-		opt, err := redis.ParseURL(redisURL)
+	processors, err := newProcessorChain(cfg, metrics)
+	if err != nil {
+		log.Fatalf("processor_error: %v", err)
+	}
+	g.processors = processors
+	if g.dlq, err = newDeadLetterQueue(cfg); err != nil {
+		log.Fatalf("dead_letter_error: %v", err)
+	}
+	if err := waitSinkReady(ctx, g.sink, cfg.SinkConnect); err != nil {
+		log.Fatalf("instance=%s sink_connect_error sink=%s err=%v", cfg.Instance, g.sink.Name(), err)
+	}
+	if cfg.SelfTest {
+		if err := g.runSelfTest(); err != nil {
+			if cfg.SelfTestFailure == selfTestExit {
+				log.Fatalf("instance=%s self_test_error sink=%s err=%v", cfg.Instance, g.sink.Name(), err)
+			}
+			log.Printf("instance=%s self_test_error sink=%s err=%v", cfg.Instance, g.sink.Name(), err)
+			g.selfTestErr = err
+		}
+	}
+	g.allowed.Store(newSymbolSet(cfg.Symbols))
+	lastPublishAge.set(g.lastPublishAge, cfg.Instance, g.sink.Name())
+	if cfg.BookMode == bookModeMaintained {
+		g.books = newBookKeeper(cfg.BookCoalesce, stateLimit{cfg.SymbolState, metrics.stateEvictions.WithLabelValues("book")}, clock, g.publishBook)
+	}
+	if cfg.ConflateInterval > 0 || len(cfg.Conflate) > 0 {
+		g.conflate = newConflater(cfg.conflateInterval, g.emit)
+	}
+	if cfg.PerSymbol {
+		g.lastPrices = newLastPriceCache(cfg.Instance, clock, cfg.Symbols)
+	}
+	g.readLimit.Store(int64(cfg.ReadLimit))
+	if cfg.NTPServer != "" && cfg.Source == sourceWS {
+		go clock.syncNTP(ctx, cfg.NTPServer, g.metrics)
+	}
+	if cfg.PublishBuffer > 0 {
+		q, err := newEventQueue(cfg, g.metrics, g.deliver)
 		if err != nil {
-			log.Fatalf("invalid REDIS_URL: %v", err)
-		}
-		g.redis = redis.NewClient(opt)
-		g.redisKey = getenv("REDIS_STREAM", "md_ticks")
-		g.sinkType = SinkRedis
-		log.Printf("sink=redis stream=%s", g.redisKey)
-	} else if kafkaBrokers != "" {
-		brokers := strings.Split(kafkaBrokers, ",")
-		g.kafkaW = &kafka.Writer{
-			Addr:         kafka.TCP(brokers...),
-			Topic:        kafkaTopic,
-			RequiredAcks: kafka.RequireAll,
-		}
-		g.kafkaTopic = kafkaTopic
-		g.sinkType = SinkKafka
-		log.Printf("sink=kafka topic=%s", kafkaTopic)
-	} else {
-		g.sinkType = SinkNone
-		log.Printf("sink=none (stdout)")
+			log.Fatalf("publish_queue_error: %v", err)
+		}
+		g.queue = q
+	}
+	if cfg.SortWindow > 0 {
+		g.sorter = newTsSorter(cfg.SortWindow, g.dispatch)
+	}
+	if cfg.MonotonicTs {
+		g.tsGuard = newTsGuard(stateLimit{cfg.SymbolState, metrics.stateEvictions.WithLabelValues("monotonic_ts")})
+	}
+	if cfg.DeadmanTimeout > 0 {
+		g.deadman = newDeadman(cfg.DeadmanTimeout)
+	}
+	if cfg.CaptureRing > 0 {
+		g.capture = newFrameCapture(cfg.CaptureRing, cfg.CaptureBytes, cfg.CaptureTotal, stateLimit{cfg.SymbolState, metrics.stateEvictions.WithLabelValues("capture")})
+	}
+	if cfg.TickerSnapshot != "" {
+		g.tickerSeed = newTickerSeed()
+	}
+	if cfg.subscribesKind("kline") {
+		g.klines = newKlineTracker(cfg.KlineConfirmed, stateLimit{cfg.SymbolState, metrics.stateEvictions.WithLabelValues("kline")})
+	}
+	if cfg.KlineBackfill != "" {
+		g.backfills = newKlineBackfiller(g.backfillKline)
+	}
+	if cfg.FlowInterval > 0 {
+		g.flow = newTradeFlow(cfg.FlowInterval, stateLimit{cfg.SymbolState, metrics.stateEvictions.WithLabelValues("flow")})
+	}
+	if cfg.VolWindow > 0 {
+		g.vol = newRollingVol(cfg.VolBasis, cfg.VolWindow, cfg.VolSample, stateLimit{cfg.SymbolState, metrics.stateEvictions.WithLabelValues("vol")})
+	}
+	if cfg.RemoteWriteURL != "" {
+		g.remoteWrite = newRemoteWriter(cfg)
+	}
+	if len(cfg.Redundant) > 0 {
+		g.race = newEndpointRace(stateLimit{cfg.SymbolState, metrics.stateEvictions.WithLabelValues("race")})
+		// The legs share ticker state, as they do the rest.
+		if cfg.TickerMerge {
+			g.tickerMerge = newTickerMerge(stateLimit{cfg.SymbolState, metrics.stateEvictions.WithLabelValues("ticker_merge")})
+		}
+		if cfg.TickerOnChange {
+			g.tickerDedup = newTickerDedup(cfg.TickerFields, stateLimit{cfg.SymbolState, metrics.stateEvictions.WithLabelValues("ticker")})
+		}
+	}
+	if cfg.ValidateOutput {
+		if g.validator, err = newEventValidator(); err != nil {
+			log.Fatalf("schema_error: %v", err)
+		}
+	}
+	if cfg.PlanKey != "" {
+		if g.planSource, err = newPlanSource(cfg); err != nil {
+			log.Fatalf("subscription_plan_error: %v", err)
+		}
+		// Start on the plan rather than move to it right after subscribing.
+		g.loadPlan(ctx)
 	}
-
 	return g
 }
 
-func getenv(k, def string) string {
-	if v := os.Getenv(k); v != "" {
-		return v
+// wsWriteBufferPool lets connections share write buffers instead of each
+// holding one between its infrequent writes.
+var wsWriteBufferPool = &sync.Pool{}
+
+func newDialer(cfg Config) *websocket.Dialer {
+	return &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: cfg.HandshakeTimeout,
+		TLSClientConfig:  &tls.Config{MinVersion: tls.VersionTLS12},
+		ReadBufferSize:   cfg.WSReadBuffer,
+		WriteBufferSize:  cfg.WSWriteBuffer,
+		WriteBufferPool:  wsWriteBufferPool,
+		NetDialContext:   wsNetDial(cfg),
+	}
+}
+
+// maxRetainedFrame bounds the frame buffer kept between reads, so one large
+// snapshot doesn't pin its size for the life of the connection.
+const maxRetainedFrame = 1 << 20
+
+// readFrame reads the next message into buf, which is reused across calls.
+// The returned slice is only valid until the next call.
+func readFrame(conn *websocket.Conn, buf *bytes.Buffer) ([]byte, error) {
+	if buf.Cap() > maxRetainedFrame {
+		*buf = bytes.Buffer{}
+	}
+	buf.Reset()
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
 	}
-	return def
+	return buf.Bytes(), nil
 }
 
 func (g *Gateway) connect() error {
-	dialer := websocket.Dialer{
-		Proxy:            http.ProxyFromEnvironment,
-		HandshakeTimeout: 15 * time.Second,
-		TLSClientConfig:  &tls.Config{MinVersion: tls.VersionTLS12},
+	if err := acquireConnSlot(g.ctx); err != nil {
+		return err
 	}
-	conn, _, err := dialer.Dial(g.wsURL, nil)
+	conn, resp, err := g.dialer.Dial(g.wsURL, nil)
 	if err != nil {
+		releaseConnSlot()
+		if isMaintenance(resp, err) {
+			return fmt.Errorf("%w: %v", errMaintenance, err)
+		}
+		if isConnLimit(resp, err) {
+			return fmt.Errorf("%w: %v", errConnLimit, err)
+		}
+		err = dialPhaseError(err)
+		var pe *phaseTimeoutError
+		if errors.As(err, &pe) {
+			g.metrics.phaseTimeouts.WithLabelValues(pe.phase).Inc()
+		}
+		return err
+	}
+	if err := g.attach(conn); err != nil {
 		return err
 	}
+	g.metrics.reconnects.WithLabelValues(primaryConn).Inc()
+	return nil
+}
+
+// attach makes conn, dialed into a held connection slot, the live
+// connection and starts its ack timeout and ping loops.
+func (g *Gateway) attach(conn *websocket.Conn) error {
+	connCtx, connCancel := context.WithCancel(g.ctx)
 	g.mu.Lock()
+	if err := g.ctx.Err(); err != nil {
+		// Stopped while dialing.
+		g.mu.Unlock()
+		connCancel()
+		_ = conn.Close()
+		releaseConnSlot()
+		return err
+	}
 	g.conn = conn
+	g.connCancel = connCancel
+	g.connCtx = connCtx
 	g.mu.Unlock()
-	connectedGauge.Set(1)
-	upgradesTotal.Inc()
+	g.progress.Store(time.Now().UnixNano())
+	g.live.Store(true)
+	g.metrics.connected.WithLabelValues(primaryConn).Set(1)
+	g.metrics.activeConns.Inc()
+
+	if g.cfg.AckTimeout > 0 {
+		g.connWG.Add(1)
+		go func() {
+			defer g.connWG.Done()
+			g.ackTimeoutLoop(connCtx, conn, g.cfg.AckTimeout)
+		}()
+	}
+	if g.pingInterval > 0 {
+		g.connWG.Add(1)
+		go func() {
+			defer g.connWG.Done()
+			g.pingLoop(connCtx, conn, 0)
+		}()
+	}
 	return nil
 }
 
+// closeConn closes the current connection and waits for every goroutine
+// started for it to exit, so reconnects never accumulate them.
 func (g *Gateway) closeConn() {
 	g.mu.Lock()
+	cancel := g.connCancel
+	g.connCancel = nil
 	if g.conn != nil {
 		_ = g.conn.Close()
 		g.conn = nil
+		releaseConnSlot()
+		g.metrics.activeConns.Dec()
+	}
+	g.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	g.connWG.Wait()
+	g.live.Store(false)
+	g.metrics.connected.WithLabelValues(primaryConn).Set(0)
+	g.metrics.subscribed.Set(0)
+}
+
+// pingLoop sends Bybit's application-level ping, which the venue requires to
+// keep idle public connections open, and with RTT_METRICS a WS ping timing
+// connection index's round trip.
+func (g *Gateway) pingLoop(ctx context.Context, conn *websocket.Conn, index int) {
+	t := time.NewTicker(g.pingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := g.sendOp(conn, "ping", nil); err != nil {
+				log.Printf("ping_error err=%v", err)
+				return
+			}
+			if g.cfg.RTTMetrics {
+				if err := sendRTTPing(conn); err != nil {
+					log.Printf("ping_error err=%v", err)
+					return
+				}
+			}
+		}
 	}
+}
+
+var defaultTopics = []string{"orderbook.25", "tickers"}
+
+// topicsFor returns the Bybit topics subscribed for symbol: each configured
+// TOPICS prefix suffixed with the symbol.
+func (g *Gateway) topicsFor(symbol string) []string {
+	g.mu.Lock()
+	prefixes := g.topicsLocked()
 	g.mu.Unlock()
-	connectedGauge.Set(0)
+	return topicArgs(prefixes, symbol)
+}
+
+// topicsLocked is the topic prefixes subscribed to: TOPICS, or those of the
+// subscription plan. g.mu must be held.
+func (g *Gateway) topicsLocked() []string {
+	if g.topics != nil {
+		return g.topics
+	}
+	return g.cfg.topicPrefixes()
+}
+
+func (c Config) topicsFor(symbol string) []string { return topicArgs(c.topicPrefixes(), symbol) }
+
+func (c Config) topicPrefixes() []string {
+	if len(c.Topics) == 0 {
+		return defaultTopics
+	}
+	return c.Topics
+}
+
+func topicArgs(prefixes []string, symbol string) []string {
+	topics := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		topics[i] = p + "." + symbol
+	}
+	return topics
+}
+
+func (g *Gateway) sendOp(conn *websocket.Conn, op string, args []string) error {
+	msg := map[string]any{"op": op}
+	if args != nil {
+		msg["args"] = args
+		msg["req_id"] = g.subs.request(op, args)
+	}
+	b, _ := json.Marshal(msg)
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+	return conn.WriteMessage(websocket.TextMessage, b)
 }
 
+const subscribeMaxAttempts = 5
+
+// subscribe sends subscribe ops for every configured symbol. Symbols whose op
+// failed are retried on the same connection with jittered backoff as long as
+// the socket still accepts a ping; an error means the caller should
+// reconnect.
 func (g *Gateway) subscribe() error {
+	g.subMu.Lock()
+	defer g.subMu.Unlock()
 	g.mu.Lock()
 	conn := g.conn
+	pending := prioritize(g.symbols, g.cfg.SymbolPriority)
 	g.mu.Unlock()
 	if conn == nil {
 		return fmt.Errorf("no connection")
 	}
-	for _, s := range g.symbols {
-		msg := map[string]any{
-			"op":   "subscribe",
-			"args": []string{fmt.Sprintf("orderbook.25.%s", s), fmt.Sprintf("tickers.%s", s)},
+
+	g.subs.reset()
+	g.resolveMetrics()
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = 250 * time.Millisecond
+	bo.MaxInterval = 5 * time.Second
+	for attempt := 1; ; attempt++ {
+		var err error
+		pending, err = g.subscribeSymbols(conn, pending)
+		if err == nil {
+			return nil
 		}
-		b, _ := json.Marshal(msg)
-		if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+		if !connAlive(conn) {
 			return err
 		}
+		if attempt >= subscribeMaxAttempts {
+			return fmt.Errorf("subscribe gave up after %d attempts with %d symbols pending: %w", attempt, len(pending), err)
+		}
+		g.metrics.subscribeRetries.Inc()
+		d := bo.NextBackOff()
+		log.Printf("subscribe_retry pending=%d attempt=%d err=%v backoff=%s", len(pending), attempt, err, d)
+		if !g.sleep(d) {
+			return g.ctx.Err()
+		}
+	}
+}
+
+// subscribeSymbols subscribes each symbol in turn and on failure returns the
+// symbols that were not subscribed, starting with the one that failed.
+func (g *Gateway) subscribeSymbols(conn *websocket.Conn, symbols []string) ([]string, error) {
+	for i, s := range symbols {
+		if err := g.sendOp(conn, "subscribe", g.topicsFor(s)); err != nil {
+			return symbols[i:], err
+		}
 		time.Sleep(100 * time.Millisecond)
 	}
-	return nil
+	return nil, nil
+}
+
+func connAlive(conn *websocket.Conn) bool {
+	return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)) == nil
 }
 
 type OutEvent struct {
-	Ts      int64       `json:"ts"`
-	Symbol  string      `json:"symbol"`
-	Type    string      `json:"type"`
+	Ts     int64  `json:"ts"`
+	Symbol string `json:"symbol"`
+	Type   string `json:"type"`
+	// Action is Bybit's message type, "snapshot" or "delta", or "update" for
+	// a maintained book rebuilt from deltas. Empty where there is none.
+	Action  string      `json:"action,omitempty"`
 	Payload interface{} `json:"payload"`
+	// Raw is the source frame with INCLUDE_RAW: the JSON itself, or a
+	// base64 string of its exact bytes.
+	Raw json.RawMessage `json:"raw,omitempty"`
+	// Part is set on the parts of a book split by MAX_OUTBOUND_BYTES.
+	Part *Part `json:"part,omitempty"`
+}
+
+const (
+	actionSnapshot = "snapshot"
+	actionDelta    = "delta"
+	actionUpdate   = "update"
+)
+
+// emit publishes a venue event, normalizing its payload if configured.
+// Conflation merges raw payloads, so it happens before this.
+func (g *Gateway) emit(ev OutEvent) { g.emitFrom(ev, time.Time{}) }
+
+// emitFrom is emit for an event decoded from a frame read at readAt, which
+// is zero for events released later by the conflater or book keeper.
+func (g *Gateway) emitFrom(ev OutEvent, readAt time.Time) {
+	if g.cfg.EmitBoth {
+		// The raw copy goes first and isn't timed, so process latency
+		// is still one sample per frame.
+		raw := ev
+		raw.Type += rawTypeSuffix
+		g.hotMetrics().emittedFor(payloadRaw).Inc()
+		g.publish(raw)
+	}
+	if g.payloadMode == payloadNormalized {
+		ev, _ = normalizer{}.Process(ev)
+	}
+	g.hotMetrics().emittedFor(g.payloadMode).Inc()
+	g.publishFrom(ev, readAt)
+}
+
+func (g *Gateway) publish(ev OutEvent) { g.publishFrom(ev, time.Time{}) }
+
+func (g *Gateway) publishFrom(ev OutEvent, readAt time.Time) {
+	if ev.Type != typeStale {
+		if g.cfg.DeadmanHalt && g.deadman.isStale(ev.Symbol) {
+			g.metrics.deadmanDropped.Inc()
+			return
+		}
+		// Markers skip the processors: a consumer must never miss one to
+		// a filter or the sampler.
+		var keep bool
+		if ev, keep = g.processors.Process(ev); !keep {
+			return
+		}
+	}
+	if g.tee != nil {
+		g.tee.send(ev)
+	}
+	if !readAt.IsZero() {
+		g.hotMetrics().kind(topicKind(ev.Type)).processLatency.Observe(float64(time.Since(readAt)) / float64(time.Millisecond))
+	}
+	if g.sorter != nil {
+		g.sorter.add(ev)
+		return
+	}
+	g.dispatch(ev)
+}
+
+// dispatch hands ev to the publish queue or, without one, the sink.
+func (g *Gateway) dispatch(ev OutEvent) {
+	g.pubMu.RLock()
+	defer g.pubMu.RUnlock()
+	if g.pubClosed {
+		g.metrics.drainIgnored.Inc()
+		return
+	}
+	if g.tsGuard != nil {
+		var clamped bool
+		if ev.Ts, clamped = g.tsGuard.clamp(ev); clamped {
+			g.metrics.tsClamped.Inc()
+		}
+	}
+	if g.queue != nil {
+		g.queue.enqueue(ev)
+		return
+	}
+	g.deliver(ev)
+}
+
+// deliver publishes ev, or with MAX_OUTBOUND_BYTES the parts it had to be
+// split into.
+func (g *Gateway) deliver(ev OutEvent) {
+	if g.cfg.MaxOutbound <= 0 {
+		g.deliverOne(ev)
+		return
+	}
+	parts, err := fitOutbound(ev, g.cfg.MaxOutbound, g.cfg.OversizePolicy)
+	if err != nil {
+		g.metrics.errors.Inc()
+		g.metrics.oversize.WithLabelValues("dropped").Inc()
+		if g.dlq != nil {
+			g.deadLetter(ev, err, deadLetterOversize, 0)
+		}
+		return
+	}
+	if len(parts) > 1 {
+		g.metrics.oversize.WithLabelValues("split").Inc()
+	}
+	for _, p := range parts {
+		g.deliverOne(p)
+	}
+}
+
+// deliverOne publishes ev, retrying failures up to MAX_PUBLISH_ATTEMPTS
+// before giving up on it and handing it to the dead-letter destination, if
+// any.
+func (g *Gateway) deliverOne(ev OutEvent) {
+	if g.validator != nil {
+		if err := g.validator.validate(ev); err != nil {
+			g.metrics.schemaInvalid.Inc()
+			if g.dlq != nil {
+				g.deadLetter(ev, err, deadLetterSchema, 0)
+			}
+			return
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		err := g.publishOnce(ev)
+		if err == nil {
+			g.lastPublish.Store(g.clock.Now().UnixNano())
+			return
+		}
+		g.metrics.errors.Inc()
+		reason := publishReason(err)
+		if reason == deadLetterPublish && attempt < g.cfg.MaxPublish && g.sleep(time.Duration(attempt)*publishRetryDelay) {
+			continue
+		}
+		if g.dlq != nil {
+			g.deadLetter(ev, err, reason, attempt)
+		}
+		return
+	}
+}
+
+// publishOnce is one sink publish bounded by SINK_WRITE_TIMEOUT.
+func (g *Gateway) publishOnce(ev OutEvent) error {
+	if g.cfg.SinkWrite <= 0 {
+		return g.sink.Publish(g.ctx, ev)
+	}
+	ctx, cancel := context.WithTimeout(g.ctx, g.cfg.SinkWrite)
+	defer cancel()
+	err := g.sink.Publish(ctx, ev)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		g.metrics.sinkTimeouts.WithLabelValues(g.sink.Name()).Inc()
+	}
+	return err
 }
 
-func (g *Gateway) publish(ev OutEvent) {
-	data, _ := json.Marshal(ev)
-	switch g.sinkType {
-	case SinkRedis:
-		_ = g.redis.XAdd(g.ctx, &redis.XAddArgs{Stream: g.redisKey, Values: map[string]interface{}{"data": data}}).Err()
-	case SinkKafka:
-		_ = g.kafkaW.WriteMessages(g.ctx, kafka.Message{Value: data})
-	default:
-		log.Printf("ev=%s", string(data))
+// lastPublishAge is the ws_gateway_last_publish_age_seconds value.
+func (g *Gateway) lastPublishAge() float64 {
+	last := g.lastPublish.Load()
+	if last == 0 {
+		return math.Inf(1)
 	}
+	return g.clock.Now().Sub(time.Unix(0, last)).Seconds()
 }
 
 func (g *Gateway) run() {
 	bo := backoff.NewExponentialBackOff()
 	bo.InitialInterval = time.Second
 	bo.MaxInterval = 30 * time.Second
+	limitBo := newConnLimitBackOff()
+	maintBo := newMaintenanceBackOff()
 	for {
 		select {
 		case <-g.ctx.Done():
@@ -196,86 +688,569 @@ func (g *Gateway) run() {
 		}
 
 		if err := g.connect(); err != nil {
-			errorsTotal.Inc()
+			g.metrics.errors.Inc()
+			if isMaintenance(nil, err) {
+				if !g.maintenanceWait(maintBo, err) {
+					return
+				}
+				continue
+			}
+			if isConnLimit(nil, err) {
+				if !g.connLimitWait(limitBo, err) {
+					return
+				}
+				continue
+			}
 			d := bo.NextBackOff()
 			log.Printf("connect_error err=%v backoff=%s", err, d)
-			time.Sleep(d)
+			if !g.sleep(d) {
+				return
+			}
+			continue
+		}
+		if err := g.subscribe(); err != nil {
+			g.metrics.errors.Inc()
+			g.closeConn()
+			d := bo.NextBackOff()
+			log.Printf("subscribe_error err=%v backoff=%s", err, d)
+			if !g.sleep(d) {
+				return
+			}
 			continue
 		}
-		_ = g.subscribe()
 		bo.Reset()
+		maintBo.Reset()
+		g.setMaintenance(false)
+		g.mu.Lock()
+		g.metrics.subscribed.Set(float64(len(g.symbols)))
+		g.mu.Unlock()
+		if g.cfg.MinConfirmed > 0 {
+			g.watchConfirmations(g.cfg.ConfirmTimeout, g.cfg.MinConfirmed)
+		}
+		if g.tickerSeed != nil {
+			g.startTickerSeed()
+		}
 
-		g.readLoop()
+		err := g.readLoop()
 		g.closeConn()
+		if isMaintenance(nil, err) {
+			if !g.maintenanceWait(maintBo, err) {
+				return
+			}
+			continue
+		}
+		if isConnLimit(nil, err) {
+			if !g.connLimitWait(limitBo, err) {
+				return
+			}
+			continue
+		}
+		limitBo.Reset()
 	}
 }
 
-func (g *Gateway) readLoop() {
+func (g *Gateway) maintenanceWait(bo backoff.BackOff, err error) bool {
+	g.setMaintenance(true)
+	d := bo.NextBackOff()
+	log.Printf("venue_maintenance err=%v backoff=%s", err, d)
+	return g.sleep(d)
+}
+
+func (g *Gateway) connLimitWait(bo backoff.BackOff, err error) bool {
+	g.metrics.connLimitHits.Inc()
+	d := bo.NextBackOff()
+	log.Printf("conn_limit_hit err=%v backoff=%s", err, d)
+	return g.sleep(d)
+}
+
+func (g *Gateway) readLoop() error {
 	g.mu.Lock()
 	conn := g.conn
+	g.reading = conn
 	g.mu.Unlock()
 	if conn == nil {
-		return
+		return fmt.Errorf("no connection")
+	}
+	// With REDUNDANT_ENDPOINTS the merged stream outlives any one
+	// connection, and a snapshot repeating what a backup already delivered
+	// is dropped as a duplicate. A migrated connection carries on the same
+	// stream too.
+	if g.race == nil {
+		if g.books != nil {
+			g.books.reset()
+		}
+		if g.conflate != nil {
+			g.conflate.reset()
+		}
+		if g.vol != nil {
+			g.vol.reset()
+		}
+	}
+	var pending [][]byte
+	for {
+		err := g.readFrames(conn, 0, pending)
+		g.mu.Lock()
+		m := g.migration
+		g.migration, g.reading = nil, nil
+		g.mu.Unlock()
+		if m == nil {
+			return err
+		}
+		// CONNECTION_MIGRATION closed conn for an already subscribed
+		// one; carry on with it, starting with what it has read.
+		g.closeConn()
+		if err := g.attach(m.conn); err != nil {
+			return err
+		}
+		g.mu.Lock()
+		g.reading = m.conn
+		g.metrics.subscribed.Set(float64(len(g.symbols)))
+		g.mu.Unlock()
+		conn, pending = m.conn, m.pending
 	}
-	conn.SetReadLimit(8 << 20)
+}
+
+// connReader is the state of one connection's read loop. index is the
+// connection's conn label: 0 for the instance's own, which alone feeds the
+// watchdog, acks and duplicate subscription checks, and from 1 for backups
+// in REDUNDANT_ENDPOINTS order.
+type connReader struct {
+	index int
+	leg   string
+	// Gaps are measured per connection, so the first message for a symbol
+	// after a reconnect starts a new series instead of counting the outage.
+	lastSeen   *symbolLRU[time.Time]
+	tickers    *tickerDedup
+	merge      *tickerMerge
+	seenTopics map[string]bool
+	unexpected symbolSet
+	// unknownTopics are those UNKNOWN_TOPIC_POLICY has logged.
+	unknownTopics map[string]bool
+	// largeFrames is the largest size by topic of frames near the read limit.
+	largeFrames map[string]int
+}
+
+// readFrames handles pending, then the frames of connection index until it
+// fails.
+func (g *Gateway) readFrames(conn *websocket.Conn, index int, pending [][]byte) error {
+	if g.cfg.PinReadLoop {
+		// No other goroutine runs on the thread, so the loop keeps its
+		// caches warm and pairs with an isolated core (taskset, cpuset).
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+	conn.SetReadLimit(g.readLimit.Load())
 	_ = conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	conn.SetPongHandler(func(string) error {
+	conn.SetPongHandler(func(payload string) error {
 		_ = conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		if g.cfg.RTTMetrics {
+			g.observePong(index, payload)
+		}
 		return nil
 	})
 
+	r := &connReader{index: index, leg: legPrimary, seenTopics: make(map[string]bool), unexpected: make(symbolSet), unknownTopics: make(map[string]bool)}
+	if index > 0 {
+		r.leg = legBackup
+	}
+	if g.cfg.PerSymbol && index == 0 {
+		r.lastSeen = newSymbolLRU[time.Time](stateLimit{g.cfg.SymbolState, g.metrics.stateEvictions.WithLabelValues("gap")}, nil)
+	}
+	if g.cfg.TickerMerge {
+		r.merge = g.tickerMerge
+		if r.merge == nil {
+			r.merge = newTickerMerge(stateLimit{g.cfg.SymbolState, g.metrics.stateEvictions.WithLabelValues("ticker_merge")})
+		}
+	}
+	if g.cfg.TickerOnChange {
+		r.tickers = g.tickerDedup
+		if r.tickers == nil {
+			r.tickers = newTickerDedup(g.cfg.TickerFields, stateLimit{g.cfg.SymbolState, g.metrics.stateEvictions.WithLabelValues("ticker")})
+		}
+	}
+	defer g.releaseTopics(r.seenTopics)
+	for _, message := range pending {
+		g.handleFrame(r, message, time.Now())
+	}
+	var frame bytes.Buffer
 	for {
-		_, message, err := conn.ReadMessage()
+		message, err := readFrame(conn, &frame)
 		if err != nil {
-			errorsTotal.Inc()
+			if index == 0 && g.migratingFrom(conn) {
+				return err
+			}
+			g.metrics.errors.Inc()
 			log.Printf("read_error err=%v", err)
+			if errors.Is(err, websocket.ErrReadLimit) {
+				g.readLimitExceeded(r)
+			}
+			return err
+		}
+		g.noteLargeFrame(r, message)
+		g.handleFrame(r, message, time.Now())
+	}
+}
+
+// handleFrame decodes one frame read at readAt and publishes its event.
+func (g *Gateway) handleFrame(r *connReader, message []byte, readAt time.Time) {
+	primary := r.leg == legPrimary
+	if primary {
+		g.progress.Store(readAt.UnixNano())
+	}
+	g.frameMu.RLock()
+	defer g.frameMu.RUnlock()
+	if g.draining() {
+		g.metrics.drainIgnored.Inc()
+		return
+	}
+	g.metrics.messageBytes.Observe(float64(len(message)))
+	var raw map[string]any
+	if err := json.Unmarshal(message, &raw); err != nil {
+		g.unmarshalError(message, err)
+		return
+	}
+	topic, _ := raw["topic"].(string)
+	if topic == "" {
+		// Subscribe acks and pongs carry no topic and no data.
+		g.metrics.controlMessages.Inc()
+		ok, present := raw["success"].(bool)
+		if present && !ok {
+			g.metrics.errors.Inc()
+			log.Printf("op_failed op=%v ret_msg=%v", raw["op"], raw["ret_msg"])
+		}
+		if id, _ := raw["req_id"].(string); present && id != "" && primary {
+			msg, _ := raw["ret_msg"].(string)
+			if d, found := g.subs.ack(id, ok, msg); found {
+				g.metrics.ackLatency.Observe(float64(d) / float64(time.Millisecond))
+			}
+		}
+		return
+	}
+	if g.race != nil {
+		if !g.race.first(topic, raceKey(raw, message)) {
 			return
 		}
-		var raw map[string]any
-		if err := json.Unmarshal(message, &raw); err != nil {
-			errorsTotal.Inc()
-			continue
+		g.metrics.raceWins.WithLabelValues(r.leg).Inc()
+	} else if h := g.handover.Load(); h != nil && !h.first(topic, raceKey(raw, message)) {
+		g.metrics.migrationDups.Inc()
+		return
+	}
+	if msgType, _ := raw["type"].(string); shedder != nil && !shedder.admit(readAt, sheddable(topicKind(topic), msgType)) {
+		g.metrics.inboundShed.WithLabelValues(topicKind(topic)).Inc()
+		return
+	}
+	if primary {
+		g.claimTopic(topic, r.seenTopics)
+	}
+	data := raw["data"]
+	now := g.clock.Now()
+	ts := now.UnixMilli()
+	kind := topicKind(topic)
+	if !knownKinds[kind] && !g.keepUnknownTopic(r, topic, kind) {
+		return
+	}
+	hot := g.hotMetrics()
+	km := hot.kind(kind)
+	if xts, ok := exchangeTs(raw, g.cfg.tsField(kind)); ok {
+		// Clock skew can put the exchange slightly ahead of us.
+		hot.exchangeLatency(r.index, kind).Observe(float64(max(ts-xts, 0)))
+		ts = xts
+	}
+	// Only some kinds, order books among them, carry the matching engine
+	// time; the rest simply aren't observed.
+	if cts, ok := exchangeTs(raw, "cts"); ok {
+		km.engineLatency.Observe(float64(max(now.UnixMilli()-cts, 0)))
+	}
+	symbol := ""
+	if m, ok := data.(map[string]any); ok {
+		if s, ok2 := m["s"].(string); ok2 {
+			symbol = s
+		}
+	}
+	if symbol == "" {
+		// Array payloads such as publicTrade carry the symbol only in
+		// the topic.
+		symbol = topic[strings.LastIndexByte(topic, '.')+1:]
+	}
+	g.subs.observe(topic, ts, raw)
+	if g.cfg.StrictSymbols && !g.allowed.Load().has(symbol) {
+		g.metrics.filteredSymbol.Inc()
+		if _, logged := r.unexpected[symbol]; !logged {
+			r.unexpected[symbol] = struct{}{}
+			log.Printf("unexpected_symbol instance=%s symbol=%s topic=%s", g.cfg.Instance, symbol, topic)
+		}
+		return
+	}
+	action, _ := raw["type"].(string)
+	if g.capture != nil {
+		g.capture.record(symbol, message, readAt)
+		if kind == "orderbook" {
+			if prev, id, gap := g.capture.bookGap(symbol, topic, action, data); gap {
+				log.Printf("instance=%s book_gap topic=%s prev=%d update_id=%d", g.cfg.Instance, topic, prev, id)
+				g.dumpCapture(symbol, captureBookGap)
+			}
+		}
+	}
+	g.warmup.observe(symbol)
+	if g.deadman != nil {
+		g.observeData(symbol)
+	}
+	if g.lastPrices != nil && kind == "publicTrade" {
+		g.lastPrices.observeTrades(symbol, data)
+	}
+	if g.flow != nil && kind == "publicTrade" {
+		g.publishFlows(symbol, g.flow.observe(symbol, data))
+	}
+	if g.vol != nil && kind == volKind(g.cfg.VolBasis) {
+		g.publishVols(symbol, g.vol.observe(symbol, ts, data))
+	}
+	if g.remoteWrite != nil && kind == "tickers" {
+		g.remoteWrite.observe(symbol, data, now.UnixMilli())
+	}
+	if r.lastSeen != nil && symbol != "" {
+		if prev, ok := r.lastSeen.get(symbol); ok {
+			hot.gap(symbol).Observe(float64(now.Sub(prev)) / float64(time.Millisecond))
+		}
+		r.lastSeen.put(symbol, now)
+	}
+	hot.wsMessages.Inc()
+	if g.books != nil && kind == "orderbook" {
+		g.books.handle(symbol, topic, action, data)
+		return
+	}
+	if g.tickerSeed != nil && kind == "tickers" && !g.tickerSeed.ws(symbol, ts) {
+		// Older than the REST snapshot already published.
+		g.metrics.tickerSnapshots.WithLabelValues("stale_ws").Inc()
+		return
+	}
+	if g.klines != nil && kind == "kline" {
+		var (
+			kept bool
+			gaps []klineGap
+		)
+		if data, kept, gaps = g.klines.observe(topic, symbol, data); !kept {
+			return
 		}
-		topic, _ := raw["topic"].(string)
-		data := raw["data"]
-		ts := time.Now().UnixMilli()
-		symbol := ""
-		if m, ok := data.(map[string]any); ok {
-			if s, ok2 := m["s"].(string); ok2 {
-				symbol = s
+		for _, gap := range gaps {
+			g.metrics.klineGaps.Inc()
+			log.Printf("instance=%s kline_gap topic=%s from=%d to=%d", g.cfg.Instance, topic, gap.from, gap.to)
+			if g.capture != nil {
+				g.dumpCapture(symbol, captureKlineGap)
+			}
+			if g.backfills != nil {
+				g.queueBackfill(gap)
 			}
 		}
-		out := OutEvent{Ts: ts, Symbol: symbol, Type: topic, Payload: data}
-		messagesTotal.WithLabelValues("ws").Inc()
-		g.publish(out)
 	}
+	out := OutEvent{Ts: ts, Symbol: symbol, Type: topic, Action: action, Payload: data}
+	if r.merge != nil && kind == "tickers" {
+		var ok bool
+		if out, ok = r.merge.merge(out); !ok {
+			g.metrics.tickerUnmerged.Inc()
+			return
+		}
+	}
+	if r.tickers != nil && kind == "tickers" && !r.tickers.changed(out) {
+		g.metrics.tickerSuppressed.Inc()
+		return
+	}
+	if g.cfg.IncludeRaw != includeRawOff {
+		// message aliases the reused frame buffer.
+		out.Raw = encodeRaw(g.cfg.IncludeRaw, message)
+	}
+	if g.conflate != nil && g.conflate.handle(out) {
+		return
+	}
+	g.emitFrom(out, readAt)
 }
 
-func (g *Gateway) healthz(w http.ResponseWriter, r *http.Request) {
+// Start launches the gateway's source loop in the background.
+func (g *Gateway) Start() {
+	go func() {
+		defer close(g.done)
+		if g.cfg.Source == sourceReplay {
+			g.replay()
+			return
+		}
+		if g.symbolsFile != "" {
+			go g.watchSymbolsFile()
+		}
+		if g.planSource != nil {
+			go g.watchPlan()
+		}
+		if g.cfg.WatchdogTimeout > 0 {
+			go g.watchdog(g.cfg.WatchdogTimeout)
+		}
+		if g.deadman != nil {
+			go g.watchDeadman()
+		}
+		if g.cfg.ConnMigration {
+			go g.watchEndpoint(g.cfg.MigrationInterval)
+		}
+		if g.remoteWrite != nil {
+			go g.watchRemoteWrite()
+		}
+		defer g.legs.Wait()
+		for i, url := range g.cfg.Redundant {
+			g.legs.Add(1)
+			go func(index int, url string) {
+				defer g.legs.Done()
+				g.runBackup(index, url)
+			}(i+1, url)
+		}
+		g.run()
+	}()
+}
+
+// Stop ends the source loop, delivers whatever is still buffered and closes
+// the sink.
+func (g *Gateway) Stop() {
+	g.cancel()
+	g.closeConn()
+	<-g.done
+	g.closePublish()
+}
+
+func (g *Gateway) replay() {
+	src, err := openReplaySource(g.cfg)
+	if err != nil {
+		g.replayErr = err
+		log.Printf("instance=%s replay_error err=%v", g.cfg.Instance, err)
+		return
+	}
+	defer src.Close()
+	n, err := g.runReplay(src, g.cfg.ReplaySpeed)
+	if err != nil {
+		g.replayErr = err
+		log.Printf("instance=%s replay_error events=%d err=%v", g.cfg.Instance, n, err)
+		return
+	}
+	log.Printf("instance=%s replay_done events=%d", g.cfg.Instance, n)
+}
+
+// sleep waits for d or until the gateway is stopped, reporting whether the
+// caller should carry on.
+func (g *Gateway) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-g.ctx.Done():
+		return false
+	}
+}
+
+// healthState reports "ok", "maintenance" or "unhealthy".
+func (g *Gateway) healthState() string {
 	g.mu.Lock()
-	connected := g.conn != nil
-	g.mu.Unlock()
-	status := http.StatusOK
-	if !connected {
-		status = http.StatusServiceUnavailable
+	defer g.mu.Unlock()
+	switch {
+	case g.selfTestErr != nil:
+		return "selftest_failed"
+	case g.drainState.Load() == drainDraining:
+		return "draining"
+	case g.drainState.Load() == drainDrained:
+		return "drained"
+	case g.cfg.Source == sourceReplay:
+		return "ok"
+	case g.conn != nil:
+		if !g.warmup.ready(g.symbols) {
+			return "warming"
+		}
+		return "ok"
+	case g.maintenance:
+		return "maintenance"
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"%s"}`, map[bool]string{true: "ok", false: "unhealthy"}[connected])))
+	return "unhealthy"
 }
 
 func main() {
-	g := NewGateway()
-	go g.run()
+	printCfg := flag.Bool("print-config", false, "print the effective configuration as JSON, secrets redacted, and exit")
+	setFlags := bindConfigFlags(flag.CommandLine)
+	flag.Parse()
+	flagOverrides = setFlags()
+	if v, _ := strconv.ParseBool(os.Getenv("PRINT_CONFIG")); v {
+		*printCfg = true
+	}
 
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/healthz", g.healthz)
+	cfgs, err := loadValidConfigs()
+	if err != nil {
+		log.Fatalf("config_error: %v", err)
+	}
+	namespace, constLabels, err := loadMetricsConfig()
+	if err != nil {
+		log.Fatalf("config_error: %v", err)
+	}
+	auth, err := loadAdminAuth()
+	if err != nil {
+		log.Fatalf("config_error: %v", err)
+	}
+	reg, err := newMetricsRegistry(namespace, constLabels)
+	if err != nil {
+		log.Fatalf("metrics_error: %v", err)
+	}
+	if *printCfg {
+		if err := printConfig(os.Stdout, cfgs); err != nil {
+			log.Fatalf("print_config_error: %v", err)
+		}
+		return
+	}
+	log.Printf("ws-gateway version=%s commit=%s instances=%d", version, commit, len(cfgs))
+	if auto, err := autoMaxProcs(); err != nil {
+		log.Fatalf("config_error: %v", err)
+	} else if auto {
+		tuneMaxProcs(cgroupRoot)
+	}
 
-	addr := getenv("ADDR", ":8082")
-	log.Printf("starting ws-gateway on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("http_server_error: %v", err)
+	gateways := make(gatewaySet, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		gateways = append(gateways, NewGateway(cfg))
 	}
-}
+	for _, g := range gateways {
+		g.Start()
+	}
+	sampleCtx, stopSampling := context.WithCancel(context.Background())
+	defer stopSampling()
+	go sampleGoroutines(sampleCtx)
+
+	mux := http.NewServeMux()
+	// promhttp gzips scrapes that accept it by itself.
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(reg, promhttp.HandlerFor(reg, promhttp.HandlerOpts{})))
+	mux.HandleFunc("/healthz", compressed(gateways.healthz))
+	mux.HandleFunc("/info", compressed(gateways.info))
+	mux.HandleFunc("/status/subscriptions", compressed(gateways.subscriptionStatus))
+	mux.HandleFunc("/debug/tee", gateways.tee)
+	mux.HandleFunc("/ingest", gateways.ingest)
+	mux.HandleFunc("/reconnect", gateways.reconnect)
+	mux.HandleFunc("/drain", gateways.drain)
+
+	addr := cfgs[0].Addr
+	srv := &http.Server{Addr: addr, Handler: auth.protect(mux)}
+	go func() {
+		log.Printf("starting ws-gateway on %s", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("http_server_error: %v", err)
+		}
+	}()
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go gateways.rotateOnSignal(hup)
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case <-ctx.Done():
+		log.Printf("shutdown_requested")
+	case <-gateways.replaysDone():
+	}
+
+	gateways.stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = srv.Shutdown(shutdownCtx)
+	if gateways.replayFailed() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestConnectSubscribePublish(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	if err := g.subscribe(); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	op := fake.nextOp(t)
+	if op["op"] != "subscribe" {
+		t.Fatalf("op = %v, want subscribe", op["op"])
+	}
+	wantArgs := []any{"orderbook.25.BTCUSDT", "tickers.BTCUSDT"}
+	if !reflect.DeepEqual(op["args"], wantArgs) {
+		t.Fatalf("args = %v, want %v", op["args"], wantArgs)
+	}
+
+	go g.readLoop()
+	sendJSON(t, server, map[string]any{
+		"topic": "tickers.BTCUSDT",
+		"type":  "snapshot",
+		"ts":    1700000000000,
+		"data":  map[string]any{"s": "BTCUSDT", "lastPrice": "42000.5"},
+	})
+
+	ev := waitEvents(t, sink, 1)[0]
+	if ev.Symbol != "BTCUSDT" || ev.Type != "tickers.BTCUSDT" || ev.Action != actionSnapshot {
+		t.Fatalf("event = %+v", ev)
+	}
+	if ev.Ts != 1700000000000 {
+		t.Fatalf("ts = %d, want the fake clock's 1700000000000", ev.Ts)
+	}
+	payload, ok := ev.Payload.(map[string]any)
+	if !ok || payload["lastPrice"] != "42000.5" {
+		t.Fatalf("payload = %#v", ev.Payload)
+	}
+}
+
+func TestTopicsFor(t *testing.T) {
+	g := &Gateway{}
+	if got, want := g.topicsFor("BTCUSDT"), []string{"orderbook.25.BTCUSDT", "tickers.BTCUSDT"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("default topics = %v, want %v", got, want)
+	}
+	g.cfg.Topics = []string{"publicTrade", "orderbook.50"}
+	if got, want := g.topicsFor("ETHUSDT"), []string{"publicTrade.ETHUSDT", "orderbook.50.ETHUSDT"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("topics = %v, want %v", got, want)
+	}
+}
+
+func TestDiffSymbols(t *testing.T) {
+	added, removed := diffSymbols([]string{"BTCUSDT", "ETHUSDT"}, []string{"ETHUSDT", "SOLUSDT"})
+	if !reflect.DeepEqual(added, []string{"SOLUSDT"}) {
+		t.Fatalf("added = %v", added)
+	}
+	if !reflect.DeepEqual(removed, []string{"BTCUSDT"}) {
+		t.Fatalf("removed = %v", removed)
+	}
+}
+
+func TestDedupeSymbols(t *testing.T) {
+	unique, dups := dedupeSymbols([]string{"BTCUSDT", "ETHUSDT", "BTCUSDT", "SOLUSDT", "ETHUSDT"})
+	if !reflect.DeepEqual(unique, []string{"BTCUSDT", "ETHUSDT", "SOLUSDT"}) {
+		t.Fatalf("unique = %v", unique)
+	}
+	if !reflect.DeepEqual(dups, []string{"BTCUSDT", "ETHUSDT"}) {
+		t.Fatalf("dups = %v", dups)
+	}
+}
+
+func TestPrioritize(t *testing.T) {
+	symbols := []string{"ETHUSDT", "SOLUSDT", "BTCUSDT", "XRPUSDT"}
+	got := prioritize(symbols, []string{"BTCUSDT", "DOGEUSDT", "SOLUSDT", "BTCUSDT"})
+	if want := []string{"BTCUSDT", "SOLUSDT", "ETHUSDT", "XRPUSDT"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("prioritize = %v, want %v", got, want)
+	}
+	if got := prioritize(symbols, nil); !reflect.DeepEqual(got, symbols) || &got[0] == &symbols[0] {
+		t.Fatalf("prioritize without priority = %v", got)
+	}
+}
+
+func TestSubscribeByPriority(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "ETHUSDT", "SOLUSDT", "BTCUSDT")
+	g.cfg.SymbolPriority = []string{"BTCUSDT"}
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	fake.nextConn(t)
+	if err := g.subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	var order []any
+	for i := 0; i < 3; i++ {
+		order = append(order, fake.nextOp(t)["args"].([]any)[0])
+	}
+	if want := []any{"orderbook.25.BTCUSDT", "orderbook.25.ETHUSDT", "orderbook.25.SOLUSDT"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("subscribed %v, want %v", order, want)
+	}
+	g.closeConn()
+}
+
+func TestSymbolChangeWaitsForSubscribe(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "BTCUSDT", "ETHUSDT", "XRPUSDT")
+	g.cfg.Topics = []string{"tickers"}
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	fake.nextConn(t)
+	done := make(chan error, 1)
+	go func() { done <- g.subscribe() }()
+	time.Sleep(50 * time.Millisecond)
+	if err := g.applySymbols([]string{"BTCUSDT", "ETHUSDT", "XRPUSDT", "SOLUSDT"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	var order []any
+	for i := 0; i < 4; i++ {
+		order = append(order, fake.nextOp(t)["args"].([]any)[0])
+	}
+	if want := []any{"tickers.BTCUSDT", "tickers.ETHUSDT", "tickers.XRPUSDT", "tickers.SOLUSDT"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("subscribed %v, want %v", order, want)
+	}
+	g.closeConn()
+}
+
+func TestDuplicateSubscriptionAcrossInstances(t *testing.T) {
+	fake := newFakeBybit(t)
+	var servers []*websocket.Conn
+	var gateways []*Gateway
+	var sinks []*memSink
+	for _, name := range []string{"dup_a", "dup_b"} {
+		g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+		g.cfg.Instance = name
+		g.metrics = newGatewayMetrics(name)
+		if err := g.connect(); err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+		servers = append(servers, fake.nextConn(t))
+		go g.readLoop()
+		gateways, sinks = append(gateways, g), append(sinks, sink)
+	}
+
+	ticker := map[string]any{"topic": "tickers.BTCUSDT", "data": map[string]any{"s": "BTCUSDT"}}
+	sendJSON(t, servers[0], ticker)
+	waitEvents(t, sinks[0], 1)
+	sendJSON(t, servers[1], ticker)
+	sendJSON(t, servers[1], ticker)
+	waitEvents(t, sinks[1], 2)
+	if n := testutil.ToFloat64(gateways[0].metrics.duplicateSubs); n != 0 {
+		t.Fatalf("first instance duplicates = %v, want 0", n)
+	}
+	if n := testutil.ToFloat64(gateways[1].metrics.duplicateSubs); n != 1 {
+		t.Fatalf("second instance duplicates = %v, want 1", n)
+	}
+}
+
+func TestSubscribeReportsBrokenSocket(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "BTCUSDT", "ETHUSDT")
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	fake.nextConn(t)
+
+	g.mu.Lock()
+	conn := g.conn
+	g.mu.Unlock()
+	_ = conn.UnderlyingConn().Close()
+
+	pending, err := g.subscribeSymbols(conn, []string{"BTCUSDT", "ETHUSDT"})
+	if err == nil {
+		t.Fatal("expected write error on closed socket")
+	}
+	if !reflect.DeepEqual(pending, []string{"BTCUSDT", "ETHUSDT"}) {
+		t.Fatalf("pending = %v", pending)
+	}
+	if connAlive(conn) {
+		t.Fatal("closed socket reported alive")
+	}
+	if err := g.subscribe(); err == nil {
+		t.Fatal("subscribe should fail without retrying on a broken socket")
+	}
+}
+
+func TestReconnectDoesNotLeakGoroutines(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.pingInterval = 5 * time.Millisecond
+
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		if err := g.connect(); err != nil {
+			t.Fatalf("connect %d: %v", i, err)
+		}
+		done := make(chan struct{})
+		go func() {
+			_ = g.readLoop()
+			close(done)
+		}()
+		time.Sleep(2 * time.Millisecond)
+		g.closeConn()
+		<-done
+	}
+
+	// Server-side handlers exit asynchronously once they see the close.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= baseline+2 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines = %d after reconnects, baseline %d", n, baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPingLoopSendsPing(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.pingInterval = 5 * time.Millisecond
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	fake.nextConn(t)
+	if op := fake.nextOp(t); op["op"] != "ping" {
+		t.Fatalf("op = %v, want ping", op)
+	}
+}
+
+func TestStopEndsRunLoop(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.Start()
+	fake.nextConn(t)
+
+	stopped := make(chan struct{})
+	go func() {
+		g.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+}
+
+func histogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestInterMessageGapResetsOnReconnect(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.cfg.PerSymbol = true
+	g.metrics = newGatewayMetrics("gap_test")
+	gap := interMsgGap.WithLabelValues("gap_test", "BTCUSDT")
+	tick := map[string]any{"topic": "tickers.BTCUSDT", "data": map[string]any{"s": "BTCUSDT"}}
+
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	errc := make(chan error, 1)
+	go func() { errc <- g.readLoop() }()
+	sendJSON(t, server, tick)
+	sendJSON(t, server, tick)
+	waitEvents(t, sink, 2)
+	if n := histogramCount(t, gap); n != 1 {
+		t.Fatalf("gap samples = %d, want 1", n)
+	}
+
+	_ = server.Close()
+	<-errc
+	g.closeConn()
+	if err := g.connect(); err != nil {
+		t.Fatalf("reconnect: %v", err)
+	}
+	server = fake.nextConn(t)
+	go func() { errc <- g.readLoop() }()
+	sendJSON(t, server, tick)
+	waitEvents(t, sink, 3)
+	if n := histogramCount(t, gap); n != 1 {
+		t.Fatalf("gap samples after reconnect = %d, want 1", n)
+	}
+}
+
+func TestControlMessagesAreNotPublished(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("control_test")
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	go g.readLoop()
+
+	sendJSON(t, server, map[string]any{"success": true, "ret_msg": "", "conn_id": "abc", "req_id": "", "op": "subscribe"})
+	sendJSON(t, server, map[string]any{"success": true, "ret_msg": "pong", "conn_id": "abc", "op": "ping"})
+	sendJSON(t, server, map[string]any{"topic": "tickers.BTCUSDT", "data": map[string]any{"s": "BTCUSDT"}})
+
+	// Frames are handled in order, so once the ticker is out the acks have
+	// been seen.
+	if evs := waitEvents(t, sink, 1); len(evs) != 1 || evs[0].Type != "tickers.BTCUSDT" {
+		t.Fatalf("published %+v, want only the ticker", evs)
+	}
+	if n := testutil.ToFloat64(g.metrics.controlMessages); n != 2 {
+		t.Fatalf("control messages = %v, want 2", n)
+	}
+}
+
+func TestConnectionGauges(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("gauges_test")
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	fake.nextConn(t)
+	if n := testutil.ToFloat64(g.metrics.activeConns); n != 1 {
+		t.Fatalf("active connections = %v, want 1", n)
+	}
+	if err := g.applySymbols([]string{"BTCUSDT", "ETHUSDT"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(g.metrics.subscribed); n != 2 {
+		t.Fatalf("subscribed symbols = %v, want 2", n)
+	}
+	g.closeConn()
+	g.closeConn()
+	if n := testutil.ToFloat64(g.metrics.activeConns); n != 0 {
+		t.Fatalf("active connections after close = %v, want 0", n)
+	}
+	if n := testutil.ToFloat64(g.metrics.subscribed); n != 0 {
+		t.Fatalf("subscribed symbols after close = %v, want 0", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sampleGoroutines(ctx)
+	if n := testutil.ToFloat64(goroutinesGauge); n < 1 {
+		t.Fatalf("goroutines = %v", n)
+	}
+}
+
+func TestStrictSymbols(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.cfg.StrictSymbols = true
+	g.allowed.Store(newSymbolSet(g.symbols))
+	g.metrics = newGatewayMetrics("strict_test")
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	go g.readLoop()
+
+	sendJSON(t, server, map[string]any{"topic": "tickers.ETHUSDT", "data": map[string]any{"s": "ETHUSDT"}})
+	sendJSON(t, server, map[string]any{"topic": "publicTrade.SOLUSDT", "data": []any{}})
+	sendJSON(t, server, map[string]any{"topic": "tickers.BTCUSDT", "data": map[string]any{"s": "BTCUSDT"}})
+	if evs := waitEvents(t, sink, 1); len(evs) != 1 || evs[0].Symbol != "BTCUSDT" {
+		t.Fatalf("published %+v, want only BTCUSDT", evs)
+	}
+	if n := testutil.ToFloat64(g.metrics.filteredSymbol); n != 2 {
+		t.Fatalf("filtered symbols = %v, want 2", n)
+	}
+
+	// A symbol added at runtime is let through.
+	if err := g.applySymbols([]string{"BTCUSDT", "ETHUSDT"}); err != nil {
+		t.Fatal(err)
+	}
+	sendJSON(t, server, map[string]any{"topic": "tickers.ETHUSDT", "data": map[string]any{"s": "ETHUSDT"}})
+	if evs := waitEvents(t, sink, 2); evs[1].Symbol != "ETHUSDT" {
+		t.Fatalf("published %+v, want ETHUSDT after adding it", evs)
+	}
+}
+
+func TestIncludeRaw(t *testing.T) {
+	frame := `{"topic":"tickers.BTCUSDT","type":"snapshot","data":{"s":"BTCUSDT","lastPrice":"1"}}`
+	for _, mode := range []string{includeRawJSON, includeRawBase64} {
+		fake := newFakeBybit(t)
+		g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+		g.cfg.IncludeRaw = mode
+		if err := g.connect(); err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+		server := fake.nextConn(t)
+		go g.readLoop()
+		if err := server.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		// A second frame reuses the read buffer; the first event's Raw must
+		// not change.
+		sendJSON(t, server, map[string]any{"topic": "tickers.BTCUSDT", "data": map[string]any{"s": "BTCUSDT", "lastPrice": "2"}})
+		ev := waitEvents(t, sink, 2)[0]
+		got, err := decodeRaw(ev.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != frame {
+			t.Fatalf("%s: raw = %s, want %s", mode, got, frame)
+		}
+		if mode == includeRawBase64 && ev.Raw[0] != '"' {
+			t.Fatalf("base64 raw = %s, want a JSON string", ev.Raw)
+		}
+	}
+
+	for v, want := range map[string]string{"": includeRawOff, "false": includeRawOff, "true": includeRawJSON, "base64": includeRawBase64} {
+		if got, err := parseIncludeRaw(v); err != nil || got != want {
+			t.Fatalf("parseIncludeRaw(%q) = %q, %v; want %q", v, got, err, want)
+		}
+	}
+	if _, err := parseIncludeRaw("gzip"); err == nil {
+		t.Fatal("expected error for unknown INCLUDE_RAW")
+	}
+}
+
+func TestExchangeTimestamps(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("exchange_ts_test")
+	g.cfg.TsFields = tsFields{"tickers": tsLocal}
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	go g.readLoop()
+
+	now := g.clock.Now().UnixMilli()
+	sendJSON(t, server, map[string]any{"topic": "orderbook.50.BTCUSDT", "ts": now - 5, "cts": now - 40, "data": map[string]any{"s": "BTCUSDT"}})
+	sendJSON(t, server, map[string]any{"topic": "publicTrade.BTCUSDT", "ts": now - 5, "data": []any{map[string]any{"T": now - 30}}})
+	sendJSON(t, server, map[string]any{"topic": "tickers.BTCUSDT", "ts": now - 5, "data": map[string]any{"s": "BTCUSDT"}})
+	sendJSON(t, server, map[string]any{"topic": "kline.1.BTCUSDT", "data": []any{}})
+	evs := waitEvents(t, sink, 4)
+	for i, want := range []int64{now - 40, now - 30, now, now} {
+		if evs[i].Ts != want {
+			t.Fatalf("%s ts = %d, want %d", evs[i].Type, evs[i].Ts, want)
+		}
+	}
+	if n := histogramCount(t, g.metrics.exchangeLatency.WithLabelValues(primaryConn, "orderbook")); n != 1 {
+		t.Fatalf("orderbook latency samples = %d, want 1", n)
+	}
+	if n := histogramCount(t, g.metrics.exchangeLatency.WithLabelValues(primaryConn, "tickers")); n != 0 {
+		t.Fatalf("local tickers latency samples = %d, want 0", n)
+	}
+	if n := histogramCount(t, g.metrics.engineLatency.WithLabelValues("orderbook")); n != 1 {
+		t.Fatalf("orderbook engine latency samples = %d, want 1", n)
+	}
+	if n := histogramCount(t, g.metrics.engineLatency.WithLabelValues("publicTrade")); n != 0 {
+		t.Fatalf("publicTrade engine latency samples = %d, want none without cts", n)
+	}
+
+	if got, err := parseTsFields("orderbook:ts, publicTrade:data.T"); err != nil || !reflect.DeepEqual(got, tsFields{"orderbook": "ts", "publicTrade": "data.T"}) {
+		t.Fatalf("parseTsFields = %v, %v", got, err)
+	}
+	for _, v := range []string{"orderbook", "orderbook:data.", "orderbook:ts,orderbook:cts", ":ts"} {
+		if _, err := parseTsFields(v); err == nil {
+			t.Fatalf("parseTsFields(%q): expected error", v)
+		}
+	}
+}
+
+func TestProcessLatency(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("process_latency_test")
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	go g.readLoop()
+
+	sendJSON(t, server, map[string]any{"topic": "tickers.BTCUSDT", "data": map[string]any{"s": "BTCUSDT"}})
+	sendJSON(t, server, map[string]any{"topic": "publicTrade.BTCUSDT", "data": []any{}})
+	waitEvents(t, sink, 2)
+	for _, kind := range []string{"tickers", "publicTrade"} {
+		if n := histogramCount(t, g.metrics.processLatency.WithLabelValues(kind)); n != 1 {
+			t.Fatalf("%s process latency samples = %d, want 1", kind, n)
+		}
+	}
+
+	// Events released later by a timer were not just read.
+	g.publish(OutEvent{Type: "tickers.BTCUSDT"})
+	if n := histogramCount(t, g.metrics.processLatency.WithLabelValues("tickers")); n != 1 {
+		t.Fatalf("samples after a timer publish = %d, want 1", n)
+	}
+}
+
+func TestTickerOnChange(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT", "ETHUSDT")
+	g.metrics = newGatewayMetrics("ticker_on_change_test")
+	g.cfg.TickerOnChange = true
+	g.cfg.TickerFields = defaultTickerFields
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	go g.readLoop()
+
+	ticker := func(symbol string, fields map[string]any) {
+		data := map[string]any{"symbol": symbol}
+		for k, v := range fields {
+			data[k] = v
+		}
+		sendJSON(t, server, map[string]any{"topic": "tickers." + symbol, "type": "snapshot", "data": data})
+	}
+	ticker("BTCUSDT", map[string]any{"lastPrice": "100", "bid1Price": "99", "volume24h": "1"})
+	ticker("BTCUSDT", map[string]any{"lastPrice": "100", "bid1Price": "99", "volume24h": "2"})
+	ticker("BTCUSDT", map[string]any{"volume24h": "3"})
+	ticker("ETHUSDT", map[string]any{"lastPrice": "100"})
+	ticker("BTCUSDT", map[string]any{"bid1Price": "98"})
+	sendJSON(t, server, map[string]any{"topic": "publicTrade.BTCUSDT", "data": []any{}})
+
+	evs := waitEvents(t, sink, 4)
+	var got []string
+	for _, ev := range evs {
+		got = append(got, ev.Type)
+	}
+	want := []string{"tickers.BTCUSDT", "tickers.ETHUSDT", "tickers.BTCUSDT", "publicTrade.BTCUSDT"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("published %v, want %v", got, want)
+	}
+	if n := testutil.ToFloat64(g.metrics.tickerSuppressed); n != 2 {
+		t.Fatalf("suppressed = %v, want 2", n)
+	}
+}
+
+func TestLastPublishAge(t *testing.T) {
+	g, _ := newTestGateway(t, "ws://unused", "BTCUSDT")
+	clock := g.clock.(*fakeClock)
+	if age := g.lastPublishAge(); !math.IsInf(age, 1) {
+		t.Fatalf("age before any publish = %v, want +Inf", age)
+	}
+	g.deliver(OutEvent{Symbol: "BTCUSDT"})
+	clock.Advance(5 * time.Second)
+	if age := g.lastPublishAge(); age != 5 {
+		t.Fatalf("age = %v, want 5", age)
+	}
+
+	v := newFuncGaugeVec("test_last_publish_age_seconds", "test", "instance", "sink")
+	v.set(g.lastPublishAge, "test", g.sink.Name())
+	if got := testutil.ToFloat64(v); got != 5 {
+		t.Fatalf("collected age = %v, want 5", got)
+	}
+}
+
+// countSink signals done once n events have been published.
+type countSink struct {
+	n    atomic.Int64
+	want int64
+	done chan struct{}
+}
+
+func (s *countSink) Name() string { return "count" }
+func (s *countSink) Close() error { return nil }
+func (s *countSink) Publish(context.Context, OutEvent) error {
+	if s.n.Add(1) == s.want {
+		close(s.done)
+	}
+	return nil
+}
+
+func BenchmarkReadLoop(b *testing.B) {
+	levels := make([]any, 25)
+	for i := range levels {
+		levels[i] = []any{fmt.Sprintf("%d.5", 42000+i), "1.25"}
+	}
+	frame, err := json.Marshal(map[string]any{
+		"topic": "orderbook.25.BTCUSDT", "type": "delta", "ts": 1700000000000,
+		"data": map[string]any{"s": "BTCUSDT", "b": levels, "a": levels, "u": 1, "seq": 1},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []int{0, 64 << 10} {
+		b.Run(fmt.Sprintf("read_buffer=%d", size), func(b *testing.B) {
+			fake := newFakeBybit(b)
+			g, _ := newTestGateway(b, fake.url(), "BTCUSDT")
+			g.dialer = newDialer(Config{WSReadBuffer: size})
+			sink := &countSink{want: int64(b.N), done: make(chan struct{})}
+			g.sink = sink
+			if err := g.connect(); err != nil {
+				b.Fatal(err)
+			}
+			server := fake.nextConn(b)
+			go g.readLoop()
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(frame)))
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if server.WriteMessage(websocket.TextMessage, frame) != nil {
+						return
+					}
+				}
+			}()
+			<-sink.done
+		})
+	}
+}
+
+// BenchmarkFrameMetrics compares the per-frame metric updates through the
+// vectors with the handles hotMetrics resolves at subscribe.
+func BenchmarkFrameMetrics(b *testing.B) {
+	m := newGatewayMetrics("bench_frame_metrics")
+	cfg := Config{Topics: []string{"orderbook.25", "tickers"}, PerSymbol: true}
+	b.Run("vectors", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m.exchangeLatency.WithLabelValues(primaryConn, "orderbook").Observe(1)
+			m.interMsgGap.WithLabelValues("BTCUSDT").Observe(1)
+			m.messages.WithLabelValues("ws").Inc()
+			m.emitted.WithLabelValues(payloadRaw).Inc()
+			m.processLatency.WithLabelValues("orderbook").Observe(1)
+		}
+	})
+	b.Run("resolved", func(b *testing.B) {
+		h := newHotMetrics(m, cfg, []string{"BTCUSDT"})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			h.exchangeLatency(0, "orderbook").Observe(1)
+			h.gap("BTCUSDT").Observe(1)
+			h.wsMessages.Inc()
+			h.emittedFor(payloadRaw).Inc()
+			h.kind("orderbook").processLatency.Observe(1)
+		}
+	})
+}
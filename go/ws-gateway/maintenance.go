@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/gorilla/websocket"
+)
+
+var errMaintenance = errors.New("venue maintenance")
+
+// isMaintenance reports whether a dial or read failure is Bybit's scheduled
+// maintenance signal: a 503 on the upgrade, a service-restart close, or a
+// close/error text mentioning maintenance.
+func isMaintenance(resp *http.Response, err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, errMaintenance) {
+		return true
+	}
+	if resp != nil && resp.StatusCode == http.StatusServiceUnavailable {
+		return true
+	}
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		if ce.Code == websocket.CloseServiceRestart {
+			return true
+		}
+		return hasMaintenanceMarker(ce.Text)
+	}
+	return hasMaintenanceMarker(err.Error())
+}
+
+func hasMaintenanceMarker(s string) bool {
+	return strings.Contains(strings.ToLower(s), "maintenance")
+}
+
+func newMaintenanceBackOff() *backoff.ExponentialBackOff {
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = time.Minute
+	bo.MaxInterval = 10 * time.Minute
+	bo.MaxElapsedTime = 0
+	return bo
+}
+
+func (g *Gateway) setMaintenance(on bool) {
+	g.mu.Lock()
+	g.maintenance = on
+	g.mu.Unlock()
+	if on {
+		g.metrics.maintenance.Set(1)
+	} else {
+		g.metrics.maintenance.Set(0)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIsMaintenance(t *testing.T) {
+	cases := []struct {
+		name string
+		resp *http.Response
+		err  error
+		want bool
+	}{
+		{"503 on upgrade", &http.Response{StatusCode: http.StatusServiceUnavailable}, websocket.ErrBadHandshake, true},
+		{"service restart close", nil, &websocket.CloseError{Code: websocket.CloseServiceRestart}, true},
+		{"maintenance text", nil, &websocket.CloseError{Code: websocket.CloseGoingAway, Text: "System Maintenance"}, true},
+		{"generic read error", nil, errors.New("i/o timeout"), false},
+		{"normal close", nil, &websocket.CloseError{Code: websocket.CloseNormalClosure}, false},
+	}
+	for _, tc := range cases {
+		if got := isMaintenance(tc.resp, tc.err); got != tc.want {
+			t.Errorf("%s: isMaintenance = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHealthzDuringMaintenance(t *testing.T) {
+	g, _ := newTestGateway(t, "")
+	g.setMaintenance(true)
+	defer g.setMaintenance(false)
+
+	rec := httptest.NewRecorder()
+	gatewaySet{g}.healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "maintenance") {
+		t.Fatalf("healthz = %d %s", rec.Code, rec.Body.String())
+	}
+
+	g.setMaintenance(false)
+	rec = httptest.NewRecorder()
+	gatewaySet{g}.healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("healthz = %d, want 503 when disconnected", rec.Code)
+	}
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Every metric carries an instance label so several gateways can share one
+// process and one /metrics endpoint.
+var (
+	upgradesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_reconnects_total",
+		Help: "Total reconnects to Bybit WS, by connection (0 for WS_URL, then REDUNDANT_ENDPOINTS in order)",
+	}, []string{"instance", "conn"})
+	messagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_messages_total",
+		Help: "Total messages processed",
+	}, []string{"instance", "type"})
+	drainIgnoredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_drain_ignored_total",
+		Help: "Frames and events ignored because the instance was drained (POST /drain)",
+	}, []string{"instance"})
+	raceWinsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_redundant_first_total",
+		Help: "Frames delivered first by each REDUNDANT_ENDPOINTS leg (primary or backup); later copies are dropped",
+	}, []string{"instance", "leg"})
+	schemaInvalidTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_schema_invalid_total",
+		Help: "Events dropped by VALIDATE_OUTPUT for not matching outevent.schema.json",
+	}, []string{"instance"})
+	emittedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_emitted_total",
+		Help: "Venue events handed to the publish path, by payload stream (raw or normalized)",
+	}, []string{"instance", "stream"})
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_errors_total",
+		Help: "Total errors",
+	}, []string{"instance"})
+	unmarshalErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_unmarshal_errors_total",
+		Help: "Frames that aren't valid JSON, by the topic kind they appear to be (control, unknown)",
+	}, []string{"instance", "type_guess"})
+	readLimitExceededTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_read_limit_exceeded_total",
+		Help: "Frames larger than the read limit, each failing its connection",
+	}, []string{"instance"})
+	connectedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_connected",
+		Help: "WS connection state (1 connected), by connection (0 for WS_URL, then REDUNDANT_ENDPOINTS in order)",
+	}, []string{"instance", "conn"})
+	subscribeRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_subscribe_retries_total",
+		Help: "Subscribe retries on a live connection after a partial failure",
+	}, []string{"instance"})
+	connLimitHitsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_conn_limit_hits_total",
+		Help: "Times Bybit rejected or closed a connection for exceeding connection limits",
+	}, []string{"instance"})
+	maintenanceGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_maintenance",
+		Help: "1 while the venue is signalling scheduled maintenance",
+	}, []string{"instance"})
+	publishQueueLen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_publish_queue_len",
+		Help: "Events waiting in the in-memory publish buffer",
+	}, []string{"instance"})
+	publishBlockedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_publish_blocked_total",
+		Help: "Enqueues that had to wait for buffer space (BACKPRESSURE=block)",
+	}, []string{"instance"})
+	publishDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_publish_dropped_total",
+		Help: "Events dropped because the publish buffer was full, by which end was dropped",
+	}, []string{"instance", "reason"})
+	publishSpilledTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_publish_spilled_total",
+		Help: "Events written to the disk spill file (BACKPRESSURE=spill)",
+	}, []string{"instance"})
+	publishSpillPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_publish_spill_pending",
+		Help: "Events in the spill file not yet delivered",
+	}, []string{"instance"})
+	filteredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_filtered_total",
+		Help: "Events dropped by the FILTER expression",
+	}, []string{"instance"})
+	planVersionGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_subscription_plan_version",
+		Help: "Version of the SUBSCRIPTION_PLAN_KEY plan last applied",
+	}, []string{"instance"})
+	captureDumpsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_capture_dumps_total",
+		Help: "CAPTURE_RING_SIZE frame rings dumped, by the gap that triggered them",
+	}, []string{"instance", "reason"})
+	staleSymbolsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_stale_symbols",
+		Help: "Subscribed symbols without data for DEADMAN_TIMEOUT",
+	}, []string{"instance"})
+	staleMarkersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_stale_markers_total",
+		Help: "Stale markers published for symbols going DEADMAN_TIMEOUT without data",
+	}, []string{"instance"})
+	deadmanDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_deadman_dropped_total",
+		Help: "Events of stale symbols dropped with DEADMAN_HALT",
+	}, []string{"instance"})
+	sampledTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_sampled_total",
+		Help: "Events dropped by the sampler processor (SAMPLE_EVERY)",
+	}, []string{"instance"})
+	inboundShedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_inbound_shed_total",
+		Help: "Data frames dropped over MAX_INBOUND_MSGS_PER_SEC, by topic kind",
+	}, []string{"instance", "kind"})
+	tsClampedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_ts_clamped_total",
+		Help: "Events whose ts MONOTONIC_TS raised to keep it from going backward",
+	}, []string{"instance"})
+	unknownTopicTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_unknown_topic_messages_total",
+		Help: "Frames of a topic kind the gateway has no handling for, by kind",
+	}, []string{"instance", "kind"})
+	filteredSymbolTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_filtered_symbol_total",
+		Help: "Inbound messages dropped for a symbol outside the subscribed set (STRICT_SYMBOLS)",
+	}, []string{"instance"})
+	invalidSymbolsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_invalid_symbols",
+		Help: "Configured symbols the last SYMBOL_VALIDATION check found not trading",
+	}, []string{"instance"})
+	interMsgGap = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_gateway_intermsg_gap_ms",
+		Help:    "Wall-clock gap between consecutive data messages for a symbol on one connection (PER_SYMBOL_METRICS)",
+		Buckets: []float64{1, 5, 10, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000},
+	}, []string{"instance", "symbol"})
+	exchangeLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_gateway_exchange_latency_ms",
+		Help:    "Time from the exchange timestamp of a data message (TS_FIELDS) to its receipt, by connection and topic kind",
+		Buckets: []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000},
+	}, []string{"instance", "conn", "kind"})
+	engineLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_gateway_engine_to_gateway_ms",
+		Help:    "Time from the matching engine timestamp (cts) of a data message to its receipt, by topic kind; kinds without cts are not observed",
+		Buckets: []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000},
+	}, []string{"instance", "kind"})
+	rttHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_gateway_ws_rtt_ms",
+		Help:    "Round trip of a WS ping to its pong, by connection (RTT_METRICS)",
+		Buckets: []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000},
+	}, []string{"instance", "conn"})
+	rttLastGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_ws_rtt_last_ms",
+		Help: "Latest WS ping round trip, by connection (RTT_METRICS)",
+	}, []string{"instance", "conn"})
+	subscribeAckLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_gateway_subscribe_ack_latency_ms",
+		Help:    "Time from sending a subscribe op to the exchange's ack for its req_id",
+		Buckets: []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000},
+	}, []string{"instance"})
+	subscribeAckTimeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_subscribe_ack_timeouts_total",
+		Help: "Topics whose subscribe op got no ack within SUBSCRIBE_ACK_TIMEOUT",
+	}, []string{"instance"})
+	processLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_gateway_process_latency_ms",
+		Help:    "Time from reading a frame to handing its event to the publish queue or sink: parse, normalize and filter, by topic kind",
+		Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50},
+	}, []string{"instance", "kind"})
+	sinkTimeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_sink_write_timeouts_total",
+		Help: "Sink publishes that failed because SINK_WRITE_TIMEOUT expired; also counted in ws_gateway_errors_total",
+	}, []string{"instance", "sink"})
+	ingestMalformedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_ingest_malformed_total",
+		Help: "POST /ingest lines that were not a valid event",
+	}, []string{"instance"})
+	depthBytesSavedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_publish_depth_bytes_saved_total",
+		Help: "Approximate JSON bytes of order book levels dropped by PUBLISH_DEPTH",
+	}, []string{"instance"})
+	tickerSuppressedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_ticker_suppressed_total",
+		Help: "Ticker messages dropped by TICKER_ON_CHANGE because no watched field changed",
+	}, []string{"instance"})
+	tickerMergeDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_ticker_merge_dropped_total",
+		Help: "Ticker deltas dropped by TICKER_MERGE for arriving before their symbol's snapshot",
+	}, []string{"instance"})
+	klineGapsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_kline_gap_total",
+		Help: "Gaps found between consecutive confirmed kline candles of a topic",
+	}, []string{"instance"})
+	klineBackfilledTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_kline_backfilled_total",
+		Help: "Candles published from KLINE_BACKFILL_URL to fill kline gaps",
+	}, []string{"instance"})
+	klineUnfilledTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_kline_backfill_unfilled_total",
+		Help: "Kline gaps KLINE_BACKFILL_URL left unfilled, by reason: queue_full, or truncated where the gap outran the REST limit",
+	}, []string{"instance", "reason"})
+	remoteWritesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_remote_writes_total",
+		Help: "REMOTE_WRITE_URL pushes of ticker samples, by result: ok or error",
+	}, []string{"instance", "result"})
+	tickerSnapshotsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_ticker_snapshots_total",
+		Help: "TICKER_SNAPSHOT_URL outcomes: snapshots published, superseded by a WS ticker or failed, and WS tickers dropped as older",
+	}, []string{"instance", "result"})
+	phaseTimeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_connect_phase_timeouts_total",
+		Help: "WS dials that timed out, by phase: connect (CONNECT_TIMEOUT) or handshake (HANDSHAKE_TIMEOUT)",
+	}, []string{"instance", "phase"})
+	messageBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_gateway_message_bytes",
+		Help:    "Size of frames read from the WS connection",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+	}, []string{"instance"})
+	controlMessagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_control_messages_total",
+		Help: "Frames without a topic, such as subscribe acks and pongs, which are not published",
+	}, []string{"instance"})
+	routeEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_route_events_total",
+		Help: "Events delivered per SINK_ROUTES route and sink",
+	}, []string{"instance", "route", "sink"})
+	routeErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_route_errors_total",
+		Help: "Failed deliveries per SINK_ROUTES route and sink",
+	}, []string{"instance", "route", "sink"})
+	duplicateSubsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_duplicate_subscription_total",
+		Help: "Topics already delivered by another instance's connection to the same WS endpoint, once per connection",
+	}, []string{"instance"})
+	stateEvictionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_symbol_state_evictions_total",
+		Help: "Per-symbol state entries evicted at SYMBOL_STATE_CAPACITY, by kind of state",
+	}, []string{"instance", "state"})
+	forcedReconnectsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_forced_reconnects_total",
+		Help: "Connections closed by the gateway itself to reconnect, by reason",
+	}, []string{"instance", "reason"})
+	migrationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_connection_migrations_total",
+		Help: "CONNECTION_MIGRATION attempts after the WS host's address changed, by result",
+	}, []string{"instance", "result"})
+	migrationDuplicatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_migration_duplicates_total",
+		Help: "Frames dropped during a CONNECTION_MIGRATION handover because the other connection delivered them first",
+	}, []string{"instance"})
+	watchdogStallsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_watchdog_stalls_total",
+		Help: "Reconnects forced because a connection read nothing for WATCHDOG_TIMEOUT",
+	}, []string{"instance"})
+	shadowErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_shadow_errors_total",
+		Help: "Events the SHADOW_SINK failed to publish or dropped because its buffer was full",
+	}, []string{"instance"})
+	shadowLag = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_gateway_shadow_lag_seconds",
+		Help:    "Time from the primary publish of an event to its SHADOW_SINK publish",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 4, 9),
+	}, []string{"instance"})
+	kafkaDRErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_kafka_dr_errors_total",
+		Help: "Events the KAFKA_DR_BROKERS cluster failed to take or dropped because KAFKA_DR_BUFFER was full",
+	}, []string{"instance"})
+	kafkaDRLag = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_gateway_kafka_dr_lag_seconds",
+		Help:    "Time from the primary Kafka publish of an event to its DR cluster write",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 4, 9),
+	}, []string{"instance"})
+	kafkaDRPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_kafka_dr_pending",
+		Help: "Events buffered for the DR cluster",
+	}, []string{"instance"})
+	kafkaDRUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_kafka_dr_up",
+		Help: "1 if the last write to the DR cluster succeeded, 0 if it failed",
+	}, []string{"instance"})
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_active_connections",
+		Help: "Open WS connections",
+	}, []string{"instance"})
+	subscribedSymbols = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_subscribed_symbols",
+		Help: "Symbols subscribed on the live connection; 0 while disconnected",
+	}, []string{"instance"})
+	bookImbalanceGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_book_imbalance",
+		Help: "Top IMBALANCE_DEPTH level order book imbalance, -1 (all asks) to 1 (all bids) (PER_SYMBOL_METRICS)",
+	}, []string{"instance", "symbol"})
+	buyVolumeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_buy_volume",
+		Help: "Taker buy volume of the latest complete FLOW_INTERVAL (PER_SYMBOL_METRICS)",
+	}, []string{"instance", "symbol"})
+	sellVolumeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_sell_volume",
+		Help: "Taker sell volume of the latest complete FLOW_INTERVAL (PER_SYMBOL_METRICS)",
+	}, []string{"instance", "symbol"})
+	rollingVolGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_gateway_rolling_vol",
+		Help: "Standard deviation of VOL_SAMPLE log returns over VOL_WINDOW (PER_SYMBOL_METRICS)",
+	}, []string{"instance", "symbol"})
+	oversizeTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_oversize_total",
+		Help: "Events over MAX_OUTBOUND_BYTES, by result: split or dropped",
+	}, []string{"instance", "result"})
+	teeDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_tee_dropped_total",
+		Help: "Events a slow /debug/tee client missed",
+	}, []string{"instance"})
+	deadLetteredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_gateway_dead_lettered_total",
+		Help: "Events written to the dead-letter destination after their last publish attempt, by reason",
+	}, []string{"instance", "reason"})
+	kafkaBatchFill = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_gateway_kafka_batch_fill_ratio",
+		Help:    "Messages per Kafka write batch as a fraction of KAFKA_BATCH_SIZE",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 0.9, 1},
+	}, []string{"instance"})
+	recordBatchEvents = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_gateway_record_batch_events",
+		Help:    "Events per sink record written with RECORD_BATCH_SIZE",
+		Buckets: []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000},
+	}, []string{"instance"})
+)
+
+// goroutinesGauge is process-wide, sampled by sampleGoroutines.
+var goroutinesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ws_gateway_goroutines",
+	Help: "Goroutines in the process, sampled every 10s",
+})
+
+// inboundRateGauge is process-wide, like MAX_INBOUND_MSGS_PER_SEC, and set
+// only while it is.
+var inboundRateGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ws_gateway_inbound_rate",
+	Help: "Data frames read across the process in the last full second (MAX_INBOUND_MSGS_PER_SEC)",
+})
+
+// adminAuthFailuresTotal is process-wide, like the HTTP server.
+var adminAuthFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ws_gateway_admin_auth_failures_total",
+	Help: "HTTP requests refused for missing or invalid ADMIN_TOKEN or ADMIN_USER credentials",
+})
+
+const goroutineSampleInterval = 10 * time.Second
+
+// sampleGoroutines updates goroutinesGauge on a timer, so leaks after many
+// reconnects show up without counting on every event.
+func sampleGoroutines(ctx context.Context) {
+	t := time.NewTicker(goroutineSampleInterval)
+	defer t.Stop()
+	for {
+		goroutinesGauge.Set(float64(runtime.NumGoroutine()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// lastPublishAge is computed at scrape time from each gateway's last
+// successful publish.
+var lastPublishAge = newFuncGaugeVec("ws_gateway_last_publish_age_seconds",
+	"Seconds since the last successful sink publish; +Inf until the first one", "instance", "sink")
+
+var gatewayCollectors = []prometheus.Collector{
+	upgradesTotal, messagesTotal, emittedTotal, drainIgnoredTotal, raceWinsTotal, schemaInvalidTotal, errorsTotal, unmarshalErrorsTotal, readLimitExceededTotal, connectedGauge, subscribeRetriesTotal,
+	connLimitHitsTotal, maintenanceGauge, phaseTimeoutsTotal, tickerSuppressedTotal, tickerMergeDroppedTotal, tickerSnapshotsTotal, remoteWritesTotal,
+	klineGapsTotal, klineBackfilledTotal, klineUnfilledTotal,
+	publishQueueLen, publishBlockedTotal, publishDroppedTotal, publishSpilledTotal, publishSpillPending,
+	filteredTotal, interMsgGap, exchangeLatency, engineLatency, rttHistogram, rttLastGauge, processLatency, lastPrices, kafkaBatchFill, recordBatchEvents,
+	controlMessagesTotal, lastPublishAge, messageBytes, routeEventsTotal, routeErrorsTotal,
+	duplicateSubsTotal, subscribeAckLatency, subscribeAckTimeoutsTotal, stateEvictionsTotal, forcedReconnectsTotal, migrationsTotal, migrationDuplicatesTotal, watchdogStallsTotal, filteredSymbolTotal, invalidSymbolsGauge, unknownTopicTotal, tsClampedTotal, captureDumpsTotal, inboundShedTotal, sampledTotal, staleSymbolsGauge, staleMarkersTotal, deadmanDroppedTotal, planVersionGauge, shadowErrorsTotal, shadowLag,
+	kafkaDRErrorsTotal, kafkaDRLag, kafkaDRPending, kafkaDRUp,
+	activeConnections, subscribedSymbols, goroutinesGauge, inboundRateGauge, adminAuthFailuresTotal, bookImbalanceGauge, buyVolumeGauge, sellVolumeGauge, rollingVolGauge,
+	teeDroppedTotal, deadLetteredTotal, oversizeTotal, depthBytesSavedTotal, ingestMalformedTotal,
+	sinkTimeoutsTotal,
+}
+
+// newMetricsRegistry registers the gateway metrics, prefixed with namespace
+// when set, alongside the Go and process collectors. constLabels are added
+// to every series, runtime ones included.
+func newMetricsRegistry(namespace string, constLabels map[string]string) (*prometheus.Registry, error) {
+	reg := prometheus.NewRegistry()
+	var labelled prometheus.Registerer = reg
+	if len(constLabels) > 0 {
+		labelled = prometheus.WrapRegistererWith(constLabels, reg)
+	}
+	own := labelled
+	if namespace != "" {
+		own = prometheus.WrapRegistererWithPrefix(namespace+"_", labelled)
+	}
+	std := []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	}
+	for _, c := range std {
+		if err := labelled.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range gatewayCollectors {
+		if err := own.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
+}
+
+// gatewayMetrics holds one instance's children of the metric vectors,
+// resolved once so hot paths skip the label lookup.
+type gatewayMetrics struct {
+	reconnects       *prometheus.CounterVec
+	messages         *prometheus.CounterVec
+	emitted          *prometheus.CounterVec
+	drainIgnored     prometheus.Counter
+	schemaInvalid    prometheus.Counter
+	raceWins         *prometheus.CounterVec
+	errors           prometheus.Counter
+	connected        *prometheus.GaugeVec
+	subscribeRetries prometheus.Counter
+	connLimitHits    prometheus.Counter
+	maintenance      prometheus.Gauge
+	queueLen         prometheus.Gauge
+	publishBlocked   prometheus.Counter
+	publishDropped   *prometheus.CounterVec
+	publishSpilled   prometheus.Counter
+	spillPending     prometheus.Gauge
+	filtered         prometheus.Counter
+	interMsgGap      prometheus.ObserverVec
+	exchangeLatency  prometheus.ObserverVec
+	engineLatency    prometheus.ObserverVec
+	rtt              prometheus.ObserverVec
+	rttLast          *prometheus.GaugeVec
+	processLatency   prometheus.ObserverVec
+	phaseTimeouts    *prometheus.CounterVec
+	tickerSuppressed prometheus.Counter
+	tickerSnapshots  *prometheus.CounterVec
+	remoteWrites     *prometheus.CounterVec
+	tickerUnmerged   prometheus.Counter
+	klineGaps        prometheus.Counter
+	klineBackfilled  prometheus.Counter
+	klineUnfilled    *prometheus.CounterVec
+	depthBytesSaved  prometheus.Counter
+	ingestMalformed  prometheus.Counter
+	sinkTimeouts     *prometheus.CounterVec
+	kafkaBatchFill   prometheus.Observer
+	recordBatch      prometheus.Observer
+	controlMessages  prometheus.Counter
+	messageBytes     prometheus.Observer
+	routeEvents      *prometheus.CounterVec
+	routeErrors      *prometheus.CounterVec
+	duplicateSubs    prometheus.Counter
+	watchdogStalls   prometheus.Counter
+	forcedReconnects *prometheus.CounterVec
+	migrations       *prometheus.CounterVec
+	migrationDups    prometheus.Counter
+	stateEvictions   *prometheus.CounterVec
+	ackLatency       prometheus.Observer
+	ackTimeouts      prometheus.Counter
+	filteredSymbol   prometheus.Counter
+	invalidSymbols   prometheus.Gauge
+	unknownTopics    *prometheus.CounterVec
+	unmarshalErrors  *prometheus.CounterVec
+	readLimitHits    prometheus.Counter
+	tsClamped        prometheus.Counter
+	captureDumps     *prometheus.CounterVec
+	inboundShed      *prometheus.CounterVec
+	sampled          prometheus.Counter
+	staleSymbols     prometheus.Gauge
+	staleMarkers     prometheus.Counter
+	deadmanDropped   prometheus.Counter
+	planVersion      prometheus.Gauge
+	shadowErrors     prometheus.Counter
+	shadowLag        prometheus.Observer
+	kafkaDRErrors    prometheus.Counter
+	kafkaDRLag       prometheus.Observer
+	kafkaDRPending   prometheus.Gauge
+	kafkaDRUp        prometheus.Gauge
+	activeConns      prometheus.Gauge
+	subscribed       prometheus.Gauge
+	imbalance        *prometheus.GaugeVec
+	buyVolume        *prometheus.GaugeVec
+	sellVolume       *prometheus.GaugeVec
+	oversize         *prometheus.CounterVec
+	rollingVol       *prometheus.GaugeVec
+	teeDropped       prometheus.Counter
+	deadLettered     *prometheus.CounterVec
+}
+
+func newGatewayMetrics(instance string) *gatewayMetrics {
+	l := prometheus.Labels{"instance": instance}
+	return &gatewayMetrics{
+		reconnects:       upgradesTotal.MustCurryWith(l),
+		messages:         messagesTotal.MustCurryWith(l),
+		emitted:          emittedTotal.MustCurryWith(l),
+		drainIgnored:     drainIgnoredTotal.With(l),
+		schemaInvalid:    schemaInvalidTotal.With(l),
+		raceWins:         raceWinsTotal.MustCurryWith(l),
+		errors:           errorsTotal.With(l),
+		connected:        connectedGauge.MustCurryWith(l),
+		subscribeRetries: subscribeRetriesTotal.With(l),
+		connLimitHits:    connLimitHitsTotal.With(l),
+		maintenance:      maintenanceGauge.With(l),
+		queueLen:         publishQueueLen.With(l),
+		publishBlocked:   publishBlockedTotal.With(l),
+		publishDropped:   publishDroppedTotal.MustCurryWith(l),
+		publishSpilled:   publishSpilledTotal.With(l),
+		spillPending:     publishSpillPending.With(l),
+		filtered:         filteredTotal.With(l),
+		interMsgGap:      interMsgGap.MustCurryWith(l),
+		exchangeLatency:  exchangeLatency.MustCurryWith(l),
+		engineLatency:    engineLatency.MustCurryWith(l),
+		rtt:              rttHistogram.MustCurryWith(l),
+		rttLast:          rttLastGauge.MustCurryWith(l),
+		processLatency:   processLatency.MustCurryWith(l),
+		phaseTimeouts:    phaseTimeoutsTotal.MustCurryWith(l),
+		tickerSuppressed: tickerSuppressedTotal.With(l),
+		tickerSnapshots:  tickerSnapshotsTotal.MustCurryWith(l),
+		remoteWrites:     remoteWritesTotal.MustCurryWith(l),
+		tickerUnmerged:   tickerMergeDroppedTotal.With(l),
+		klineGaps:        klineGapsTotal.With(l),
+		klineBackfilled:  klineBackfilledTotal.With(l),
+		klineUnfilled:    klineUnfilledTotal.MustCurryWith(l),
+		depthBytesSaved:  depthBytesSavedTotal.With(l),
+		ingestMalformed:  ingestMalformedTotal.With(l),
+		sinkTimeouts:     sinkTimeoutsTotal.MustCurryWith(l),
+		kafkaBatchFill:   kafkaBatchFill.With(l),
+		recordBatch:      recordBatchEvents.With(l),
+		controlMessages:  controlMessagesTotal.With(l),
+		messageBytes:     messageBytes.With(l),
+		routeEvents:      routeEventsTotal.MustCurryWith(l),
+		routeErrors:      routeErrorsTotal.MustCurryWith(l),
+		duplicateSubs:    duplicateSubsTotal.With(l),
+		watchdogStalls:   watchdogStallsTotal.With(l),
+		forcedReconnects: forcedReconnectsTotal.MustCurryWith(l),
+		migrations:       migrationsTotal.MustCurryWith(l),
+		migrationDups:    migrationDuplicatesTotal.With(l),
+		stateEvictions:   stateEvictionsTotal.MustCurryWith(l),
+		ackLatency:       subscribeAckLatency.With(l),
+		ackTimeouts:      subscribeAckTimeoutsTotal.With(l),
+		filteredSymbol:   filteredSymbolTotal.With(l),
+		invalidSymbols:   invalidSymbolsGauge.With(l),
+		unknownTopics:    unknownTopicTotal.MustCurryWith(l),
+		unmarshalErrors:  unmarshalErrorsTotal.MustCurryWith(l),
+		readLimitHits:    readLimitExceededTotal.With(l),
+		tsClamped:        tsClampedTotal.With(l),
+		captureDumps:     captureDumpsTotal.MustCurryWith(l),
+		inboundShed:      inboundShedTotal.MustCurryWith(l),
+		sampled:          sampledTotal.With(l),
+		staleSymbols:     staleSymbolsGauge.With(l),
+		staleMarkers:     staleMarkersTotal.With(l),
+		deadmanDropped:   deadmanDroppedTotal.With(l),
+		planVersion:      planVersionGauge.With(l),
+		shadowErrors:     shadowErrorsTotal.With(l),
+		shadowLag:        shadowLag.With(l),
+		kafkaDRErrors:    kafkaDRErrorsTotal.With(l),
+		kafkaDRLag:       kafkaDRLag.With(l),
+		kafkaDRPending:   kafkaDRPending.With(l),
+		kafkaDRUp:        kafkaDRUp.With(l),
+		activeConns:      activeConnections.With(l),
+		subscribed:       subscribedSymbols.With(l),
+		imbalance:        bookImbalanceGauge.MustCurryWith(l),
+		buyVolume:        buyVolumeGauge.MustCurryWith(l),
+		sellVolume:       sellVolumeGauge.MustCurryWith(l),
+		oversize:         oversizeTotal.MustCurryWith(l),
+		rollingVol:       rollingVolGauge.MustCurryWith(l),
+		teeDropped:       teeDroppedTotal.With(l),
+		deadLettered:     deadLetteredTotal.MustCurryWith(l),
+	}
+}
+
+// funcGaugeVec is a gauge vector whose values are read from callbacks when
+// scraped, for values such as ages that a plain gauge would only update on
+// events.
+type funcGaugeVec struct {
+	desc *prometheus.Desc
+
+	mu  sync.Mutex
+	fns map[string]funcGauge
+}
+
+type funcGauge struct {
+	labels []string
+	fn     func() float64
+}
+
+func newFuncGaugeVec(name, help string, labels ...string) *funcGaugeVec {
+	return &funcGaugeVec{
+		desc: prometheus.NewDesc(name, help, labels, nil),
+		fns:  make(map[string]funcGauge),
+	}
+}
+
+// set installs or replaces fn as the value for labels.
+func (v *funcGaugeVec) set(fn func() float64, labels ...string) {
+	v.mu.Lock()
+	v.fns[strings.Join(labels, "\x00")] = funcGauge{labels: labels, fn: fn}
+	v.mu.Unlock()
+}
+
+func (v *funcGaugeVec) Describe(ch chan<- *prometheus.Desc) { ch <- v.desc }
+
+func (v *funcGaugeVec) Collect(ch chan<- prometheus.Metric) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, g := range v.fns {
+		ch <- prometheus.MustNewConstMetric(v.desc, prometheus.GaugeValue, g.fn(), g.labels...)
+	}
+}
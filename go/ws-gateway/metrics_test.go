@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsRegistryNamespaceAndConstLabels(t *testing.T) {
+	reg, err := newMetricsRegistry("mm", map[string]string{"region": "eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMetrics.errors.Add(0)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			region := ""
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "region" {
+					region = lp.GetValue()
+				}
+			}
+			if region != "eu" {
+				t.Fatalf("%s missing region label", mf.GetName())
+			}
+		}
+		found[mf.GetName()] = true
+	}
+	for _, name := range []string{"mm_ws_gateway_errors_total", "go_goroutines"} {
+		if !found[name] {
+			t.Errorf("%s not exported", name)
+		}
+	}
+	if found["ws_gateway_errors_total"] {
+		t.Error("unprefixed gateway metric exported")
+	}
+}
+
+func TestMetricsRegistryRejectsBadOptions(t *testing.T) {
+	if _, err := newMetricsRegistry("bad-ns", nil); err == nil {
+		t.Error("invalid namespace accepted")
+	}
+	if _, err := newMetricsRegistry("", map[string]string{"instance": "x"}); err == nil {
+		t.Error("const label clashing with instance accepted")
+	}
+}
+
+func TestHotMetrics(t *testing.T) {
+	m := newGatewayMetrics("hot_metrics")
+	h := newHotMetrics(m, Config{Topics: []string{"tickers"}, PerSymbol: true}, []string{"BTCUSDT"})
+	h.wsMessages.Inc()
+	h.emittedFor(payloadNormalized).Inc()
+	// Neither is resolved up front.
+	h.emittedFor("other").Inc()
+	h.kind("publicTrade").processLatency.Observe(1)
+	h.kind("tickers").processLatency.Observe(1)
+	h.gap("ETHUSDT").Observe(1)
+	if got := testutil.ToFloat64(m.messages.WithLabelValues("ws")); got != 1 {
+		t.Fatalf("messages{ws} = %v", got)
+	}
+	for _, stream := range []string{payloadNormalized, "other"} {
+		if got := testutil.ToFloat64(m.emitted.WithLabelValues(stream)); got != 1 {
+			t.Fatalf("emitted{%s} = %v", stream, got)
+		}
+	}
+	for _, kind := range []string{"publicTrade", "tickers"} {
+		if n := histogramCount(t, m.processLatency.WithLabelValues(kind)); n != 1 {
+			t.Fatalf("process latency{%s} count = %d", kind, n)
+		}
+	}
+	if n := histogramCount(t, m.interMsgGap.WithLabelValues("ETHUSDT")); n != 1 {
+		t.Fatalf("gap{ETHUSDT} count = %d", n)
+	}
+}
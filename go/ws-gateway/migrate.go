@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	migrationMigrated = "migrated"
+	migrationFailed   = "failed"
+	migrationSameAddr = "same_address"
+
+	// migrationConfirmTimeout bounds how long a migration waits for the new
+	// connection's first data frame.
+	migrationConfirmTimeout = 10 * time.Second
+	migrationLookupTimeout  = 5 * time.Second
+	// migrationHandover is how long after a migration frames are still
+	// checked against those the old connection delivered, enough for the
+	// new one's backlog.
+	migrationHandover = 10 * time.Second
+)
+
+// migration is a subscribed connection ready to replace from, with the
+// frames it has read so far.
+type migration struct {
+	from, conn *websocket.Conn
+	pending    [][]byte
+}
+
+// watchEndpoint re-resolves the WS host every interval and, once the live
+// connection's address is no longer among the host's, migrates it.
+func (g *Gateway) watchEndpoint(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-t.C:
+		}
+		g.mu.Lock()
+		conn := g.reading
+		g.mu.Unlock()
+		if conn == nil {
+			continue
+		}
+		moved, err := g.endpointMoved(conn)
+		if err != nil {
+			log.Printf("instance=%s migration_lookup_error err=%v", g.cfg.Instance, err)
+			continue
+		}
+		if !moved {
+			continue
+		}
+		if err := g.migrate(conn); err != nil {
+			g.metrics.migrations.WithLabelValues(migrationFailed).Inc()
+			log.Printf("instance=%s migration_error err=%v", g.cfg.Instance, err)
+		}
+	}
+}
+
+// endpointMoved reports whether conn's remote address is no longer one the
+// WS host resolves to. A host given as an IP never moves.
+func (g *Gateway) endpointMoved(conn *websocket.Conn) (bool, error) {
+	u, err := url.Parse(g.wsURL)
+	if err != nil {
+		return false, err
+	}
+	host := u.Hostname()
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if net.ParseIP(host) != nil || !ok {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(g.ctx, migrationLookupTimeout)
+	defer cancel()
+	addrs, err := g.lookupHost(ctx, host)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.Equal(remote.IP) {
+			return false, nil
+		}
+	}
+	log.Printf("instance=%s endpoint_moved host=%s from=%s to=%v", g.cfg.Instance, host, remote.IP, addrs)
+	return true, nil
+}
+
+// migrate makes before it breaks: it dials WS_URL again, subscribes the
+// new connection and waits for its first data frame, and only then closes
+// from, leaving readLoop to carry on with the new one. From the subscribe
+// until migrationHandover after the switch, frames of either connection
+// are deduplicated as in the REDUNDANT_ENDPOINTS race, so the overlap is
+// published once.
+func (g *Gateway) migrate(from *websocket.Conn) error {
+	if err := acquireConnSlot(g.ctx); err != nil {
+		return err
+	}
+	conn, _, err := g.dialer.Dial(g.wsURL, nil)
+	if err != nil {
+		releaseConnSlot()
+		return dialPhaseError(err)
+	}
+	handed := false
+	defer func() {
+		if !handed {
+			_ = conn.Close()
+			releaseConnSlot()
+		}
+	}()
+	if conn.RemoteAddr().String() == from.RemoteAddr().String() {
+		// The resolver still handed out the old address.
+		g.metrics.migrations.WithLabelValues(migrationSameAddr).Inc()
+		return nil
+	}
+	h := newEndpointRace(stateLimit{g.cfg.SymbolState, g.metrics.stateEvictions.WithLabelValues("migration")})
+	g.handover.Store(h)
+	defer func() {
+		if !handed {
+			g.handover.CompareAndSwap(h, nil)
+		}
+	}()
+
+	g.mu.Lock()
+	symbols := prioritize(g.symbols, g.cfg.SymbolPriority)
+	g.mu.Unlock()
+	for _, s := range symbols {
+		// Acks for these carry no req_id, so they leave the
+		// subscription status alone.
+		if err := g.sendBackupOp(conn, "subscribe", g.topicsFor(s)); err != nil {
+			return err
+		}
+		if !g.sleep(100 * time.Millisecond) {
+			return g.ctx.Err()
+		}
+	}
+	var pending [][]byte
+	if len(symbols) > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(migrationConfirmTimeout))
+		var frame bytes.Buffer
+		for {
+			message, err := readFrame(conn, &frame)
+			if err != nil {
+				return fmt.Errorf("no data on new connection: %w", err)
+			}
+			pending = append(pending, bytes.Clone(message))
+			var f struct {
+				Topic string `json:"topic"`
+			}
+			if json.Unmarshal(message, &f) == nil && f.Topic != "" {
+				break
+			}
+		}
+	}
+
+	g.mu.Lock()
+	if g.reading != from {
+		g.mu.Unlock()
+		return fmt.Errorf("connection replaced while migrating")
+	}
+	g.migration = &migration{from: from, conn: conn, pending: pending}
+	g.mu.Unlock()
+	handed = true
+	g.metrics.migrations.WithLabelValues(migrationMigrated).Inc()
+	log.Printf("instance=%s connection_migrated from=%s to=%s", g.cfg.Instance, from.RemoteAddr(), conn.RemoteAddr())
+	_ = from.Close()
+	time.AfterFunc(migrationHandover, func() { g.handover.CompareAndSwap(h, nil) })
+	return nil
+}
+
+// migratingFrom reports whether conn was closed to hand over to a
+// migration.
+func (g *Gateway) migratingFrom(conn *websocket.Conn) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.migration != nil && g.migration.from == conn
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnectionMigration(t *testing.T) {
+	old, moved := newFakeBybit(t), newFakeBybit(t)
+	g, sink := newTestGateway(t, old.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("migration")
+	g.cfg.Topics = []string{"tickers", "orderbook.50"}
+	g.books = newBookKeeper(0, stateLimit{}, g.clock, g.publishBook)
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	oldConn := old.nextConn(t)
+	readErr := make(chan error, 1)
+	go func() { readErr <- g.readLoop() }()
+
+	ticker := func(ts int) map[string]any {
+		return map[string]any{"topic": "tickers.BTCUSDT", "type": "snapshot", "ts": 1700000000000 + ts,
+			"data": map[string]any{"symbol": "BTCUSDT", "lastPrice": "100"}}
+	}
+	book := func(u int, msgType string, bid string) map[string]any {
+		return map[string]any{"topic": "orderbook.50.BTCUSDT", "type": msgType, "data": bookData(u, [][2]string{{bid, "1"}}, nil)}
+	}
+	sendJSON(t, oldConn, book(1, actionSnapshot, "100"))
+	waitEvents(t, sink, 1)
+	sendJSON(t, oldConn, ticker(1))
+	waitEvents(t, sink, 2)
+
+	// The host now resolves elsewhere, where the second server listens.
+	g.wsURL = strings.Replace(moved.url(), "127.0.0.1", "localhost", 1)
+	g.lookupHost = func(context.Context, string) ([]string, error) { return []string{"127.0.0.1"}, nil }
+	g.mu.Lock()
+	conn := g.reading
+	g.mu.Unlock()
+	if ok, err := g.endpointMoved(conn); err != nil || ok {
+		t.Fatalf("endpointMoved = %v, %v with the address unchanged", ok, err)
+	}
+	g.lookupHost = func(context.Context, string) ([]string, error) { return []string{"192.0.2.1"}, nil }
+	if ok, err := g.endpointMoved(conn); err != nil || !ok {
+		t.Fatalf("endpointMoved = %v, %v", ok, err)
+	}
+
+	migrated := make(chan error, 1)
+	go func() { migrated <- g.migrate(conn) }()
+	newConn := moved.nextConn(t)
+	if op := moved.nextOp(t); op["op"] != "subscribe" {
+		t.Fatalf("new connection op = %v", op)
+	}
+	select {
+	case err := <-migrated:
+		t.Fatalf("migrated before any data on the new connection: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	sendJSON(t, oldConn, ticker(2))
+	waitEvents(t, sink, 3)
+	sendJSON(t, newConn, ticker(3))
+	if err := <-migrated; err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	sendJSON(t, newConn, ticker(4))
+	evs := waitEvents(t, sink, 5)
+	for i, ev := range evs[1:] {
+		if ev.Ts != 1700000000001+int64(i) {
+			t.Fatalf("event %d ts = %d", i, ev.Ts)
+		}
+	}
+	// The book kept from the old connection takes the new one's deltas.
+	sendJSON(t, newConn, book(2, actionDelta, "99"))
+	evs = waitEvents(t, sink, 6)
+	if b, ok := evs[5].Payload.(NormalizedBook); !ok || b.UpdateID != 2 || len(b.Bids) != 2 {
+		t.Fatalf("book after migrating = %+v", evs[5])
+	}
+	select {
+	case err := <-readErr:
+		t.Fatalf("readLoop returned %v", err)
+	default:
+	}
+	if got := testutil.ToFloat64(g.metrics.migrations.WithLabelValues(migrationMigrated)); got != 1 {
+		t.Fatalf("migrations = %v", got)
+	}
+	if testutil.ToFloat64(g.metrics.connected.WithLabelValues(primaryConn)) != 1 || !g.live.Load() {
+		t.Fatal("not connected after migrating")
+	}
+	g.mu.Lock()
+	remote := g.conn.RemoteAddr().String()
+	g.mu.Unlock()
+	if remote != newConn.LocalAddr().String() {
+		t.Fatalf("connected to %s, want the new server %s", remote, newConn.LocalAddr())
+	}
+}
+
+func TestConnectionMigrationPublishesOverlapOnce(t *testing.T) {
+	old, moved := newFakeBybit(t), newFakeBybit(t)
+	g, sink := newTestGateway(t, old.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("migration_overlap")
+	g.cfg.Topics = []string{"publicTrade"}
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	oldConn := old.nextConn(t)
+	go func() { _ = g.readLoop() }()
+	trade := func(id string) map[string]any {
+		return map[string]any{"topic": "publicTrade.BTCUSDT", "type": "snapshot", "ts": 1700000000000,
+			"data": []any{map[string]any{"i": id, "T": 1700000000000, "p": "100", "v": "1", "S": "Buy", "s": "BTCUSDT"}}}
+	}
+	sendJSON(t, oldConn, trade("t1"))
+	waitEvents(t, sink, 1)
+
+	g.wsURL = strings.Replace(moved.url(), "127.0.0.1", "localhost", 1)
+	g.mu.Lock()
+	conn := g.reading
+	g.mu.Unlock()
+	migrated := make(chan error, 1)
+	go func() { migrated <- g.migrate(conn) }()
+	newConn := moved.nextConn(t)
+	moved.nextOp(t)
+	// Both connections deliver t2; the new one's copy is its first frame.
+	sendJSON(t, oldConn, trade("t2"))
+	waitEvents(t, sink, 2)
+	sendJSON(t, newConn, trade("t2"))
+	if err := <-migrated; err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	sendJSON(t, newConn, trade("t3"))
+	evs := waitEvents(t, sink, 3)
+	time.Sleep(50 * time.Millisecond)
+	seen := map[string]bool{}
+	for _, ev := range sink.Events() {
+		id := ev.Payload.([]any)[0].(map[string]any)["i"].(string)
+		if seen[id] {
+			t.Fatalf("trade %s published twice: %+v", id, evs)
+		}
+		seen[id] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("published trades %v, want t1 t2 t3", seen)
+	}
+	if n := testutil.ToFloat64(g.metrics.migrationDups); n != 1 {
+		t.Fatalf("migration duplicates = %v, want 1", n)
+	}
+	g.closeConn()
+}
+
+func TestConnectionMigrationConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"CONNECTION_MIGRATION": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.ConnMigration || cfg.MigrationInterval != time.Minute || cfg.Validate() != nil {
+		t.Fatalf("ConnMigration = %v, interval %s, Validate = %v", cfg.ConnMigration, cfg.MigrationInterval, cfg.Validate())
+	}
+	cfg.Source = sourceReplay
+	cfg.ReplayPath = "events.jsonl"
+	if cfg.Validate() == nil {
+		t.Fatal("CONNECTION_MIGRATION accepted with SOURCE=replay")
+	}
+}
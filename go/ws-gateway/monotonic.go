@@ -0,0 +1,38 @@
+package main
+
+import "sync"
+
+// tsGuard keeps each symbol's events of a type from going backward with
+// MONOTONIC_TS, as a stepped clock or NTP_SERVER correcting the offset can
+// make it. It is keyed by symbol and type, the full topic: kinds stamped
+// from different exchange fields may legitimately trail one another for the
+// same symbol, and a type's symbols don't share a clock either. Backfilled
+// candles are historical by nature, so they are kept apart from the live
+// ones of their topic.
+type tsGuard struct {
+	mu   sync.Mutex
+	last *symbolLRU[int64]
+}
+
+func newTsGuard(limit stateLimit) *tsGuard {
+	return &tsGuard{last: newSymbolLRU[int64](limit, nil)}
+}
+
+// clamp returns ev's Ts, or one millisecond past the last Ts of its symbol
+// and type if it is earlier, and whether it was clamped.
+func (g *tsGuard) clamp(ev OutEvent) (int64, bool) {
+	key := ev.Symbol + "\x00" + ev.Type
+	if klineBackfilled(ev) {
+		key += "\x00backfill"
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ts := ev.Ts
+	last, ok := g.last.get(key)
+	clamped := ok && ts < last
+	if clamped {
+		ts = last + 1
+	}
+	g.last.put(key, ts)
+	return ts, clamped
+}
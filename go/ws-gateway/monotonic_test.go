@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTsGuard(t *testing.T) {
+	g := newTsGuard(stateLimit{})
+	for _, tc := range []struct {
+		typ     string
+		ts      int64
+		want    int64
+		clamped bool
+	}{
+		{"tickers.BTCUSDT", 1000, 1000, false},
+		{"tickers.BTCUSDT", 1000, 1000, false},
+		{"tickers.BTCUSDT", 990, 1001, true},
+		{"tickers.BTCUSDT", 995, 1002, true},
+		{"publicTrade.BTCUSDT", 900, 900, false},
+		{"tickers.BTCUSDT", 1500, 1500, false},
+	} {
+		if ts, clamped := g.clamp(OutEvent{Ts: tc.ts, Symbol: "BTCUSDT", Type: tc.typ}); ts != tc.want || clamped != tc.clamped {
+			t.Fatalf("clamp(%s, %d) = %d, %v; want %d, %v", tc.typ, tc.ts, ts, clamped, tc.want, tc.clamped)
+		}
+	}
+
+	// Symbols sharing a type, such as a marker's, are guarded apart.
+	if ts, clamped := g.clamp(OutEvent{Ts: 1400, Symbol: "ETHUSDT", Type: "tickers.BTCUSDT"}); clamped {
+		t.Fatalf("ETHUSDT clamped to %d by BTCUSDT", ts)
+	}
+	// So are backfilled candles from the live ones of their topic.
+	live := OutEvent{Ts: 5000, Symbol: "BTCUSDT", Type: "kline.1.BTCUSDT", Payload: []any{map[string]any{"confirm": false}}}
+	if _, clamped := g.clamp(live); clamped {
+		t.Fatal("live candle clamped")
+	}
+	for _, ts := range []int64{1000, 2000} {
+		backfill := OutEvent{Ts: ts, Symbol: "BTCUSDT", Type: "kline.1.BTCUSDT", Payload: []any{map[string]any{"confirm": true, "backfill": true}}}
+		if got, clamped := g.clamp(backfill); clamped {
+			t.Fatalf("backfilled candle at %d clamped to %d", ts, got)
+		}
+	}
+}
+
+func TestMonotonicTsDispatch(t *testing.T) {
+	g, sink := newTestGateway(t, "", "BTCUSDT")
+	g.metrics = newGatewayMetrics("monotonic_ts")
+	g.tsGuard = newTsGuard(stateLimit{})
+	g.dispatch(OutEvent{Ts: 2000, Symbol: "BTCUSDT", Type: "tickers.BTCUSDT"})
+	g.dispatch(OutEvent{Ts: 1000, Symbol: "BTCUSDT", Type: "tickers.BTCUSDT"})
+	if evs := sink.Events(); len(evs) != 2 || evs[1].Ts != 2001 {
+		t.Fatalf("published %+v", evs)
+	}
+	if n := testutil.ToFloat64(g.metrics.tsClamped); n != 1 {
+		t.Fatalf("clamped = %v, want 1", n)
+	}
+}
+
+func TestAnchoredClock(t *testing.T) {
+	c := newSystemClock(time.Hour)
+	c.anchor()
+	a := c.Now()
+	if d := a.Sub(time.Now()); d < 59*time.Minute || d > 61*time.Minute {
+		t.Fatalf("anchored clock is %s ahead, want ~1h", d)
+	}
+	if b := c.Now(); b.Round(0).Before(a.Round(0)) {
+		t.Fatalf("anchored clock went back from %s to %s", a, b)
+	}
+}
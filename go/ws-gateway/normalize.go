@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	payloadRaw        = "raw"
+	payloadNormalized = "normalized"
+
+	// rawTypeSuffix marks the raw copy of an event published with EMIT_BOTH.
+	rawTypeSuffix = ".raw"
+)
+
+func parsePayloadMode(v string) (string, error) {
+	switch v {
+	case payloadRaw, payloadNormalized:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown payload mode %q (want raw|normalized)", v)
+}
+
+// topicKind returns the stream kind of a Bybit topic, e.g. "orderbook" for
+// "orderbook.25.BTCUSDT" and "tickers" for "tickers.BTCUSDT".
+func topicKind(topic string) string {
+	if i := strings.IndexByte(topic, '.'); i >= 0 {
+		return topic[:i]
+	}
+	return topic
+}
+
+// Level is a single price level of a NormalizedBook.
+type Level struct {
+	Price float64 `json:"price"`
+	Size  float64 `json:"size"`
+}
+
+// NormalizedBook is the venue-independent order book payload. Levels are in
+// venue order (best first); a zero Size removes the level in a delta.
+type NormalizedBook struct {
+	Bids     []Level `json:"bids"`
+	Asks     []Level `json:"asks"`
+	UpdateID int64   `json:"updateId,omitempty"`
+	Seq      int64   `json:"seq,omitempty"`
+}
+
+// NormalizedTicker is the venue-independent ticker payload. Fields are nil
+// when the venue omitted them, which Bybit does for unchanged fields in
+// ticker deltas.
+type NormalizedTicker struct {
+	LastPrice    *float64 `json:"lastPrice,omitempty"`
+	MarkPrice    *float64 `json:"markPrice,omitempty"`
+	IndexPrice   *float64 `json:"indexPrice,omitempty"`
+	BidPrice     *float64 `json:"bidPrice,omitempty"`
+	BidSize      *float64 `json:"bidSize,omitempty"`
+	AskPrice     *float64 `json:"askPrice,omitempty"`
+	AskSize      *float64 `json:"askSize,omitempty"`
+	Volume24h    *float64 `json:"volume24h,omitempty"`
+	Turnover24h  *float64 `json:"turnover24h,omitempty"`
+	FundingRate  *float64 `json:"fundingRate,omitempty"`
+	OpenInterest *float64 `json:"openInterest,omitempty"`
+}
+
+// normalizePayload maps a decoded Bybit data field into the normalized
+// schema. Kinds without a normalized form are returned unchanged.
+func normalizePayload(topic string, data any) any {
+	m, ok := data.(map[string]any)
+	if !ok {
+		return data
+	}
+	switch topicKind(topic) {
+	case "orderbook":
+		return normalizeBook(m)
+	case "tickers":
+		return normalizeTicker(m)
+	}
+	return data
+}
+
+func normalizeBook(m map[string]any) NormalizedBook {
+	return NormalizedBook{
+		Bids:     parseLevels(m["b"]),
+		Asks:     parseLevels(m["a"]),
+		UpdateID: int64(toFloat(m["u"])),
+		Seq:      int64(toFloat(m["seq"])),
+	}
+}
+
+func normalizeTicker(m map[string]any) NormalizedTicker {
+	return NormalizedTicker{
+		LastPrice:    optFloat(m, "lastPrice"),
+		MarkPrice:    optFloat(m, "markPrice"),
+		IndexPrice:   optFloat(m, "indexPrice"),
+		BidPrice:     optFloat(m, "bid1Price"),
+		BidSize:      optFloat(m, "bid1Size"),
+		AskPrice:     optFloat(m, "ask1Price"),
+		AskSize:      optFloat(m, "ask1Size"),
+		Volume24h:    optFloat(m, "volume24h"),
+		Turnover24h:  optFloat(m, "turnover24h"),
+		FundingRate:  optFloat(m, "fundingRate"),
+		OpenInterest: optFloat(m, "openInterest"),
+	}
+}
+
+func parseLevels(v any) []Level {
+	rows, ok := v.([]any)
+	if !ok {
+		return []Level{}
+	}
+	levels := make([]Level, 0, len(rows))
+	for _, r := range rows {
+		pair, ok := r.([]any)
+		if !ok || len(pair) < 2 {
+			continue
+		}
+		levels = append(levels, Level{Price: toFloat(pair[0]), Size: toFloat(pair[1])})
+	}
+	return levels
+}
+
+func optFloat(m map[string]any, k string) *float64 {
+	v, ok := m[k]
+	if !ok {
+		return nil
+	}
+	if s, ok := v.(string); ok && s == "" {
+		return nil
+	}
+	f := toFloat(v)
+	return &f
+}
+
+// toFloat accepts both JSON numbers and Bybit's string-encoded decimals.
+func toFloat(v any) float64 {
+	switch x := v.(type) {
+	case float64:
+		return x
+	case string:
+		f, _ := strconv.ParseFloat(x, 64)
+		return f
+	}
+	return 0
+}
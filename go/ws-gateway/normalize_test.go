@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func decodeData(t *testing.T, frame string) map[string]any {
+	t.Helper()
+	var raw map[string]any
+	if err := json.Unmarshal([]byte(frame), &raw); err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestNormalizeBookRoundTrip(t *testing.T) {
+	raw := decodeData(t, `{"topic":"orderbook.25.BTCUSDT","type":"snapshot","ts":1,
+		"data":{"s":"BTCUSDT","b":[["42000.5","1.25"],["42000","0"]],"a":[["42001","3"]],"u":77,"seq":9001}}`)
+	got := normalizePayload(raw["topic"].(string), raw["data"])
+	want := NormalizedBook{
+		Bids:     []Level{{Price: 42000.5, Size: 1.25}, {Price: 42000, Size: 0}},
+		Asks:     []Level{{Price: 42001, Size: 3}},
+		UpdateID: 77,
+		Seq:      9001,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("normalized = %+v, want %+v", got, want)
+	}
+
+	b, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back NormalizedBook
+	if err := json.Unmarshal(b, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, want) {
+		t.Fatalf("round trip = %+v, want %+v", back, want)
+	}
+}
+
+func TestNormalizeTickerRoundTrip(t *testing.T) {
+	raw := decodeData(t, `{"topic":"tickers.BTCUSDT","type":"delta","ts":1,
+		"data":{"symbol":"BTCUSDT","lastPrice":"42000.5","markPrice":"42001.1","indexPrice":"","bid1Price":"42000"}}`)
+	got := normalizePayload(raw["topic"].(string), raw["data"]).(NormalizedTicker)
+	if got.LastPrice == nil || *got.LastPrice != 42000.5 {
+		t.Fatalf("lastPrice = %v", got.LastPrice)
+	}
+	if got.MarkPrice == nil || *got.MarkPrice != 42001.1 {
+		t.Fatalf("markPrice = %v", got.MarkPrice)
+	}
+	if got.IndexPrice != nil || got.AskPrice != nil {
+		t.Fatalf("absent fields should stay nil: %+v", got)
+	}
+
+	b, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"lastPrice":42000.5,"markPrice":42001.1,"bidPrice":42000}` {
+		t.Fatalf("encoded = %s", b)
+	}
+	var back NormalizedTicker
+	if err := json.Unmarshal(b, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, got) {
+		t.Fatalf("round trip = %+v, want %+v", back, got)
+	}
+}
+
+func TestNormalizeUnknownKindPassesThrough(t *testing.T) {
+	data := map[string]any{"foo": "bar"}
+	if got := normalizePayload("liquidation.BTCUSDT", data); !reflect.DeepEqual(got, data) {
+		t.Fatalf("got %#v", got)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	oversizeSplit = "split"
+	oversizeDrop  = "drop"
+
+	deadLetterOversize = "oversize"
+)
+
+func parseOversizePolicy(v string) (string, error) {
+	switch v {
+	case oversizeSplit, oversizeDrop:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown oversize policy %q (want split|drop)", v)
+}
+
+// Part marks one of the events an order book over MAX_OUTBOUND_BYTES was
+// split into: Index from 0 of Total, all with the original's symbol, type
+// and ts.
+type Part struct {
+	Index int `json:"index"`
+	Total int `json:"total"`
+}
+
+// errOversize is an event over MAX_OUTBOUND_BYTES that couldn't be split.
+type errOversize struct {
+	size, limit int
+}
+
+func (e errOversize) Error() string {
+	return fmt.Sprintf("event is %d bytes, over MAX_OUTBOUND_BYTES=%d", e.size, e.limit)
+}
+
+// fitOutbound returns ev, or with OVERSIZE_POLICY=split and ev over limit
+// bytes as JSON, the parts its book levels split into, each within limit.
+// Parts carry no raw frame.
+func fitOutbound(ev OutEvent, limit int, policy string) ([]OutEvent, error) {
+	size := encodedSize(ev)
+	if size <= limit {
+		return []OutEvent{ev}, nil
+	}
+	levels := bookLevels(ev.Payload)
+	if policy != oversizeSplit || levels < 2 {
+		return nil, errOversize{size, limit}
+	}
+	ev.Raw = nil
+	for n := min(max(2, (size+limit-1)/limit), levels); ; n = min(n+n/2+1, levels) {
+		parts := splitBook(ev, n)
+		fits := true
+		for _, p := range parts {
+			if encodedSize(p) > limit {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			return parts, nil
+		}
+		if n == levels {
+			return nil, errOversize{size, limit}
+		}
+	}
+}
+
+func encodedSize(ev OutEvent) int {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		// deliver reports it when encoding for the sink.
+		return 0
+	}
+	return len(b)
+}
+
+// bookBids and bookAsks are the level arrays of a raw Bybit order book.
+const (
+	bookBids = "b"
+	bookAsks = "a"
+)
+
+// bookLevels counts the levels of an order book payload, raw or
+// normalized; other payloads have none.
+func bookLevels(payload any) int {
+	switch p := payload.(type) {
+	case NormalizedBook:
+		return len(p.Bids) + len(p.Asks)
+	case map[string]any:
+		bids, _ := p[bookBids].([]any)
+		asks, _ := p[bookAsks].([]any)
+		return len(bids) + len(asks)
+	}
+	return 0
+}
+
+// splitBook spreads ev's bids and asks, in order, over n events carrying
+// the rest of the payload unchanged.
+func splitBook(ev OutEvent, n int) []OutEvent {
+	parts := make([]OutEvent, n)
+	for i := range parts {
+		parts[i] = ev
+		parts[i].Part = &Part{Index: i, Total: n}
+	}
+	switch p := ev.Payload.(type) {
+	case NormalizedBook:
+		bids, asks := chunks(p.Bids, n), chunks(p.Asks, n)
+		for i := range parts {
+			b := p
+			b.Bids, b.Asks = bids[i], asks[i]
+			parts[i].Payload = b
+		}
+	case map[string]any:
+		bids, _ := p[bookBids].([]any)
+		asks, _ := p[bookAsks].([]any)
+		bc, ac := chunks(bids, n), chunks(asks, n)
+		for i := range parts {
+			m := make(map[string]any, len(p))
+			for k, v := range p {
+				m[k] = v
+			}
+			m[bookBids], m[bookAsks] = orEmpty(bc[i]), orEmpty(ac[i])
+			parts[i].Payload = m
+		}
+	}
+	return parts
+}
+
+// chunks splits s into n consecutive runs as even as possible.
+func chunks[T any](s []T, n int) [][]T {
+	out := make([][]T, n)
+	for i := range out {
+		lo, hi := len(s)*i/n, len(s)*(i+1)/n
+		out[i] = s[lo:hi:hi]
+	}
+	return out
+}
+
+// orEmpty keeps an empty raw level array as [] rather than null, as Bybit
+// sends it.
+func orEmpty(s []any) []any {
+	if s == nil {
+		return []any{}
+	}
+	return s
+}
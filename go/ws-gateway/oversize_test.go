@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func bigBook(levels int) NormalizedBook {
+	var b NormalizedBook
+	for i := 0; i < levels; i++ {
+		b.Bids = append(b.Bids, Level{Price: 100 - float64(i)/100, Size: 1.2345})
+		b.Asks = append(b.Asks, Level{Price: 100 + float64(i)/100, Size: 1.2345})
+	}
+	b.UpdateID = 42
+	return b
+}
+
+func TestFitOutboundSplitsBooks(t *testing.T) {
+	book := bigBook(500)
+	ev := OutEvent{Ts: 1, Symbol: "BTCUSDT", Type: "orderbook.500", Action: actionSnapshot, Payload: book, Raw: []byte(`{}`)}
+	const limit = 4096
+	parts, err := fitOutbound(ev, limit, oversizeSplit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("%d parts", len(parts))
+	}
+	var got NormalizedBook
+	for i, p := range parts {
+		if size := encodedSize(p); size > limit {
+			t.Fatalf("part %d is %d bytes", i, size)
+		}
+		if p.Part == nil || p.Part.Index != i || p.Part.Total != len(parts) || p.Ts != ev.Ts || p.Raw != nil {
+			t.Fatalf("part %d = %+v", i, p)
+		}
+		b := p.Payload.(NormalizedBook)
+		if b.UpdateID != 42 {
+			t.Fatalf("part %d lost the update id", i)
+		}
+		got.Bids = append(got.Bids, b.Bids...)
+		got.Asks = append(got.Asks, b.Asks...)
+	}
+	got.UpdateID = 42
+	if !reflect.DeepEqual(got, book) {
+		t.Fatal("reassembled parts differ from the book")
+	}
+
+	if parts, err := fitOutbound(OutEvent{Ts: 1, Payload: NormalizedBook{Bids: []Level{{1, 1}}}}, limit, oversizeSplit); err != nil || len(parts) != 1 || parts[0].Part != nil {
+		t.Fatalf("small event = %+v, %v", parts, err)
+	}
+}
+
+func TestFitOutboundRawBook(t *testing.T) {
+	var bids, asks []any
+	for i := 0; i < 200; i++ {
+		bids = append(bids, []any{fmt.Sprint(100 - i), "1"})
+	}
+	asks = append(asks, []any{"101", "1"})
+	ev := OutEvent{Ts: 1, Symbol: "BTCUSDT", Type: "orderbook.200", Payload: map[string]any{"s": "BTCUSDT", "u": 7.0, bookBids: bids, bookAsks: asks}}
+	parts, err := fitOutbound(ev, 1024, oversizeSplit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for _, p := range parts {
+		m := p.Payload.(map[string]any)
+		if m["u"] != 7.0 || m[bookAsks] == nil {
+			t.Fatalf("part payload = %v", m)
+		}
+		n += len(m[bookBids].([]any)) + len(m[bookAsks].([]any))
+	}
+	if n != 201 {
+		t.Fatalf("parts hold %d levels, want 201", n)
+	}
+	if _, ok := ev.Payload.(map[string]any)[bookBids].([]any); !ok || len(ev.Payload.(map[string]any)[bookBids].([]any)) != 200 {
+		t.Fatal("splitting modified the event")
+	}
+}
+
+func TestFitOutboundDrops(t *testing.T) {
+	ev := OutEvent{Ts: 1, Symbol: "BTCUSDT", Type: "orderbook.500", Payload: bigBook(500)}
+	var oe errOversize
+	if _, err := fitOutbound(ev, 4096, oversizeDrop); !errors.As(err, &oe) {
+		t.Fatalf("drop policy = %v", err)
+	}
+	trade := OutEvent{Ts: 1, Symbol: "BTCUSDT", Type: "publicTrade.BTCUSDT", Payload: []any{map[string]any{"p": "100"}}}
+	if _, err := fitOutbound(trade, 10, oversizeSplit); !errors.As(err, &oe) {
+		t.Fatalf("unsplittable event = %v", err)
+	}
+}
+
+func TestDeliverOversize(t *testing.T) {
+	g, sink := newTestGateway(t, "", "BTCUSDT")
+	g.metrics = newGatewayMetrics("oversize")
+	g.cfg.MaxOutbound = 4096
+	g.cfg.OversizePolicy = oversizeSplit
+	g.deliver(OutEvent{Ts: 1, Symbol: "BTCUSDT", Type: "orderbook.500", Payload: bigBook(500)})
+	g.deliver(OutEvent{Ts: 2, Symbol: "BTCUSDT", Type: "tickers.BTCUSDT", Payload: map[string]any{"pad": string(make([]byte, 5000))}})
+	evs := sink.Events()
+	if len(evs) < 2 || evs[0].Part == nil || evs[len(evs)-1].Ts != 1 {
+		t.Fatalf("published %d events", len(evs))
+	}
+	if testutil.ToFloat64(g.metrics.oversize.WithLabelValues("split")) != 1 || testutil.ToFloat64(g.metrics.oversize.WithLabelValues("dropped")) != 1 {
+		t.Fatal("oversize events not counted")
+	}
+}
+
+func TestOversizeConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"MAX_OUTBOUND_BYTES": "1000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxOutbound != 1000000 || cfg.OversizePolicy != oversizeSplit || cfg.Validate() != nil {
+		t.Fatalf("MaxOutbound = %d, policy %q, Validate = %v", cfg.MaxOutbound, cfg.OversizePolicy, cfg.Validate())
+	}
+	cfg.OversizePolicy = "truncate"
+	if cfg.Validate() == nil {
+		t.Fatal("OVERSIZE_POLICY=truncate accepted")
+	}
+}
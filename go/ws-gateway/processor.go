@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	processorFilter     = "filter"
+	processorSampler    = "sampler"
+	processorNormalizer = "normalizer"
+	processorEnricher   = "enricher"
+)
+
+// Processor is a stage of the pipeline every event goes through before it
+// is buffered for publishing. Process returns the event to pass on, and
+// false to drop it.
+type Processor interface {
+	Process(ev OutEvent) (OutEvent, bool)
+}
+
+// processorChain runs its processors in order, stopping at the first that
+// drops the event.
+type processorChain []Processor
+
+func (c processorChain) Process(ev OutEvent) (OutEvent, bool) {
+	for _, p := range c {
+		var keep bool
+		if ev, keep = p.Process(ev); !keep {
+			return ev, false
+		}
+	}
+	return ev, true
+}
+
+// parseProcessors parses PROCESSORS, the built-in processors by name in the
+// order they run.
+func parseProcessors(v string) ([]string, error) {
+	names := splitList(v)
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		switch name {
+		case processorFilter, processorSampler, processorNormalizer, processorEnricher:
+		default:
+			return nil, fmt.Errorf("unknown processor %q (want filter|sampler|normalizer|enricher)", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s listed twice", name)
+		}
+		seen[name] = true
+	}
+	return names, nil
+}
+
+// processorNames is PROCESSORS or, without it, the stages the other
+// settings imply: filter with FILTER.
+func (c Config) processorNames() []string {
+	if c.Processors != nil {
+		return c.Processors
+	}
+	if c.Filter != "" {
+		return []string{processorFilter}
+	}
+	return nil
+}
+
+func (c Config) hasProcessor(name string) bool {
+	for _, n := range c.processorNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func newProcessorChain(cfg Config, m *gatewayMetrics) (processorChain, error) {
+	var chain processorChain
+	for _, name := range cfg.processorNames() {
+		switch name {
+		case processorFilter:
+			f, err := parseFilter(cfg.Filter)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, &filterProcessor{filter: f, filtered: m.filtered})
+		case processorSampler:
+			chain = append(chain, newSampler(cfg.SampleEvery, stateLimit{cfg.SymbolState, m.stateEvictions.WithLabelValues("sampler")}, m.sampled))
+		case processorNormalizer:
+			chain = append(chain, normalizer{})
+		case processorEnricher:
+			chain = append(chain, enricher{fields: cfg.EnrichFields})
+		}
+	}
+	return chain, nil
+}
+
+// filterProcessor drops events not matching FILTER.
+type filterProcessor struct {
+	filter   *eventFilter
+	filtered prometheus.Counter
+}
+
+func (p *filterProcessor) Process(ev OutEvent) (OutEvent, bool) {
+	if !p.filter.match(&ev) {
+		p.filtered.Inc()
+		return ev, false
+	}
+	return ev, true
+}
+
+// sampler keeps snapshots and one in every SAMPLE_EVERY other events of
+// each symbol and type, the first included. Order book deltas and stale
+// markers are always kept: a book missing one is wrong from then on.
+type sampler struct {
+	every   int
+	sampled prometheus.Counter
+
+	mu    sync.Mutex
+	count *symbolLRU[int]
+}
+
+func newSampler(every int, limit stateLimit, sampled prometheus.Counter) *sampler {
+	return &sampler{every: every, sampled: sampled, count: newSymbolLRU[int](limit, nil)}
+}
+
+func (s *sampler) Process(ev OutEvent) (OutEvent, bool) {
+	if ev.Action == actionSnapshot || ev.Type == typeStale || topicKind(ev.Type) == "orderbook" {
+		return ev, true
+	}
+	key := ev.Symbol + "\x00" + ev.Type
+	s.mu.Lock()
+	n, _ := s.count.get(key)
+	s.count.put(key, (n+1)%s.every)
+	s.mu.Unlock()
+	if n != 0 {
+		s.sampled.Inc()
+		return ev, false
+	}
+	return ev, true
+}
+
+// normalizer is PAYLOAD_MODE=normalized as a processor. The raw copies of
+// EMIT_BOTH are left alone.
+type normalizer struct{}
+
+func (normalizer) Process(ev OutEvent) (OutEvent, bool) {
+	if !strings.HasSuffix(ev.Type, rawTypeSuffix) {
+		ev.Payload = normalizePayload(ev.Type, ev.Payload)
+	}
+	return ev, true
+}
+
+// enricher adds ENRICH_FIELDS to object payloads, and to every object of an
+// array payload such as publicTrade's, without replacing fields the event
+// already has. Other payloads, normalized ones among them, are left alone.
+type enricher struct {
+	fields map[string]string
+}
+
+func (e enricher) Process(ev OutEvent) (OutEvent, bool) {
+	switch p := ev.Payload.(type) {
+	case map[string]any:
+		ev.Payload = e.enrich(p)
+	case []any:
+		out := make([]any, len(p))
+		for i, item := range p {
+			if m, ok := item.(map[string]any); ok {
+				item = e.enrich(m)
+			}
+			out[i] = item
+		}
+		ev.Payload = out
+	}
+	return ev, true
+}
+
+// enrich returns a copy of m with the fields added; the raw copy of an
+// EMIT_BOTH event shares m.
+func (e enricher) enrich(m map[string]any) map[string]any {
+	out := make(map[string]any, len(m)+len(e.fields))
+	for k, v := range e.fields {
+		out[k] = v
+	}
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
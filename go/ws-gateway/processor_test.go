@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProcessorChain(t *testing.T) {
+	g, sink := newTestGateway(t, "ws://unused", "BTCUSDT")
+	g.metrics = newGatewayMetrics("processors")
+	cfg, err := loadConfig(env{"PROCESSORS": "filter,enricher,sampler", "FILTER": "symbol != SOLUSDT", "SAMPLE_EVERY": "2", "ENRICH_FIELDS": "venue=bybit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if g.processors, err = newProcessorChain(cfg, g.metrics); err != nil {
+		t.Fatal(err)
+	}
+	for i, sym := range []string{"BTCUSDT", "SOLUSDT", "BTCUSDT", "BTCUSDT"} {
+		g.publish(OutEvent{Ts: int64(i), Symbol: sym, Type: "tickers." + sym, Action: actionDelta, Payload: map[string]any{"lastPrice": "1"}})
+	}
+	evs := waitEvents(t, sink, 2)
+	if len(evs) != 2 || evs[0].Ts != 0 || evs[1].Ts != 3 {
+		t.Fatalf("published %+v", evs)
+	}
+	if p := evs[1].Payload.(map[string]any); p["venue"] != "bybit" || p["lastPrice"] != "1" {
+		t.Fatalf("payload = %v", p)
+	}
+	if n := testutil.ToFloat64(g.metrics.filtered); n != 1 {
+		t.Fatalf("filtered = %v", n)
+	}
+	if n := testutil.ToFloat64(g.metrics.sampled); n != 1 {
+		t.Fatalf("sampled = %v", n)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	s := newSampler(3, stateLimit{}, newGatewayMetrics("sampler").sampled)
+	var kept []int64
+	for i := int64(1); i <= 7; i++ {
+		action := actionDelta
+		if i == 4 {
+			action = actionSnapshot
+		}
+		if _, ok := s.Process(OutEvent{Ts: i, Symbol: "BTCUSDT", Type: "tickers.BTCUSDT", Action: action}); ok {
+			kept = append(kept, i)
+		}
+	}
+	if want := []int64{1, 4, 5}; !reflect.DeepEqual(kept, want) {
+		t.Fatalf("kept %v, want %v", kept, want)
+	}
+	// Symbols sharing a type are sampled apart.
+	if _, ok := s.Process(OutEvent{Symbol: "ETHUSDT", Type: "tickers.BTCUSDT", Action: actionDelta}); !ok {
+		t.Fatal("first ETHUSDT event sampled out")
+	}
+	for i := 0; i < 3; i++ {
+		for _, ev := range []OutEvent{
+			{Symbol: "BTCUSDT", Type: "orderbook.25.BTCUSDT", Action: actionDelta},
+			{Symbol: "BTCUSDT", Type: "orderbook.25.BTCUSDT", Action: actionUpdate},
+			{Symbol: "BTCUSDT", Type: typeStale},
+		} {
+			if _, ok := s.Process(ev); !ok {
+				t.Fatalf("sampled out %+v", ev)
+			}
+		}
+	}
+}
+
+func TestBuiltinProcessors(t *testing.T) {
+	book := map[string]any{"b": []any{[]any{"100", "1"}}, "a": []any{}, "u": 7.0}
+	ev, _ := normalizer{}.Process(OutEvent{Type: "orderbook.25.BTCUSDT", Payload: book})
+	if nb, ok := ev.Payload.(NormalizedBook); !ok || nb.UpdateID != 7 {
+		t.Fatalf("normalized payload = %#v", ev.Payload)
+	}
+	if ev, _ := (normalizer{}).Process(OutEvent{Type: "orderbook.25.BTCUSDT" + rawTypeSuffix, Payload: book}); !reflect.DeepEqual(ev.Payload, book) {
+		t.Fatalf("raw copy normalized: %#v", ev.Payload)
+	}
+
+	e := enricher{fields: map[string]string{"venue": "bybit", "p": "x"}}
+	trades := []any{map[string]any{"p": "100"}, "odd"}
+	ev, _ = e.Process(OutEvent{Payload: trades})
+	want := []any{map[string]any{"p": "100", "venue": "bybit"}, "odd"}
+	if !reflect.DeepEqual(ev.Payload, want) {
+		t.Fatalf("enriched = %v", ev.Payload)
+	}
+	if len(trades[0].(map[string]any)) != 1 {
+		t.Fatal("enricher modified the original payload")
+	}
+}
+
+func TestProcessorsConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"FILTER": "type == tickers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := cfg.processorNames(); len(names) != 1 || names[0] != processorFilter || cfg.Validate() != nil {
+		t.Fatalf("processors = %v, Validate = %v", names, cfg.Validate())
+	}
+	for _, e := range []env{
+		{"PROCESSORS": "normalizer", "FILTER": "type == tickers"},
+		{"PROCESSORS": "sampler"},
+		{"SAMPLE_EVERY": "5"},
+		{"PROCESSORS": "sampler", "SAMPLE_EVERY": "1"},
+		{"PROCESSORS": "enricher"},
+	} {
+		cfg, err := loadConfig(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Validate() == nil {
+			t.Fatalf("%v accepted", e)
+		}
+	}
+	for _, bad := range []string{"filter,filter", "lua"} {
+		if _, err := loadConfig(env{"PROCESSORS": bad}); err == nil {
+			t.Fatalf("PROCESSORS=%s accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	backpressureBlock      = "block"
+	backpressureDropNewest = "drop_newest"
+	backpressureDropOldest = "drop_oldest"
+	backpressureSpill      = "spill"
+)
+
+func parseBackpressure(v string) (string, error) {
+	switch v {
+	case backpressureBlock, backpressureDropNewest, backpressureDropOldest, backpressureSpill:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown backpressure strategy %q (want block|drop_newest|drop_oldest|spill)", v)
+}
+
+const (
+	orderingPerSymbol = "per_symbol"
+	orderingNone      = "none"
+)
+
+func parseOrdering(v string) (string, error) {
+	switch v {
+	case orderingPerSymbol, orderingNone:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown ordering %q (want per_symbol|none)", v)
+}
+
+// eventQueue is an asynchronous publish path: a single publishQueue or a
+// set of them sharded by symbol.
+type eventQueue interface {
+	enqueue(ev OutEvent)
+	Close()
+}
+
+// newEventQueue builds the publish path for cfg. With one worker it is a
+// plain FIFO queue. With several, ORDERING=per_symbol gives each worker its
+// own queue and routes every symbol to exactly one of them, while
+// ORDERING=none lets all workers share one queue.
+func newEventQueue(cfg Config, m *gatewayMetrics, deliver func(OutEvent)) (eventQueue, error) {
+	workers := cfg.PublishWorkers
+	if workers <= 1 || cfg.Ordering == orderingNone {
+		return newPublishQueue(cfg.PublishBuffer, max(workers, 1), cfg.Backpressure, cfg.SpillDir, m, deliver)
+	}
+	size := max(cfg.PublishBuffer/workers, 1)
+	s := make(shardedQueue, 0, workers)
+	for i := 0; i < workers; i++ {
+		q, err := newPublishQueue(size, 1, cfg.Backpressure, cfg.SpillDir, m, deliver)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s = append(s, q)
+	}
+	return s, nil
+}
+
+// shardedQueue routes events by a stable hash of the symbol, so events of
+// one symbol are always delivered in order by the same worker.
+type shardedQueue []*publishQueue
+
+func (s shardedQueue) enqueue(ev OutEvent) {
+	// Inline FNV-1a keeps the hot path allocation-free.
+	h := uint32(2166136261)
+	for i := 0; i < len(ev.Symbol); i++ {
+		h ^= uint32(ev.Symbol[i])
+		h *= 16777619
+	}
+	s[h%uint32(len(s))].enqueue(ev)
+}
+
+func (s shardedQueue) Close() {
+	var wg sync.WaitGroup
+	for _, q := range s {
+		wg.Add(1)
+		go func(q *publishQueue) {
+			defer wg.Done()
+			q.Close()
+		}(q)
+	}
+	wg.Wait()
+}
+
+// publishQueue decouples the read loop from sink latency. With one worker
+// events are delivered in FIFO order; what happens when the buffer is full
+// is decided by the backpressure strategy. The queue length gauge is moved
+// by increments so that sharded queues add up.
+type publishQueue struct {
+	ch       chan OutEvent
+	strategy string
+	deliver  func(OutEvent)
+	m        *gatewayMetrics
+
+	mu      sync.Mutex
+	spill   *spillFile
+	spilled chan struct{}
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newPublishQueue(size, workers int, strategy, spillDir string, m *gatewayMetrics, deliver func(OutEvent)) (*publishQueue, error) {
+	q := &publishQueue{
+		m:        m,
+		ch:       make(chan OutEvent, size),
+		strategy: strategy,
+		deliver:  deliver,
+		spilled:  make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+	}
+	if strategy == backpressureSpill {
+		sf, err := newSpillFile(spillDir, m.spillPending)
+		if err != nil {
+			return nil, err
+		}
+		q.spill = sf
+	}
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.run()
+	}
+	return q, nil
+}
+
+// trySend queues ev if there is room, keeping the length gauge in step.
+func (q *publishQueue) trySend(ev OutEvent) bool {
+	q.m.queueLen.Inc()
+	select {
+	case q.ch <- ev:
+		return true
+	default:
+		q.m.queueLen.Dec()
+		return false
+	}
+}
+
+func (q *publishQueue) enqueue(ev OutEvent) {
+	switch q.strategy {
+	case backpressureDropNewest:
+		if !q.trySend(ev) {
+			q.m.publishDropped.WithLabelValues("newest").Inc()
+		}
+	case backpressureDropOldest:
+		for !q.trySend(ev) {
+			select {
+			case <-q.ch:
+				q.m.queueLen.Dec()
+				q.m.publishDropped.WithLabelValues("oldest").Inc()
+			default:
+			}
+		}
+	case backpressureSpill:
+		q.mu.Lock()
+		// Once anything is spilled, later events follow it to disk so that
+		// delivery stays FIFO.
+		if q.spill.pending == 0 && q.trySend(ev) {
+			q.mu.Unlock()
+			return
+		}
+		err := q.spill.write(ev)
+		q.mu.Unlock()
+		if err != nil {
+			q.m.errors.Inc()
+			q.m.publishDropped.WithLabelValues("spill_error").Inc()
+			log.Printf("spill_error err=%v", err)
+			return
+		}
+		q.m.publishSpilled.Inc()
+		select {
+		case q.spilled <- struct{}{}:
+		default:
+		}
+	default:
+		if !q.trySend(ev) {
+			q.m.publishBlocked.Inc()
+			q.m.queueLen.Inc()
+			q.ch <- ev
+		}
+	}
+}
+
+func (q *publishQueue) run() {
+	defer q.wg.Done()
+	for {
+		select {
+		case ev := <-q.ch:
+			q.m.queueLen.Dec()
+			q.deliver(ev)
+			continue
+		default:
+		}
+		if q.deliverSpilled() {
+			continue
+		}
+		select {
+		case ev := <-q.ch:
+			q.m.queueLen.Dec()
+			q.deliver(ev)
+		case <-q.spilled:
+		case <-q.closing:
+			q.drain()
+			return
+		}
+	}
+}
+
+// deliverSpilled delivers one spilled event if there is any.
+func (q *publishQueue) deliverSpilled() bool {
+	if q.spill == nil {
+		return false
+	}
+	q.mu.Lock()
+	ev, ok, err := q.spill.read()
+	dropped := 0
+	if err != nil {
+		// The rest of the file can't be trusted: give up on it, so later
+		// events go through the channel again.
+		dropped = q.spill.discard()
+	}
+	q.mu.Unlock()
+	if err != nil {
+		q.m.errors.Inc()
+		q.m.publishDropped.WithLabelValues("spill_error").Add(float64(dropped))
+		log.Printf("spill_read_error dropped=%d err=%v", dropped, err)
+	}
+	if ok {
+		q.deliver(ev)
+	}
+	return ok
+}
+
+func (q *publishQueue) drain() {
+	for {
+		select {
+		case ev := <-q.ch:
+			q.m.queueLen.Dec()
+			q.deliver(ev)
+			continue
+		default:
+		}
+		if !q.deliverSpilled() {
+			return
+		}
+	}
+}
+
+// Close delivers everything still buffered and stops the workers. Callers
+// must stop enqueueing first.
+func (q *publishQueue) Close() {
+	close(q.closing)
+	q.wg.Wait()
+	if q.spill != nil {
+		q.spill.close()
+	}
+}
+
+// spillFile is an append-only NDJSON overflow that is read back in order and
+// truncated whenever it has been fully drained. Each shard has its own, so
+// they add to and take from the shared pending gauge rather than set it.
+type spillFile struct {
+	path    string
+	wf      *os.File
+	rf      *os.File
+	r       *bufio.Reader
+	pending int
+	gauge   prometheus.Gauge
+}
+
+func newSpillFile(dir string, gauge prometheus.Gauge) (*spillFile, error) {
+	wf, err := os.CreateTemp(dir, "ws-gateway-spill-*.ndjson")
+	if err != nil {
+		return nil, err
+	}
+	rf, err := os.Open(wf.Name())
+	if err != nil {
+		wf.Close()
+		return nil, err
+	}
+	return &spillFile{path: wf.Name(), wf: wf, rf: rf, r: bufio.NewReader(rf), gauge: gauge}, nil
+}
+
+// spilledEvent is an event as written to the spill file. The payload is
+// stored with the name of its Go type, so that read can rebuild the typed
+// payloads consumers switch on rather than hand back maps.
+type spilledEvent struct {
+	OutEvent
+	PayloadType string          `json:"payloadType,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// spillPayloads decodes the typed payloads by name. Any other payload, such
+// as the venue's own data, is decoded with numbers as json.Number, so it
+// encodes to the literals it was spilled with.
+var spillPayloads = map[string]func([]byte) (any, error){
+	"NormalizedBook":   decodeSpilled[NormalizedBook],
+	"NormalizedTicker": decodeSpilled[NormalizedTicker],
+	"Stale":            decodeSpilled[Stale],
+	"Flow":             decodeSpilled[Flow],
+	"Imbalance":        decodeSpilled[Imbalance],
+	"Vol":              decodeSpilled[Vol],
+	"SelfTest":         decodeSpilled[SelfTest],
+}
+
+func decodeSpilled[T any](b []byte) (any, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+func encodeSpill(ev OutEvent) ([]byte, error) {
+	payload, err := json.Marshal(ev.Payload)
+	if err != nil {
+		return nil, err
+	}
+	rec := spilledEvent{OutEvent: ev, Payload: payload}
+	if t := reflect.TypeOf(ev.Payload); t != nil && spillPayloads[t.Name()] != nil {
+		rec.PayloadType = t.Name()
+	}
+	return json.Marshal(rec)
+}
+
+func decodeSpill(line []byte) (OutEvent, error) {
+	var rec spilledEvent
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return OutEvent{}, err
+	}
+	ev := rec.OutEvent
+	if decode := spillPayloads[rec.PayloadType]; decode != nil {
+		p, err := decode(rec.Payload)
+		if err != nil {
+			return OutEvent{}, fmt.Errorf("%s payload: %w", rec.PayloadType, err)
+		}
+		ev.Payload = p
+		return ev, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(rec.Payload))
+	dec.UseNumber()
+	if err := dec.Decode(&ev.Payload); err != nil {
+		return OutEvent{}, err
+	}
+	return ev, nil
+}
+
+func (s *spillFile) write(ev OutEvent) error {
+	b, err := encodeSpill(ev)
+	if err != nil {
+		return err
+	}
+	if _, err := s.wf.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	s.pending++
+	s.gauge.Inc()
+	return nil
+}
+
+func (s *spillFile) read() (OutEvent, bool, error) {
+	if s.pending == 0 {
+		return OutEvent{}, false, nil
+	}
+	line, err := s.r.ReadBytes('\n')
+	if err != nil {
+		return OutEvent{}, false, err
+	}
+	ev, err := decodeSpill(line)
+	if err != nil {
+		return OutEvent{}, false, err
+	}
+	s.pending--
+	s.gauge.Dec()
+	if s.pending == 0 {
+		// ev is still good if the file can't be emptied.
+		return ev, true, s.reset()
+	}
+	return ev, true, nil
+}
+
+// discard gives up on the events still pending and empties the file,
+// returning how many there were.
+func (s *spillFile) discard() int {
+	n := s.pending
+	s.gauge.Sub(float64(n))
+	s.pending = 0
+	if err := s.reset(); err != nil {
+		log.Printf("spill_reset_error err=%v", err)
+	}
+	return n
+}
+
+func (s *spillFile) reset() error {
+	if err := s.wf.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.wf.Seek(0, 0); err != nil {
+		return err
+	}
+	if _, err := s.rf.Seek(0, 0); err != nil {
+		return err
+	}
+	s.r.Reset(s.rf)
+	return nil
+}
+
+func (s *spillFile) close() {
+	s.gauge.Sub(float64(s.pending))
+	s.pending = 0
+	s.wf.Close()
+	s.rf.Close()
+	os.Remove(s.path)
+}
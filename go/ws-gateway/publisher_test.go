@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// gatedDeliver blocks delivery until release is closed and records the
+// symbols it delivered.
+type gatedDeliver struct {
+	release chan struct{}
+	mu      sync.Mutex
+	got     []string
+}
+
+func newGatedDeliver() *gatedDeliver {
+	return &gatedDeliver{release: make(chan struct{})}
+}
+
+func (d *gatedDeliver) deliver(ev OutEvent) {
+	<-d.release
+	d.mu.Lock()
+	d.got = append(d.got, ev.Symbol)
+	d.mu.Unlock()
+}
+
+func (d *gatedDeliver) symbols() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.got...)
+}
+
+func fill(q *publishQueue, symbols ...string) {
+	for _, s := range symbols {
+		q.enqueue(OutEvent{Symbol: s})
+	}
+}
+
+func TestPublishQueueDropNewest(t *testing.T) {
+	d := newGatedDeliver()
+	q, err := newPublishQueue(2, 1, backpressureDropNewest, "", testMetrics, d.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.enqueue(OutEvent{Symbol: "A"})
+	waitQueueEmpty(t, q) // worker now holds A
+	fill(q, "B", "C", "D")
+	close(d.release)
+	q.Close()
+	if got := d.symbols(); len(got) != 3 || got[0] != "A" || got[1] != "B" || got[2] != "C" {
+		t.Fatalf("delivered %v, want [A B C]", got)
+	}
+}
+
+func TestPublishQueueDropOldest(t *testing.T) {
+	d := newGatedDeliver()
+	q, err := newPublishQueue(2, 1, backpressureDropOldest, "", testMetrics, d.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.enqueue(OutEvent{Symbol: "A"})
+	waitQueueEmpty(t, q)
+	fill(q, "B", "C", "D")
+	close(d.release)
+	q.Close()
+	if got := d.symbols(); len(got) != 3 || got[0] != "A" || got[1] != "C" || got[2] != "D" {
+		t.Fatalf("delivered %v, want [A C D]", got)
+	}
+}
+
+func TestPublishQueueSpillKeepsOrder(t *testing.T) {
+	d := newGatedDeliver()
+	q, err := newPublishQueue(2, 1, backpressureSpill, t.TempDir(), testMetrics, d.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.enqueue(OutEvent{Symbol: "A"})
+	waitQueueEmpty(t, q)
+	fill(q, "B", "C", "D", "E", "F")
+	close(d.release)
+	q.Close()
+	want := []string{"A", "B", "C", "D", "E", "F"}
+	got := d.symbols()
+	if len(got) != len(want) {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("delivered %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPublishQueueBlockDeliversEverything(t *testing.T) {
+	d := newGatedDeliver()
+	close(d.release)
+	q, err := newPublishQueue(1, 1, backpressureBlock, "", testMetrics, d.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(q, "A", "B", "C", "D")
+	q.Close()
+	if got := d.symbols(); len(got) != 4 {
+		t.Fatalf("delivered %v", got)
+	}
+}
+
+func waitQueueEmpty(t *testing.T, q *publishQueue) {
+	t.Helper()
+	for i := 0; i < 1000 && len(q.ch) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if len(q.ch) > 0 {
+		t.Fatal("worker did not pick up the first event")
+	}
+}
+
+func TestShardedQueuePreservesPerSymbolOrder(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string][]int64{}
+	var active, peak int
+	deliver := func(ev OutEvent) {
+		mu.Lock()
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+		time.Sleep(100 * time.Microsecond)
+		mu.Lock()
+		active--
+		seen[ev.Symbol] = append(seen[ev.Symbol], ev.Ts)
+		mu.Unlock()
+	}
+	cfg := Config{PublishBuffer: 64, PublishWorkers: 4, Ordering: orderingPerSymbol, Backpressure: backpressureBlock}
+	q, err := newEventQueue(cfg, testMetrics, deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.(shardedQueue); !ok {
+		t.Fatalf("queue = %T, want shardedQueue", q)
+	}
+	symbols := []string{"BTCUSDT", "ETHUSDT", "SOLUSDT", "XRPUSDT", "DOGEUSDT", "ADAUSDT"}
+	for i := int64(0); i < 200; i++ {
+		q.enqueue(OutEvent{Ts: i, Symbol: symbols[i%int64(len(symbols))]})
+	}
+	q.Close()
+
+	for s, ts := range seen {
+		if len(ts) == 0 {
+			t.Fatalf("%s: nothing delivered", s)
+		}
+		for i := 1; i < len(ts); i++ {
+			if ts[i] <= ts[i-1] {
+				t.Fatalf("%s delivered out of order: %v", s, ts)
+			}
+		}
+	}
+	if peak < 2 {
+		t.Fatalf("deliveries never overlapped (peak %d), symbols aren't spread over workers", peak)
+	}
+}
+
+func TestEventQueueShape(t *testing.T) {
+	deliver := func(OutEvent) {}
+	for _, c := range []struct {
+		cfg     Config
+		sharded bool
+	}{
+		{Config{PublishBuffer: 8, PublishWorkers: 1, Ordering: orderingPerSymbol}, false},
+		{Config{PublishBuffer: 8, PublishWorkers: 4, Ordering: orderingNone}, false},
+		{Config{PublishBuffer: 8, PublishWorkers: 4, Ordering: orderingPerSymbol}, true},
+	} {
+		q, err := newEventQueue(c.cfg, testMetrics, deliver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := q.(shardedQueue); ok != c.sharded {
+			t.Errorf("workers=%d ordering=%s: got %T", c.cfg.PublishWorkers, c.cfg.Ordering, q)
+		}
+		q.Close()
+	}
+}
+
+func TestSpillPendingSumsShards(t *testing.T) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "spill_pending_test"})
+	a, err := newSpillFile(t.TempDir(), gauge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newSpillFile(t.TempDir(), gauge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*spillFile{a, a, b} {
+		if err := s.write(OutEvent{Symbol: "BTCUSDT"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := b.read(); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(gauge); n != 2 {
+		t.Fatalf("pending = %v, want a's 2 after b drained", n)
+	}
+	a.close()
+	b.close()
+	if n := testutil.ToFloat64(gauge); n != 0 {
+		t.Fatalf("pending = %v after closing", n)
+	}
+}
+
+func TestSpillKeepsPayloadTypes(t *testing.T) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "spill_types_test"})
+	s, err := newSpillFile(t.TempDir(), gauge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	book := NormalizedBook{Bids: []Level{{Price: 100, Size: 1}}, Asks: []Level{}, UpdateID: 1<<60 + 1}
+	raw := map[string]any{"b": []any{[]any{"100", "1"}}, "u": float64(42)}
+	for _, p := range []any{book, raw, Stale{Stale: true, LastData: 1700000000000}} {
+		if err := s.write(OutEvent{Symbol: "BTCUSDT", Payload: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ev, _, err := s.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := ev.Payload.(NormalizedBook); !ok || !reflect.DeepEqual(got, book) {
+		t.Fatalf("book came back as %#v", ev.Payload)
+	}
+	if ev, _, err = s.read(); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := ev.Payload.(map[string]any)
+	if !ok || m["u"] != json.Number("42") {
+		t.Fatalf("raw payload came back as %#v", ev.Payload)
+	}
+	if ev, _, err = s.read(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ev.Payload.(Stale); !ok {
+		t.Fatalf("stale payload came back as %T", ev.Payload)
+	}
+}
+
+func TestSpillReadErrorFallsBack(t *testing.T) {
+	m := newGatewayMetrics("spill_read_error")
+	d := newGatedDeliver()
+	q, err := newPublishQueue(1, 1, backpressureSpill, t.TempDir(), m, d.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.enqueue(OutEvent{Symbol: "A"})
+	waitQueueEmpty(t, q)
+	fill(q, "B", "C", "D")
+	// Cut D's line short, as a full disk would.
+	q.mu.Lock()
+	info, err := q.spill.wf.Stat()
+	if err == nil {
+		err = q.spill.wf.Truncate(info.Size() - 5)
+	}
+	q.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(d.release)
+	for i := 0; i < 1000 && testutil.ToFloat64(m.spillPending) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	q.enqueue(OutEvent{Symbol: "E"})
+	q.Close()
+	if got, want := d.symbols(), []string{"A", "B", "C", "E"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+	if n := testutil.ToFloat64(m.publishDropped.WithLabelValues("spill_error")); n != 1 {
+		t.Fatalf("spill_error drops = %v, want 1", n)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+const (
+	includeRawOff    = ""
+	includeRawJSON   = "json"
+	includeRawBase64 = "base64"
+)
+
+// parseIncludeRaw accepts INCLUDE_RAW: a boolean, where true means json, or
+// the encoding by name.
+func parseIncludeRaw(v string) (string, error) {
+	switch v {
+	case includeRawJSON, includeRawBase64:
+		return v, nil
+	}
+	if v == "" {
+		return includeRawOff, nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return "", fmt.Errorf("%q (want a boolean, json or base64)", v)
+	}
+	if on {
+		return includeRawJSON, nil
+	}
+	return includeRawOff, nil
+}
+
+// encodeRaw copies frame into an OutEvent.Raw value. json embeds the frame
+// as is, which serializers may re-indent; base64 preserves it byte for byte.
+func encodeRaw(mode string, frame []byte) json.RawMessage {
+	if mode == includeRawBase64 {
+		out := make([]byte, base64.StdEncoding.EncodedLen(len(frame))+2)
+		out[0] = '"'
+		base64.StdEncoding.Encode(out[1:], frame)
+		out[len(out)-1] = '"'
+		return out
+	}
+	return append(json.RawMessage(nil), frame...)
+}
+
+// decodeRaw returns the frame bytes held in an OutEvent.Raw value.
+func decodeRaw(raw json.RawMessage) ([]byte, error) {
+	if len(raw) == 0 || raw[0] != '"' {
+		return raw, nil
+	}
+	var b []byte
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return nil, fmt.Errorf("raw frame: %w", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	reconnectAdmin = "admin"
+
+	// adminReconnectWait bounds how long POST /reconnect waits for the
+	// replacement connection before reporting its state.
+	adminReconnectWait = 10 * time.Second
+)
+
+type reconnectResult struct {
+	Instance  string `json:"instance"`
+	Shard     int    `json:"shard"`
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+}
+
+// reconnect closes the WS connection of every instance, or of the one picked
+// by ?instance= or ?shard= (its index in INSTANCES_FILE), and reports each
+// one's state once it has reconnected or adminReconnectWait has passed.
+func (s gatewaySet) reconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	shard := -1
+	if v := q.Get("shard"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n >= len(s) {
+			http.Error(w, "invalid shard", http.StatusBadRequest)
+			return
+		}
+		shard = n
+	}
+	name := q.Get("instance")
+	var results []reconnectResult
+	var targets []*Gateway
+	for i, g := range s {
+		if (shard >= 0 && i != shard) || (name != "" && g.cfg.Instance != name) {
+			continue
+		}
+		results = append(results, reconnectResult{Instance: g.cfg.Instance, Shard: i})
+		targets = append(targets, g)
+	}
+	if len(targets) == 0 {
+		http.Error(w, "no such instance", http.StatusNotFound)
+		return
+	}
+	var wg sync.WaitGroup
+	for i, g := range targets {
+		if g.cfg.Source != sourceWS {
+			results[i].Error = "not a ws source"
+			continue
+		}
+		wg.Add(1)
+		go func(res *reconnectResult, g *Gateway) {
+			defer wg.Done()
+			res.Connected = g.adminReconnect(adminReconnectWait)
+		}(&results[i], g)
+	}
+	wg.Wait()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+// adminReconnect closes the current connection so run reconnects, then
+// waits up to wait for a new one, reporting whether it came up.
+func (g *Gateway) adminReconnect(wait time.Duration) bool {
+	g.mu.Lock()
+	old := g.conn
+	g.mu.Unlock()
+	if old != nil {
+		g.metrics.forcedReconnects.WithLabelValues(reconnectAdmin).Inc()
+		log.Printf("instance=%s admin_reconnect", g.cfg.Instance)
+		_ = old.Close()
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		g.mu.Lock()
+		cur := g.conn
+		g.mu.Unlock()
+		if cur != nil && cur != old && g.live.Load() {
+			return true
+		}
+		if time.Now().After(deadline) || !g.sleep(50*time.Millisecond) {
+			return false
+		}
+	}
+}
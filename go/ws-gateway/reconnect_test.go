@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAdminReconnect(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("admin_reconnect")
+	other, _ := newTestGateway(t, fake.url(), "ETHUSDT")
+	other.cfg.Instance = "other"
+	g.Start()
+	defer g.Stop()
+	fake.nextConn(t)
+	deadline := time.Now().Add(2 * time.Second)
+	for !g.live.Load() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	set := gatewaySet{g, other}
+	rec := httptest.NewRecorder()
+	set.reconnect(rec, httptest.NewRequest("POST", "/reconnect?shard=0", nil))
+	var resp []reconnectResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+	if len(resp) != 1 || resp[0].Instance != "test" || resp[0].Shard != 0 || !resp[0].Connected {
+		t.Fatalf("reconnect = %+v", resp)
+	}
+	fake.nextConn(t)
+	if n := testutil.ToFloat64(g.metrics.forcedReconnects.WithLabelValues(reconnectAdmin)); n != 1 {
+		t.Fatalf("admin reconnects = %v", n)
+	}
+
+	rec = httptest.NewRecorder()
+	set.reconnect(rec, httptest.NewRequest("POST", "/reconnect?shard=5", nil))
+	if rec.Code != 400 {
+		t.Fatalf("out-of-range shard: %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	set.reconnect(rec, httptest.NewRequest("POST", "/reconnect?instance=nope", nil))
+	if rec.Code != 404 {
+		t.Fatalf("unknown instance: %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	set.reconnect(rec, httptest.NewRequest("GET", "/reconnect", nil))
+	if rec.Code != 405 {
+		t.Fatalf("GET: %d", rec.Code)
+	}
+}
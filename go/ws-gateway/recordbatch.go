@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// recordBatchHeader is the Kafka header, and Redis stream field, giving
+	// the number of events packed into a record.
+	recordBatchHeader = "batch-size"
+	// recordBatchFlushTimeout bounds each flush not made from Publish.
+	recordBatchFlushTimeout = 10 * time.Second
+)
+
+// recordBatcher is a sink that can write several events as one record.
+// Events are encoded as they are published, so one that can't be fails
+// that publish rather than its record.
+type recordBatcher interface {
+	encodeRecord(ctx context.Context, ev OutEvent) ([]byte, error)
+	publishBatch(ctx context.Context, evs []OutEvent, encoded [][]byte) error
+}
+
+// recordBatchSink packs up to size events into one record of the sink it
+// wraps, written once the batch is full or interval after its first event.
+// A full batch is written by the Publish that fills it; if that fails the
+// batch is kept and retried by the next Publish, which fails without
+// taking its event while it can't be written, so a down sink still fails
+// events one by one into retries and the dead-letter destination. A batch
+// the interval timer can't write is kept and retried after another
+// interval, and one still unwritten at Close is returned in an
+// unwrittenBatch error for the gateway to dead-letter. With maxBytes
+// (MAX_OUTBOUND_BYTES) a batch is also written before an event would take
+// its record over the limit.
+type recordBatchSink struct {
+	Sink
+	batcher  recordBatcher
+	size     int
+	maxBytes int
+	interval time.Duration
+	m        *gatewayMetrics
+
+	mu      sync.Mutex
+	pending []OutEvent
+	encoded [][]byte
+	used    int
+	timer   *time.Timer
+}
+
+func newRecordBatchSink(s Sink, size, maxBytes int, interval time.Duration, m *gatewayMetrics) Sink {
+	b, ok := s.(recordBatcher)
+	if !ok || size < 2 {
+		return s
+	}
+	log.Printf("record_batch sink=%s size=%d interval=%s", s.Name(), size, interval)
+	return &recordBatchSink{Sink: s, batcher: b, size: size, maxBytes: maxBytes, interval: interval, m: m}
+}
+
+// unwrittenBatch is the error Close returns for events it couldn't write.
+type unwrittenBatch struct {
+	sink string
+	evs  []OutEvent
+	err  error
+}
+
+func (e *unwrittenBatch) Error() string {
+	return fmt.Sprintf("record batch of %d events to %s not written: %v", len(e.evs), e.sink, e.err)
+}
+
+func (e *unwrittenBatch) Unwrap() error { return e.err }
+
+// unwrittenBatches finds every unwrittenBatch in err, which routed sinks
+// join.
+func unwrittenBatches(err error) []*unwrittenBatch {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *unwrittenBatch:
+		return []*unwrittenBatch{e}
+	case interface{ Unwrap() []error }:
+		var out []*unwrittenBatch
+		for _, err := range e.Unwrap() {
+			out = append(out, unwrittenBatches(err)...)
+		}
+		return out
+	}
+	return unwrittenBatches(errors.Unwrap(err))
+}
+
+func (s *recordBatchSink) Publish(ctx context.Context, ev OutEvent) error {
+	data, err := s.batcher.encodeRecord(ctx, ev)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A JSON array record takes a separator per event and its brackets.
+	if len(s.pending) >= s.size || s.maxBytes > 0 && len(s.pending) > 0 && s.used+len(data)+2 > s.maxBytes {
+		if err := s.flushLocked(ctx); err != nil {
+			return err
+		}
+	}
+	s.pending = append(s.pending, ev)
+	s.encoded = append(s.encoded, data)
+	s.used += len(data) + 1
+	if len(s.pending) < s.size {
+		if s.timer == nil {
+			s.timer = time.AfterFunc(s.interval, s.flushTimer)
+		}
+		return nil
+	}
+	if err := s.flushLocked(ctx); err != nil {
+		s.flushFailed(err)
+	}
+	return nil
+}
+
+func (s *recordBatchSink) flushTimer() {
+	ctx, cancel := context.WithTimeout(context.Background(), recordBatchFlushTimeout)
+	defer cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timer = nil
+	if err := s.flushLocked(ctx); err != nil {
+		s.flushFailed(err)
+		s.timer = time.AfterFunc(s.interval, s.flushTimer)
+	}
+}
+
+// flushLocked writes the pending events as one record, keeping them on
+// failure.
+func (s *recordBatchSink) flushLocked(ctx context.Context) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	if err := s.batcher.publishBatch(ctx, s.pending, s.encoded); err != nil {
+		return err
+	}
+	s.m.recordBatch.Observe(float64(len(s.pending)))
+	s.pending, s.encoded, s.used = nil, nil, 0
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	return nil
+}
+
+// flushFailed counts a failed write that no Publish returned.
+func (s *recordBatchSink) flushFailed(err error) {
+	s.m.errors.Inc()
+	log.Printf("record_batch_error sink=%s events=%d err=%v", s.Name(), len(s.pending), err)
+}
+
+// Ping and selfTest go to the wrapped sink; the self-test event is written
+// on its own.
+func (s *recordBatchSink) Ping(ctx context.Context) error {
+	if p, ok := s.Sink.(sinkPinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (s *recordBatchSink) selfTest(ctx context.Context, ev OutEvent) error {
+	return selfTestSink(ctx, s.Sink, ev)
+}
+
+// Close writes what is pending before closing the wrapped sink, returning
+// the events it couldn't write in an unwrittenBatch.
+func (s *recordBatchSink) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), recordBatchFlushTimeout)
+	defer cancel()
+	s.mu.Lock()
+	var unwritten error
+	if err := s.flushLocked(ctx); err != nil {
+		s.flushFailed(err)
+		unwritten = &unwrittenBatch{sink: s.Name(), evs: s.pending, err: err}
+		s.pending, s.encoded, s.used = nil, nil, 0
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.mu.Unlock()
+	return errors.Join(unwritten, s.Sink.Close())
+}
+
+// closeSink closes s, dead-lettering the events of record batches it
+// couldn't write on the way.
+func (g *Gateway) closeSink(s Sink) {
+	err := s.Close()
+	if err == nil {
+		return
+	}
+	for _, b := range unwrittenBatches(err) {
+		if g.dlq == nil {
+			break
+		}
+		for _, ev := range b.evs {
+			g.deadLetter(ev, b.err, deadLetterPublish, 1)
+		}
+	}
+	log.Printf("instance=%s sink_close_error err=%v", g.cfg.Instance, err)
+}
+
+// jsonArray joins encoded JSON events into an array.
+func jsonArray(encoded [][]byte) []byte {
+	return append(append([]byte{'['}, bytes.Join(encoded, []byte{','})...), ']')
+}
+
+func (s *redisSink) encodeRecord(_ context.Context, ev OutEvent) ([]byte, error) {
+	return marshalEvent(ev, s.canonical)
+}
+
+// publishBatch writes evs as a JSON array, with their count in the
+// batch-size field. Records always use the blob layout.
+func (s *redisSink) publishBatch(ctx context.Context, evs []OutEvent, encoded [][]byte) error {
+	data := jsonArray(encoded)
+	if s.channel != "" {
+		// REDIS_CHANNEL has no placeholders when batching.
+		return s.client.Publish(ctx, s.channel, data).Err()
+	}
+	return s.client.XAdd(ctx, &redis.XAddArgs{Stream: s.stream, Values: map[string]interface{}{"data": data, recordBatchHeader: len(evs)}}).Err()
+}
+
+// encodeRecord encodes ev as JSON, or with KAFKA_FORMAT=protobuf or avro as
+// its Confluent-framed message after its length as a 4-byte big-endian
+// integer.
+func (s *kafkaSink) encodeRecord(ctx context.Context, ev OutEvent) ([]byte, error) {
+	data, err := s.encode(ctx, ev)
+	if err != nil || s.registry == nil {
+		return data, err
+	}
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), data...), nil
+}
+
+// publishBatch writes evs as one message: a JSON array, or length-prefixed
+// protobuf or Avro frames back to back. The symbol header is set only if every
+// event has the same symbol.
+func (s *kafkaSink) publishBatch(ctx context.Context, evs []OutEvent, encoded [][]byte) error {
+	return s.w.WriteMessages(ctx, s.batchMessage(evs, encoded))
+}
+
+func (s *kafkaSink) batchMessage(evs []OutEvent, encoded [][]byte) kafka.Message {
+	data := bytes.Join(encoded, nil)
+	if s.registry == nil {
+		data = jsonArray(encoded)
+	}
+	symbol := evs[0].Symbol
+	for _, ev := range evs[1:] {
+		if ev.Symbol != symbol {
+			symbol = ""
+			break
+		}
+	}
+	headers := append(s.messageHeaders(OutEvent{Symbol: symbol}), kafka.Header{Key: recordBatchHeader, Value: []byte(strconv.Itoa(len(evs)))})
+	return kafka.Message{Value: data, Headers: headers}
+}
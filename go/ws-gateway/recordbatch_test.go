@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchingSink records the batches written to it, failing them with err.
+type batchingSink struct {
+	memSink
+	mu      sync.Mutex
+	err     error
+	batches [][]OutEvent
+	records [][]byte
+}
+
+func (s *batchingSink) encodeRecord(_ context.Context, ev OutEvent) ([]byte, error) {
+	return json.Marshal(ev)
+}
+
+func (s *batchingSink) publishBatch(_ context.Context, evs []OutEvent, encoded [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, append([]OutEvent(nil), evs...))
+	s.records = append(s.records, jsonArray(encoded))
+	return nil
+}
+
+func (s *batchingSink) written() [][]OutEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+func TestRecordBatchSink(t *testing.T) {
+	inner := &batchingSink{}
+	s := newRecordBatchSink(inner, 2, 0, time.Hour, newGatewayMetrics("record_batch"))
+	for i := 1; i <= 5; i++ {
+		if err := s.Publish(context.Background(), OutEvent{Ts: int64(i), Symbol: "BTCUSDT"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(inner.written()); n != 2 {
+		t.Fatalf("%d records before Close, want 2", n)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var ts []int64
+	for _, b := range inner.written() {
+		for _, ev := range b {
+			ts = append(ts, ev.Ts)
+		}
+	}
+	if len(inner.batches) != 3 || len(ts) != 5 || ts[0] != 1 || ts[4] != 5 || ts[2] != 3 {
+		t.Fatalf("records hold %v", ts)
+	}
+	var evs []OutEvent
+	if err := json.Unmarshal(inner.records[0], &evs); err != nil || len(evs) != 2 || evs[1].Ts != 2 {
+		t.Fatalf("record %s = %v, %v", inner.records[0], evs, err)
+	}
+}
+
+func TestRecordBatchInterval(t *testing.T) {
+	inner := &batchingSink{}
+	s := newRecordBatchSink(inner, 10, 0, 20*time.Millisecond, newGatewayMetrics("record_batch_interval"))
+	defer s.Close()
+	if err := s.Publish(context.Background(), OutEvent{Ts: 1}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(inner.written()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("partial record not written after RECORD_BATCH_INTERVAL")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRecordBatchFailure(t *testing.T) {
+	inner := &batchingSink{err: errors.New("down")}
+	s := newRecordBatchSink(inner, 2, 0, time.Hour, newGatewayMetrics("record_batch_failure"))
+	defer s.Close()
+	ctx := context.Background()
+	for i := 1; i <= 2; i++ {
+		if err := s.Publish(ctx, OutEvent{Ts: int64(i)}); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+	}
+	if err := s.Publish(ctx, OutEvent{Ts: 3}); err == nil {
+		t.Fatal("publish into a full record that can't be written succeeded")
+	}
+	inner.mu.Lock()
+	inner.err = nil
+	inner.mu.Unlock()
+	if err := s.Publish(ctx, OutEvent{Ts: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if b := inner.written(); len(b) != 1 || len(b[0]) != 2 || b[0][0].Ts != 1 {
+		t.Fatalf("records = %v", b)
+	}
+}
+
+func TestRecordBatchCloseDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dlq.ndjson")
+	g, _ := newTestGateway(t, "")
+	g.metrics = newGatewayMetrics("record_batch_close")
+	g.cfg.DLQFile = path
+	dlq, err := newDeadLetterQueue(g.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dlq.Close()
+	g.dlq = dlq
+	inner := &batchingSink{err: errors.New("down")}
+	s := newRecordBatchSink(inner, 10, 0, time.Hour, g.metrics)
+	for i := 1; i <= 3; i++ {
+		if err := s.Publish(context.Background(), OutEvent{Ts: int64(i), Symbol: "BTCUSDT"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g.closeSink(s)
+	recs := readDeadLetters(t, path)
+	if len(recs) != 3 || recs[0].Reason != deadLetterPublish || recs[2].Symbol != "BTCUSDT" {
+		t.Fatalf("dead letters = %+v, want the 3 buffered events", recs)
+	}
+}
+
+func TestRecordBatchMaxBytes(t *testing.T) {
+	inner := &batchingSink{}
+	s := newRecordBatchSink(inner, 10, 200, time.Hour, newGatewayMetrics("record_batch_bytes"))
+	for i := 1; i <= 5; i++ {
+		if err := s.Publish(context.Background(), OutEvent{Ts: int64(i), Symbol: "BTCUSDT", Type: "tickers.BTCUSDT", Payload: map[string]any{"lastPrice": "100"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(inner.records) < 2 {
+		t.Fatalf("%d records, want the events split by size", len(inner.records))
+	}
+	for _, r := range inner.records {
+		if len(r) > 200 {
+			t.Fatalf("record of %d bytes over MAX_OUTBOUND_BYTES", len(r))
+		}
+	}
+}
+
+func TestRecordBatchConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"RECORD_BATCH_SIZE": "50"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RecordBatch != 50 || cfg.RecordInterval != 100*time.Millisecond || cfg.Validate() != nil {
+		t.Fatalf("RecordBatch = %d, interval %s, Validate = %v", cfg.RecordBatch, cfg.RecordInterval, cfg.Validate())
+	}
+	if _, ok := newRecordBatchSink(stdoutSink{}, 50, 0, time.Second, nil).(stdoutSink); !ok {
+		t.Fatal("stdout sink wrapped")
+	}
+	cfg.KafkaPartitions = map[string]int{"BTCUSDT": 0}
+	if cfg.Validate() == nil {
+		t.Fatal("RECORD_BATCH_SIZE with KAFKA_PARTITION_MAP accepted")
+	}
+	cfg.KafkaPartitions = nil
+	cfg.RedisMode, cfg.RedisChannel = redisModePubSub, "md.{symbol}"
+	if cfg.Validate() == nil {
+		t.Fatal("RECORD_BATCH_SIZE with a templated REDIS_CHANNEL accepted")
+	}
+}
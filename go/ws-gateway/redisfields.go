@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+const (
+	redisLayoutBlob   = "blob"
+	redisLayoutFields = "fields"
+)
+
+func parseRedisLayout(v string) (string, error) {
+	switch v {
+	case redisLayoutBlob, redisLayoutFields:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown field layout %q (want blob|fields)", v)
+}
+
+// redisStreamValues is the stream entry for ev: the whole event as JSON in
+// data, or with REDIS_FIELD_LAYOUT=fields its symbol, type, ts and action
+// as fields of their own and the payload as JSON. raw and part are only
+// written when the event has them.
+func redisStreamValues(ev OutEvent, layout string, canonical bool) (map[string]interface{}, error) {
+	if layout != redisLayoutFields {
+		data, err := marshalEvent(ev, canonical)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"data": data}, nil
+	}
+	payload, err := marshalEvent(ev.Payload, canonical)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{
+		"symbol":  ev.Symbol,
+		"type":    ev.Type,
+		"ts":      strconv.FormatInt(ev.Ts, 10),
+		"payload": payload,
+	}
+	if ev.Action != "" {
+		values["action"] = ev.Action
+	}
+	if len(ev.Raw) > 0 {
+		raw, err := marshalEvent(ev.Raw, canonical)
+		if err != nil {
+			return nil, err
+		}
+		values["raw"] = raw
+	}
+	if ev.Part != nil {
+		part, err := json.Marshal(ev.Part)
+		if err != nil {
+			return nil, err
+		}
+		values["part"] = part
+	}
+	return values, nil
+}
+
+// decodeStreamEntry reads an event back from a stream entry in either
+// layout.
+func decodeStreamEntry(values map[string]interface{}) (OutEvent, error) {
+	var ev OutEvent
+	if data, ok := values["data"].(string); ok {
+		err := json.Unmarshal([]byte(data), &ev)
+		return ev, err
+	}
+	payload, ok := values["payload"].(string)
+	if !ok {
+		return ev, fmt.Errorf("no data or payload field")
+	}
+	if err := json.Unmarshal([]byte(payload), &ev.Payload); err != nil {
+		return ev, fmt.Errorf("payload: %w", err)
+	}
+	ev.Symbol, _ = values["symbol"].(string)
+	ev.Type, _ = values["type"].(string)
+	ev.Action, _ = values["action"].(string)
+	ts, _ := values["ts"].(string)
+	var err error
+	if ev.Ts, err = strconv.ParseInt(ts, 10, 64); err != nil {
+		return ev, fmt.Errorf("invalid ts %q", ts)
+	}
+	if raw, ok := values["raw"].(string); ok {
+		ev.Raw = json.RawMessage(raw)
+	}
+	if part, ok := values["part"].(string); ok {
+		ev.Part = &Part{}
+		if err := json.Unmarshal([]byte(part), ev.Part); err != nil {
+			return ev, fmt.Errorf("part: %w", err)
+		}
+	}
+	return ev, nil
+}
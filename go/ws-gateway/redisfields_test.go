@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// asRead converts stream values to the strings XRANGE returns.
+func asRead(values map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func TestRedisStreamValues(t *testing.T) {
+	ev := OutEvent{Ts: 1700000000000, Symbol: "BTCUSDT", Type: "orderbook.50.BTCUSDT", Action: actionSnapshot,
+		Payload: map[string]any{"b": []any{[]any{"100", "1"}}}, Raw: json.RawMessage(`{"topic":"orderbook.50.BTCUSDT"}`), Part: &Part{Index: 1, Total: 2}}
+	values, err := redisStreamValues(ev, redisLayoutFields, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := asRead(values)
+	want := map[string]interface{}{
+		"symbol":  "BTCUSDT",
+		"type":    "orderbook.50.BTCUSDT",
+		"ts":      "1700000000000",
+		"action":  "snapshot",
+		"payload": `{"b":[["100","1"]]}`,
+		"raw":     `{"topic":"orderbook.50.BTCUSDT"}`,
+		"part":    `{"index":1,"total":2}`,
+	}
+	if !reflect.DeepEqual(read, want) {
+		t.Fatalf("fields = %v, want %v", read, want)
+	}
+	got, err := decodeStreamEntry(read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, ev) {
+		t.Fatalf("decoded %+v, want %+v", got, ev)
+	}
+
+	// Fields the event doesn't have aren't written.
+	values, err = redisStreamValues(OutEvent{Ts: 1, Symbol: "BTCUSDT", Type: typeVol, Payload: Vol{Basis: volBasisTrades}}, redisLayoutFields, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"action", "raw", "part"} {
+		if _, ok := values[k]; ok {
+			t.Fatalf("%s written for an event without it", k)
+		}
+	}
+
+	values, err = redisStreamValues(ev, redisLayoutBlob, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 {
+		t.Fatalf("blob values = %v", values)
+	}
+	if got, err := decodeStreamEntry(asRead(values)); err != nil || !reflect.DeepEqual(got, ev) {
+		t.Fatalf("decoded blob %+v, %v", got, err)
+	}
+	if _, err := decodeStreamEntry(map[string]interface{}{"symbol": "BTCUSDT"}); err == nil {
+		t.Fatal("decoded an entry without data or payload")
+	}
+}
+
+func TestRedisFieldLayoutConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"REDIS_URL": "redis://localhost:6379/0", "REDIS_FIELD_LAYOUT": "Fields"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RedisLayout != redisLayoutFields || cfg.Validate() != nil {
+		t.Fatalf("RedisLayout = %q, Validate = %v", cfg.RedisLayout, cfg.Validate())
+	}
+	for _, bad := range []env{
+		{"REDIS_URL": "redis://localhost:6379/0", "REDIS_FIELD_LAYOUT": "fields", "REDIS_MODE": "pubsub"},
+		{"REDIS_URL": "redis://localhost:6379/0", "REDIS_FIELD_LAYOUT": "fields", "RECORD_BATCH_SIZE": "10"},
+		{"REDIS_URL": "redis://localhost:6379/0", "REDIS_FIELD_LAYOUT": "hash"},
+	} {
+		if cfg, err := loadConfig(bad); err == nil && cfg.Validate() == nil {
+			t.Fatalf("accepted %v", bad)
+		}
+	}
+}
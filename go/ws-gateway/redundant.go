@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gorilla/websocket"
+)
+
+// primaryConn is the conn label of the instance's own connection.
+const primaryConn = "0"
+
+func connLabel(index int) string { return strconv.Itoa(index) }
+
+const (
+	legPrimary = "primary"
+	legBackup  = "backup"
+
+	// raceWindow is how many recent frames per topic the race remembers,
+	// enough to cover one endpoint running this far behind the other.
+	raceWindow = 256
+)
+
+// endpointRace merges the primary connection with REDUNDANT_ENDPOINTS: the
+// first copy of each frame from any of them is handled, later copies are
+// dropped. Frames are told apart by topic and update id (or the trade id,
+// or failing both, the frame's bytes). Only the check is serialized: each
+// leg handles the frames it won concurrently with the others, so a slow
+// sink or a busy leg doesn't hold the rest back.
+type endpointRace struct {
+	mu     sync.Mutex
+	recent *symbolLRU[*raceKeys]
+}
+
+// raceKeys is a ring of a topic's latest frame keys.
+type raceKeys struct {
+	keys [raceWindow]string
+	next int
+}
+
+func newEndpointRace(limit stateLimit) *endpointRace {
+	return &endpointRace{recent: newSymbolLRU[*raceKeys](limit, nil)}
+}
+
+// first reports whether this is the first copy of a frame for topic, with
+// key from raceKey.
+func (r *endpointRace) first(topic, key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rk, ok := r.recent.get(topic)
+	if !ok {
+		rk = &raceKeys{}
+		r.recent.put(topic, rk)
+	}
+	for _, k := range rk.keys {
+		if k == key {
+			return false
+		}
+	}
+	rk.keys[rk.next] = key
+	rk.next = (rk.next + 1) % raceWindow
+	return true
+}
+
+// raceKey identifies a frame across endpoints: the book's update id, the
+// ticker's cross sequence or the first trade id, else a hash of message.
+func raceKey(raw map[string]any, message []byte) string {
+	switch data := raw["data"].(type) {
+	case map[string]any:
+		if u, ok := data["u"].(float64); ok {
+			return "u" + strconv.FormatFloat(u, 'f', -1, 64)
+		}
+		if cs, ok := raw["cs"].(float64); ok {
+			return "cs" + strconv.FormatFloat(cs, 'f', -1, 64)
+		}
+	case []any:
+		if len(data) > 0 {
+			if m, ok := data[0].(map[string]any); ok {
+				if id, ok := m["i"].(string); ok {
+					return "i" + id
+				}
+			}
+		}
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(message)
+	return "h" + strconv.FormatUint(h.Sum64(), 16)
+}
+
+// runBackup keeps connection index, to one REDUNDANT_ENDPOINTS url,
+// subscribed to the instance's symbols, feeding its frames into the race,
+// until Stop.
+// Symbol changes reach it on its next reconnect; until then STRICT_SYMBOLS
+// still applies.
+func (g *Gateway) runBackup(index int, url string) {
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = time.Second
+	bo.MaxInterval = 30 * time.Second
+	bo.MaxElapsedTime = 0
+	for g.ctx.Err() == nil {
+		start := time.Now()
+		err := g.backupSession(index, url)
+		if g.ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > bo.MaxInterval {
+			bo.Reset()
+		}
+		d := bo.NextBackOff()
+		log.Printf("instance=%s backup_error url=%s err=%v backoff=%s", g.cfg.Instance, redactURL(url), err, d)
+		if !g.sleep(d) {
+			return
+		}
+	}
+}
+
+// backupSession is one connection to url, from dial to read error.
+func (g *Gateway) backupSession(index int, url string) error {
+	if err := acquireConnSlot(g.ctx); err != nil {
+		return err
+	}
+	defer releaseConnSlot()
+	conn, _, err := g.dialer.Dial(url, nil)
+	if err != nil {
+		return dialPhaseError(err)
+	}
+	label := connLabel(index)
+	g.metrics.activeConns.Inc()
+	defer g.metrics.activeConns.Dec()
+	g.metrics.reconnects.WithLabelValues(label).Inc()
+	g.metrics.connected.WithLabelValues(label).Set(1)
+	defer g.metrics.connected.WithLabelValues(label).Set(0)
+	ctx, cancel := context.WithCancel(g.ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	g.mu.Lock()
+	symbols := prioritize(g.symbols, g.cfg.SymbolPriority)
+	g.mu.Unlock()
+	for _, s := range symbols {
+		// Acks for these carry no req_id, so they leave the
+		// subscription status alone.
+		if err := g.sendBackupOp(conn, "subscribe", g.topicsFor(s)); err != nil {
+			return err
+		}
+		if !g.sleep(100 * time.Millisecond) {
+			return g.ctx.Err()
+		}
+	}
+	log.Printf("instance=%s backup_subscribed url=%s symbols=%d", g.cfg.Instance, redactURL(url), len(symbols))
+	if g.pingInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.pingLoop(ctx, conn, index)
+		}()
+	}
+	return g.readFrames(conn, index, nil)
+}
+
+func (g *Gateway) sendBackupOp(conn *websocket.Conn, op string, args []string) error {
+	b, _ := json.Marshal(map[string]any{"op": op, "args": args})
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+	return conn.WriteMessage(websocket.TextMessage, b)
+}
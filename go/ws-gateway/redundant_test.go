@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRedundantEndpoints(t *testing.T) {
+	primary, backup := newFakeBybit(t), newFakeBybit(t)
+	g, sink := newTestGateway(t, primary.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("redundant")
+	g.cfg.Topics = []string{"tickers"}
+	g.race = newEndpointRace(stateLimit{})
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	pconn := primary.nextConn(t)
+	go g.readLoop()
+	g.legs.Add(1)
+	go func() {
+		defer g.legs.Done()
+		g.runBackup(1, backup.url())
+	}()
+	defer func() {
+		g.cancel()
+		g.legs.Wait()
+	}()
+	bconn := backup.nextConn(t)
+	if op := backup.nextOp(t); op["op"] != "subscribe" {
+		t.Fatalf("backup op = %v", op)
+	}
+
+	ticker := func(cs int) map[string]any {
+		return map[string]any{"topic": "tickers.BTCUSDT", "type": "delta", "ts": 1700000000000 + cs, "cs": cs,
+			"data": map[string]any{"symbol": "BTCUSDT", "lastPrice": "100"}}
+	}
+	sendJSON(t, pconn, ticker(1))
+	waitEvents(t, sink, 1)
+	// The backup's copy of 1 is dropped; it then wins 2.
+	sendJSON(t, bconn, ticker(1))
+	sendJSON(t, bconn, ticker(2))
+	waitEvents(t, sink, 2)
+	sendJSON(t, pconn, ticker(2))
+	sendJSON(t, pconn, ticker(3))
+	evs := waitEvents(t, sink, 3)
+	time.Sleep(50 * time.Millisecond)
+	if evs = sink.Events(); len(evs) != 3 {
+		t.Fatalf("published %d events, want one per frame", len(evs))
+	}
+	for i, ev := range evs {
+		if ev.Ts != 1700000000001+int64(i) {
+			t.Fatalf("event %d ts = %d", i, ev.Ts)
+		}
+	}
+	if got := testutil.ToFloat64(g.metrics.raceWins.WithLabelValues(legPrimary)); got != 2 {
+		t.Fatalf("primary first = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(g.metrics.raceWins.WithLabelValues(legBackup)); got != 1 {
+		t.Fatalf("backup first = %v, want 1", got)
+	}
+	for _, conn := range []string{primaryConn, "1"} {
+		if testutil.ToFloat64(g.metrics.connected.WithLabelValues(conn)) != 1 || testutil.ToFloat64(g.metrics.reconnects.WithLabelValues(conn)) != 1 {
+			t.Fatalf("conn %s not counted as connected once", conn)
+		}
+	}
+	if n := histogramCount(t, g.metrics.exchangeLatency.WithLabelValues("1", "tickers")); n != 1 {
+		t.Fatalf("backup exchange latency samples = %d, want 1", n)
+	}
+}
+
+func TestRaceKey(t *testing.T) {
+	book := map[string]any{"type": "delta", "data": map[string]any{"s": "BTCUSDT", "u": float64(42)}}
+	snapshot := map[string]any{"type": "snapshot", "data": map[string]any{"s": "BTCUSDT", "u": float64(42)}}
+	if raceKey(book, []byte("a")) != raceKey(snapshot, []byte("b")) {
+		t.Fatal("a snapshot and delta with the same update id differ")
+	}
+	trades := map[string]any{"data": []any{map[string]any{"i": "t-1"}}}
+	if got := raceKey(trades, nil); got != "it-1" {
+		t.Fatalf("trade key = %q", got)
+	}
+	other := map[string]any{"data": "x"}
+	if raceKey(other, []byte("a")) == raceKey(other, []byte("b")) {
+		t.Fatal("frames without ids share a key")
+	}
+}
+
+func TestRedundantEndpointsConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"REDUNDANT_ENDPOINTS": "wss://a.example/v5/public, wss://b.example/v5/public"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Redundant) != 2 || cfg.Validate() != nil {
+		t.Fatalf("Redundant = %v, Validate = %v", cfg.Redundant, cfg.Validate())
+	}
+	for _, v := range []string{"https://a.example", cfg.WSURL} {
+		cfg.Redundant = []string{v}
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("REDUNDANT_ENDPOINTS=%s accepted", v)
+		}
+	}
+}
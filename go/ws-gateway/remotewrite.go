@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/klauspost/compress/s2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteFields are the Bybit ticker fields REMOTE_WRITE_FIELDS may
+// name, the numeric ones normalizeTicker reads.
+var remoteWriteFields = map[string]bool{
+	"lastPrice": true, "markPrice": true, "indexPrice": true,
+	"bid1Price": true, "bid1Size": true, "ask1Price": true, "ask1Size": true,
+	"volume24h": true, "turnover24h": true, "fundingRate": true, "openInterest": true,
+}
+
+// remoteWriteMetric names the series of a ticker field, e.g.
+// ws_gateway_ticker_last_price for lastPrice.
+func remoteWriteMetric(field string) string {
+	var b strings.Builder
+	b.WriteString("ws_gateway_ticker_")
+	for _, r := range field {
+		if unicode.IsUpper(r) {
+			b.WriteByte('_')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type remoteSeries struct {
+	metric, symbol string
+}
+
+// remoteWriter keeps the latest value of each REMOTE_WRITE_FIELDS ticker
+// field of each REMOTE_WRITE_SYMBOLS symbol and pushes them all to a
+// Prometheus remote-write endpoint every REMOTE_WRITE_INTERVAL, stamped
+// with the push time like a scrape. Ticker deltas only carry the fields
+// that changed, so a value stays until the next one arrives, unless its
+// symbol has had no ticker for two intervals: then it is dropped, as a
+// scrape target gone quiet goes stale, rather than pushed on as current.
+type remoteWriter struct {
+	instance string
+	url      string
+	symbols  []string
+	fields   map[string]string // ticker field to metric name
+	staleMs  int64
+	client   *http.Client
+
+	mu      sync.Mutex
+	allowed map[string]bool
+	values  map[remoteSeries]float64
+	seen    map[string]int64 // symbol to its last ticker
+}
+
+func newRemoteWriter(cfg Config) *remoteWriter {
+	w := &remoteWriter{
+		instance: cfg.Instance,
+		url:      cfg.RemoteWriteURL,
+		symbols:  cfg.RemoteSymbols,
+		fields:   make(map[string]string, len(cfg.RemoteFields)),
+		staleMs:  2 * cfg.RemoteInterval.Milliseconds(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		values:   make(map[remoteSeries]float64),
+		seen:     make(map[string]int64),
+	}
+	for _, f := range cfg.RemoteFields {
+		w.fields[f] = remoteWriteMetric(f)
+	}
+	w.retain(cfg.Symbols)
+	return w
+}
+
+// retain restricts the series to the allow-listed symbols among those
+// subscribed, dropping the others.
+func (w *remoteWriter) retain(subscribed []string) {
+	sub := make(map[string]bool, len(subscribed))
+	for _, s := range subscribed {
+		sub[s] = true
+	}
+	allowed := make(map[string]bool, len(w.symbols))
+	for _, s := range w.symbols {
+		if sub[s] {
+			allowed[s] = true
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.allowed = allowed
+	for k := range w.values {
+		if !allowed[k.symbol] {
+			delete(w.values, k)
+		}
+	}
+	for s := range w.seen {
+		if !allowed[s] {
+			delete(w.seen, s)
+		}
+	}
+}
+
+// observe records the fields present in a ticker's data, read at now in
+// local Unix ms.
+func (w *remoteWriter) observe(symbol string, data any, now int64) {
+	m, ok := data.(map[string]any)
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.allowed[symbol] {
+		return
+	}
+	w.seen[symbol] = now
+	for field, metric := range w.fields {
+		if v := optFloat(m, field); v != nil && !math.IsNaN(*v) {
+			w.values[remoteSeries{metric, symbol}] = *v
+		}
+	}
+}
+
+// writeRequest encodes the current values as a remote-write WriteRequest
+// stamped ts, series in name order, or returns nil if there are none. The
+// values of symbols without a ticker for two intervals are dropped first.
+func (w *remoteWriter) writeRequest(ts int64) []byte {
+	w.mu.Lock()
+	for s, at := range w.seen {
+		if ts-at > w.staleMs {
+			delete(w.seen, s)
+		}
+	}
+	series := make([]remoteSeries, 0, len(w.values))
+	for k := range w.values {
+		if _, ok := w.seen[k.symbol]; !ok {
+			delete(w.values, k)
+			continue
+		}
+		series = append(series, k)
+	}
+	values := make([]float64, len(series))
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].metric != series[j].metric {
+			return series[i].metric < series[j].metric
+		}
+		return series[i].symbol < series[j].symbol
+	})
+	for i, k := range series {
+		values[i] = w.values[k]
+	}
+	w.mu.Unlock()
+	if len(series) == 0 {
+		return nil
+	}
+	var b, one, sample []byte
+	for i, k := range series {
+		// Labels sorted by name, as remote write requires.
+		one = appendRemoteLabel(one[:0], "__name__", k.metric)
+		one = appendRemoteLabel(one, "instance", w.instance)
+		one = appendRemoteLabel(one, "symbol", k.symbol)
+		sample = protowire.AppendTag(sample[:0], 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(values[i]))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(ts))
+		one = protowire.AppendTag(one, 2, protowire.BytesType)
+		one = protowire.AppendBytes(one, sample)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, one)
+	}
+	return b
+}
+
+func appendRemoteLabel(b []byte, name, value string) []byte {
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendVarint(b, uint64(protowire.SizeTag(1)+protowire.SizeBytes(len(name))+protowire.SizeTag(2)+protowire.SizeBytes(len(value))))
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+// push sends the current values stamped ts; sent is false when there were
+// none yet.
+func (w *remoteWriter) push(ctx context.Context, ts int64) (sent bool, err error) {
+	body := w.writeRequest(ts)
+	if body == nil {
+		return false, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(s2.EncodeSnappy(nil, body)))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("remote write: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return false, fmt.Errorf("remote write: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return true, nil
+}
+
+// watchRemoteWrite pushes every REMOTE_WRITE_INTERVAL. A failed push isn't
+// retried: the next one carries the then current values.
+func (g *Gateway) watchRemoteWrite() {
+	t := time.NewTicker(g.cfg.RemoteInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-t.C:
+			ctx, cancel := context.WithTimeout(g.ctx, g.cfg.RemoteInterval)
+			sent, err := g.remoteWrite.push(ctx, g.clock.Now().UnixMilli())
+			cancel()
+			if err != nil {
+				g.metrics.remoteWrites.WithLabelValues("error").Inc()
+				log.Printf("instance=%s remote_write_error url=%s err=%v", g.cfg.Instance, redactURL(g.cfg.RemoteWriteURL), err)
+				continue
+			}
+			if sent {
+				g.metrics.remoteWrites.WithLabelValues("ok").Inc()
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+const (
+	sourceWS     = "ws"
+	sourceReplay = "replay"
+)
+
+// eventSource yields recorded events in order and returns io.EOF when
+// exhausted.
+type eventSource interface {
+	Next(ctx context.Context) (OutEvent, error)
+	Close() error
+}
+
+func isRedisURL(s string) bool {
+	return strings.HasPrefix(s, "redis://") || strings.HasPrefix(s, "rediss://")
+}
+
+func openReplaySource(cfg Config) (eventSource, error) {
+	if isRedisURL(cfg.ReplayPath) {
+		opt, err := redis.ParseURL(cfg.ReplayPath)
+		if err != nil {
+			return nil, urlError(err)
+		}
+		return &redisStreamSource{client: redis.NewClient(opt), stream: cfg.ReplayStream, cursor: "-"}, nil
+	}
+	f, err := os.Open(cfg.ReplayPath)
+	if err != nil {
+		return nil, err
+	}
+	return newNDJSONSource(f), nil
+}
+
+// ndjsonSource reads one JSON-encoded OutEvent per line.
+type ndjsonSource struct {
+	r  io.ReadCloser
+	sc *bufio.Scanner
+}
+
+func newNDJSONSource(r io.ReadCloser) *ndjsonSource {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	return &ndjsonSource{r: r, sc: sc}
+}
+
+func (s *ndjsonSource) Next(_ context.Context) (OutEvent, error) {
+	for s.sc.Scan() {
+		line := s.sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var ev OutEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			return OutEvent{}, fmt.Errorf("decode replay line: %w", err)
+		}
+		return ev, nil
+	}
+	if err := s.sc.Err(); err != nil {
+		return OutEvent{}, err
+	}
+	return OutEvent{}, io.EOF
+}
+
+func (s *ndjsonSource) Close() error { return s.r.Close() }
+
+// redisStreamSource pages through a stream written by the Redis sink.
+type redisStreamSource struct {
+	client *redis.Client
+	stream string
+	cursor string
+	buf    []redis.XMessage
+}
+
+const redisReplayPage = 500
+
+func (s *redisStreamSource) Next(ctx context.Context) (OutEvent, error) {
+	for len(s.buf) == 0 {
+		msgs, err := s.client.XRangeN(ctx, s.stream, s.cursor, "+", redisReplayPage).Result()
+		if err != nil {
+			return OutEvent{}, err
+		}
+		if len(msgs) == 0 {
+			return OutEvent{}, io.EOF
+		}
+		s.buf = msgs
+		s.cursor = "(" + msgs[len(msgs)-1].ID
+	}
+	msg := s.buf[0]
+	s.buf = s.buf[1:]
+
+	ev, err := decodeStreamEntry(msg.Values)
+	if err != nil {
+		return OutEvent{}, fmt.Errorf("decode stream entry %s: %w", msg.ID, err)
+	}
+	return ev, nil
+}
+
+func (s *redisStreamSource) Close() error { return s.client.Close() }
+
+// runReplay publishes every event from src through the normal publish path.
+// With speed > 0 events are paced by the gaps between their Ts values
+// divided by speed; speed 0 replays as fast as the sinks accept.
+func (g *Gateway) runReplay(src eventSource, speed float64) (int, error) {
+	var n int
+	var prevTs int64
+	for {
+		ev, err := src.Next(g.ctx)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if speed > 0 && n > 0 && ev.Ts > prevTs {
+			wait := time.Duration(float64(time.Duration(ev.Ts-prevTs)*time.Millisecond) / speed)
+			select {
+			case <-time.After(wait):
+			case <-g.ctx.Done():
+				return n, g.ctx.Err()
+			}
+		}
+		prevTs = ev.Ts
+		g.metrics.messages.WithLabelValues("replay").Inc()
+		g.publish(ev)
+		n++
+	}
+}
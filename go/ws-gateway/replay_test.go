@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+const replayFixture = `{"ts":1000,"symbol":"BTCUSDT","type":"tickers.BTCUSDT","payload":{"lastPrice":"1"}}
+
+{"ts":1050,"symbol":"ETHUSDT","type":"tickers.ETHUSDT","payload":{"lastPrice":"2"}}
+{"ts":1100,"symbol":"BTCUSDT","type":"orderbook.25.BTCUSDT","payload":{"u":3}}
+`
+
+func TestReplayPublishesInOrder(t *testing.T) {
+	g, sink := newTestGateway(t, "", "BTCUSDT")
+	src := newNDJSONSource(io.NopCloser(strings.NewReader(replayFixture)))
+
+	n, err := g.runReplay(src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("replayed %d events, want 3", n)
+	}
+	evs := sink.Events()
+	if evs[0].Ts != 1000 || evs[1].Symbol != "ETHUSDT" || evs[2].Type != "orderbook.25.BTCUSDT" {
+		t.Fatalf("events = %+v", evs)
+	}
+}
+
+func TestReplayPacing(t *testing.T) {
+	g, _ := newTestGateway(t, "", "BTCUSDT")
+	src := newNDJSONSource(io.NopCloser(strings.NewReader(replayFixture)))
+
+	start := time.Now()
+	// 100ms of recorded time at 5x speed.
+	if _, err := g.runReplay(src, 5); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("replay took %s, want >= 20ms", d)
+	}
+}
+
+func TestReplayRejectsMalformedLine(t *testing.T) {
+	g, _ := newTestGateway(t, "", "BTCUSDT")
+	src := newNDJSONSource(io.NopCloser(strings.NewReader("{not json}\n")))
+	if _, err := g.runReplay(src, 0); err == nil {
+		t.Fatal("expected decode error")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// sinkCredentials are the settings a credential rotation may change; the
+// rest of the sink configuration needs a restart.
+type sinkCredentials struct {
+	redisURL, schemaRegistry, kafkaUser, kafkaPassword string
+}
+
+func (c Config) sinkCredentials() sinkCredentials {
+	return sinkCredentials{c.RedisURL, c.SchemaRegistry, c.KafkaUser, c.KafkaPassword}
+}
+
+func (c Config) withSinkCredentials(cr sinkCredentials) Config {
+	c.RedisURL, c.SchemaRegistry, c.KafkaUser, c.KafkaPassword = cr.redisURL, cr.schemaRegistry, cr.kafkaUser, cr.kafkaPassword
+	return c
+}
+
+// rotatingSink lets the sink be replaced while the gateway runs. A swap
+// waits for in-flight publishes to the old sink to return; publishes
+// arriving meanwhile wait for the new one, so the publish queue keeps
+// buffering rather than losing events.
+type rotatingSink struct {
+	mu   sync.RWMutex
+	cur  Sink
+	name string
+}
+
+func newRotatingSink(s Sink) *rotatingSink { return &rotatingSink{cur: s, name: s.Name()} }
+
+func (s *rotatingSink) Name() string { return s.name }
+
+func (s *rotatingSink) Publish(ctx context.Context, ev OutEvent) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cur.Publish(ctx, ev)
+}
+
+func (s *rotatingSink) Ping(ctx context.Context) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if p, ok := s.cur.(sinkPinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// swap installs next and returns the sink it replaced, which no publish is
+// using any more.
+func (s *rotatingSink) swap(next Sink) Sink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.cur
+	s.cur = next
+	return old
+}
+
+func (s *rotatingSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cur.Close()
+}
+
+// rotateSink rebuilds the sink with the credentials in fresh, a newly loaded
+// configuration for this instance, if they changed. The new sink must answer
+// within SINK_CONNECT_TIMEOUT or the old one is kept. The old sink is closed
+// once swapped out, flushing its pending writes. A DLQ_REDIS_STREAM client
+// follows a new REDIS_URL.
+func (g *Gateway) rotateSink(fresh Config) (bool, error) {
+	rs, ok := g.sink.(*rotatingSink)
+	if !ok {
+		return false, fmt.Errorf("sink %s can't be rotated", g.sink.Name())
+	}
+	g.rotateMu.Lock()
+	defer g.rotateMu.Unlock()
+	creds := fresh.sinkCredentials()
+	if creds == g.creds || g.ctx.Err() != nil || g.draining() {
+		return false, nil
+	}
+	next := newSink(g.cfg.withSinkCredentials(creds), g.metrics)
+	if err := waitSinkReady(g.ctx, next, g.cfg.SinkConnect); err != nil {
+		next.Close()
+		return false, err
+	}
+	g.closeSink(rs.swap(next))
+	if d, ok := g.dlq.(*redisDeadLetters); ok && creds.redisURL != g.creds.redisURL {
+		// Dead letters go to the same Redis, so the old password is
+		// likely on its way out there too.
+		if err := d.rotate(creds.redisURL); err != nil {
+			log.Printf("instance=%s dead_letter_rotate_error err=%v", g.cfg.Instance, err)
+		}
+	}
+	g.creds = creds
+	return true, nil
+}
+
+// rotateSinks re-reads the configuration, including _FILE secrets, and
+// rotates every gateway's sink credentials. A gateway whose rotation fails
+// keeps its current sink.
+func (s gatewaySet) rotateSinks() {
+	cfgs, err := loadValidConfigs()
+	if err != nil {
+		log.Printf("sink_rotate_error err=%v", err)
+		return
+	}
+	byInstance := make(map[string]Config, len(cfgs))
+	for _, cfg := range cfgs {
+		byInstance[cfg.Instance] = cfg
+	}
+	for _, g := range s {
+		fresh, ok := byInstance[g.cfg.Instance]
+		if !ok {
+			continue
+		}
+		rotated, err := g.rotateSink(fresh)
+		if err != nil {
+			log.Printf("instance=%s sink_rotate_error err=%v", g.cfg.Instance, err)
+			continue
+		}
+		if rotated {
+			log.Printf("instance=%s sink_rotated sink=%s", g.cfg.Instance, g.sink.Name())
+		}
+	}
+}
+
+// rotateOnSignal rotates sink credentials on every signal received on ch.
+func (s gatewaySet) rotateOnSignal(ch <-chan os.Signal) {
+	for range ch {
+		s.rotateSinks()
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+func TestRotatingSinkWaitsForInFlightPublish(t *testing.T) {
+	old := &blockingSink{release: make(chan struct{})}
+	s := newRotatingSink(old)
+	go s.Publish(context.Background(), OutEvent{})
+	time.Sleep(20 * time.Millisecond)
+
+	next := &memSink{}
+	swapped := make(chan Sink)
+	go func() { swapped <- s.swap(next) }()
+	select {
+	case <-swapped:
+		t.Fatal("swap returned while a publish to the old sink was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(old.release)
+	if got := <-swapped; got != old {
+		t.Fatalf("swap returned %v, want the old sink", got)
+	}
+	if err := s.Publish(context.Background(), OutEvent{Symbol: "BTCUSDT"}); err != nil {
+		t.Fatal(err)
+	}
+	if evs := next.Events(); len(evs) != 1 {
+		t.Fatalf("new sink got %d events, want 1", len(evs))
+	}
+	if s.Name() != "blocking" {
+		t.Fatalf("name = %q, want the original sink's", s.Name())
+	}
+}
+
+func TestRotateSinkOnCredentialChange(t *testing.T) {
+	g, _ := newTestGateway(t, "")
+	rs := newRotatingSink(&memSink{})
+	g.sink = rs
+	dlq := &redisDeadLetters{client: redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"}), stream: "md_dead"}
+	g.dlq = dlq
+
+	if rotated, err := g.rotateSink(g.cfg); err != nil || rotated {
+		t.Fatalf("unchanged credentials: rotated=%v err=%v", rotated, err)
+	}
+	fresh := g.cfg
+	fresh.RedisURL = "redis://:rotated@127.0.0.1:1"
+	rotated, err := g.rotateSink(fresh)
+	if err != nil || !rotated {
+		t.Fatalf("rotated=%v err=%v", rotated, err)
+	}
+	if _, ok := rs.cur.(*redisSink); !ok {
+		t.Fatalf("sink after rotation = %T, want *redisSink", rs.cur)
+	}
+	if g.creds.redisURL != fresh.RedisURL {
+		t.Fatalf("creds = %+v", g.creds)
+	}
+	if pw := dlq.client.Options().Password; pw != "rotated" {
+		t.Fatalf("dead-letter client password = %q after rotation", pw)
+	}
+	rs.Close()
+	dlq.Close()
+
+	if _, err := (&Gateway{sink: &memSink{}}).rotateSink(fresh); err == nil {
+		t.Fatal("expected error for a sink that can't be rotated")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	sinkRedis = "redis"
+	sinkKafka = "kafka"
+	sinkNone  = "none"
+
+	routeAny       = "*"
+	routeDefault   = "default"
+	routeRawSuffix = "@raw"
+)
+
+// sinkRoute sends events for a set of symbols, or every symbol for "*", to
+// one or more sinks. name is the symbol list as written and labels the route
+// metrics. A raw route only takes the raw copies EMIT_BOTH publishes.
+type sinkRoute struct {
+	name    string
+	symbols map[string]struct{}
+	raw     bool
+	sinks   []string
+}
+
+func (r sinkRoute) matches(ev *OutEvent) bool {
+	if r.raw && !strings.HasSuffix(ev.Type, rawTypeSuffix) {
+		return false
+	}
+	if r.symbols == nil {
+		return true
+	}
+	_, ok := r.symbols[ev.Symbol]
+	return ok
+}
+
+// parseSinkRoutes parses SINK_ROUTES: ';'-separated rules of the form
+// "SYM1,SYM2->sink1,sink2", where "*" matches any symbol. A "@raw" suffix on
+// the symbols, as in "*@raw->kafka", restricts the rule to EMIT_BOTH's raw
+// copies. Rules are tried in order and the first match wins.
+func parseSinkRoutes(v string) ([]sinkRoute, error) {
+	var routes []sinkRoute
+	for _, rule := range strings.Split(v, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		lhs, rhs, ok := strings.Cut(rule, "->")
+		if !ok {
+			return nil, fmt.Errorf("rule %q: expected symbols->sinks", rule)
+		}
+		lhs, raw := strings.CutSuffix(strings.TrimSpace(lhs), routeRawSuffix)
+		r := sinkRoute{name: strings.Join(splitList(lhs), ","), raw: raw}
+		if r.name == "" {
+			return nil, fmt.Errorf("rule %q: no symbols", rule)
+		}
+		if r.name != routeAny {
+			r.symbols = make(map[string]struct{})
+			for _, s := range splitList(lhs) {
+				r.symbols[s] = struct{}{}
+			}
+		}
+		if raw {
+			r.name += routeRawSuffix
+		}
+		for _, name := range splitList(rhs) {
+			switch name {
+			case sinkRedis, sinkKafka, sinkNone:
+			default:
+				return nil, fmt.Errorf("rule %q: unknown sink %q (want redis|kafka|none)", rule, name)
+			}
+			r.sinks = append(r.sinks, name)
+		}
+		if len(r.sinks) == 0 {
+			return nil, fmt.Errorf("rule %q: no sinks", rule)
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// defaultRoute is the route for events no rule matches: a "*" rule if there
+// is one, otherwise the sink used without SINK_ROUTES.
+func (c Config) defaultRoute(routes []sinkRoute) sinkRoute {
+	for _, r := range routes {
+		if r.symbols == nil && !r.raw {
+			return r
+		}
+	}
+	return sinkRoute{name: routeDefault, sinks: []string{c.defaultSink()}}
+}
+
+func routeSinkNames(routes []sinkRoute) []string {
+	var names []string
+	for _, r := range routes {
+		names = append(names, r.sinks...)
+	}
+	return names
+}
+
+// routedSink publishes each event to the sinks of the first route matching
+// it.
+type routedSink struct {
+	routes []resolvedRoute
+	def    resolvedRoute
+	sinks  []Sink
+}
+
+type resolvedRoute struct {
+	sinkRoute
+	targets []Sink
+	events  []prometheus.Counter
+	errors  []prometheus.Counter
+}
+
+// newRoutedSink builds one sink per name the routes use. sinkFor constructs
+// a sink by name.
+func newRoutedSink(routes []sinkRoute, def sinkRoute, m *gatewayMetrics, sinkFor func(string) Sink) *routedSink {
+	s := &routedSink{}
+	byName := map[string]Sink{}
+	resolve := func(r sinkRoute) resolvedRoute {
+		rr := resolvedRoute{sinkRoute: r}
+		for _, name := range r.sinks {
+			sink, ok := byName[name]
+			if !ok {
+				sink = sinkFor(name)
+				byName[name] = sink
+				s.sinks = append(s.sinks, sink)
+			}
+			l := prometheus.Labels{"route": r.name, "sink": name}
+			rr.targets = append(rr.targets, sink)
+			rr.events = append(rr.events, m.routeEvents.With(l))
+			rr.errors = append(rr.errors, m.routeErrors.With(l))
+		}
+		return rr
+	}
+	for _, r := range routes {
+		s.routes = append(s.routes, resolve(r))
+	}
+	s.def = resolve(def)
+	return s
+}
+
+func (s *routedSink) Name() string {
+	names := make([]string, len(s.sinks))
+	for i, sink := range s.sinks {
+		names[i] = sink.Name()
+	}
+	sort.Strings(names)
+	return strings.Join(names, "+")
+}
+
+func (s *routedSink) route(ev *OutEvent) *resolvedRoute {
+	for i := range s.routes {
+		if s.routes[i].matches(ev) {
+			return &s.routes[i]
+		}
+	}
+	return &s.def
+}
+
+// Publish delivers ev to every sink of its route and fails if any of them
+// did.
+func (s *routedSink) Publish(ctx context.Context, ev OutEvent) error {
+	r := s.route(&ev)
+	var errs []error
+	for i, sink := range r.targets {
+		if err := sink.Publish(ctx, ev); err != nil {
+			r.errors[i].Inc()
+			errs = append(errs, fmt.Errorf("%s: %w", sink.Name(), err))
+			continue
+		}
+		r.events[i].Inc()
+	}
+	return errors.Join(errs...)
+}
+
+// Ping checks every sink the routes use.
+func (s *routedSink) Ping(ctx context.Context) error {
+	for _, sink := range s.sinks {
+		if p, ok := sink.(sinkPinger); ok {
+			if err := p.Ping(ctx); err != nil {
+				return fmt.Errorf("%s: %w", sink.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *routedSink) Close() error {
+	var errs []error
+	for _, sink := range s.sinks {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
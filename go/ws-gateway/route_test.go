@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseSinkRoutes(t *testing.T) {
+	routes, err := parseSinkRoutes("BTCUSDT, ETHUSDT->redis; *->kafka")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes[0].name != "BTCUSDT,ETHUSDT" || routes[1].name != "*" {
+		t.Fatalf("routes = %+v", routes)
+	}
+	if !routes[0].matches(&OutEvent{Symbol: "ETHUSDT"}) || routes[0].matches(&OutEvent{Symbol: "SOLUSDT"}) || !routes[1].matches(&OutEvent{Symbol: "SOLUSDT"}) {
+		t.Fatal("unexpected match")
+	}
+	for _, bad := range []string{"BTCUSDT", "->redis", "BTCUSDT->", "BTCUSDT->s3"} {
+		if _, err := parseSinkRoutes(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestRawRoutes(t *testing.T) {
+	routes, err := parseSinkRoutes("*@raw->kafka; BTCUSDT @raw->none; *->redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes[0].name != "*@raw" || !routes[0].raw || routes[1].name != "BTCUSDT@raw" || routes[2].raw {
+		t.Fatalf("routes = %+v", routes)
+	}
+	raw := &OutEvent{Symbol: "ETHUSDT", Type: "tickers.ETHUSDT" + rawTypeSuffix}
+	normalized := &OutEvent{Symbol: "ETHUSDT", Type: "tickers.ETHUSDT"}
+	if !routes[0].matches(raw) || routes[0].matches(normalized) {
+		t.Fatal("raw route must take only raw copies")
+	}
+	if def := (Config{}).defaultRoute(routes); def.name != "*" {
+		t.Fatalf("default route = %q, want the plain * rule", def.name)
+	}
+}
+
+func TestEmitBoth(t *testing.T) {
+	g, sink := newTestGateway(t, "")
+	g.metrics = newGatewayMetrics("emit_both")
+	g.cfg.EmitBoth = true
+	g.payloadMode = payloadNormalized
+	g.emit(OutEvent{Symbol: "BTCUSDT", Type: "tickers.BTCUSDT", Payload: map[string]any{"symbol": "BTCUSDT", "lastPrice": "100"}})
+	evs := sink.Events()
+	if len(evs) != 2 || evs[0].Type != "tickers.BTCUSDT.raw" || evs[1].Type != "tickers.BTCUSDT" {
+		t.Fatalf("events = %+v", evs)
+	}
+	if _, ok := evs[0].Payload.(map[string]any); !ok {
+		t.Fatalf("raw payload = %T", evs[0].Payload)
+	}
+	if _, ok := evs[1].Payload.(map[string]any); ok {
+		t.Fatalf("normalized payload left raw: %T", evs[1].Payload)
+	}
+	for _, stream := range []string{payloadRaw, payloadNormalized} {
+		if n := testutil.ToFloat64(g.metrics.emitted.WithLabelValues(stream)); n != 1 {
+			t.Fatalf("emitted{stream=%s} = %v", stream, n)
+		}
+	}
+
+	cfg, err := loadConfig(env{"EMIT_BOTH": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected EMIT_BOTH with raw PAYLOAD_MODE to be rejected")
+	}
+}
+
+func TestValidateSinkRoutes(t *testing.T) {
+	cfg, err := loadConfig(env{"SINK_ROUTES": "BTCUSDT->redis;*->kafka", "KAFKA_BROKERS": "k:9092"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for route to unconfigured redis")
+	}
+	cfg.RedisURL = "redis://r:6379"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.SinkNames(); len(got) != 2 || got[0] != "kafka" || got[1] != "redis" {
+		t.Fatalf("SinkNames = %v", got)
+	}
+}
+
+func TestRoutedSink(t *testing.T) {
+	cfg := Config{RedisURL: "redis://r:6379", KafkaBrokers: []string{"k:9092"}}
+	routes, err := parseSinkRoutes("BTCUSDT,ETHUSDT->redis,kafka;SOLUSDT->kafka")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sinks := map[string]*memSink{}
+	m := newGatewayMetrics("route-test")
+	s := newRoutedSink(routes, cfg.defaultRoute(routes), m, func(name string) Sink {
+		sinks[name] = &memSink{}
+		return sinks[name]
+	})
+
+	for _, sym := range []string{"BTCUSDT", "SOLUSDT", "XRPUSDT"} {
+		if err := s.Publish(context.Background(), OutEvent{Symbol: sym}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// XRPUSDT matches no rule and takes the default route, Redis here.
+	if got := len(sinks["redis"].Events()); got != 2 {
+		t.Fatalf("redis got %d events, want 2", got)
+	}
+	if got := len(sinks["kafka"].Events()); got != 2 {
+		t.Fatalf("kafka got %d events, want 2", got)
+	}
+	if got := testutil.ToFloat64(m.routeEvents.WithLabelValues(routeDefault, sinkRedis)); got != 1 {
+		t.Fatalf("default route events = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.routeEvents.WithLabelValues("BTCUSDT,ETHUSDT", sinkKafka)); got != 1 {
+		t.Fatalf("BTCUSDT,ETHUSDT->kafka events = %v, want 1", got)
+	}
+}
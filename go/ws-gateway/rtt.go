@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// rttEpoch and rttNonce make RTT_METRICS ping payloads: the process's
+// random nonce and the monotonic send time since rttEpoch, which the pong
+// echoes back. Pongs to other pings, such as connAlive's empty one, don't
+// carry the nonce and are ignored.
+var (
+	rttEpoch = time.Now()
+	rttNonce = newRTTNonce()
+)
+
+func newRTTNonce() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func rttPayload(now time.Time) []byte {
+	return []byte(rttNonce + ":" + strconv.FormatInt(int64(now.Sub(rttEpoch)), 10))
+}
+
+// pongRTT is the round trip of the ping a pong with payload answers.
+func pongRTT(payload string, now time.Time) (time.Duration, bool) {
+	nonce, sent, ok := strings.Cut(payload, ":")
+	if !ok || nonce != rttNonce {
+		return 0, false
+	}
+	ns, err := strconv.ParseInt(sent, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return now.Sub(rttEpoch) - time.Duration(ns), true
+}
+
+// sendRTTPing sends a WS control ping timed by the pong handler.
+func sendRTTPing(conn *websocket.Conn) error {
+	return conn.WriteControl(websocket.PingMessage, rttPayload(time.Now()), time.Now().Add(time.Second))
+}
+
+// observePong records the RTT of connection index's pong, if it answers an
+// RTT_METRICS ping.
+func (g *Gateway) observePong(index int, payload string) {
+	d, ok := pongRTT(payload, time.Now())
+	if !ok {
+		return
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	label := connLabel(index)
+	g.metrics.rtt.WithLabelValues(label).Observe(ms)
+	g.metrics.rttLast.WithLabelValues(label).Set(ms)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPongRTT(t *testing.T) {
+	sent := time.Now()
+	payload := string(rttPayload(sent))
+	if d, ok := pongRTT(payload, sent.Add(15*time.Millisecond)); !ok || d != 15*time.Millisecond {
+		t.Fatalf("pongRTT = %v, %v", d, ok)
+	}
+	for _, p := range []string{"", "other:1", rttNonce + ":x"} {
+		if _, ok := pongRTT(p, sent); ok {
+			t.Fatalf("pongRTT(%q) matched", p)
+		}
+	}
+}
+
+func TestRTTMetrics(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("rtt")
+	g.cfg.RTTMetrics = true
+	g.pingInterval = 10 * time.Millisecond
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	fake.nextConn(t)
+	go g.readLoop()
+
+	// The fake server answers WS pings with gorilla's default handler.
+	deadline := time.Now().Add(2 * time.Second)
+	for histogramCount(t, g.metrics.rtt.WithLabelValues(primaryConn)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no RTT recorded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if last := testutil.ToFloat64(g.metrics.rttLast.WithLabelValues(primaryConn)); last <= 0 || last > 2000 {
+		t.Fatalf("last RTT = %vms", last)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// outEventSchema is the JSON Schema of the event contract. VALIDATE_OUTPUT
+// checks events against it, and the tests hold OutEvent and the normalized
+// payloads to it.
+//
+//go:embed outevent.schema.json
+var outEventSchema []byte
+
+// jsonSchema is the subset of JSON Schema outevent.schema.json uses: type,
+// enum, required, properties, additionalProperties: false, items, minLength,
+// minimum and local $refs into $defs.
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []any                  `json:"enum"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinLength            *int                   `json:"minLength"`
+	Minimum              *float64               `json:"minimum"`
+	Ref                  string                 `json:"$ref"`
+	Defs                 map[string]*jsonSchema `json:"$defs"`
+}
+
+// schemaTypes is "type", either one name or a list of them.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var one string
+	if json.Unmarshal(b, &one) == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(t))
+}
+
+// eventValidator validates encoded events against the root schema and
+// normalized payloads against their $defs entry.
+type eventValidator struct {
+	root *jsonSchema
+}
+
+func newEventValidator() (*eventValidator, error) {
+	var s jsonSchema
+	if err := json.Unmarshal(outEventSchema, &s); err != nil {
+		return nil, fmt.Errorf("outevent.schema.json: %w", err)
+	}
+	return &eventValidator{root: &s}, nil
+}
+
+// payloadDef names the $defs entry for ev's payload; raw payloads are the
+// venue's own and are not checked.
+func payloadDef(ev OutEvent) string {
+	switch ev.Payload.(type) {
+	case NormalizedBook:
+		return "NormalizedBook"
+	case NormalizedTicker:
+		return "NormalizedTicker"
+	}
+	return ""
+}
+
+func (v *eventValidator) validate(ev OutEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	if err := v.check(v.root, doc, "$"); err != nil {
+		return err
+	}
+	if def := payloadDef(ev); def != "" {
+		return v.check(v.root.Defs[def], doc["payload"], "$.payload")
+	}
+	return nil
+}
+
+func (v *eventValidator) check(s *jsonSchema, val any, path string) error {
+	if s.Ref != "" {
+		name, ok := strings.CutPrefix(s.Ref, "#/$defs/")
+		def := v.root.Defs[name]
+		if !ok || def == nil {
+			return fmt.Errorf("%s: unresolvable $ref %q", path, s.Ref)
+		}
+		s = def
+	}
+	if len(s.Type) > 0 && !s.Type.match(val) {
+		return fmt.Errorf("%s: want %s, got %s", path, strings.Join(s.Type, "|"), jsonType(val))
+	}
+	if len(s.Enum) > 0 && !enumHas(s.Enum, val) {
+		return fmt.Errorf("%s: %v is not one of %v", path, val, s.Enum)
+	}
+	switch x := val.(type) {
+	case string:
+		if s.MinLength != nil && len([]rune(x)) < *s.MinLength {
+			return fmt.Errorf("%s: shorter than %d", path, *s.MinLength)
+		}
+	case float64:
+		if s.Minimum != nil && x < *s.Minimum {
+			return fmt.Errorf("%s: %v is below %v", path, x, *s.Minimum)
+		}
+	case []any:
+		if s.Items != nil {
+			for i, item := range x {
+				if err := v.check(s.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		for _, k := range s.Required {
+			if _, ok := x[k]; !ok {
+				return fmt.Errorf("%s: missing %q", path, k)
+			}
+		}
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			prop, ok := s.Properties[k]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected %q", path, k)
+				}
+				continue
+			}
+			if err := v.check(prop, x[k], path+"."+k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t schemaTypes) match(val any) bool {
+	got := jsonType(val)
+	for _, want := range t {
+		if want == got || (want == "number" && got == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType names val's JSON type as decoded by encoding/json, telling
+// integers apart from other numbers.
+func jsonType(val any) string {
+	switch x := val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if x == math.Trunc(x) && !math.IsInf(x, 0) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", val)
+}
+
+func enumHas(enum []any, val any) bool {
+	for _, e := range enum {
+		if e == val {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestSchemaMatchesTypes keeps outevent.schema.json and the Go types that
+// produce events in step.
+func TestSchemaMatchesTypes(t *testing.T) {
+	v, err := newEventValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		schema *jsonSchema
+		typ    reflect.Type
+	}{
+		{v.root, reflect.TypeOf(OutEvent{})},
+		{v.root.Defs["NormalizedBook"], reflect.TypeOf(NormalizedBook{})},
+		{v.root.Defs["NormalizedTicker"], reflect.TypeOf(NormalizedTicker{})},
+		{v.root.Defs["Level"], reflect.TypeOf(Level{})},
+		{v.root.Properties["part"], reflect.TypeOf(Part{})},
+	} {
+		var fields []string
+		for i := 0; i < c.typ.NumField(); i++ {
+			fields = append(fields, strings.Split(c.typ.Field(i).Tag.Get("json"), ",")[0])
+		}
+		var props []string
+		for k := range c.schema.Properties {
+			props = append(props, k)
+		}
+		sort.Strings(fields)
+		sort.Strings(props)
+		if !reflect.DeepEqual(fields, props) {
+			t.Errorf("%s fields %v, schema properties %v", c.typ.Name(), fields, props)
+		}
+	}
+}
+
+func TestValidateEvent(t *testing.T) {
+	v, err := newEventValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	price := 100.5
+	for _, ev := range []OutEvent{
+		{Ts: 1, Symbol: "BTCUSDT", Type: "orderbook.50", Action: actionSnapshot, Payload: NormalizedBook{Bids: []Level{{100, 1}}, Asks: []Level{{101, 2}}, UpdateID: 7}},
+		{Ts: 1, Symbol: "BTCUSDT", Type: "orderbook.50", Action: actionUpdate, Payload: NormalizedBook{}},
+		{Ts: 1, Symbol: "BTCUSDT", Type: "orderbook.50", Action: actionSnapshot, Payload: NormalizedBook{Bids: []Level{{100, 1}}}, Part: &Part{Index: 1, Total: 2}},
+		{Ts: 1, Symbol: "BTCUSDT", Type: "tickers", Action: actionDelta, Payload: NormalizedTicker{LastPrice: &price}},
+		{Ts: 1, Symbol: "BTCUSDT", Type: "tickers.raw", Payload: map[string]any{"lastPrice": "100.5"}, Raw: json.RawMessage(`{}`)},
+	} {
+		if err := v.validate(ev); err != nil {
+			t.Errorf("validate(%+v) = %v", ev, err)
+		}
+	}
+	for _, c := range []struct {
+		ev   OutEvent
+		want string
+	}{
+		{OutEvent{Ts: 1, Type: "tickers"}, `$.symbol: shorter than 1`},
+		{OutEvent{Symbol: "BTCUSDT", Type: "tickers"}, `$.ts: 0 is below 1`},
+		{OutEvent{Ts: 1, Symbol: "BTCUSDT", Type: "tickers", Action: "insert"}, `$.action: insert is not one of`},
+		{OutEvent{Ts: 1, Symbol: "BTCUSDT", Type: "orderbook.1", Payload: NormalizedBook{Bids: []Level{{-1, 1}}}}, `$.payload.bids[0].price: -1 is below 0`},
+	} {
+		if err := v.validate(c.ev); err == nil || !strings.HasPrefix(err.Error(), c.want) {
+			t.Errorf("validate(%+v) = %v, want %q", c.ev, err, c.want)
+		}
+	}
+}
+
+func TestValidateOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dlq.ndjson")
+	g, sink := newTestGateway(t, "")
+	g.metrics = newGatewayMetrics("validate_output")
+	g.cfg.DLQFile = path
+	dlq, err := newDeadLetterQueue(g.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.dlq = dlq
+	defer dlq.Close()
+	if g.validator, err = newEventValidator(); err != nil {
+		t.Fatal(err)
+	}
+
+	g.deliver(OutEvent{Ts: 1, Symbol: "BTCUSDT", Type: "tickers", Payload: NormalizedTicker{}})
+	g.deliver(OutEvent{Ts: 1, Type: "tickers", Payload: NormalizedTicker{}})
+	if n := len(sink.Events()); n != 1 {
+		t.Fatalf("published %d events, want the valid one", n)
+	}
+	if got := testutil.ToFloat64(g.metrics.schemaInvalid); got != 1 {
+		t.Fatalf("schema_invalid = %v", got)
+	}
+	recs := readDeadLetters(t, path)
+	if len(recs) != 1 || recs[0].Reason != deadLetterSchema || recs[0].Attempts != 0 || !strings.Contains(recs[0].Error, "$.symbol") {
+		t.Fatalf("dead letters = %+v", recs)
+	}
+}
+
+func TestValidateOutputConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"VALIDATE_OUTPUT": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.ValidateOutput {
+		t.Fatal("VALIDATE_OUTPUT not loaded")
+	}
+}
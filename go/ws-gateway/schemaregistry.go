@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	kafkaFormatJSON     = "json"
+	kafkaFormatProtobuf = "protobuf"
+	kafkaFormatAvro     = "avro"
+
+	contentTypeProtobuf = "application/x-protobuf"
+)
+
+func parseKafkaFormat(v string) (string, error) {
+	switch v {
+	case kafkaFormatJSON, kafkaFormatProtobuf, kafkaFormatAvro:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown kafka format %q (want json|protobuf|avro)", v)
+}
+
+//go:embed outevent.proto
+var outEventProto string
+
+// schemaRegistry registers the OutEvent schema for a KAFKA_FORMAT with a
+// Confluent-compatible registry and caches the id it is assigned.
+// Registration is idempotent, so the first successful call on each process
+// returns the existing id.
+type schemaRegistry struct {
+	url     string
+	subject string
+	format  string
+	client  *http.Client
+
+	mu sync.Mutex
+	id uint32
+}
+
+func newSchemaRegistry(rawURL, subject, format string) *schemaRegistry {
+	return &schemaRegistry{
+		url:     strings.TrimRight(rawURL, "/"),
+		subject: subject,
+		format:  format,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (r *schemaRegistry) schemaID(ctx context.Context) (uint32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.id != 0 {
+		return r.id, nil
+	}
+	schemaType, schema := "PROTOBUF", outEventProto
+	if r.format == kafkaFormatAvro {
+		schemaType, schema = "AVRO", outEventAvsc
+	}
+	body, err := json.Marshal(map[string]string{"schemaType": schemaType, "schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	endpoint := r.url + "/subjects/" + url.PathEscape(r.subject) + "/versions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("schema registry: %w", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("schema registry: register %s: %s: %s", r.subject, resp.Status, strings.TrimSpace(string(b)))
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			// Incompatible schema or bad credentials; waiting won't help.
+			return 0, backoff.Permanent(err)
+		}
+		return 0, err
+	}
+	var out struct {
+		ID uint32 `json:"id"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil || out.ID == 0 {
+		return 0, fmt.Errorf("schema registry: unexpected response %q", b)
+	}
+	r.id = out.ID
+	return r.id, nil
+}
+
+// schemaIDWithRetry keeps trying while the registry is unavailable, so a
+// registry blip stalls the publish queue instead of dropping events. It
+// gives up after a bounded time so the failure is counted and surfaced.
+func (r *schemaRegistry) schemaIDWithRetry(ctx context.Context) (uint32, error) {
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = 200 * time.Millisecond
+	bo.MaxInterval = 5 * time.Second
+	bo.MaxElapsedTime = 30 * time.Second
+	var id uint32
+	err := backoff.Retry(func() error {
+		var err error
+		id, err = r.schemaID(ctx)
+		return err
+	}, backoff.WithContext(bo, ctx))
+	return id, err
+}
+
+// encodeOutEventProto serializes ev as the message in outevent.proto, the
+// payload canonically encoded if canonical is set.
+func encodeOutEventProto(ev OutEvent, canonical bool) ([]byte, error) {
+	payload, err := marshalEvent(ev.Payload, canonical)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(payload)+len(ev.Symbol)+len(ev.Type)+len(ev.Action)+32)
+	if ev.Ts != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(ev.Ts))
+	}
+	if ev.Symbol != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, ev.Symbol)
+	}
+	if ev.Type != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, ev.Type)
+	}
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	b = protowire.AppendBytes(b, payload)
+	if ev.Action != "" {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendString(b, ev.Action)
+	}
+	if len(ev.Raw) > 0 {
+		frame, err := decodeRaw(ev.Raw)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, frame)
+	}
+	if ev.Part != nil {
+		// part_index 0 is the proto3 default, so only the total is
+		// always written.
+		if ev.Part.Index != 0 {
+			b = protowire.AppendTag(b, 7, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(ev.Part.Index))
+		}
+		b = protowire.AppendTag(b, 8, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(ev.Part.Total))
+	}
+	return b, nil
+}
+
+// confluentFrame prepends the Confluent wire-format header: magic byte 0,
+// the big-endian schema id, and the message-index list, which for the first
+// message in the schema is the single byte 0.
+func confluentFrame(id uint32, msg []byte) []byte {
+	out := make([]byte, 6, 6+len(msg))
+	binary.BigEndian.PutUint32(out[1:5], id)
+	return append(out, msg...)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestKafkaProtobufEncoding(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/subjects/md_ticks-value/versions" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["schemaType"] != "PROTOBUF" || body["schema"] == "" {
+			t.Errorf("register body = %v, %v", body, err)
+		}
+		if calls.Add(1) == 1 {
+			http.Error(w, `{"error_code":50003,"message":"unavailable"}`, http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":42}`))
+	}))
+	defer srv.Close()
+
+	s := &kafkaSink{registry: newSchemaRegistry(srv.URL+"/", "md_ticks-value", kafkaFormatProtobuf)}
+	ev := OutEvent{Ts: 1700000000000, Symbol: "BTCUSDT", Type: "tickers.BTCUSDT", Action: actionSnapshot, Payload: map[string]any{"lastPrice": "42000.5"}}
+	for i := 0; i < 2; i++ {
+		b, err := s.encode(context.Background(), ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[0] != 0 || binary.BigEndian.Uint32(b[1:5]) != 42 || b[5] != 0 {
+			t.Fatalf("header = %v", b[:6])
+		}
+		got := decodeOutEventProto(t, b[6:])
+		if got.Ts != ev.Ts || got.Symbol != ev.Symbol || got.Type != ev.Type || got.Payload != `{"lastPrice":"42000.5"}` || got.Action != ev.Action {
+			t.Fatalf("decoded = %+v", got)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("registry calls = %d, want 2 (one failure, then cached)", n)
+	}
+}
+
+func TestSchemaRegistryRejectionIsNotRetried(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, `{"error_code":409,"message":"incompatible"}`, http.StatusConflict)
+	}))
+	defer srv.Close()
+
+	s := &kafkaSink{registry: newSchemaRegistry(srv.URL, "md_ticks-value", kafkaFormatProtobuf)}
+	if _, err := s.encode(context.Background(), OutEvent{}); err == nil {
+		t.Fatal("expected registration error")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("registry calls = %d, want 1", n)
+	}
+}
+
+type decodedEvent struct {
+	Ts        int64
+	Symbol    string
+	Type      string
+	Payload   string
+	Action    string
+	PartIndex int
+	PartTotal int
+}
+
+func TestProtobufPart(t *testing.T) {
+	for _, part := range []Part{{Index: 0, Total: 3}, {Index: 2, Total: 3}} {
+		b, err := encodeOutEventProto(OutEvent{Ts: 1, Symbol: "BTCUSDT", Type: "orderbook.500.BTCUSDT", Payload: NormalizedBook{}, Part: &part}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decodeOutEventProto(t, b); got.PartIndex != part.Index || got.PartTotal != part.Total {
+			t.Fatalf("decoded part %d/%d, want %+v", got.PartIndex, got.PartTotal, part)
+		}
+	}
+}
+
+func decodeOutEventProto(t *testing.T, b []byte) decodedEvent {
+	t.Helper()
+	var ev decodedEvent
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch {
+		case typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			switch num {
+			case 1:
+				ev.Ts = int64(v)
+			case 7:
+				ev.PartIndex = int(v)
+			case 8:
+				ev.PartTotal = int(v)
+			}
+			b = b[n:]
+		case typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			switch num {
+			case 2:
+				ev.Symbol = string(v)
+			case 3:
+				ev.Type = string(v)
+			case 4:
+				ev.Payload = string(v)
+			case 5:
+				ev.Action = string(v)
+			}
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected field %d type %d", num, typ)
+		}
+	}
+	return ev
+}
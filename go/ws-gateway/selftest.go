@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// typeSelfTest is the OutEvent.Type, and symbol, of SELF_TEST events.
+	typeSelfTest = "selftest"
+
+	selfTestExit    = "exit"
+	selfTestUnready = "unready"
+
+	// selfTestHeader carries a SELF_TEST event's id on Kafka, so it can be
+	// found while reading back without decoding values.
+	selfTestHeader = "selftest-id"
+	// selfTestPoll is how often Kafka partitions are re-read for the event.
+	selfTestPoll = 200 * time.Millisecond
+)
+
+func parseSelfTestFailure(v string) (string, error) {
+	switch v {
+	case selfTestExit, selfTestUnready:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown self-test failure action %q (want exit|unready)", v)
+}
+
+// SelfTest is the payload of a SELF_TEST event.
+type SelfTest struct {
+	Instance string `json:"instance"`
+	ID       string `json:"id"`
+}
+
+// sinkSelfTester is a sink that can confirm an event round-trips through
+// its backend, or a wrapper passing the test on to the sinks it holds.
+type sinkSelfTester interface {
+	selfTest(ctx context.Context, ev OutEvent) error
+}
+
+// selfTestSink writes ev to s, reading it back where s supports it.
+func selfTestSink(ctx context.Context, s Sink, ev OutEvent) error {
+	if t, ok := s.(sinkSelfTester); ok {
+		return t.selfTest(ctx, ev)
+	}
+	return s.Publish(ctx, ev)
+}
+
+// runSelfTest writes a selftest event to every configured sink within
+// SELF_TEST_TIMEOUT, reading it back from Redis and Kafka.
+func (g *Gateway) runSelfTest() error {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	ev := OutEvent{
+		Ts:      g.clock.Now().UnixMilli(),
+		Symbol:  typeSelfTest,
+		Type:    typeSelfTest,
+		Payload: SelfTest{Instance: g.cfg.Instance, ID: hex.EncodeToString(b)},
+	}
+	ctx, cancel := context.WithTimeout(g.ctx, g.cfg.SelfTestTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := selfTestSink(ctx, g.sink, ev); err != nil {
+		return err
+	}
+	log.Printf("instance=%s self_test_ok sink=%s elapsed=%s", g.cfg.Instance, g.sink.Name(), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func (s *rotatingSink) selfTest(ctx context.Context, ev OutEvent) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return selfTestSink(ctx, s.cur, ev)
+}
+
+// selfTest tests every sink the routes use.
+func (s *routedSink) selfTest(ctx context.Context, ev OutEvent) error {
+	var errs []error
+	for _, sink := range s.sinks {
+		if err := selfTestSink(ctx, sink, ev); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sink.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// selfTest tests the shadow too: unlike Ping, it is asked for.
+func (s *shadowSink) selfTest(ctx context.Context, ev OutEvent) error {
+	if err := selfTestSink(ctx, s.primary, ev); err != nil {
+		return err
+	}
+	if err := selfTestSink(ctx, s.shadow, ev); err != nil {
+		return fmt.Errorf("shadow %s: %w", s.shadow.Name(), err)
+	}
+	return nil
+}
+
+// selfTest reads ev back by its stream entry id, or receives it on the
+// channel it was published to.
+func (s *redisSink) selfTest(ctx context.Context, ev OutEvent) error {
+	if s.channel != "" {
+		data, err := marshalEvent(ev, s.canonical)
+		if err != nil {
+			return err
+		}
+		channel := redisChannel(s.channel, ev)
+		sub := s.client.Subscribe(ctx, channel)
+		defer sub.Close()
+		if _, err := sub.Receive(ctx); err != nil {
+			return err
+		}
+		if err := s.client.Publish(ctx, channel, data).Err(); err != nil {
+			return err
+		}
+		for {
+			msg, err := sub.ReceiveMessage(ctx)
+			if err != nil {
+				return fmt.Errorf("not received on %s: %w", channel, err)
+			}
+			if msg.Payload == string(data) {
+				return nil
+			}
+		}
+	}
+	values, err := redisStreamValues(ev, s.layout, s.canonical)
+	if err != nil {
+		return err
+	}
+	id, err := s.client.XAdd(ctx, &redis.XAddArgs{Stream: s.stream, Values: values}).Result()
+	if err != nil {
+		return err
+	}
+	entries, err := s.client.XRange(ctx, s.stream, id, id).Result()
+	if err != nil {
+		return err
+	}
+	if len(entries) != 1 {
+		return fmt.Errorf("entry %s not read back from %s", id, s.stream)
+	}
+	for k, v := range values {
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		if entries[0].Values[k] != v {
+			return fmt.Errorf("entry %s not read back from %s", id, s.stream)
+		}
+	}
+	return nil
+}
+
+// selfTest writes ev tagged with its id and reads the topic's partitions
+// from where they ended until one returns it.
+func (s *kafkaSink) selfTest(ctx context.Context, ev OutEvent) error {
+	st, _ := ev.Payload.(SelfTest)
+	broker, offsets, err := s.partitionOffsets(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := s.encode(ctx, ev)
+	if err != nil {
+		return err
+	}
+	msg := s.message(ev, data)
+	msg.Headers = append(msg.Headers, kafka.Header{Key: selfTestHeader, Value: []byte(st.ID)})
+	if err := s.w.WriteMessages(ctx, msg); err != nil {
+		return err
+	}
+	for {
+		for partition, offset := range offsets {
+			found, next, err := s.findSelfTest(ctx, broker, partition, offset, st.ID)
+			if err != nil {
+				return err
+			}
+			if found {
+				return nil
+			}
+			offsets[partition] = next
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("not read back from %s: %w", s.w.Topic, ctx.Err())
+		case <-time.After(selfTestPoll):
+		}
+	}
+}
+
+// partitionOffsets returns a reachable broker and the end offset of each
+// partition of the topic.
+func (s *kafkaSink) partitionOffsets(ctx context.Context) (string, map[int]int64, error) {
+	conn, broker, err := s.dialAny(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+	partitions, err := conn.ReadPartitions(s.w.Topic)
+	if err != nil {
+		return "", nil, err
+	}
+	offsets := make(map[int]int64, len(partitions))
+	for _, p := range partitions {
+		pc, err := s.dialer.DialLeader(ctx, "tcp", broker, s.w.Topic, p.ID)
+		if err != nil {
+			return "", nil, err
+		}
+		last, err := pc.ReadLastOffset()
+		pc.Close()
+		if err != nil {
+			return "", nil, err
+		}
+		offsets[p.ID] = last
+	}
+	return broker, offsets, nil
+}
+
+// findSelfTest reads one batch of partition from offset, looking for the
+// message with id, and returns the offset to continue from.
+func (s *kafkaSink) findSelfTest(ctx context.Context, broker string, partition int, offset int64, id string) (bool, int64, error) {
+	pc, err := s.dialer.DialLeader(ctx, "tcp", broker, s.w.Topic, partition)
+	if err != nil {
+		return false, offset, err
+	}
+	defer pc.Close()
+	last, err := pc.ReadLastOffset()
+	if err != nil || last <= offset {
+		return false, offset, err
+	}
+	if _, err := pc.Seek(offset, kafka.SeekAbsolute); err != nil {
+		return false, offset, err
+	}
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	batch := pc.ReadBatch(1, 10<<20)
+	defer batch.Close()
+	for {
+		m, err := batch.ReadMessage()
+		if err != nil {
+			// The end of the batch.
+			return false, offset, nil
+		}
+		offset = m.Offset + 1
+		for _, h := range m.Headers {
+			if h.Key == selfTestHeader && string(h.Value) == id {
+				return true, offset, nil
+			}
+		}
+	}
+}
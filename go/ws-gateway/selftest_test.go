@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripSink is a sink whose self-test fails with err.
+type roundTripSink struct {
+	memSink
+	name   string
+	err    error
+	tested []OutEvent
+}
+
+func (s *roundTripSink) Name() string { return s.name }
+
+func (s *roundTripSink) selfTest(_ context.Context, ev OutEvent) error {
+	s.tested = append(s.tested, ev)
+	return s.err
+}
+
+func TestSelfTestSink(t *testing.T) {
+	redisLike, kafkaLike := &roundTripSink{name: sinkRedis}, &roundTripSink{name: sinkKafka, err: errors.New("topic not found")}
+	plain := &memSink{}
+	s := newRotatingSink(&shadowSink{primary: &routedSink{sinks: []Sink{redisLike, plain}}, shadow: kafkaLike})
+	ev := OutEvent{Ts: 1, Symbol: typeSelfTest, Type: typeSelfTest, Payload: SelfTest{Instance: "test", ID: "x"}}
+	err := selfTestSink(context.Background(), s, ev)
+	if err == nil || !strings.Contains(err.Error(), "shadow kafka: topic not found") {
+		t.Fatalf("selfTestSink = %v", err)
+	}
+	if len(redisLike.tested) != 1 || len(kafkaLike.tested) != 1 {
+		t.Fatal("not every sink was tested")
+	}
+	if evs := plain.Events(); len(evs) != 1 || evs[0].Type != typeSelfTest {
+		t.Fatalf("sink without a read-back got %v, want the event published", evs)
+	}
+
+	routed := &routedSink{sinks: []Sink{&roundTripSink{name: sinkRedis, err: fmt.Errorf("NOPERM")}, redisLike}}
+	if err := selfTestSink(context.Background(), routed, ev); err == nil || !strings.Contains(err.Error(), "redis: NOPERM") {
+		t.Fatalf("routed selfTestSink = %v", err)
+	}
+}
+
+func TestRunSelfTest(t *testing.T) {
+	g, _ := newTestGateway(t, "")
+	sink := &roundTripSink{name: sinkRedis}
+	g.sink = sink
+	g.cfg.SelfTestTimeout = time.Second
+	if err := g.runSelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.tested) != 1 {
+		t.Fatalf("tested %d events", len(sink.tested))
+	}
+	if st, ok := sink.tested[0].Payload.(SelfTest); !ok || st.Instance != "test" || st.ID == "" || sink.tested[0].Ts <= 0 {
+		t.Fatalf("self-test event = %+v", sink.tested[0])
+	}
+
+	g.selfTestErr = errors.New("not read back")
+	if got := (gatewaySet{g}).health(); got.Status != "unhealthy" || got.Instances["test"] != "selftest_failed" {
+		t.Fatalf("health = %+v", got)
+	}
+}
+
+func TestSelfTestConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"SELF_TEST": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.SelfTest || cfg.SelfTestFailure != selfTestExit || cfg.Validate() != nil {
+		t.Fatalf("SelfTest = %v, failure %q, Validate = %v", cfg.SelfTest, cfg.SelfTestFailure, cfg.Validate())
+	}
+	cfg.SelfTestFailure = "ignore"
+	if cfg.Validate() == nil {
+		t.Fatal("SELF_TEST_FAILURE=ignore accepted")
+	}
+}
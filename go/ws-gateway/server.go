@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// gatewaySet is every gateway instance in the process; the HTTP endpoints
+// are shared and report on all of them.
+type gatewaySet []*Gateway
+
+type healthResponse struct {
+	Status    string            `json:"status"`
+	Instances map[string]string `json:"instances"`
+}
+
+// healthz is 503 if any instance is unhealthy, failed SELF_TEST or is
+// still waiting for its first data (WARMUP_REQUIRE_DATA). Instances in
+// announced venue maintenance report "maintenance" without failing the
+// probe. Once POST /drain was called the status is "draining" and then
+// "drained", both 503.
+func (s gatewaySet) healthz(w http.ResponseWriter, r *http.Request) {
+	resp := s.health()
+	status := http.StatusOK
+	switch resp.Status {
+	case "unhealthy", "warming", "draining", "drained":
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s gatewaySet) health() healthResponse {
+	resp := healthResponse{Status: "ok", Instances: make(map[string]string, len(s))}
+	drain := ""
+	for _, g := range s {
+		state := g.healthState()
+		resp.Instances[g.cfg.Instance] = state
+		switch {
+		case state == "draining":
+			drain = state
+		case state == "drained" && drain == "":
+			drain = state
+		case state == "unhealthy":
+			resp.Status = state
+		case state == "selftest_failed":
+			resp.Status = "unhealthy"
+		case state == "warming" && resp.Status != "unhealthy":
+			resp.Status = state
+		case state == "maintenance" && resp.Status == "ok":
+			resp.Status = state
+		}
+	}
+	if drain != "" {
+		resp.Status = drain
+	}
+	return resp
+}
+
+// stop shuts every instance down concurrently.
+func (s gatewaySet) stop() {
+	var wg sync.WaitGroup
+	for _, g := range s {
+		wg.Add(1)
+		go func(g *Gateway) {
+			defer wg.Done()
+			g.Stop()
+		}(g)
+	}
+	wg.Wait()
+}
+
+// replaysDone is closed once every instance has finished, when all of them
+// are replays. For live instances it returns nil, which never fires.
+func (s gatewaySet) replaysDone() <-chan struct{} {
+	for _, g := range s {
+		if g.cfg.Source != sourceReplay {
+			return nil
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, g := range s {
+			<-g.done
+		}
+		close(done)
+	}()
+	return done
+}
+
+func (s gatewaySet) replayFailed() bool {
+	for _, g := range s {
+		if g.replayErr != nil {
+			return true
+		}
+	}
+	return false
+}
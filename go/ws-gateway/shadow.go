@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// shadowDrainTimeout bounds how long Close waits for the shadow to catch up.
+const shadowDrainTimeout = 5 * time.Second
+
+type shadowEvent struct {
+	ev        OutEvent
+	primaryAt time.Time // zero if the primary publish failed
+}
+
+// shadowSink publishes to primary as usual and copies every event to a
+// shadow sink, for comparing a new sink against the current one. The copy
+// goes through its own buffer and goroutine: shadow failures, slowness or a
+// full buffer are counted in ws_gateway_shadow_errors_total and never delay
+// or fail the primary publish.
+type shadowSink struct {
+	primary Sink
+	shadow  Sink
+	m       *gatewayMetrics
+	ch      chan shadowEvent
+	done    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func newShadowSink(primary, shadow Sink, buffer int, m *gatewayMetrics) *shadowSink {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &shadowSink{
+		primary: primary,
+		shadow:  shadow,
+		m:       m,
+		ch:      make(chan shadowEvent, buffer),
+		done:    make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	go s.run()
+	return s
+}
+
+// Name is the primary's: the shadow doesn't count toward publish age.
+func (s *shadowSink) Name() string { return s.primary.Name() }
+
+// Ping checks only the primary; the shadow must not hold up startup.
+func (s *shadowSink) Ping(ctx context.Context) error {
+	if p, ok := s.primary.(sinkPinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (s *shadowSink) Publish(ctx context.Context, ev OutEvent) error {
+	err := s.primary.Publish(ctx, ev)
+	se := shadowEvent{ev: ev}
+	if err == nil {
+		se.primaryAt = time.Now()
+	}
+	select {
+	case s.ch <- se:
+	default:
+		s.m.shadowErrors.Inc()
+	}
+	return err
+}
+
+func (s *shadowSink) run() {
+	defer close(s.done)
+	for se := range s.ch {
+		if err := s.shadow.Publish(s.ctx, se.ev); err != nil {
+			s.m.shadowErrors.Inc()
+			log.Printf("shadow_publish_error sink=%s err=%v", s.shadow.Name(), err)
+			continue
+		}
+		if !se.primaryAt.IsZero() {
+			s.m.shadowLag.Observe(time.Since(se.primaryAt).Seconds())
+		}
+	}
+}
+
+// Close closes the primary, then gives the shadow shadowDrainTimeout to
+// publish what is still buffered before closing it too.
+func (s *shadowSink) Close() error {
+	err := s.primary.Close()
+	close(s.ch)
+	select {
+	case <-s.done:
+	case <-time.After(shadowDrainTimeout):
+		log.Printf("shadow_drain_timeout sink=%s pending=%d", s.shadow.Name(), len(s.ch))
+		s.cancel()
+		<-s.done
+	}
+	s.cancel()
+	if serr := s.shadow.Close(); serr != nil {
+		log.Printf("shadow_close_error sink=%s err=%v", s.shadow.Name(), serr)
+	}
+	return err
+}
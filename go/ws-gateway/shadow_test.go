@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingSink fails every publish, after waiting for release if set.
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (s *blockingSink) Name() string { return "blocking" }
+func (s *blockingSink) Close() error { return nil }
+func (s *blockingSink) Publish(context.Context, OutEvent) error {
+	if s.release != nil {
+		<-s.release
+	}
+	return errors.New("shadow down")
+}
+
+func TestShadowSinkNeverAffectsPrimary(t *testing.T) {
+	m := newGatewayMetrics("shadow_test")
+	primary := &memSink{}
+	shadow := &blockingSink{release: make(chan struct{})}
+	s := newShadowSink(primary, shadow, 1, m)
+
+	// The shadow is stuck and its buffer holds one event, so copies are
+	// dropped; the primary sees all of them.
+	for i := 0; i < 3; i++ {
+		if err := s.Publish(context.Background(), OutEvent{Ts: int64(i)}); err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+	}
+	if n := len(primary.Events()); n != 3 {
+		t.Fatalf("primary got %d events, want 3", n)
+	}
+	close(shadow.release)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Each copy counts once, dropped or failed, however the worker raced
+	// the publishes.
+	if n := testutil.ToFloat64(m.shadowErrors); n != 3 {
+		t.Fatalf("shadow errors = %v, want 3", n)
+	}
+}
+
+func TestShadowSinkObservesLag(t *testing.T) {
+	m := newGatewayMetrics("shadow_lag_test")
+	shadow := &memSink{}
+	s := newShadowSink(&memSink{}, shadow, 10, m)
+	for i := 0; i < 2; i++ {
+		if err := s.Publish(context.Background(), OutEvent{Ts: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(shadow.Events()); n != 2 {
+		t.Fatalf("shadow got %d events, want 2 after draining", n)
+	}
+	if n := histogramCount(t, shadowLag.WithLabelValues("shadow_lag_test")); n != 2 {
+		t.Fatalf("lag samples = %d, want 2", n)
+	}
+	if s.Name() != "memory" {
+		t.Fatalf("Name = %q, want the primary's", s.Name())
+	}
+}
+
+func TestValidateShadowSink(t *testing.T) {
+	cfg, err := loadConfig(env{"REDIS_URL": "redis://r:6379", "SHADOW_SINK": "kafka"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for a shadow without KAFKA_BROKERS")
+	}
+	cfg.KafkaBrokers = []string{"k:9092"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.ShadowSink = sinkRedis
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for a shadow that is also the primary")
+	}
+}
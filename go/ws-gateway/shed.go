@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// inboundShedder caps the data frames handled per second across the whole
+// process (MAX_INBOUND_MSGS_PER_SEC). Past the cap within a second, it
+// keeps one sheddable frame in every n, n being how many times over the
+// cap the previous second was, so a flood is sampled down rather than cut
+// off. Other frames are counted but always kept.
+type inboundShedder struct {
+	limit int
+
+	mu     sync.Mutex
+	second int64
+	count  int
+	last   int
+}
+
+var (
+	shedder     *inboundShedder
+	shedderOnce sync.Once
+)
+
+func initShedder(limit int) {
+	shedderOnce.Do(func() {
+		if limit > 0 {
+			shedder = &inboundShedder{limit: limit}
+		}
+	})
+}
+
+// shedKinds are the topic kinds whose frames a later one supersedes or that
+// carry no sequence, so dropping some doesn't corrupt state built from the
+// rest. Order book deltas are never shed: a missing one leaves every
+// maintained book wrong until the next snapshot.
+var shedKinds = map[string]bool{"tickers": true, "publicTrade": true}
+
+// sheddable reports whether a frame of kind with the given type may be shed.
+func sheddable(kind, msgType string) bool {
+	return shedKinds[kind] && msgType != actionSnapshot
+}
+
+// admit counts a data frame read at readAt and reports whether to handle
+// it.
+func (s *inboundShedder) admit(readAt time.Time, sheddable bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sec := readAt.Unix(); sec != s.second {
+		s.last = 0
+		if sec == s.second+1 {
+			s.last = s.count
+		}
+		s.second, s.count = sec, 0
+		inboundRateGauge.Set(float64(s.last))
+	}
+	s.count++
+	over := s.count - s.limit
+	if over <= 0 || !sheddable {
+		return true
+	}
+	n := max(2, (s.last+s.limit-1)/s.limit)
+	return over%n == 0
+}
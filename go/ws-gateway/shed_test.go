@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInboundShedder(t *testing.T) {
+	s := &inboundShedder{limit: 10}
+	base := time.Unix(1700000000, 0)
+	admitted := func(sec int64, n int, exempt bool) int {
+		kept := 0
+		for i := 0; i < n; i++ {
+			if s.admit(base.Add(time.Duration(sec)*time.Second), !exempt) {
+				kept++
+			}
+		}
+		return kept
+	}
+	if kept := admitted(0, 10, false); kept != 10 {
+		t.Fatalf("%d of 10 kept under the cap", kept)
+	}
+	// Over the cap without a previous second: one in two.
+	if kept := admitted(0, 10, false); kept != 5 {
+		t.Fatalf("%d of 10 over the cap kept, want 5", kept)
+	}
+	if kept := admitted(0, 3, true); kept != 3 {
+		t.Fatalf("%d of 3 unsheddable frames kept", kept)
+	}
+	// The previous second was 23 frames, three times the cap.
+	if kept := admitted(1, 40, false); kept != 20 {
+		t.Fatalf("%d of 40 kept, want 10 plus one in three of 30", kept)
+	}
+	if s.last != 23 {
+		t.Fatalf("last second = %d frames", s.last)
+	}
+	// A quiet second in between starts over.
+	admitted(3, 1, false)
+	if s.last != 0 {
+		t.Fatalf("last second = %d frames after a gap", s.last)
+	}
+}
+
+func TestShedKeepsBooks(t *testing.T) {
+	prev := shedder
+	shedder = &inboundShedder{limit: 2}
+	defer func() { shedder = prev }()
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("shed_books")
+	g.books = newBookKeeper(0, stateLimit{}, g.clock, g.publishBook)
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	go g.readLoop()
+
+	book := func(u int, msgType string, bid string) map[string]any {
+		return map[string]any{"topic": "orderbook.50.BTCUSDT", "type": msgType, "data": bookData(u, [][2]string{{bid, "1"}}, nil)}
+	}
+	sendJSON(t, server, book(1, actionSnapshot, "100"))
+	for i := 0; i < 20; i++ {
+		sendJSON(t, server, map[string]any{"topic": "tickers.BTCUSDT", "type": actionDelta, "data": map[string]any{"symbol": "BTCUSDT", "lastPrice": "100"}})
+	}
+	for i := 2; i <= 11; i++ {
+		sendJSON(t, server, book(i, actionDelta, strconv.Itoa(100-i)))
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var last *NormalizedBook
+		for _, ev := range sink.Events() {
+			if b, ok := ev.Payload.(NormalizedBook); ok {
+				last = &b
+			}
+		}
+		if last != nil && last.UpdateID == 11 {
+			if len(last.Bids) != 11 {
+				t.Fatalf("book has %d levels after shedding, want all 11", len(last.Bids))
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("book update 11 not published, last %+v", last)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := testutil.ToFloat64(g.metrics.inboundShed.WithLabelValues("orderbook")); n != 0 {
+		t.Fatalf("%v order book frames shed", n)
+	}
+	if n := testutil.ToFloat64(g.metrics.inboundShed.WithLabelValues("tickers")); n == 0 {
+		t.Fatal("no ticker frames shed over the cap")
+	}
+}
+
+func TestMaxInboundConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"MAX_INBOUND_MSGS_PER_SEC": "5000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxInbound != 5000 || cfg.Validate() != nil {
+		t.Fatalf("MaxInbound = %d, Validate = %v", cfg.MaxInbound, cfg.Validate())
+	}
+	cfg.MaxInbound = -1
+	if cfg.Validate() == nil {
+		t.Fatal("MAX_INBOUND_MSGS_PER_SEC=-1 accepted")
+	}
+}
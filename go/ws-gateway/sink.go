@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	redis "github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	contentTypeJSON    = "application/json"
+	eventSchemaVersion = "1"
+)
+
+// Sink is a destination for published events.
+type Sink interface {
+	Name() string
+	Publish(ctx context.Context, ev OutEvent) error
+	Close() error
+}
+
+// newSink builds the default sink, or with SINK_ROUTES a sink routing each
+// event by symbol, copying to SHADOW_SINK if set.
+func newSink(cfg Config, m *gatewayMetrics) Sink {
+	primary := newPrimarySink(cfg, m)
+	if cfg.ShadowSink == "" {
+		return primary
+	}
+	shadow := newNamedSink(cfg, m, cfg.ShadowSink)
+	log.Printf("sink_shadow=%s buffer=%d", shadow.Name(), cfg.ShadowBuffer)
+	return newShadowSink(primary, shadow, cfg.ShadowBuffer, m)
+}
+
+// sinkPinger is a sink that can check it reaches its backend.
+type sinkPinger interface {
+	Ping(ctx context.Context) error
+}
+
+// waitSinkReady pings s until it answers, backing off for up to timeout, so
+// a dependency still starting during a deploy doesn't crash-loop the pod.
+// Sinks that can't be pinged are ready at once.
+func waitSinkReady(ctx context.Context, s Sink, timeout time.Duration) error {
+	p, ok := s.(sinkPinger)
+	if !ok || timeout <= 0 {
+		return nil
+	}
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = 500 * time.Millisecond
+	bo.MaxInterval = 10 * time.Second
+	bo.MaxElapsedTime = timeout
+	return backoff.RetryNotify(func() error {
+		pctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		return p.Ping(pctx)
+	}, backoff.WithContext(bo, ctx), func(err error, d time.Duration) {
+		log.Printf("sink_connect_retry sink=%s err=%v backoff=%s", s.Name(), err, d)
+	})
+}
+
+func newPrimarySink(cfg Config, m *gatewayMetrics) Sink {
+	sinkFor := func(name string) Sink { return newNamedSink(cfg, m, name) }
+	routes, err := parseSinkRoutes(cfg.SinkRoutes)
+	if err != nil {
+		log.Fatalf("invalid SINK_ROUTES: %v", err)
+	}
+	if len(routes) == 0 {
+		return sinkFor(cfg.defaultSink())
+	}
+	s := newRoutedSink(routes, cfg.defaultRoute(routes), m, sinkFor)
+	log.Printf("sink_routes=%q default=%s", cfg.SinkRoutes, strings.Join(s.def.sinks, ","))
+	return s
+}
+
+// newNamedSink builds the named sink, packing events into records with
+// RECORD_BATCH_SIZE and copying Kafka's to KAFKA_DR_BROKERS.
+func newNamedSink(cfg Config, m *gatewayMetrics, name string) Sink {
+	s := newRecordBatchSink(newBackendSink(cfg, m, name), cfg.RecordBatch, cfg.MaxOutbound, cfg.RecordInterval, m)
+	if name == sinkKafka && len(cfg.KafkaDRBrokers) > 0 {
+		return newKafkaDRSink(cfg, s, m)
+	}
+	return s
+}
+
+func newBackendSink(cfg Config, m *gatewayMetrics, name string) Sink {
+	switch name {
+	case sinkRedis:
+		opt, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			log.Fatalf("invalid REDIS_URL: %v", urlError(err))
+		}
+		s := &redisSink{client: redis.NewClient(opt), stream: cfg.RedisStream, layout: cfg.RedisLayout, canonical: cfg.CanonicalJSON}
+		if cfg.RedisMode == redisModePubSub {
+			s.channel = cfg.RedisChannel
+			log.Printf("sink=redis mode=pubsub channel=%s", s.channel)
+			return s
+		}
+		log.Printf("sink=redis stream=%s layout=%s", s.stream, s.layout)
+		return s
+	case sinkKafka:
+		mech, tlsCfg, err := kafkaAuth(cfg)
+		if err != nil {
+			log.Fatalf("kafka_auth_error: %v", err)
+		}
+		s := &kafkaSink{
+			w: &kafka.Writer{
+				Addr:         kafka.TCP(cfg.KafkaBrokers...),
+				Transport:    kafkaTransport(mech, tlsCfg),
+				Topic:        cfg.KafkaTopic,
+				RequiredAcks: kafka.RequireAll,
+				BatchSize:    cfg.KafkaBatchSize,
+				BatchTimeout: cfg.KafkaBatchTimeout,
+				Async:        cfg.KafkaAsync,
+				MaxAttempts:  cfg.KafkaMaxAttempts,
+				Completion:   kafkaCompletion(cfg, m),
+			},
+			headers:   kafkaHeaders(cfg),
+			canonical: cfg.CanonicalJSON,
+			brokers:   cfg.KafkaBrokers,
+			dialer:    kafkaDialer(mech, tlsCfg),
+		}
+		if cfg.KafkaFormat != kafkaFormatJSON {
+			s.registry = newSchemaRegistry(cfg.SchemaRegistry, cfg.SchemaSubject, cfg.KafkaFormat)
+		}
+		if len(cfg.KafkaPartitions) > 0 {
+			s.partitions = cfg.KafkaPartitions
+			s.w.Balancer = &symbolBalancer{partitions: cfg.KafkaPartitions}
+		}
+		log.Printf("sink=kafka topic=%s format=%s batch_size=%d batch_timeout=%s async=%v sasl=%s tls=%v",
+			cfg.KafkaTopic, cfg.KafkaFormat, cfg.KafkaBatchSize, cfg.KafkaBatchTimeout, cfg.KafkaAsync, cfg.KafkaSASL, cfg.KafkaTLS)
+		return s
+	}
+	if cfg.StdoutFormat == stdoutNDJSON {
+		log.Printf("sink=none (stdout) format=ndjson")
+		return stdoutSink{ndjson: true, canonical: cfg.CanonicalJSON, out: os.Stdout}
+	}
+	log.Printf("sink=none (stdout) log_payload=%s", cfg.LogPayload)
+	return stdoutSink{mode: cfg.LogPayload}
+}
+
+const (
+	redisModeStream = "stream"
+	redisModePubSub = "pubsub"
+)
+
+// redisSink XADDs to stream, or with a channel PUBLISHes to it instead.
+// Pub/Sub is at-most-once: subscribers that aren't connected miss events.
+type redisSink struct {
+	client    *redis.Client
+	stream    string
+	layout    string
+	channel   string
+	canonical bool
+}
+
+func (s *redisSink) Name() string { return sinkRedis }
+
+func (s *redisSink) Publish(ctx context.Context, ev OutEvent) error {
+	if s.channel != "" {
+		data, err := marshalEvent(ev, s.canonical)
+		if err != nil {
+			return err
+		}
+		return s.client.Publish(ctx, redisChannel(s.channel, ev), data).Err()
+	}
+	values, err := redisStreamValues(ev, s.layout, s.canonical)
+	if err != nil {
+		return err
+	}
+	return s.client.XAdd(ctx, &redis.XAddArgs{Stream: s.stream, Values: values}).Err()
+}
+
+// redisChannel expands the {symbol} and {topic} placeholders of REDIS_CHANNEL.
+func redisChannel(tmpl string, ev OutEvent) string {
+	if !strings.Contains(tmpl, "{") {
+		return tmpl
+	}
+	return strings.NewReplacer("{symbol}", ev.Symbol, "{topic}", ev.Type).Replace(tmpl)
+}
+
+func (s *redisSink) Ping(ctx context.Context) error { return s.client.Ping(ctx).Err() }
+
+func (s *redisSink) Close() error { return s.client.Close() }
+
+type kafkaSink struct {
+	w         *kafka.Writer
+	headers   []kafka.Header
+	registry  *schemaRegistry
+	canonical bool
+	brokers   []string
+	dialer    *kafka.Dialer
+	// partitions is KAFKA_PARTITION_MAP; with it messages are keyed by
+	// symbol.
+	partitions map[string]int
+}
+
+func (s *kafkaSink) Name() string { return sinkKafka }
+
+func (s *kafkaSink) Publish(ctx context.Context, ev OutEvent) error {
+	data, err := s.encode(ctx, ev)
+	if err != nil {
+		return err
+	}
+	return s.w.WriteMessages(ctx, s.message(ev, data))
+}
+
+func (s *kafkaSink) message(ev OutEvent, data []byte) kafka.Message {
+	m := kafka.Message{Value: data, Headers: s.messageHeaders(ev)}
+	if len(s.partitions) > 0 && ev.Symbol != "" {
+		m.Key = []byte(ev.Symbol)
+	}
+	return m
+}
+
+// encode renders ev as JSON, or with a schema registry as Confluent-framed
+// protobuf or Avro.
+func (s *kafkaSink) encode(ctx context.Context, ev OutEvent) ([]byte, error) {
+	if s.registry == nil {
+		return marshalEvent(ev, s.canonical)
+	}
+	id, err := s.registry.schemaIDWithRetry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s.registry.format == kafkaFormatAvro {
+		msg, err := encodeOutEventAvro(ev, s.canonical)
+		if err != nil {
+			return nil, err
+		}
+		return confluentAvroFrame(id, msg), nil
+	}
+	msg, err := encodeOutEventProto(ev, s.canonical)
+	if err != nil {
+		return nil, err
+	}
+	return confluentFrame(id, msg), nil
+}
+
+// kafkaCompletion observes how full each written batch was and, in async
+// mode where WriteMessages returns before delivery, counts failed messages.
+func kafkaCompletion(cfg Config, m *gatewayMetrics) func([]kafka.Message, error) {
+	return func(msgs []kafka.Message, err error) {
+		if cfg.KafkaBatchSize > 0 {
+			m.kafkaBatchFill.Observe(float64(len(msgs)) / float64(cfg.KafkaBatchSize))
+		}
+		if err != nil && cfg.KafkaAsync {
+			m.errors.Add(float64(len(msgs)))
+			log.Printf("kafka_async_error messages=%d err=%v", len(msgs), err)
+		}
+	}
+}
+
+func (s *kafkaSink) messageHeaders(ev OutEvent) []kafka.Header {
+	headers := make([]kafka.Header, len(s.headers), len(s.headers)+1)
+	copy(headers, s.headers)
+	if ev.Symbol != "" {
+		headers = append(headers, kafka.Header{Key: "symbol", Value: []byte(ev.Symbol)})
+	}
+	return headers
+}
+
+// kafkaHeaders builds the static per-message headers: the defaults below,
+// overridden or extended by KAFKA_HEADERS, sorted by key.
+func kafkaHeaders(cfg Config) []kafka.Header {
+	contentType := contentTypeJSON
+	switch cfg.KafkaFormat {
+	case kafkaFormatProtobuf:
+		contentType = contentTypeProtobuf
+	case kafkaFormatAvro:
+		contentType = contentTypeAvro
+	}
+	kv := map[string]string{
+		"content-type":   contentType,
+		"schema-version": eventSchemaVersion,
+		"source":         cfg.Exchange,
+	}
+	for k, v := range cfg.KafkaHeaders {
+		kv[k] = v
+	}
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	headers := make([]kafka.Header, 0, len(keys))
+	for _, k := range keys {
+		headers = append(headers, kafka.Header{Key: k, Value: []byte(kv[k])})
+	}
+	return headers
+}
+
+// Ping succeeds once any broker accepts a connection, and with
+// KAFKA_PARTITION_MAP the topic has every partition it names.
+func (s *kafkaSink) Ping(ctx context.Context) error {
+	conn, _, err := s.dialAny(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if len(s.partitions) > 0 {
+		return checkPartitions(conn, s.w.Topic, s.partitions)
+	}
+	return nil
+}
+
+// dialAny connects to the first broker that accepts, returning its address.
+func (s *kafkaSink) dialAny(ctx context.Context) (*kafka.Conn, string, error) {
+	var errs []error
+	for _, broker := range s.brokers {
+		conn, err := s.dialer.DialContext(ctx, "tcp", broker)
+		if err == nil {
+			return conn, broker, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+func (s *kafkaSink) Close() error { return s.w.Close() }
+
+const (
+	logPayloadNone      = "none"
+	logPayloadTruncated = "truncated"
+	logPayloadFull      = "full"
+)
+
+func parseLogPayload(v string) (string, error) {
+	switch v {
+	case logPayloadNone, logPayloadTruncated, logPayloadFull:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown log payload mode %q (want none|truncated|full)", v)
+}
+
+const (
+	stdoutLog    = "log"
+	stdoutNDJSON = "ndjson"
+)
+
+func parseStdoutFormat(v string) (string, error) {
+	switch v {
+	case stdoutLog, stdoutNDJSON:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown stdout format %q (want log|ndjson)", v)
+}
+
+// stdoutMu keeps the lines of sinks sharing stdout, across instances and
+// publish workers, from interleaving.
+var stdoutMu sync.Mutex
+
+// stdoutSink logs events when no real sink is configured. mode is one of the
+// LOG_PAYLOAD values; truncated logs the envelope and payload size only.
+// With STDOUT_FORMAT=ndjson it instead writes each event to out as a bare
+// line of JSON, for piping into jq or another process; log lines go to
+// stderr.
+type stdoutSink struct {
+	mode      string
+	ndjson    bool
+	canonical bool
+	out       io.Writer
+}
+
+func (stdoutSink) Name() string { return sinkNone }
+
+func (s stdoutSink) Publish(_ context.Context, ev OutEvent) error {
+	if s.ndjson {
+		data, err := marshalEvent(ev, s.canonical)
+		if err != nil {
+			return err
+		}
+		stdoutMu.Lock()
+		defer stdoutMu.Unlock()
+		_, err = s.out.Write(append(data, '\n'))
+		return err
+	}
+	switch s.mode {
+	case logPayloadNone:
+		return nil
+	case logPayloadTruncated:
+		payload, err := json.Marshal(ev.Payload)
+		if err != nil {
+			return err
+		}
+		log.Printf("ev ts=%d symbol=%s type=%s payload_bytes=%d", ev.Ts, ev.Symbol, ev.Type, len(payload))
+		return nil
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	log.Printf("ev=%s", string(data))
+	return nil
+}
+
+func (stdoutSink) Close() error { return nil }
+
+// memSink records published events in memory, for tests and local harnesses.
+type memSink struct {
+	mu     sync.Mutex
+	events []OutEvent
+}
+
+func (s *memSink) Name() string { return "memory" }
+
+func (s *memSink) Publish(_ context.Context, ev OutEvent) error {
+	s.mu.Lock()
+	s.events = append(s.events, ev)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memSink) Close() error { return nil }
+
+// Events returns a copy of everything published so far.
+func (s *memSink) Events() []OutEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]OutEvent(nil), s.events...)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestKafkaMessageHeaders(t *testing.T) {
+	s := &kafkaSink{headers: kafkaHeaders(Config{
+		Exchange:     exchangeBybit,
+		KafkaHeaders: map[string]string{"schema-version": "2", "env": "staging"},
+	})}
+	got := map[string]string{}
+	var keys []string
+	for _, h := range s.messageHeaders(OutEvent{Symbol: "BTCUSDT"}) {
+		got[h.Key] = string(h.Value)
+		keys = append(keys, h.Key)
+	}
+	want := map[string]string{
+		"content-type":   contentTypeJSON,
+		"env":            "staging",
+		"schema-version": "2",
+		"source":         exchangeBybit,
+		"symbol":         "BTCUSDT",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("headers = %v", got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("header %s = %q, want %q", k, got[k], v)
+		}
+	}
+	if keys[0] != "content-type" || keys[len(keys)-1] != "symbol" {
+		t.Fatalf("unexpected header order %v", keys)
+	}
+}
+
+func TestParseKeyValues(t *testing.T) {
+	kv, err := parseKeyValues("a=1, b = two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv["a"] != "1" || kv["b"] != "two" {
+		t.Fatalf("kv = %v", kv)
+	}
+	if _, err := parseKeyValues("novalue"); err == nil {
+		t.Fatal("expected error for missing '='")
+	}
+}
+
+func TestStdoutSinkLogPayload(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	ev := OutEvent{Ts: 1700000000000, Symbol: "BTCUSDT", Type: "orderbook.25.BTCUSDT", Payload: map[string]any{"b": []any{"1", "2"}}}
+
+	for mode, want := range map[string]string{
+		logPayloadFull:      `ev={"ts":1700000000000,"symbol":"BTCUSDT","type":"orderbook.25.BTCUSDT","payload":{"b":["1","2"]}}`,
+		logPayloadTruncated: "ev ts=1700000000000 symbol=BTCUSDT type=orderbook.25.BTCUSDT payload_bytes=15",
+		logPayloadNone:      "",
+	} {
+		buf.Reset()
+		if err := (stdoutSink{mode: mode}).Publish(context.Background(), ev); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(buf.String()); !strings.HasSuffix(got, want) || (want == "" && got != "") {
+			t.Errorf("%s: logged %q, want suffix %q", mode, got, want)
+		}
+	}
+}
+
+func TestStdoutSinkNDJSON(t *testing.T) {
+	var out, logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	s := stdoutSink{ndjson: true, out: &out}
+	for i := int64(1); i <= 2; i++ {
+		if err := s.Publish(context.Background(), OutEvent{Ts: i, Symbol: "BTCUSDT", Type: "tickers.BTCUSDT", Payload: map[string]any{"lastPrice": "1"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := `{"ts":1,"symbol":"BTCUSDT","type":"tickers.BTCUSDT","payload":{"lastPrice":"1"}}` + "\n" +
+		`{"ts":2,"symbol":"BTCUSDT","type":"tickers.BTCUSDT","payload":{"lastPrice":"1"}}` + "\n"
+	if out.String() != want || logged.Len() != 0 {
+		t.Fatalf("stdout %q, logged %q", out.String(), logged.String())
+	}
+
+	cfg, err := loadConfig(env{"STDOUT_FORMAT": "ndjson"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if ss := newNamedSink(cfg, newGatewayMetrics("stdout_ndjson"), sinkNone).(stdoutSink); !ss.ndjson || ss.out != os.Stdout {
+		t.Fatalf("sink = %+v", ss)
+	}
+	cfg.StdoutFormat = "csv"
+	if cfg.Validate() == nil {
+		t.Fatal("STDOUT_FORMAT=csv accepted")
+	}
+}
+
+func TestKafkaCompletion(t *testing.T) {
+	m := newGatewayMetrics("kafka_completion_test")
+	done := kafkaCompletion(Config{KafkaBatchSize: 4, KafkaAsync: true}, m)
+	done(make([]kafka.Message, 1), nil)
+	done(make([]kafka.Message, 4), nil)
+	done(make([]kafka.Message, 2), errors.New("leader not available"))
+
+	var h dto.Metric
+	if err := m.kafkaBatchFill.(prometheus.Metric).Write(&h); err != nil {
+		t.Fatal(err)
+	}
+	if n, sum := h.GetHistogram().GetSampleCount(), h.GetHistogram().GetSampleSum(); n != 3 || sum != 0.25+1+0.5 {
+		t.Fatalf("fill samples = %d sum = %v", n, sum)
+	}
+	if got := testutil.ToFloat64(m.errors); got != 2 {
+		t.Fatalf("async errors = %v, want 2", got)
+	}
+}
+
+// flakySink fails its first pings.
+type flakySink struct {
+	memSink
+	failures int
+	pings    int
+}
+
+func (s *flakySink) Ping(context.Context) error {
+	s.pings++
+	if s.pings <= s.failures {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestWaitSinkReady(t *testing.T) {
+	s := &flakySink{failures: 2}
+	if err := waitSinkReady(context.Background(), s, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if s.pings != 3 {
+		t.Fatalf("pings = %d, want 3", s.pings)
+	}
+
+	down := &flakySink{failures: 1 << 30}
+	start := time.Now()
+	if err := waitSinkReady(context.Background(), down, time.Second); err == nil {
+		t.Fatal("expected error once SINK_CONNECT_TIMEOUT passes")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("gave up after %s", d)
+	}
+
+	if err := waitSinkReady(context.Background(), &memSink{}, time.Second); err != nil {
+		t.Fatalf("sink without Ping: %v", err)
+	}
+}
+
+// hangingSink blocks every publish until its context ends.
+type hangingSink struct{ memSink }
+
+func (s *hangingSink) Name() string { return "hanging" }
+
+func (s *hangingSink) Publish(ctx context.Context, _ OutEvent) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestSinkWriteTimeout(t *testing.T) {
+	g, _ := newTestGateway(t, "")
+	g.metrics = newGatewayMetrics("sink_write_timeout")
+	g.cfg.SinkWrite = 20 * time.Millisecond
+	g.cfg.MaxPublish = 2
+	g.sink = &hangingSink{}
+
+	start := time.Now()
+	g.deliver(OutEvent{Symbol: "BTCUSDT", Type: "tickers.BTCUSDT"})
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("deliver took %s", d)
+	}
+	if n := testutil.ToFloat64(g.metrics.sinkTimeouts.WithLabelValues("hanging")); n != 2 {
+		t.Fatalf("write timeouts = %v, want one per attempt", n)
+	}
+	if n := testutil.ToFloat64(g.metrics.errors); n != 2 {
+		t.Fatalf("errors = %v, want 2", n)
+	}
+}
+
+func TestRedisPubSubMode(t *testing.T) {
+	t.Setenv("REDIS_URL", "redis://localhost:6379/0")
+	t.Setenv("REDIS_MODE", "PubSub")
+	t.Setenv("REDIS_CHANNEL", "md:{topic}")
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := newNamedSink(cfg, newGatewayMetrics("redis_pubsub"), sinkRedis).(*redisSink)
+	defer s.Close()
+	if s.channel != "md:{topic}" {
+		t.Fatalf("channel = %q", s.channel)
+	}
+	ev := OutEvent{Symbol: "BTCUSDT", Type: "tickers.BTCUSDT"}
+	if got := redisChannel(s.channel, ev); got != "md:tickers.BTCUSDT" {
+		t.Fatalf("channel for event = %q", got)
+	}
+	if got := redisChannel("ticks.{symbol}", ev); got != "ticks.BTCUSDT" {
+		t.Fatalf("symbol channel = %q", got)
+	}
+
+	cfg.RedisMode = "list"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected unknown REDIS_MODE to be rejected")
+	}
+}
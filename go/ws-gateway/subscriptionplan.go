@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// planLoadTimeout bounds each read of SUBSCRIPTION_PLAN_KEY.
+const planLoadTimeout = 5 * time.Second
+
+// subscriptionPlan is the JSON a control plane writes to
+// SUBSCRIPTION_PLAN_KEY. Version identifies it in /info and
+// ws_gateway_subscription_plan_version; Topics, if set, must be prefixes
+// from TOPICS and replace them.
+type subscriptionPlan struct {
+	Version int64    `json:"version"`
+	Symbols []string `json:"symbols"`
+	Topics  []string `json:"topics,omitempty"`
+}
+
+func parseSubscriptionPlan(data []byte, configured []string) (subscriptionPlan, error) {
+	var p subscriptionPlan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, err
+	}
+	if len(p.Symbols) == 0 {
+		return p, fmt.Errorf("no symbols")
+	}
+	allowed := make(map[string]bool, len(configured))
+	for _, t := range configured {
+		allowed[t] = true
+	}
+	for _, t := range p.Topics {
+		if !allowed[t] {
+			// Features such as FLOW_INTERVAL are set up for TOPICS at
+			// startup.
+			return p, fmt.Errorf("topic %q is not in TOPICS", t)
+		}
+	}
+	return p, nil
+}
+
+// planStatus is the applied plan, reported by /info.
+type planStatus struct {
+	Key       string    `json:"key"`
+	Version   int64     `json:"version"`
+	Topics    []string  `json:"topics"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+// planSource reads the plan from Redis and hears of changes to it through
+// keyspace notifications, when the server has them enabled.
+type planSource struct {
+	client   *redis.Client
+	key      string
+	channel  string
+	interval time.Duration
+}
+
+func newPlanSource(cfg Config) (*planSource, error) {
+	opt, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", urlError(err))
+	}
+	return &planSource{
+		client:   redis.NewClient(opt),
+		key:      cfg.PlanKey,
+		channel:  fmt.Sprintf("__keyspace@%d__:%s", opt.DB, cfg.PlanKey),
+		interval: cfg.PlanInterval,
+	}, nil
+}
+
+// loadPlan reads and applies the plan. A missing key keeps the current
+// subscriptions.
+func (g *Gateway) loadPlan(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, planLoadTimeout)
+	defer cancel()
+	data, err := g.planSource.client.Get(ctx, g.planSource.key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		log.Printf("instance=%s subscription_plan_missing key=%s", g.cfg.Instance, g.planSource.key)
+		return
+	}
+	if err == nil {
+		err = g.applyPlanData(data)
+	}
+	if err != nil {
+		g.metrics.errors.Inc()
+		log.Printf("instance=%s subscription_plan_error key=%s err=%v", g.cfg.Instance, g.planSource.key, err)
+	}
+}
+
+// applyPlanData applies a plan through applyPlan, so only the difference
+// is sent. A plan without topics goes back to TOPICS, and one older than
+// the applied plan is rejected.
+func (g *Gateway) applyPlanData(data []byte) error {
+	p, err := parseSubscriptionPlan(data, g.cfg.topicPrefixes())
+	if err != nil {
+		return err
+	}
+	prev := g.plan.Load()
+	if prev != nil && p.Version < prev.Version {
+		return fmt.Errorf("version %d is older than the applied %d", p.Version, prev.Version)
+	}
+	topics := p.Topics
+	if len(topics) == 0 {
+		topics = g.cfg.topicPrefixes()
+	}
+	// The state is replaced even if sending an op fails; the next
+	// subscribe after a reconnect catches up.
+	err = g.applyPlan(p.Symbols, topics)
+	if prev != nil && prev.Version == p.Version {
+		return err
+	}
+	g.plan.Store(&planStatus{Key: g.cfg.PlanKey, Version: p.Version, Topics: topics, AppliedAt: g.clock.Now().UTC()})
+	g.metrics.planVersion.Set(float64(p.Version))
+	log.Printf("instance=%s subscription_plan version=%d symbols=%d topics=%v", g.cfg.Instance, p.Version, len(p.Symbols), topics)
+	return err
+}
+
+// watchPlan reloads the plan on every keyspace notification for its key
+// and every SUBSCRIPTION_PLAN_INTERVAL, for servers without them, until
+// the gateway stops and the client is closed.
+func (g *Gateway) watchPlan() {
+	defer g.planSource.client.Close()
+	sub := g.planSource.client.Subscribe(g.ctx, g.planSource.channel)
+	defer sub.Close()
+	notify := sub.Channel()
+	t := time.NewTicker(g.planSource.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-t.C:
+		case <-notify:
+		}
+		g.loadPlan(g.ctx)
+	}
+}
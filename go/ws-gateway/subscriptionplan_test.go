@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSubscriptionPlan(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("subscription_plan")
+	g.cfg.PlanKey = "mm:plan"
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	fake.nextConn(t)
+	if err := g.subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	fake.nextOp(t)
+
+	if err := g.applyPlanData([]byte(`{"version":3,"symbols":["BTCUSDT","ETHUSDT"],"topics":["tickers"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	unsub, sub := fake.nextOp(t), fake.nextOp(t)
+	if unsub["op"] != "unsubscribe" || len(unsub["args"].([]any)) != 1 || unsub["args"].([]any)[0] != "orderbook.25.BTCUSDT" {
+		t.Fatalf("first op = %v", unsub)
+	}
+	if sub["op"] != "subscribe" || len(sub["args"].([]any)) != 1 || sub["args"].([]any)[0] != "tickers.ETHUSDT" {
+		t.Fatalf("second op = %v", sub)
+	}
+	if got := g.topicsFor("ETHUSDT"); len(got) != 1 || got[0] != "tickers.ETHUSDT" {
+		t.Fatalf("topicsFor = %v", got)
+	}
+	if v := testutil.ToFloat64(g.metrics.planVersion); v != 3 {
+		t.Fatalf("plan version = %v", v)
+	}
+	p := g.instanceInfo().Plan
+	if p == nil || p.Key != "mm:plan" || p.Version != 3 || len(p.Topics) != 1 {
+		t.Fatalf("/info plan = %+v", p)
+	}
+
+	if err := g.applyPlanData([]byte(`{"version":2,"symbols":["BTCUSDT"]}`)); err == nil {
+		t.Fatal("applied an older plan")
+	}
+	if err := g.applyPlanData([]byte(`{"version":3,"symbols":["BTCUSDT","ETHUSDT"],"topics":["tickers"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if again := g.instanceInfo().Plan; again != p {
+		t.Fatalf("rereading version 3 replaced %+v with %+v", p, again)
+	}
+	if got := g.topicsFor("ETHUSDT"); len(got) != 1 || got[0] != "tickers.ETHUSDT" {
+		t.Fatalf("topicsFor = %v after rejecting an older plan", got)
+	}
+	g.closeConn()
+}
+
+func TestParseSubscriptionPlan(t *testing.T) {
+	configured := []string{"orderbook.25", "tickers"}
+	p, err := parseSubscriptionPlan([]byte(`{"version":1,"symbols":["BTCUSDT"]}`), configured)
+	if err != nil || p.Version != 1 || len(p.Symbols) != 1 || p.Topics != nil {
+		t.Fatalf("parse = %+v, %v", p, err)
+	}
+	for _, bad := range []string{`{"version":1}`, `{"symbols":["BTCUSDT"],"topics":["publicTrade"]}`, `[`} {
+		if _, err := parseSubscriptionPlan([]byte(bad), configured); err == nil {
+			t.Fatalf("%s accepted", bad)
+		}
+	}
+}
+
+func TestSubscriptionPlanConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"SUBSCRIPTION_PLAN_KEY": "mm:plan", "REDIS_URL": "redis://localhost:6379/2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PlanKey != "mm:plan" || cfg.PlanInterval.Seconds() != 10 {
+		t.Fatalf("PlanKey = %q, interval %s", cfg.PlanKey, cfg.PlanInterval)
+	}
+	src, err := newPlanSource(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.client.Close()
+	if src.channel != "__keyspace@2__:mm:plan" {
+		t.Fatalf("channel = %q", src.channel)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.SymbolsFile = "symbols.txt"
+	if cfg.Validate() == nil {
+		t.Fatal("SUBSCRIPTION_PLAN_KEY with SYMBOLS_FILE accepted")
+	}
+}
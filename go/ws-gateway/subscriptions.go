@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// subscriptionStatus is one topic in GET /status/subscriptions.
+type subscriptionStatus struct {
+	Topic     string `json:"topic"`
+	Symbol    string `json:"symbol"`
+	Confirmed bool   `json:"confirmed"`
+	Error     string `json:"error,omitempty"`
+	// Attempts counts subscribe ops sent for the topic on this connection.
+	Attempts int `json:"attempts"`
+	// LastData is the ts of the topic's latest data message and Seq its
+	// sequence id: the book's seq, else Bybit's cross sequence cs.
+	LastData int64 `json:"lastDataTs,omitempty"`
+	Seq      int64 `json:"seq,omitempty"`
+}
+
+// subscriptions tracks the topics subscribed on the current connection.
+// Subscribe ops carry a unique req_id so the exchange's ack can be matched
+// back to their topics even with several ops in flight.
+type subscriptions struct {
+	mu      sync.Mutex
+	nextReq int
+	pending map[string]pendingOp
+	topics  map[string]*subscriptionStatus
+}
+
+type pendingOp struct {
+	topics []string
+	sent   time.Time
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{pending: make(map[string]pendingOp), topics: make(map[string]*subscriptionStatus)}
+}
+
+// reset forgets everything, for a new connection.
+func (s *subscriptions) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.pending)
+	clear(s.topics)
+}
+
+// request records an op about to be sent and returns its req_id.
+func (s *subscriptions) request(op string, topics []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextReq++
+	id := fmt.Sprintf("%s-%d", op, s.nextReq)
+	switch op {
+	case "subscribe":
+		s.pending[id] = pendingOp{topics: topics, sent: time.Now()}
+		for _, t := range topics {
+			st := s.topics[t]
+			if st == nil || st.Confirmed {
+				st = &subscriptionStatus{Topic: t, Symbol: t[strings.LastIndexByte(t, '.')+1:]}
+				s.topics[t] = st
+			}
+			st.Attempts++
+		}
+	case "unsubscribe":
+		for _, t := range topics {
+			delete(s.topics, t)
+		}
+	}
+	return id
+}
+
+// ack applies the exchange's reply to request id and returns how long it
+// took, or false for an id that isn't pending.
+func (s *subscriptions) ack(id string, ok bool, msg string) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op, found := s.pending[id]
+	if !found {
+		return 0, false
+	}
+	delete(s.pending, id)
+	for _, t := range op.topics {
+		if st := s.topics[t]; st != nil {
+			st.Confirmed = ok
+			st.Error = ""
+			if !ok {
+				st.Error = msg
+			}
+		}
+	}
+	return time.Since(op.sent), true
+}
+
+// expired forgets ops sent more than timeout ago without an ack and returns
+// their topics that are still subscribed, with the attempts made so far.
+func (s *subscriptions) expired(timeout time.Duration) map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := map[string]int{}
+	for id, op := range s.pending {
+		if time.Since(op.sent) < timeout {
+			continue
+		}
+		delete(s.pending, id)
+		for _, t := range op.topics {
+			if st := s.topics[t]; st != nil && !st.Confirmed {
+				out[t] = st.Attempts
+			}
+		}
+	}
+	return out
+}
+
+// observe records a data message for topic.
+func (s *subscriptions) observe(topic string, ts int64, raw map[string]any) {
+	seq := int64(0)
+	if m, ok := raw["data"].(map[string]any); ok {
+		if v, ok := m["seq"].(float64); ok {
+			seq = int64(v)
+		}
+	}
+	if v, ok := raw["cs"].(float64); ok && seq == 0 {
+		seq = int64(v)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.topics[topic]; st != nil {
+		st.LastData = ts
+		if seq != 0 {
+			st.Seq = seq
+		}
+	}
+}
+
+// confirmed counts the tracked topics the exchange has acked successfully.
+func (s *subscriptions) confirmed() (n, total int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.topics {
+		if st.Confirmed {
+			n++
+		}
+	}
+	return n, len(s.topics)
+}
+
+// list returns the tracked topics sorted by name.
+func (s *subscriptions) list() []subscriptionStatus {
+	s.mu.Lock()
+	out := make([]subscriptionStatus, 0, len(s.topics))
+	for _, st := range s.topics {
+		out = append(out, *st)
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Topic < out[j].Topic })
+	return out
+}
+
+// ackTimeoutLoop resends subscribe ops that got no ack within timeout, up to
+// subscribeMaxAttempts per topic, one op per symbol like the initial
+// subscribe so a mass timeout stays within Bybit's args limit. Later acks
+// for the abandoned req_ids are ignored.
+func (g *Gateway) ackTimeoutLoop(ctx context.Context, conn *websocket.Conn, timeout time.Duration) {
+	t := time.NewTicker(max(timeout/4, 10*time.Millisecond))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		expired := g.subs.expired(timeout)
+		if len(expired) == 0 {
+			continue
+		}
+		retry := map[string][]string{}
+		var symbols []string
+		for topic, attempts := range expired {
+			g.metrics.ackTimeouts.Inc()
+			if attempts >= subscribeMaxAttempts {
+				log.Printf("instance=%s subscribe_unacked topic=%s attempts=%d action=give_up", g.cfg.Instance, topic, attempts)
+				continue
+			}
+			s := topic[strings.LastIndexByte(topic, '.')+1:]
+			if retry[s] == nil {
+				symbols = append(symbols, s)
+			}
+			retry[s] = append(retry[s], topic)
+		}
+		if len(symbols) == 0 {
+			continue
+		}
+		sort.Strings(symbols)
+		log.Printf("instance=%s subscribe_unacked symbols=%d action=resend", g.cfg.Instance, len(symbols))
+		for _, s := range symbols {
+			topics := retry[s]
+			sort.Strings(topics)
+			if err := g.sendOp(conn, "subscribe", topics); err != nil {
+				log.Printf("instance=%s subscribe_resend_error err=%v", g.cfg.Instance, err)
+				return
+			}
+		}
+	}
+}
+
+const reconnectPartialSubscribe = "partial_subscribe"
+
+// watchConfirmations checks, timeout after subscribing, that at least
+// fraction of the topics were acked. Venues sometimes drop part of a
+// subscribe silently; reconnecting beats running degraded.
+func (g *Gateway) watchConfirmations(timeout time.Duration, fraction float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	conn, ctx := g.conn, g.connCtx
+	if conn == nil {
+		return
+	}
+	g.connWG.Add(1)
+	go func() {
+		defer g.connWG.Done()
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		n, total := g.subs.confirmed()
+		if total == 0 || float64(n) >= fraction*float64(total) {
+			return
+		}
+		g.metrics.forcedReconnects.WithLabelValues(reconnectPartialSubscribe).Inc()
+		log.Printf("instance=%s partial_subscribe confirmed=%d/%d need=%.2f action=reconnect", g.cfg.Instance, n, total, fraction)
+		_ = conn.Close()
+	}()
+}
+
+type instanceSubscriptions struct {
+	Instance      string               `json:"instance"`
+	WSURL         string               `json:"wsUrl"`
+	Connected     bool                 `json:"connected"`
+	Subscriptions []subscriptionStatus `json:"subscriptions"`
+}
+
+// subscriptionStatus serves each instance's subscribed topics. Instances
+// split a symbol universe across connections, so one listing per instance
+// covers every connection.
+func (s gatewaySet) subscriptionStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	resp := make([]instanceSubscriptions, 0, len(s))
+	for _, g := range s {
+		resp = append(resp, instanceSubscriptions{
+			Instance:      g.cfg.Instance,
+			WSURL:         redactURL(g.cfg.WSURL),
+			Connected:     g.live.Load(),
+			Subscriptions: g.subs.list(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
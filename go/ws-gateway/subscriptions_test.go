@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSubscriptionStatus(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT", "ETHUSDT")
+	g.cfg.Topics = []string{"orderbook.50"}
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	if err := g.subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	btc, eth := fake.nextOp(t), fake.nextOp(t)
+	go g.readLoop()
+
+	sendJSON(t, server, map[string]any{"op": "subscribe", "success": true, "req_id": btc["req_id"]})
+	sendJSON(t, server, map[string]any{"op": "subscribe", "success": false, "ret_msg": "invalid symbol", "req_id": eth["req_id"]})
+	sendJSON(t, server, map[string]any{"topic": "orderbook.50.BTCUSDT", "type": "delta", "ts": 1700000000100, "cts": 1700000000090,
+		"data": map[string]any{"s": "BTCUSDT", "seq": 42}})
+	// The acks were read before the data message.
+	waitEvents(t, sink, 1)
+
+	rec := httptest.NewRecorder()
+	gatewaySet{g}.subscriptionStatus(rec, httptest.NewRequest("GET", "/status/subscriptions", nil))
+	var resp []instanceSubscriptions
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []subscriptionStatus{
+		{Topic: "orderbook.50.BTCUSDT", Symbol: "BTCUSDT", Confirmed: true, Attempts: 1, LastData: 1700000000090, Seq: 42},
+		{Topic: "orderbook.50.ETHUSDT", Symbol: "ETHUSDT", Error: "invalid symbol", Attempts: 1},
+	}
+	if len(resp) != 1 || !resp[0].Connected || !reflect.DeepEqual(resp[0].Subscriptions, want) {
+		t.Fatalf("status = %+v, want %+v", resp, want)
+	}
+
+	if err := g.applySymbols([]string{"BTCUSDT"}); err != nil {
+		t.Fatal(err)
+	}
+	if subs := g.subs.list(); len(subs) != 1 || subs[0].Symbol != "BTCUSDT" {
+		t.Fatalf("after unsubscribing ETHUSDT: %+v", subs)
+	}
+}
+
+func TestPartialSubscribeReconnects(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "BTCUSDT", "ETHUSDT")
+	g.metrics = newGatewayMetrics("partial_subscribe")
+	g.cfg.Topics = []string{"tickers"}
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	if err := g.subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	btc, _ := fake.nextOp(t), fake.nextOp(t)
+	done := make(chan error, 1)
+	go func() { done <- g.readLoop() }()
+	sendJSON(t, server, map[string]any{"op": "subscribe", "success": true, "req_id": btc["req_id"]})
+
+	g.watchConfirmations(50*time.Millisecond, 1)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("read loop still running with half the topics unconfirmed")
+	}
+	if n := testutil.ToFloat64(g.metrics.forcedReconnects.WithLabelValues(reconnectPartialSubscribe)); n != 1 {
+		t.Fatalf("partial_subscribe reconnects = %v", n)
+	}
+	g.closeConn()
+
+	if err := g.connect(); err != nil {
+		t.Fatalf("reconnect: %v", err)
+	}
+	server = fake.nextConn(t)
+	if err := g.subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	btc, eth := fake.nextOp(t), fake.nextOp(t)
+	go func() { done <- g.readLoop() }()
+	sendJSON(t, server, map[string]any{"op": "subscribe", "success": true, "req_id": btc["req_id"]})
+	sendJSON(t, server, map[string]any{"op": "subscribe", "success": true, "req_id": eth["req_id"]})
+	g.watchConfirmations(50*time.Millisecond, 1)
+	select {
+	case err := <-done:
+		t.Fatalf("fully confirmed connection closed: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := testutil.ToFloat64(g.metrics.forcedReconnects.WithLabelValues(reconnectPartialSubscribe)); n != 1 {
+		t.Fatalf("partial_subscribe reconnects = %v after full confirm", n)
+	}
+	g.closeConn()
+	<-done
+}
+
+func TestSubscribeAckTimeoutResends(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "BTCUSDT", "ETHUSDT")
+	g.metrics = newGatewayMetrics("subscribe_ack_timeout")
+	g.cfg.Topics = []string{"tickers"}
+	g.cfg.AckTimeout = 500 * time.Millisecond
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	if err := g.subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	btc, eth := fake.nextOp(t), fake.nextOp(t)
+	go g.readLoop()
+	sendJSON(t, server, map[string]any{"op": "subscribe", "success": true, "req_id": btc["req_id"]})
+
+	resend := fake.nextOp(t)
+	if resend["op"] != "subscribe" || resend["req_id"] == eth["req_id"] {
+		t.Fatalf("resend = %v, want a fresh subscribe", resend)
+	}
+	if args, _ := resend["args"].([]any); len(args) != 1 || args[0] != "tickers.ETHUSDT" {
+		t.Fatalf("resent args = %v, want only the unacked topic", resend["args"])
+	}
+	// The abandoned req_id no longer confirms anything; the new one does.
+	sendJSON(t, server, map[string]any{"op": "subscribe", "success": true, "req_id": eth["req_id"]})
+	sendJSON(t, server, map[string]any{"op": "subscribe", "success": true, "req_id": resend["req_id"]})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if n, total := g.subs.confirmed(); n == 2 && total == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscriptions = %+v", g.subs.list())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if subs := g.subs.list(); subs[1].Topic != "tickers.ETHUSDT" || subs[1].Attempts != 2 {
+		t.Fatalf("ETHUSDT status = %+v", subs[1])
+	}
+	if n := testutil.ToFloat64(g.metrics.ackTimeouts); n != 1 {
+		t.Fatalf("ack timeouts = %v", n)
+	}
+	if n := histogramCount(t, g.metrics.ackLatency); n != 2 {
+		t.Fatalf("ack latency samples = %d, want 2", n)
+	}
+}
+
+func TestSubscribeAckTimeoutResendsPerSymbol(t *testing.T) {
+	fake := newFakeBybit(t)
+	symbols := []string{"BTCUSDT", "ETHUSDT", "SOLUSDT", "XRPUSDT", "DOGEUSDT", "ADAUSDT"}
+	g, _ := newTestGateway(t, fake.url(), symbols...)
+	g.metrics = newGatewayMetrics("subscribe_ack_timeout_per_symbol")
+	g.cfg.Topics = []string{"tickers", "publicTrade"}
+	g.cfg.AckTimeout = time.Second
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	fake.nextConn(t)
+	if err := g.subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	for range symbols {
+		fake.nextOp(t)
+	}
+
+	// All 12 topics time out together; each symbol's are resent on their own.
+	resent := map[string]bool{}
+	for range symbols {
+		op := fake.nextOp(t)
+		args, _ := op["args"].([]any)
+		if op["op"] != "subscribe" || len(args) != 2 {
+			t.Fatalf("resend = %v, want one symbol's two topics", op)
+		}
+		s := strings.TrimPrefix(args[0].(string), "publicTrade.")
+		if args[1] != "tickers."+s || resent[s] {
+			t.Fatalf("resent args = %v", args)
+		}
+		resent[s] = true
+	}
+	if len(resent) != len(symbols) {
+		t.Fatalf("resent %v, want every symbol", resent)
+	}
+	g.closeConn()
+}
+
+func TestMinConfirmedFractionConfig(t *testing.T) {
+	t.Setenv("MIN_CONFIRMED_FRACTION", "1.5")
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected MIN_CONFIRMED_FRACTION > 1 to be rejected")
+	}
+}
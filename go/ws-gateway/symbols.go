@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const symbolsFileDebounce = 500 * time.Millisecond
+
+// readSymbolsFile loads a newline-delimited symbol list. Blank lines and
+// lines starting with '#' are ignored.
+func readSymbolsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var symbols []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		symbols = append(symbols, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(symbols) == 0 {
+		return nil, fmt.Errorf("%s: no symbols", path)
+	}
+	return symbols, nil
+}
+
+// symbolSet is the subscribed universe STRICT_SYMBOLS checks against.
+type symbolSet map[string]struct{}
+
+func newSymbolSet(symbols []string) *symbolSet {
+	s := make(symbolSet, len(symbols))
+	for _, sym := range symbols {
+		s[sym] = struct{}{}
+	}
+	return &s
+}
+
+func (s *symbolSet) has(symbol string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := (*s)[symbol]
+	return ok
+}
+
+// dedupeSymbols drops repeated symbols, keeping the first occurrence, and
+// returns the ones dropped.
+func dedupeSymbols(symbols []string) (unique, dups []string) {
+	seen := make(map[string]struct{}, len(symbols))
+	unique = symbols[:0:0]
+	for _, s := range symbols {
+		if _, ok := seen[s]; ok {
+			dups = append(dups, s)
+			continue
+		}
+		seen[s] = struct{}{}
+		unique = append(unique, s)
+	}
+	return unique, dups
+}
+
+// prioritize returns a copy of symbols with those in priority first, in
+// the order priority lists them, and the rest in their original order.
+// Priority symbols not in symbols are ignored.
+func prioritize(symbols, priority []string) []string {
+	out := make([]string, 0, len(symbols))
+	if len(priority) == 0 {
+		return append(out, symbols...)
+	}
+	have := newSymbolSet(symbols)
+	first := make(map[string]struct{}, len(priority))
+	for _, s := range priority {
+		if _, dup := first[s]; !dup && have.has(s) {
+			first[s] = struct{}{}
+			out = append(out, s)
+		}
+	}
+	for _, s := range symbols {
+		if _, ok := first[s]; !ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// diffSymbols returns the symbols present in next but not in prev, and those
+// present in prev but not in next, each in their original order.
+func diffSymbols(prev, next []string) (added, removed []string) {
+	prevSet := make(map[string]struct{}, len(prev))
+	for _, s := range prev {
+		prevSet[s] = struct{}{}
+	}
+	nextSet := make(map[string]struct{}, len(next))
+	for _, s := range next {
+		nextSet[s] = struct{}{}
+		if _, ok := prevSet[s]; !ok {
+			added = append(added, s)
+		}
+	}
+	for _, s := range prev {
+		if _, ok := nextSet[s]; !ok {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
+
+// applySymbols replaces the symbol set and, when connected, sends the
+// incremental subscribe/unsubscribe ops for the difference. When not
+// connected the new set is picked up by the next subscribe.
+func (g *Gateway) applySymbols(next []string) error { return g.applyPlan(next, nil) }
+
+// applyPlan is applySymbols that, given topics, also replaces the topic
+// prefixes, subscribing the symbols kept to the prefixes added and
+// unsubscribing them from those removed.
+func (g *Gateway) applyPlan(next, topics []string) error {
+	next, dups := dedupeSymbols(next)
+	if len(dups) > 0 {
+		log.Printf("duplicate_symbols instance=%s symbols=%v", g.cfg.Instance, dups)
+	}
+	if g.cfg.SymbolValidation != symbolValidationOff {
+		// Fetched before subMu so a slow list doesn't hold up reconnects.
+		// A failing set keeps the current one.
+		var err error
+		if next, err = checkSymbols(g.ctx, g.cfg, next, g.metrics); err != nil {
+			return err
+		}
+	}
+	g.subMu.Lock()
+	defer g.subMu.Unlock()
+	g.mu.Lock()
+	prevTopics := g.topicsLocked()
+	if topics == nil {
+		topics = prevTopics
+	}
+	added, removed := diffSymbols(g.symbols, next)
+	addedTopics, removedTopics := diffSymbols(prevTopics, topics)
+	// The symbols of next that aren't new. added is a subset of next, so
+	// the removed half is always empty.
+	kept, _ := diffSymbols(added, next)
+	g.symbols = next
+	g.topics = topics
+	g.allowed.Store(newSymbolSet(next))
+	conn := g.conn
+	g.mu.Unlock()
+	if g.lastPrices != nil {
+		g.lastPrices.retain(next)
+	}
+	if g.remoteWrite != nil {
+		g.remoteWrite.retain(next)
+	}
+	for _, s := range removed {
+		g.metrics.imbalance.DeleteLabelValues(s)
+		g.metrics.buyVolume.DeleteLabelValues(s)
+		g.metrics.sellVolume.DeleteLabelValues(s)
+		g.metrics.rollingVol.DeleteLabelValues(s)
+	}
+	if g.deadman != nil && len(removed) > 0 {
+		g.deadman.forget(removed)
+		g.metrics.staleSymbols.Set(float64(g.deadman.staleCount()))
+	}
+	if len(added) > 0 {
+		g.resolveMetrics()
+	}
+
+	if len(addedTopics) > 0 || len(removedTopics) > 0 {
+		log.Printf("topics_changed added=%v removed=%v", addedTopics, removedTopics)
+	} else if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		log.Printf("symbols_changed added=%v removed=%v", added, removed)
+	}
+	if conn == nil {
+		return nil
+	}
+	for _, s := range removed {
+		if err := g.sendOp(conn, "unsubscribe", topicArgs(prevTopics, s)); err != nil {
+			return err
+		}
+	}
+	for _, s := range kept {
+		if len(removedTopics) > 0 {
+			if err := g.sendOp(conn, "unsubscribe", topicArgs(removedTopics, s)); err != nil {
+				return err
+			}
+		}
+		if len(addedTopics) > 0 {
+			if err := g.sendOp(conn, "subscribe", topicArgs(addedTopics, s)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range prioritize(added, g.cfg.SymbolPriority) {
+		if err := g.sendOp(conn, "subscribe", topicArgs(topics, s)); err != nil {
+			return err
+		}
+	}
+	g.metrics.subscribed.Set(float64(len(next)))
+	return nil
+}
+
+func (g *Gateway) reloadSymbolsFile() {
+	symbols, err := readSymbolsFile(g.symbolsFile)
+	if err != nil {
+		g.metrics.errors.Inc()
+		log.Printf("symbols_file_error err=%v", err)
+		return
+	}
+	if err := g.applySymbols(symbols); err != nil {
+		g.metrics.errors.Inc()
+		log.Printf("symbols_apply_error err=%v", err)
+	}
+}
+
+// watchSymbolsFile watches the directory holding SYMBOLS_FILE so that atomic
+// replaces (including Kubernetes ConfigMap symlink swaps) are seen, and
+// reloads the file once writes have settled for symbolsFileDebounce.
+func (g *Gateway) watchSymbolsFile() {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("symbols_watch_error err=%v", err)
+		return
+	}
+	defer w.Close()
+	if err := w.Add(filepath.Dir(g.symbolsFile)); err != nil {
+		log.Printf("symbols_watch_error err=%v", err)
+		return
+	}
+
+	target := filepath.Clean(g.symbolsFile)
+	debounce := time.NewTimer(symbolsFileDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(ev.Name) != target && filepath.Base(ev.Name) != "..data" {
+				continue
+			}
+			debounce.Reset(symbolsFileDebounce)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			g.metrics.errors.Inc()
+			log.Printf("symbols_watch_error err=%v", err)
+		case <-debounce.C:
+			g.reloadSymbolsFile()
+		}
+	}
+}
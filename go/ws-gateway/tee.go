@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	teeBuffer    = 256
+	teeKeepalive = 15 * time.Second
+)
+
+// teeHub fans published events out to debug subscribers. Delivery never
+// blocks the pipeline: a subscriber whose buffer is full misses events,
+// counted in ws_gateway_tee_dropped_total.
+type teeHub struct {
+	n    atomic.Int32
+	mu   sync.Mutex
+	subs map[*teeSub]struct{}
+}
+
+type teeSub struct {
+	ch     chan OutEvent
+	symbol string
+	typ    string
+	drops  func()
+}
+
+func newTeeHub() *teeHub { return &teeHub{subs: make(map[*teeSub]struct{})} }
+
+// matches filters on symbol and on type, which may be the full topic or its
+// kind.
+func (s *teeSub) matches(ev *OutEvent) bool {
+	if s.symbol != "" && ev.Symbol != s.symbol {
+		return false
+	}
+	return s.typ == "" || ev.Type == s.typ || topicKind(ev.Type) == s.typ
+}
+
+func (h *teeHub) subscribe(s *teeSub) {
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.n.Store(int32(len(h.subs)))
+	h.mu.Unlock()
+}
+
+func (h *teeHub) unsubscribe(s *teeSub) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.n.Store(int32(len(h.subs)))
+	h.mu.Unlock()
+}
+
+func (h *teeHub) send(ev OutEvent) {
+	if h.n.Load() == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if !s.matches(&ev) {
+			continue
+		}
+		select {
+		case s.ch <- ev:
+		default:
+			s.drops()
+		}
+	}
+}
+
+// tee streams published events as server-sent events, optionally filtered
+// by ?symbol=, ?type= (topic or kind) and ?instance=.
+func (s gatewaySet) tee(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	ch := make(chan OutEvent, teeBuffer)
+	for _, g := range s {
+		if inst := q.Get("instance"); inst != "" && inst != g.cfg.Instance {
+			continue
+		}
+		sub := &teeSub{ch: ch, symbol: q.Get("symbol"), typ: q.Get("type"), drops: g.metrics.teeDropped.Inc}
+		g.tee.subscribe(sub)
+		defer g.tee.unsubscribe(sub)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(teeKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case ev := <-ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
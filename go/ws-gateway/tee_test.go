@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTeeStreamsFilteredEvents(t *testing.T) {
+	g, _ := newTestGateway(t, "ws://unused", "BTCUSDT")
+	g.tee = newTeeHub()
+	srv := httptest.NewServer(http.HandlerFunc(gatewaySet{g}.tee))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/debug/tee?symbol=BTCUSDT&type=tickers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	for deadline := time.Now().Add(2 * time.Second); g.tee.n.Load() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("client never subscribed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	g.publish(OutEvent{Symbol: "ETHUSDT", Type: "tickers.ETHUSDT"})
+	g.publish(OutEvent{Symbol: "BTCUSDT", Type: "orderbook.25.BTCUSDT"})
+	g.publish(OutEvent{Ts: 42, Symbol: "BTCUSDT", Type: "tickers.BTCUSDT"})
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var ev OutEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Ts != 42 || ev.Type != "tickers.BTCUSDT" {
+			t.Fatalf("streamed %+v, want only the BTCUSDT ticker", ev)
+		}
+		return
+	}
+	t.Fatalf("stream ended: %v", sc.Err())
+}
+
+func TestTeeDropsForSlowClients(t *testing.T) {
+	m := newGatewayMetrics("tee_drop_test")
+	h := newTeeHub()
+	sub := &teeSub{ch: make(chan OutEvent, 1), drops: m.teeDropped.Inc}
+	h.subscribe(sub)
+	for i := 0; i < 3; i++ {
+		h.send(OutEvent{Ts: int64(i)})
+	}
+	if n := testutil.ToFloat64(m.teeDropped); n != 2 {
+		t.Fatalf("dropped = %v, want 2", n)
+	}
+	h.unsubscribe(sub)
+	h.send(OutEvent{})
+	if ev := <-sub.ch; ev.Ts != 0 || len(sub.ch) != 0 {
+		t.Fatalf("unexpected delivery after unsubscribe")
+	}
+}
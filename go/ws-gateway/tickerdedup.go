@@ -0,0 +1,47 @@
+package main
+
+import "sync"
+
+// defaultTickerFields are the ticker fields TICKER_ON_CHANGE compares by
+// default: the last trade and the top of book.
+var defaultTickerFields = []string{"lastPrice", "bid1Price", "bid1Size", "ask1Price", "ask1Size"}
+
+// tickerDedup suppresses ticker events in which none of the watched fields
+// changed since the last one published for the symbol. Each connection's
+// read loop has its own, so the first ticker after a reconnect always goes
+// out; with REDUNDANT_ENDPOINTS the merged stream shares one. A symbol
+// evicted beyond limit counts as unseen again.
+type tickerDedup struct {
+	fields []string
+
+	mu   sync.Mutex
+	last *symbolLRU[map[string]string]
+}
+
+func newTickerDedup(fields []string, limit stateLimit) *tickerDedup {
+	return &tickerDedup{fields: fields, last: newSymbolLRU[map[string]string](limit, nil)}
+}
+
+// changed reports whether ev should be published, recording the watched
+// fields it carries. Fields a delta omits are unchanged by definition.
+func (d *tickerDedup) changed(ev OutEvent) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	last, seen := d.last.get(ev.Symbol)
+	if !seen {
+		last = make(map[string]string, len(d.fields))
+		d.last.put(ev.Symbol, last)
+	}
+	changed := !seen
+	for _, f := range d.fields {
+		v, ok := payloadField(ev.Payload, f)
+		if !ok {
+			continue
+		}
+		if prev, had := last[f]; !had || prev != v {
+			last[f] = v
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"maps"
+	"sync"
+)
+
+// tickerMerge rebuilds complete tickers from Bybit's ticker deltas, which
+// carry only the fields that changed (TICKER_MERGE). Each connection's read
+// loop has its own, so after a reconnect deltas wait for a fresh snapshot;
+// with REDUNDANT_ENDPOINTS the merged stream shares one. A symbol evicted
+// beyond limit waits for its next snapshot too.
+type tickerMerge struct {
+	mu   sync.Mutex
+	last *symbolLRU[map[string]any]
+}
+
+func newTickerMerge(limit stateLimit) *tickerMerge {
+	return &tickerMerge{last: newSymbolLRU[map[string]any](limit, nil)}
+}
+
+// merge returns ev with the symbol's complete ticker as payload: a snapshot
+// replaces the state, a delta is folded into it and goes out as an update.
+// A delta with no snapshot to apply to reports false. Payloads that aren't
+// objects pass through.
+func (m *tickerMerge) merge(ev OutEvent) (OutEvent, bool) {
+	fields, ok := ev.Payload.(map[string]any)
+	if !ok {
+		return ev, true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ev.Action != actionDelta {
+		m.last.put(ev.Symbol, maps.Clone(fields))
+		return ev, true
+	}
+	full, ok := m.last.get(ev.Symbol)
+	if !ok {
+		return ev, false
+	}
+	maps.Copy(full, fields)
+	// The state keeps changing after ev is published.
+	ev.Payload = maps.Clone(full)
+	ev.Action = actionUpdate
+	return ev, true
+}
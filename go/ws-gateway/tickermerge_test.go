@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTickerMerge(t *testing.T) {
+	m := newTickerMerge(stateLimit{})
+	delta := OutEvent{Symbol: "BTCUSDT", Action: actionDelta, Payload: map[string]any{"lastPrice": "101"}}
+	if _, ok := m.merge(delta); ok {
+		t.Fatal("delta before any snapshot merged")
+	}
+	snap := OutEvent{Symbol: "BTCUSDT", Action: actionSnapshot, Payload: map[string]any{"lastPrice": "100", "bid1Price": "99"}}
+	if got, ok := m.merge(snap); !ok || got.Action != actionSnapshot {
+		t.Fatalf("snapshot = %+v, %v", got, ok)
+	}
+	got, ok := m.merge(delta)
+	if !ok || got.Action != actionUpdate || !reflect.DeepEqual(got.Payload, map[string]any{"lastPrice": "101", "bid1Price": "99"}) {
+		t.Fatalf("merged delta = %+v, %v", got, ok)
+	}
+	m.merge(OutEvent{Symbol: "BTCUSDT", Action: actionDelta, Payload: map[string]any{"bid1Price": "100"}})
+	if got.Payload.(map[string]any)["bid1Price"] != "99" {
+		t.Fatal("a published merged ticker changed afterwards")
+	}
+	if snap.Payload.(map[string]any)["lastPrice"] != "100" {
+		t.Fatal("merging modified the snapshot's payload")
+	}
+}
+
+func TestTickerMergeReadLoop(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("ticker_merge")
+	g.cfg.TickerMerge = true
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+	go g.readLoop()
+
+	ticker := func(action string, data map[string]any) map[string]any {
+		data["symbol"] = "BTCUSDT"
+		return map[string]any{"topic": "tickers.BTCUSDT", "type": action, "ts": 1700000000000, "data": data}
+	}
+	sendJSON(t, server, ticker(actionDelta, map[string]any{"lastPrice": "99"}))
+	sendJSON(t, server, ticker(actionSnapshot, map[string]any{"lastPrice": "100", "volume24h": "5"}))
+	sendJSON(t, server, ticker(actionDelta, map[string]any{"lastPrice": "101"}))
+	evs := waitEvents(t, sink, 2)
+	if want := map[string]any{"symbol": "BTCUSDT", "lastPrice": "101", "volume24h": "5"}; evs[1].Action != actionUpdate || !reflect.DeepEqual(evs[1].Payload, want) {
+		t.Fatalf("merged ticker = %+v, want %v", evs[1], want)
+	}
+	if got := testutil.ToFloat64(g.metrics.tickerUnmerged); got != 1 {
+		t.Fatalf("dropped deltas = %v, want the one before the snapshot", got)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const tickerSnapshotTimeout = 10 * time.Second
+
+// tickerSeed reconciles the REST ticker snapshot taken on subscribe
+// (TICKER_SNAPSHOT_URL) with the WS tickers of the same connection: the
+// snapshot is published only for symbols no WS ticker has arrived for yet,
+// and the first WS ticker after it is dropped if it is older.
+type tickerSeed struct {
+	mu     sync.Mutex
+	seeded map[string]int64 // snapshot ts, until the first WS ticker
+	live   map[string]bool  // symbols with a WS ticker since subscribe
+}
+
+func newTickerSeed() *tickerSeed {
+	return &tickerSeed{seeded: make(map[string]int64), live: make(map[string]bool)}
+}
+
+// reset starts a new connection's reconciliation.
+func (s *tickerSeed) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.seeded)
+	clear(s.live)
+}
+
+// ws records a WS ticker for symbol at ts and reports whether to publish it.
+func (s *tickerSeed) ws(symbol string, ts int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live[symbol] = true
+	seededAt, ok := s.seeded[symbol]
+	if !ok {
+		return true
+	}
+	delete(s.seeded, symbol)
+	return ts >= seededAt
+}
+
+// rest records the snapshot events of symbols no WS ticker came first for
+// and returns them to publish. The caller publishes them after the lock
+// is released, so a slow publish never holds up the read loop.
+func (s *tickerSeed) rest(evs []OutEvent) []OutEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []OutEvent
+	for _, ev := range evs {
+		if s.live[ev.Symbol] {
+			continue
+		}
+		s.seeded[ev.Symbol] = ev.Ts
+		out = append(out, ev)
+	}
+	return out
+}
+
+// startTickerSeed takes a REST snapshot for the connection just subscribed,
+// in the background so reading starts at once.
+func (g *Gateway) startTickerSeed() {
+	g.tickerSeed.reset()
+	g.mu.Lock()
+	ctx := g.connCtx
+	g.mu.Unlock()
+	g.connWG.Add(1)
+	go func() {
+		defer g.connWG.Done()
+		g.seedTickers(ctx)
+	}()
+}
+
+// seedTickers fetches TICKER_SNAPSHOT_URL once and publishes a snapshot
+// ticker event for each subscribed symbol in it.
+func (g *Gateway) seedTickers(ctx context.Context) {
+	evs, err := fetchTickerSnapshot(ctx, g.cfg.TickerSnapshot)
+	if err != nil {
+		g.metrics.tickerSnapshots.WithLabelValues("error").Inc()
+		log.Printf("instance=%s ticker_snapshot_error err=%v", g.cfg.Instance, err)
+		return
+	}
+	allowed := g.allowed.Load()
+	subscribed := evs[:0]
+	for _, ev := range evs {
+		if !allowed.has(ev.Symbol) {
+			continue
+		}
+		if ev.Ts == 0 {
+			ev.Ts = g.clock.Now().UnixMilli()
+		}
+		subscribed = append(subscribed, ev)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	seeds := g.tickerSeed.rest(subscribed)
+	g.metrics.tickerSnapshots.WithLabelValues("superseded").Add(float64(len(subscribed) - len(seeds)))
+	for _, ev := range seeds {
+		if ctx.Err() != nil {
+			return
+		}
+		g.emit(ev)
+		g.metrics.tickerSnapshots.WithLabelValues("published").Inc()
+	}
+	log.Printf("instance=%s ticker_snapshot symbols=%d", g.cfg.Instance, len(seeds))
+}
+
+// fetchTickerSnapshot reads a Bybit v5 /market/tickers response as snapshot
+// events stamped with the response time.
+func fetchTickerSnapshot(ctx context.Context, endpoint string) ([]OutEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, tickerSnapshotTimeout)
+	defer cancel()
+	var out struct {
+		RetCode int    `json:"retCode"`
+		RetMsg  string `json:"retMsg"`
+		Time    int64  `json:"time"`
+		Result  struct {
+			List []map[string]any `json:"list"`
+		} `json:"result"`
+	}
+	if err := getJSON(ctx, endpoint, &out); err != nil {
+		return nil, err
+	}
+	if out.RetCode != 0 {
+		return nil, fmt.Errorf("retCode=%d retMsg=%s", out.RetCode, out.RetMsg)
+	}
+	evs := make([]OutEvent, 0, len(out.Result.List))
+	for _, item := range out.Result.List {
+		symbol, _ := item["symbol"].(string)
+		if symbol == "" {
+			continue
+		}
+		evs = append(evs, OutEvent{Ts: out.Time, Symbol: symbol, Type: "tickers." + symbol, Action: actionSnapshot, Payload: item})
+	}
+	return evs, nil
+}
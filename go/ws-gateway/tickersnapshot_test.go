@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTickerSnapshot(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("category") != "linear" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"retCode":0,"retMsg":"OK","time":1700000000500,"result":{"category":"linear","list":[
+			{"symbol":"BTCUSDT","lastPrice":"100","bid1Price":"99.5"},
+			{"symbol":"ETHUSDT","lastPrice":"10"},
+			{"symbol":"SOLUSDT","lastPrice":"1"}]}}`))
+	}))
+	defer srv.Close()
+
+	g, sink := newTestGateway(t, "", "BTCUSDT", "ETHUSDT")
+	g.metrics = newGatewayMetrics("ticker_snapshot")
+	g.cfg.TickerSnapshot = srv.URL + "/v5/market/tickers?category=linear"
+	g.allowed.Store(newSymbolSet(g.symbols))
+	g.tickerSeed = newTickerSeed()
+	// ETHUSDT's WS ticker got in first.
+	if !g.tickerSeed.ws("ETHUSDT", 1700000000400) {
+		t.Fatal("WS ticker before any snapshot dropped")
+	}
+	g.seedTickers(context.Background())
+
+	evs := sink.Events()
+	if len(evs) != 1 || evs[0].Symbol != "BTCUSDT" || evs[0].Type != "tickers.BTCUSDT" || evs[0].Action != actionSnapshot || evs[0].Ts != 1700000000500 {
+		t.Fatalf("events = %+v, want BTCUSDT's snapshot", evs)
+	}
+	if got := testutil.ToFloat64(g.metrics.tickerSnapshots.WithLabelValues("superseded")); got != 1 {
+		t.Fatalf("superseded = %v", got)
+	}
+	if g.tickerSeed.ws("BTCUSDT", 1700000000499) {
+		t.Fatal("WS ticker older than the snapshot published")
+	}
+	if !g.tickerSeed.ws("BTCUSDT", 1700000000400) {
+		t.Fatal("only the first WS ticker is reconciled")
+	}
+
+	g.tickerSeed.reset()
+	if seeds := g.tickerSeed.rest([]OutEvent{{Symbol: "ETHUSDT", Ts: 1}}); len(seeds) != 1 {
+		t.Fatal("reset kept WS state of the previous connection")
+	}
+}
+
+func TestTickerSnapshotError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"retCode":10001,"retMsg":"params error","result":{}}`))
+	}))
+	defer srv.Close()
+	if _, err := fetchTickerSnapshot(context.Background(), srv.URL); err == nil {
+		t.Fatal("retCode error ignored")
+	}
+}
+
+func TestTickerSnapshotConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"TICKER_SNAPSHOT_URL": "https://api.bybit.com/v5/market/tickers?category=linear"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TickerSnapshot == "" || cfg.Validate() != nil {
+		t.Fatalf("TickerSnapshot = %q, Validate = %v", cfg.TickerSnapshot, cfg.Validate())
+	}
+	bad := cfg
+	bad.TickerSnapshot = "wss://api.bybit.com"
+	if bad.Validate() == nil {
+		t.Fatal("non-HTTP TICKER_SNAPSHOT_URL accepted")
+	}
+	bad = cfg
+	bad.Topics = []string{"orderbook.50"}
+	if bad.Validate() == nil {
+		t.Fatal("TICKER_SNAPSHOT_URL accepted without tickers")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// tsSorter holds published events for a window and then releases them
+// sorted by exchange timestamp. The sort is stable, so events with equal
+// Ts, including a symbol's own, keep their arrival order.
+type tsSorter struct {
+	window time.Duration
+	next   func(OutEvent)
+
+	mu      sync.Mutex
+	pending []OutEvent
+	timer   *time.Timer
+	closed  bool
+
+	// flushMu keeps one window's events from overtaking the previous
+	// window's while next blocks.
+	flushMu sync.Mutex
+}
+
+func newTsSorter(window time.Duration, next func(OutEvent)) *tsSorter {
+	return &tsSorter{window: window, next: next}
+}
+
+func (s *tsSorter) add(ev OutEvent) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.pending = append(s.pending, ev)
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.window, s.flush)
+	}
+	s.mu.Unlock()
+}
+
+func (s *tsSorter) flush() {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.timer = nil
+	s.mu.Unlock()
+	sort.SliceStable(batch, func(i, j int) bool { return batch[i].Ts < batch[j].Ts })
+	for _, ev := range batch {
+		s.next(ev)
+	}
+}
+
+// close releases whatever is pending and drops later events.
+func (s *tsSorter) close() {
+	s.mu.Lock()
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.mu.Unlock()
+	s.flush()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSortWindow(t *testing.T) {
+	g, sink := newTestGateway(t, "")
+	g.sorter = newTsSorter(30*time.Millisecond, g.dispatch)
+	for _, ev := range []OutEvent{
+		{Ts: 3, Symbol: "BTCUSDT", Type: "tickers.BTCUSDT", Action: "a"},
+		{Ts: 1, Symbol: "ETHUSDT", Type: "tickers.ETHUSDT"},
+		{Ts: 3, Symbol: "BTCUSDT", Type: "tickers.BTCUSDT", Action: "b"},
+		{Ts: 2, Symbol: "BTCUSDT", Type: "publicTrade.BTCUSDT"},
+	} {
+		g.publish(ev)
+	}
+	if n := len(sink.Events()); n != 0 {
+		t.Fatalf("%d events published before the window closed", n)
+	}
+	evs := waitEvents(t, sink, 4)
+	var got []int64
+	for _, ev := range evs {
+		got = append(got, ev.Ts)
+	}
+	if got[0] != 1 || got[1] != 2 || got[2] != 3 || got[3] != 3 {
+		t.Fatalf("ts order = %v", got)
+	}
+	if evs[2].Action != "a" || evs[3].Action != "b" {
+		t.Fatalf("ties reordered: %q then %q", evs[2].Action, evs[3].Action)
+	}
+
+	g.publish(OutEvent{Ts: 9, Symbol: "BTCUSDT", Type: "tickers.BTCUSDT"})
+	g.sorter.close()
+	if n := len(sink.Events()); n != 5 {
+		t.Fatalf("close left %d events published, want the pending one flushed", n)
+	}
+	g.publish(OutEvent{Ts: 10, Symbol: "BTCUSDT", Type: "tickers.BTCUSDT"})
+	time.Sleep(50 * time.Millisecond)
+	if n := len(sink.Events()); n != 5 {
+		t.Fatalf("event accepted after close: %d", n)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+const (
+	unknownPassthrough = "passthrough"
+	unknownDrop        = "drop"
+	unknownWarn        = "warn"
+)
+
+func parseUnknownTopicPolicy(v string) (string, error) {
+	switch v {
+	case unknownPassthrough, unknownDrop, unknownWarn:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown policy %q (want passthrough|drop|warn)", v)
+}
+
+// knownKinds are the topic kinds the gateway handles; UNKNOWN_TOPIC_POLICY
+// applies to the rest.
+var knownKinds = map[string]bool{
+	"orderbook":   true,
+	"publicTrade": true,
+	"tickers":     true,
+	"kline":       true,
+}
+
+// keepUnknownTopic counts a frame of a kind outside knownKinds and reports
+// whether UNKNOWN_TOPIC_POLICY publishes it. Drop and warn log each topic
+// once per connection.
+func (g *Gateway) keepUnknownTopic(r *connReader, topic, kind string) bool {
+	g.metrics.unknownTopics.WithLabelValues(kind).Inc()
+	policy := g.cfg.UnknownTopic
+	if policy == unknownPassthrough {
+		return true
+	}
+	if !r.unknownTopics[topic] {
+		r.unknownTopics[topic] = true
+		log.Printf("unknown_topic instance=%s topic=%s policy=%s", g.cfg.Instance, topic, policy)
+	}
+	return policy == unknownWarn
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUnknownTopicPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		want   int
+	}{
+		{unknownPassthrough, 3},
+		{unknownWarn, 3},
+		{unknownDrop, 1},
+	} {
+		fake := newFakeBybit(t)
+		g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+		g.cfg.UnknownTopic = tc.policy
+		g.metrics = newGatewayMetrics("unknown_topic_" + tc.policy)
+		if err := g.connect(); err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+		server := fake.nextConn(t)
+		go g.readLoop()
+
+		sendJSON(t, server, map[string]any{"topic": "liquidation.BTCUSDT", "data": map[string]any{"s": "BTCUSDT"}})
+		sendJSON(t, server, map[string]any{"topic": "liquidation.BTCUSDT", "data": map[string]any{"s": "BTCUSDT"}})
+		sendJSON(t, server, map[string]any{"topic": "tickers.BTCUSDT", "data": map[string]any{"s": "BTCUSDT"}})
+		evs := waitEvents(t, sink, tc.want)
+		if len(evs) != tc.want || evs[len(evs)-1].Type != "tickers.BTCUSDT" {
+			t.Fatalf("%s: published %+v", tc.policy, evs)
+		}
+		if n := testutil.ToFloat64(g.metrics.unknownTopics.WithLabelValues("liquidation")); n != 2 {
+			t.Fatalf("%s: unknown topic frames = %v, want 2", tc.policy, n)
+		}
+	}
+}
+
+func TestUnknownTopicConfig(t *testing.T) {
+	cfg, err := loadConfig(env{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.UnknownTopic != unknownPassthrough {
+		t.Fatalf("UnknownTopic = %q", cfg.UnknownTopic)
+	}
+	cfg.UnknownTopic = "reject"
+	if cfg.Validate() == nil {
+		t.Fatal("UNKNOWN_TOPIC_POLICY=reject accepted")
+	}
+}
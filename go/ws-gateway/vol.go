@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// typeVol is the OutEvent.Type of rolling volatility events.
+const typeVol = "vol"
+
+const (
+	volBasisTrades = "trades"
+	volBasisMid    = "mid"
+)
+
+func parseVolBasis(v string) (string, error) {
+	switch v {
+	case volBasisTrades, volBasisMid:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown volatility basis %q (want trades|mid)", v)
+}
+
+// volKind is the topic kind a VOL_BASIS samples prices from.
+func volKind(basis string) string {
+	if basis == volBasisMid {
+		return "tickers"
+	}
+	return "publicTrade"
+}
+
+// Vol is the payload of a vol event: the sample standard deviation of the
+// log returns between consecutive VOL_SAMPLE closes over the last
+// VOL_WINDOW, in exchange time, ending at End.
+type Vol struct {
+	Basis   string  `json:"basis"`
+	Window  int64   `json:"windowMs"`
+	Sample  int64   `json:"sampleMs"`
+	End     int64   `json:"end"`
+	Returns int     `json:"returns"`
+	Stdev   float64 `json:"stdev"`
+}
+
+type volReturn struct {
+	start int64
+	r     float64
+}
+
+// volState is one symbol's sampling state. close is the last price of the
+// open sample, prev the close of the one before.
+type volState struct {
+	start    int64
+	close    float64
+	prev     float64
+	bid, ask float64
+	returns  []volReturn
+}
+
+// rollingVol samples each symbol's trade price or ticker mid at VOL_SAMPLE
+// and keeps the returns of the samples within VOL_WINDOW. A sample is
+// complete once a price stamped after it arrives, so samples without a
+// price are skipped, their move counted in the next return.
+type rollingVol struct {
+	basis          string
+	window, sample int64
+
+	mu     sync.Mutex
+	states *symbolLRU[*volState]
+}
+
+func newRollingVol(basis string, window, sample time.Duration, limit stateLimit) *rollingVol {
+	return &rollingVol{basis: basis, window: window.Milliseconds(), sample: sample.Milliseconds(), states: newSymbolLRU[*volState](limit, nil)}
+}
+
+// observe samples the prices of a publicTrade data array or, for the mid
+// basis, a ticker stamped ts, and returns the volatility as of each sample
+// they completed.
+func (v *rollingVol) observe(symbol string, ts int64, data any) []Vol {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	st, ok := v.states.get(symbol)
+	if !ok {
+		st = &volState{start: -1}
+		v.states.put(symbol, st)
+	}
+	var out []Vol
+	if v.basis == volBasisMid {
+		m, _ := data.(map[string]any)
+		// Ticker deltas carry only the fields that changed.
+		if bid := toFloat(m["bid1Price"]); bid > 0 {
+			st.bid = bid
+		}
+		if ask := toFloat(m["ask1Price"]); ask > 0 {
+			st.ask = ask
+		}
+		if st.bid > 0 && st.ask > 0 {
+			out = v.add(st, ts, (st.bid+st.ask)/2, out)
+		}
+		return out
+	}
+	trades, _ := data.([]any)
+	for _, t := range trades {
+		trade, _ := t.(map[string]any)
+		if ts, price := int64(toFloat(trade["T"])), toFloat(trade["p"]); ts > 0 && price > 0 {
+			out = v.add(st, ts, price, out)
+		}
+	}
+	return out
+}
+
+func (v *rollingVol) add(st *volState, ts int64, price float64, out []Vol) []Vol {
+	start := ts - ts%v.sample
+	if start < st.start {
+		// Late for a sample already closed.
+		return out
+	}
+	if start == st.start {
+		st.close = price
+		return out
+	}
+	if st.start >= 0 {
+		if st.prev > 0 {
+			st.returns = append(st.returns, volReturn{start: st.start, r: math.Log(st.close / st.prev)})
+		}
+		st.prev = st.close
+		end := st.start + v.sample
+		for len(st.returns) > 0 && st.returns[0].start < end-v.window {
+			st.returns = st.returns[1:]
+		}
+		if len(st.returns) >= 2 {
+			out = append(out, Vol{Basis: v.basis, Window: v.window, Sample: v.sample, End: end - 1, Returns: len(st.returns), Stdev: stdev(st.returns)})
+		}
+	}
+	st.start, st.close = start, price
+	return out
+}
+
+func stdev(returns []volReturn) float64 {
+	var mean float64
+	for _, r := range returns {
+		mean += r.r
+	}
+	mean /= float64(len(returns))
+	var ss float64
+	for _, r := range returns {
+		ss += (r.r - mean) * (r.r - mean)
+	}
+	return math.Sqrt(ss / float64(len(returns)-1))
+}
+
+// reset forgets every symbol's samples, so returns never span a reconnect
+// gap.
+func (v *rollingVol) reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.states = newSymbolLRU[*volState](v.states.limit, nil)
+}
+
+// publishVols publishes vol events for symbol, and with PER_SYMBOL_METRICS
+// sets ws_gateway_rolling_vol to the latest for subscribed symbols.
+func (g *Gateway) publishVols(symbol string, vols []Vol) {
+	for _, vol := range vols {
+		if g.cfg.PerSymbol && g.allowed.Load().has(symbol) {
+			g.metrics.rollingVol.WithLabelValues(symbol).Set(vol.Stdev)
+		}
+		g.publish(OutEvent{Ts: vol.End, Symbol: symbol, Type: typeVol, Payload: vol})
+	}
+}
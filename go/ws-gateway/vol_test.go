@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRollingVolTrades(t *testing.T) {
+	trade := func(ts int64, price string) any {
+		return map[string]any{"T": float64(ts), "s": "BTCUSDT", "S": "Buy", "v": "1", "p": price}
+	}
+	v := newRollingVol(volBasisTrades, 2*time.Second, time.Second, stateLimit{})
+	if out := v.observe("BTCUSDT", 0, []any{trade(1000, "90"), trade(1500, "100"), trade(2000, "110"), trade(3000, "99")}); len(out) != 0 {
+		t.Fatalf("published %+v from a single return", out)
+	}
+	out := v.observe("BTCUSDT", 0, []any{trade(4000, "100")})
+	a, b := math.Log(110.0/100), math.Log(99.0/110)
+	want := Vol{Basis: volBasisTrades, Window: 2000, Sample: 1000, End: 3999, Returns: 2}
+	if len(out) != 1 || math.Abs(out[0].Stdev-math.Abs(a-b)/math.Sqrt2) > 1e-12 {
+		t.Fatalf("published %+v", out)
+	}
+	if out[0].Stdev = 0; out[0] != want {
+		t.Fatalf("published %+v, want %+v", out[0], want)
+	}
+	// A late trade doesn't reopen a closed sample, and the first return
+	// leaves the window.
+	out = v.observe("BTCUSDT", 0, []any{trade(3500, "500"), trade(5000, "100")})
+	c := math.Log(100.0 / 99)
+	if len(out) != 1 || out[0].Returns != 2 || math.Abs(out[0].Stdev-math.Abs(b-c)/math.Sqrt2) > 1e-12 {
+		t.Fatalf("published %+v", out)
+	}
+	if out := v.observe("ETHUSDT", 0, []any{trade(6000, "100")}); len(out) != 0 {
+		t.Fatal("symbols share samples")
+	}
+}
+
+func TestRollingVolMid(t *testing.T) {
+	v := newRollingVol(volBasisMid, time.Minute, time.Second, stateLimit{})
+	v.observe("BTCUSDT", 1000, map[string]any{"bid1Price": "99", "ask1Price": "101"})
+	// Deltas carry only what changed.
+	v.observe("BTCUSDT", 2000, map[string]any{"bid1Price": "109"})
+	v.observe("BTCUSDT", 3000, map[string]any{"ask1Price": "111"})
+	out := v.observe("BTCUSDT", 4000, map[string]any{"lastPrice": "110"})
+	a, b := math.Log(105.0/100), math.Log(110.0/105)
+	if len(out) != 1 || out[0].Basis != volBasisMid || math.Abs(out[0].Stdev-math.Abs(a-b)/math.Sqrt2) > 1e-12 {
+		t.Fatalf("published %+v", out)
+	}
+
+	v.reset()
+	v.observe("BTCUSDT", 5000, map[string]any{"bid1Price": "99", "ask1Price": "101"})
+	if out := v.observe("BTCUSDT", 6000, map[string]any{"bid1Price": "89"}); len(out) != 0 {
+		t.Fatalf("published %+v across a reset", out)
+	}
+}
+
+func TestPublishVols(t *testing.T) {
+	g, sink := newTestGateway(t, "", "BTCUSDT")
+	g.metrics = newGatewayMetrics("vol")
+	g.cfg.PerSymbol = true
+	g.allowed.Store(newSymbolSet([]string{"BTCUSDT"}))
+	g.publishVols("BTCUSDT", []Vol{{Basis: volBasisTrades, End: 999, Returns: 2, Stdev: 0.01}})
+	g.publishVols("XRPUSDT", []Vol{{Basis: volBasisTrades, End: 999, Returns: 2, Stdev: 0.02}})
+	evs := sink.Events()
+	if len(evs) != 2 || evs[0].Type != typeVol || evs[0].Ts != 999 {
+		t.Fatalf("events = %+v", evs)
+	}
+	if testutil.ToFloat64(g.metrics.rollingVol.WithLabelValues("BTCUSDT")) != 0.01 {
+		t.Fatal("vol gauge not set")
+	}
+	if n := testutil.CollectAndCount(rollingVolGauge, "ws_gateway_rolling_vol"); n != 1 {
+		t.Fatalf("vol series = %d, want only the subscribed symbol's", n)
+	}
+}
+
+func TestVolConfig(t *testing.T) {
+	cfg, err := loadConfig(env{"TOPICS": "publicTrade", "VOL_WINDOW": "5m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.VolWindow != 5*time.Minute || cfg.VolSample != time.Second || cfg.VolBasis != volBasisTrades || cfg.Validate() != nil {
+		t.Fatalf("vol config = %s/%s/%s, Validate = %v", cfg.VolWindow, cfg.VolSample, cfg.VolBasis, cfg.Validate())
+	}
+	cfg.VolBasis = volBasisMid
+	if cfg.Validate() == nil {
+		t.Fatal("VOL_BASIS=mid accepted without tickers in TOPICS")
+	}
+	cfg.Topics = []string{"tickers"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []env{
+		{"TOPICS": "tickers", "VOL_WINDOW": "5m", "VOL_BASIS": "vwap"},
+		{"TOPICS": "tickers", "VOL_WINDOW": "5m", "VOL_SAMPLE": "5m"},
+		{"TOPICS": "tickers", "VOL_WINDOW": "5m", "VOL_SAMPLE": "0"},
+		{"TOPICS": "tickers", "VOL_WINDOW": "1.5ms"},
+	} {
+		if cfg, err := loadConfig(bad); err == nil && cfg.Validate() == nil {
+			t.Fatalf("accepted %v", bad)
+		}
+	}
+}
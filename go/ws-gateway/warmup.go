@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// parseWarmupFraction accepts a boolean (true requires every symbol) or the
+// fraction of configured symbols that must have delivered data.
+func parseWarmupFraction(v string) (float64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if b, err := strconv.ParseBool(v); err == nil {
+		if b {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > 1 {
+		return 0, fmt.Errorf("want true|false or a fraction in [0,1], got %q", v)
+	}
+	return f, nil
+}
+
+// warmup tracks whether enough symbols have delivered a first data message
+// for the gateway to be reported ready. Once warm it stays warm; later
+// outages are the connection state's business.
+type warmup struct {
+	clock    Clock
+	fraction float64
+	deadline time.Time
+
+	warm atomic.Bool
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newWarmup(clock Clock, fraction float64, timeout time.Duration) *warmup {
+	w := &warmup{clock: clock, fraction: fraction, seen: make(map[string]struct{})}
+	if fraction == 0 {
+		w.warm.Store(true)
+	}
+	if timeout > 0 {
+		w.deadline = clock.Now().Add(timeout)
+	}
+	return w
+}
+
+// observe records data for symbol.
+func (w *warmup) observe(symbol string) {
+	if w.warm.Load() || symbol == "" {
+		return
+	}
+	w.mu.Lock()
+	w.seen[symbol] = struct{}{}
+	w.mu.Unlock()
+}
+
+// ready reports whether the share of symbols with data has been reached, or
+// the warmup timeout has passed.
+func (w *warmup) ready(symbols []string) bool {
+	if w.warm.Load() {
+		return true
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	need := int(math.Ceil(w.fraction * float64(len(symbols))))
+	have := 0
+	for _, s := range symbols {
+		if _, ok := w.seen[s]; ok {
+			have++
+		}
+	}
+	switch {
+	case have >= need:
+		log.Printf("warmup_done symbols=%d/%d", have, len(symbols))
+	case !w.deadline.IsZero() && w.clock.Now().After(w.deadline):
+		log.Printf("warmup_timeout symbols=%d/%d need=%d", have, len(symbols), need)
+	default:
+		return false
+	}
+	w.warm.Store(true)
+	w.seen = nil
+	return true
+}
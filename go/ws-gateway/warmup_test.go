@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseWarmupFraction(t *testing.T) {
+	for in, want := range map[string]float64{"": 0, "false": 0, "true": 1, "0.5": 0.5, "1": 1} {
+		if got, err := parseWarmupFraction(in); err != nil || got != want {
+			t.Errorf("parseWarmupFraction(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"1.5", "-0.1", "most"} {
+		if _, err := parseWarmupFraction(in); err == nil {
+			t.Errorf("parseWarmupFraction(%q) succeeded", in)
+		}
+	}
+}
+
+func TestWarmupFraction(t *testing.T) {
+	symbols := []string{"BTCUSDT", "ETHUSDT", "SOLUSDT", "XRPUSDT"}
+	w := newWarmup(newSystemClock(0), 0.5, 0)
+	w.observe("BTCUSDT")
+	w.observe("DOGEUSDT")
+	if w.ready(symbols) {
+		t.Fatal("ready with 1 of 4 symbols")
+	}
+	w.observe("SOLUSDT")
+	if !w.ready(symbols) {
+		t.Fatal("not ready with 2 of 4 symbols")
+	}
+}
+
+func TestWarmupTimeout(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	w := newWarmup(clock, 1, time.Minute)
+	if w.ready([]string{"BTCUSDT"}) {
+		t.Fatal("ready before any data")
+	}
+	clock.Advance(time.Minute + time.Millisecond)
+	if !w.ready([]string{"BTCUSDT"}) {
+		t.Fatal("not ready after warmup timeout")
+	}
+}
+
+func TestHealthzWaitsForFirstData(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, sink := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.warmup = newWarmup(g.clock, 1, 0)
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	server := fake.nextConn(t)
+
+	probe := func() int {
+		rec := httptest.NewRecorder()
+		gatewaySet{g}.healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return rec.Code
+	}
+	if code := probe(); code != http.StatusServiceUnavailable {
+		t.Fatalf("healthz before data = %d, want 503", code)
+	}
+	go g.readLoop()
+	sendJSON(t, server, map[string]any{"topic": "tickers.BTCUSDT", "data": map[string]any{"s": "BTCUSDT"}})
+	waitEvents(t, sink, 1)
+	if code := probe(); code != http.StatusOK {
+		t.Fatalf("healthz after data = %d, want 200", code)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// watchdogExit ends the process when a forced reconnect didn't unstick the
+// gateway; tests replace it.
+var watchdogExit = func(instance string) {
+	log.Fatalf("watchdog_exit instance=%s: no progress after forced reconnect", instance)
+}
+
+// watchdog checks that a connected gateway keeps reading frames. After
+// timeout without one it closes the connection so run reconnects; if the
+// next timeout passes with still no progress, the loop is presumed
+// deadlocked and the process exits for the orchestrator to restart it.
+func (g *Gateway) watchdog(timeout time.Duration) {
+	t := time.NewTicker(timeout / 4)
+	defer t.Stop()
+	var forced time.Time
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case now := <-t.C:
+			last := time.Unix(0, g.progress.Load())
+			live := g.live.Load()
+			if !forced.IsZero() {
+				// Either the connection went away or a new one is
+				// reading: the loop reacted to the forced close.
+				if !live || last.After(forced) {
+					forced = time.Time{}
+				} else if now.Sub(forced) > timeout {
+					watchdogExit(g.cfg.Instance)
+					return
+				} else {
+					continue
+				}
+			}
+			if !live || now.Sub(last) <= timeout {
+				continue
+			}
+			g.metrics.watchdogStalls.Inc()
+			log.Printf("watchdog_stall instance=%s idle=%s action=reconnect", g.cfg.Instance, now.Sub(last).Round(time.Millisecond))
+			forced = now
+			// The read loop may be stuck holding locks; close from a
+			// separate goroutine so the watchdog keeps running.
+			go g.forceReconnect()
+		}
+	}
+}
+
+// forceReconnect closes the current connection, ending its read loop.
+// Closing the socket directly also unblocks a stuck write; run's own
+// closeConn then cleans up.
+func (g *Gateway) forceReconnect() {
+	g.mu.Lock()
+	conn := g.conn
+	g.mu.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
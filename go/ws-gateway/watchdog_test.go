@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWatchdogForcesReconnect(t *testing.T) {
+	fake := newFakeBybit(t)
+	g, _ := newTestGateway(t, fake.url(), "BTCUSDT")
+	g.metrics = newGatewayMetrics("watchdog_test")
+	if err := g.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	fake.nextConn(t)
+	readDone := make(chan error, 1)
+	go func() { readDone <- g.readLoop() }()
+	go g.watchdog(100 * time.Millisecond)
+
+	// The server never sends anything, so the watchdog must close the
+	// connection out from under the read loop.
+	select {
+	case err := <-readDone:
+		if err == nil {
+			t.Fatal("readLoop returned nil")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("watchdog did not end the stalled read loop")
+	}
+	if n := testutil.ToFloat64(g.metrics.watchdogStalls); n != 1 {
+		t.Fatalf("stalls = %v, want 1", n)
+	}
+}
+
+func TestWatchdogExitsWhenReconnectDoesNotHelp(t *testing.T) {
+	exited := make(chan string, 1)
+	prev := watchdogExit
+	watchdogExit = func(instance string) { exited <- instance }
+	t.Cleanup(func() { watchdogExit = prev })
+
+	g, _ := newTestGateway(t, "ws://unused", "BTCUSDT")
+	g.metrics = newGatewayMetrics("watchdog_exit_test")
+	// Connected but with no socket to close: the forced reconnect can't
+	// take effect, as when run is deadlocked.
+	g.progress.Store(time.Now().UnixNano())
+	g.live.Store(true)
+	go g.watchdog(50 * time.Millisecond)
+
+	select {
+	case instance := <-exited:
+		if instance != "test" {
+			t.Fatalf("exit for instance %q", instance)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("watchdog did not exit")
+	}
+}
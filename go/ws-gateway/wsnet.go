@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	wsNetworkAny  = "tcp"
+	wsNetworkIPv4 = "tcp4"
+	wsNetworkIPv6 = "tcp6"
+)
+
+func parseWSNetwork(v string) (string, error) {
+	switch v {
+	case wsNetworkAny, wsNetworkIPv4, wsNetworkIPv6:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown network %q (want tcp|tcp4|tcp6)", v)
+}
+
+// parseDNSServer accepts host or host:port, defaulting to port 53.
+func parseDNSServer(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	if _, _, err := net.SplitHostPort(v); err == nil {
+		return v, nil
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(v, "["), "]")
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid address %q", v)
+	}
+	return net.JoinHostPort(host, "53"), nil
+}
+
+const (
+	phaseConnect   = "connect"
+	phaseHandshake = "handshake"
+)
+
+// phaseTimeoutError is a WS dial that timed out, naming the phase: the TCP
+// connect (CONNECT_TIMEOUT) or the TLS and upgrade handshake
+// (HANDSHAKE_TIMEOUT).
+type phaseTimeoutError struct {
+	phase string
+	err   error
+}
+
+func (e *phaseTimeoutError) Error() string { return e.phase + " timeout: " + e.err.Error() }
+func (e *phaseTimeoutError) Unwrap() error { return e.err }
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// dialPhaseError attributes a failed WS dial to the phase that timed out,
+// if any. wsNetDial marks connect timeouts itself, so any other timeout
+// happened during the handshake.
+func dialPhaseError(err error) error {
+	var pe *phaseTimeoutError
+	if errors.As(err, &pe) || !isTimeout(err) {
+		return err
+	}
+	return &phaseTimeoutError{phase: phaseHandshake, err: err}
+}
+
+// wsResolver resolves the WS host, through WS_DNS_SERVER when set.
+func wsResolver(cfg Config) *net.Resolver {
+	if cfg.WSDNSServer == "" {
+		return net.DefaultResolver
+	}
+	server := cfg.WSDNSServer
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var rd net.Dialer
+			return rd.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// wsNetDial dials WS connections over WS_NETWORK within CONNECT_TIMEOUT,
+// resolving with wsResolver.
+func wsNetDial(cfg Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	network := cfg.WSNetwork
+	if network == "" {
+		network = wsNetworkAny
+	}
+	d := &net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second, Resolver: wsResolver(cfg)}
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil && isTimeout(err) {
+			return nil, &phaseTimeoutError{phase: phaseConnect, err: err}
+		}
+		return conn, err
+	}
+}
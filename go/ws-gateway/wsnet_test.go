@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWSNetwork(t *testing.T) {
+	fake := newFakeBybit(t)
+	for network, ok := range map[string]bool{wsNetworkIPv4: true, wsNetworkIPv6: false} {
+		d := newDialer(Config{WSNetwork: network})
+		conn, _, err := d.Dial(fake.url(), nil)
+		if ok != (err == nil) {
+			t.Fatalf("%s: dial err = %v", network, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestConnectPhaseTimeouts(t *testing.T) {
+	// A listener that accepts but never answers stalls the upgrade.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 8)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+	defer func() {
+		ln.Close()
+		for c := range accepted {
+			c.Close()
+		}
+	}()
+	url := "ws://" + ln.Addr().String()
+
+	for phase, cfg := range map[string]Config{
+		phaseConnect:   {ConnectTimeout: time.Nanosecond, HandshakeTimeout: time.Second},
+		phaseHandshake: {ConnectTimeout: time.Second, HandshakeTimeout: 100 * time.Millisecond},
+	} {
+		g, _ := newTestGateway(t, url)
+		g.metrics = newGatewayMetrics("phase_timeout_" + phase)
+		g.dialer = newDialer(cfg)
+		err := g.connect()
+		var pe *phaseTimeoutError
+		if !errors.As(err, &pe) || pe.phase != phase {
+			t.Fatalf("%s: err = %v", phase, err)
+		}
+		if !strings.HasPrefix(err.Error(), phase+" timeout: ") {
+			t.Fatalf("%s: error %q doesn't name the phase", phase, err)
+		}
+		if n := testutil.ToFloat64(g.metrics.phaseTimeouts.WithLabelValues(phase)); n != 1 {
+			t.Fatalf("%s timeouts = %v, want 1", phase, n)
+		}
+	}
+
+	refused := errors.New("connection refused")
+	if got := dialPhaseError(refused); got != refused {
+		t.Fatalf("non-timeout error rewritten to %v", got)
+	}
+}
+
+func TestWSDNSServer(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	queried := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 512)
+		if _, _, err := pc.ReadFrom(buf); err == nil {
+			queried <- struct{}{}
+		}
+	}()
+
+	dial := wsNetDial(Config{WSNetwork: wsNetworkIPv4, WSDNSServer: pc.LocalAddr().String()})
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if conn, err := dial(ctx, "tcp", "stream.bybit.invalid:443"); err == nil {
+		conn.Close()
+	}
+	select {
+	case <-queried:
+	case <-time.After(2 * time.Second):
+		t.Fatal("WS_DNS_SERVER was not queried")
+	}
+
+	for v, want := range map[string]string{"": "", "1.1.1.1": "1.1.1.1:53", "dns.local:5353": "dns.local:5353", "[::1]": "[::1]:53"} {
+		if got, err := parseDNSServer(v); err != nil || got != want {
+			t.Fatalf("parseDNSServer(%q) = %q, %v; want %q", v, got, err, want)
+		}
+	}
+	if _, err := parseDNSServer("1.2.3.4:53:53"); err == nil {
+		t.Fatal("expected error for a malformed address")
+	}
+}